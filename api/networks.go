@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+type Network struct {
+	ID      string
+	Subnet  string
+	Options map[string]string
+}
+
+func (client *Client) CreateNetwork(ID string, subnet *net.IPNet, options map[string]string) error {
+	values := url.Values{
+		"subnet": {subnet.String()},
+	}
+	for key, value := range options {
+		values.Add("option", key+"="+value)
+	}
+	_, err := client.httpVerb("PUT", fmt.Sprintf("/network/%s", ID), values)
+	return err
+}
+
+func (client *Client) DeleteNetwork(ID string) error {
+	_, err := client.httpVerb("DELETE", fmt.Sprintf("/network/%s", ID), nil)
+	return err
+}
+
+func (client *Client) LookupNetwork(ID string) (*Network, error) {
+	body, err := client.httpVerb("GET", fmt.Sprintf("/network/%s", ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	var network Network
+	if err := json.Unmarshal([]byte(body), &network); err != nil {
+		return nil, err
+	}
+	return &network, nil
+}
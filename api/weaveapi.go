@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -71,11 +72,37 @@ func NewClient(addr string, log Logger) *Client {
 	return &Client{baseURL: fmt.Sprintf("http://%s:%s", host, port), log: log}
 }
 
+// Status returns the router's status summary, and fails if the
+// router isn't running
+func (client *Client) Status() (string, error) {
+	return client.httpVerb("GET", "/status", nil)
+}
+
 func (client *Client) Connect(remote string) error {
 	_, err := client.httpVerb("POST", "/connect", url.Values{"peer": {remote}})
 	return err
 }
 
+// MTU returns the MTU that container interfaces on the weave network
+// should have; zero if the router does not know it
+func (client *Client) MTU() (int, error) {
+	mtu, err := client.httpVerb("GET", "/mtu", nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(mtu)
+}
+
+// Encrypted says whether the router encrypts all traffic between
+// peers
+func (client *Client) Encrypted() (bool, error) {
+	encrypted, err := client.httpVerb("GET", "/encrypted", nil)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(encrypted)
+}
+
 type Logger interface {
 	Infof(string, ...interface{})
 	Debugf(string, ...interface{})
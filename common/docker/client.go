@@ -21,6 +21,7 @@ type ContainerObserver interface {
 	ContainerStarted(ident string)
 	ContainerDied(ident string)
 	ContainerDestroyed(ident string)
+	ContainerHealthChanged(ident string, healthy bool)
 }
 
 type Client struct {
@@ -106,6 +107,10 @@ func (c *Client) AddObserver(ob ContainerObserver) error {
 					case "destroy":
 						pending.finish(event.ID)
 						ob.ContainerDestroyed(event.ID)
+					case "health_status: healthy":
+						ob.ContainerHealthChanged(event.ID, true)
+					case "health_status: unhealthy":
+						ob.ContainerHealthChanged(event.ID, false)
 					}
 				}
 				if time.Since(start) > retryInterval {
@@ -181,6 +186,16 @@ func (c *Client) IsContainerNotRunning(idStr string) bool {
 	return false
 }
 
+// IsContainerHealthy returns false if the container is failing its
+// Docker health check. Containers without one count as healthy.
+func (c *Client) IsContainerHealthy(idStr string) (bool, error) {
+	container, err := c.InspectContainer(idStr)
+	if err != nil {
+		return false, err
+	}
+	return container.State.Health.Status != "unhealthy", nil
+}
+
 // This is intended to find an IP address that we can reach the container on;
 // if it is on the Docker bridge network then that address; if on the host network
 // then localhost
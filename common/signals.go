@@ -30,3 +30,15 @@ func SignalHandlerLoop(ss ...SignalReceiver) {
 		}
 	}
 }
+
+// ReloadOnSignal calls reload every time the process receives SIGHUP.
+func ReloadOnSignal(reload func() error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		Log.Infof("=== received SIGHUP ===\n*** reloading configuration")
+		if err := reload(); err != nil {
+			Log.Errorf("Reload failed: %s", err)
+		}
+	}
+}
@@ -73,6 +73,8 @@ type Allocator struct {
 	isKnownPeer       func(mesh.PeerName) bool
 	quorum            func() uint
 	now               func() time.Time
+
+	ownedWatchers []func(map[address.Address]string) // told whenever owned changes
 }
 
 type Config struct {
@@ -291,6 +293,38 @@ func (alloc *Allocator) Lookup(ident string, r address.Range) ([]address.CIDR, e
 	return <-resultChan, nil
 }
 
+// Owner (Sync) - get the ident that addr is allocated to on this peer, if any
+func (alloc *Allocator) Owner(addr address.Address) (string, bool) {
+	resultChan := make(chan string)
+	alloc.actionChan <- func() {
+		for ident, d := range alloc.owned {
+			for _, cidr := range d.Cidrs {
+				if cidr.Addr == addr {
+					resultChan <- ident
+					return
+				}
+			}
+		}
+		resultChan <- ""
+	}
+	ident := <-resultChan
+	return ident, ident != ""
+}
+
+// OnOwnedChange (Sync) - call f with the owner of each address we have
+// given out, now and whenever they change.  f is called from the
+// actor, so must not call back into the allocator, and must not modify
+// the map.
+func (alloc *Allocator) OnOwnedChange(f func(owners map[address.Address]string)) {
+	doneChan := make(chan struct{})
+	alloc.actionChan <- func() {
+		alloc.ownedWatchers = append(alloc.ownedWatchers, f)
+		f(alloc.owners())
+		close(doneChan)
+	}
+	<-doneChan
+}
+
 // Claim an address that we think we should own (Sync)
 func (alloc *Allocator) Claim(ident string, cidr address.CIDR, isContainer, noErrorOnUnknown bool, hasBeenCancelled func() bool) error {
 	resultChan := make(chan error)
@@ -348,6 +382,8 @@ func (alloc *Allocator) ContainerStarted(ident string) {
 	}
 }
 
+func (alloc *Allocator) ContainerHealthChanged(ident string, healthy bool) {}
+
 func (alloc *Allocator) PruneOwned(ids []string) {
 	idmap := make(map[string]struct{}, len(ids))
 	for _, id := range ids {
@@ -976,6 +1012,23 @@ func (alloc *Allocator) persistOwned() {
 	if err := alloc.db.Save(ownedIdent, alloc.owned); err != nil {
 		alloc.fatalf("Error persisting address data: %s", err)
 	}
+	if len(alloc.ownedWatchers) > 0 {
+		owners := alloc.owners()
+		for _, f := range alloc.ownedWatchers {
+			f(owners)
+		}
+	}
+}
+
+// The ident that owns each address we have given out
+func (alloc *Allocator) owners() map[address.Address]string {
+	owners := make(map[address.Address]string)
+	for ident, d := range alloc.owned {
+		for _, cidr := range d.Cidrs {
+			owners[cidr.Addr] = ident
+		}
+	}
+	return owners
 }
 
 // Owned addresses
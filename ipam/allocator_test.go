@@ -95,6 +95,31 @@ func TestAllocFree(t *testing.T) {
 	require.Equal(t, address.Count(spaceSize+1), alloc.NumFreeAddresses(subnet.Range()))
 }
 
+func TestOwnedChange(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		container2 = "baddf00d"
+		universe   = "10.0.3.0/26"
+	)
+
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", universe, 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+	addr1, err := alloc.SimplyAllocate(container1, subnet)
+	require.NoError(t, err)
+
+	var owners map[address.Address]string
+	alloc.OnOwnedChange(func(o map[address.Address]string) { owners = o })
+	require.Equal(t, map[address.Address]string{addr1: container1}, owners)
+
+	addr2, err := alloc.SimplyAllocate(container2, subnet)
+	require.NoError(t, err)
+	require.Equal(t, map[address.Address]string{addr1: container1, addr2: container2}, owners)
+
+	require.NoError(t, alloc.Delete(container1))
+	require.Equal(t, map[address.Address]string{addr2: container2}, owners)
+}
+
 func TestBootstrap(t *testing.T) {
 	const (
 		donateSize     = 5
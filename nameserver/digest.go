@@ -0,0 +1,167 @@
+package nameserver
+
+import (
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// OriginDigest summarises the entries we have from one origin: the
+// latest change to them, and a checksum of the live ones.  Changes
+// are numbered by the origin's incarnation, i.e. when it started, and
+// a sequence number within that, so that a restarted origin's changes
+// count as later than any it made before, whatever it numbers them.
+//
+// Rather than sending all their entries every gossip interval, peers
+// send each other digests, and reply with just the entries the other
+// is missing: those changed since the other's latest change. If the
+// latest changes agree but the checksums don't, some update was lost
+// on the way, and we send all the entries from that origin. A new
+// peer has no entries at all, so gets everything.  And when an origin
+// restarts, its peers send it the entries it made before, for it to
+// delete any it no longer has.
+type OriginDigest struct {
+	Incarnation int64
+	Seq         uint64
+	Checksum    uint64
+}
+
+type Digest map[mesh.PeerName]OriginDigest
+
+// Peers from before digests were gossiped send no protocol number,
+// only ever gossip all their entries, and take no notice of digests.
+// While we hear from any such peer, our periodic gossip carries all
+// our entries too, as it used to.
+const (
+	digestProtocol      = 1
+	legacyGossipTimeout = 10 * time.Minute
+)
+
+// Whether the digest has seen the change numbered incarnation and seq
+func (d OriginDigest) before(incarnation int64, seq uint64) bool {
+	return d.Incarnation < incarnation || (d.Incarnation == incarnation && d.Seq < seq)
+}
+
+// FNV-1a, written out so checksumming every entry doesn't allocate
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+func fnvString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint64(s[i])) * fnvPrime
+	}
+	return h * fnvPrime // as if hashing a zero byte, so "ab","c" differs from "a","bc"
+}
+
+func fnvUint64(h, v uint64) uint64 {
+	for i := uint(0); i < 64; i += 8 {
+		h = (h ^ (v >> i & 0xff)) * fnvPrime
+	}
+	return h
+}
+
+func (e *Entry) checksum() uint64 {
+	h := fnvString(fnvOffset, e.Hostname)
+	h = fnvString(h, e.ContainerID)
+	h = fnvUint64(h, uint64(e.Addr))
+	if e.Target != "" {
+		h = fnvString(h, e.Target)
+	}
+	h = fnvUint64(h, uint64(e.Version))
+	if e.Unhealthy {
+		h = fnvUint64(h, 1)
+	}
+	return h
+}
+
+// Must be called with a lock held
+func (n *Nameserver) digest() Digest {
+	digest := Digest{}
+	for _, e := range n.entries {
+		d := digest[e.Origin]
+		if d.before(e.Incarnation, e.Seq) {
+			d.Incarnation, d.Seq = e.Incarnation, e.Seq
+		}
+		if e.Tombstone == 0 {
+			d.Checksum ^= e.checksum()
+		}
+		digest[e.Origin] = d
+	}
+	return digest
+}
+
+// missing returns the entries that peer, with the given digest,
+// lacks, along with those it made before it restarted. Must be called
+// with a lock held.
+func (n *Nameserver) missing(peer mesh.PeerName, theirs Digest) Entries {
+	ours := n.digest()
+	missing := Entries{}
+	for _, e := range n.entries {
+		their, found := theirs[e.Origin]
+		our := ours[e.Origin]
+		switch {
+		case !found || their.before(e.Incarnation, e.Seq):
+		case their.Incarnation == our.Incarnation && their.Seq == our.Seq && their.Checksum != our.Checksum:
+		case e.Origin == peer && e.Incarnation < their.Incarnation:
+		default:
+			continue
+		}
+		missing = append(missing, e)
+	}
+	return missing
+}
+
+// stamp gives those of the changed entries that are ours the next
+// sequence numbers, both in our store and in the copies we are about
+// to broadcast. Must be called with the write lock held.
+func (n *Nameserver) stamp(changed Entries) {
+	for i := range changed {
+		if changed[i].Origin != n.ourName {
+			continue
+		}
+		n.stampEntry(&changed[i])
+		if e, found := n.entries.findEqual(&changed[i]); found {
+			e.Incarnation, e.Seq = changed[i].Incarnation, changed[i].Seq
+		}
+	}
+}
+
+// Must be called with the write lock held
+func (n *Nameserver) stampEntry(e *Entry) {
+	e.Incarnation, e.Seq = n.incarnation, n.nextSeq()
+}
+
+// Must be called with the write lock held
+func (n *Nameserver) nextSeq() uint64 {
+	n.seq++
+	return n.seq
+}
+
+// noteSeq makes sure we carry on from the highest sequence number we
+// have ever used, which peers may remember from before we restarted.
+// Must be called with the write lock held.
+func (n *Nameserver) noteSeq(seq uint64) {
+	if seq > n.seq {
+		n.seq = seq
+	}
+}
+
+// sendMissing replies to a peer's digest with the entries it lacks
+func (n *Nameserver) sendMissing(peer mesh.PeerName, digest Digest) {
+	n.Lock()
+	n.noteSeq(digest[n.ourName].Seq)
+	missing := n.missing(peer, digest)
+	n.Unlock()
+
+	if n.gossip == nil || peer == n.ourName || len(missing) == 0 {
+		return
+	}
+	n.debugf("sending %d entries to %s", len(missing), peer)
+	for _, msg := range (&GossipData{Entries: missing, Timestamp: now(), Protocol: digestProtocol}).Encode() {
+		if err := n.gossip.GossipUnicast(peer, msg); err != nil {
+			n.errorf("unable to send entries to %s: %s", peer, err)
+		}
+	}
+}
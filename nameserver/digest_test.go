@@ -0,0 +1,197 @@
+package nameserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/testing/gossip"
+)
+
+func exchangeDigests(from, to *Nameserver) {
+	for _, msg := range from.Gossip().Encode() {
+		if _, err := to.OnGossip(msg); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestDigestGossip(t *testing.T) {
+	grouter := gossip.NewTestRouter(0.0)
+	defer grouter.Stop()
+	name1, _ := mesh.PeerNameFromString("01:00:00:02:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	ns1, ns2 := makeNameserver(name1), makeNameserver(name2)
+
+	// entries added before ns1 joins are not broadcast
+	ns1.AddEntry("hostname", "c1", name1, address.Address(1))
+	ns1.AddEntry("hostname", "c2", name1, address.Address(2))
+	client1 := grouter.Connect(name1, ns1)
+	ns1.SetGossip(client1)
+	ns2.SetGossip(grouter.Connect(name2, ns2))
+
+	require.Len(t, ns1.Gossip().(*GossipData).Entries, 0, "periodic gossip only carries the digest")
+
+	// ns2 is new, so gets everything
+	exchangeDigests(ns2, ns1)
+	grouter.Flush()
+	require.Equal(t, []address.Address{1, 2}, ns2.Lookup("hostname"))
+
+	// a lost update is made good
+	ns1.SetGossip(nil)
+	ns1.ContainerDied("c1")
+	ns1.SetGossip(client1)
+	require.Equal(t, []address.Address{1, 2}, ns2.Lookup("hostname"))
+	ns2.RLock()
+	missing := ns1.missing(name2, ns2.digest())
+	ns2.RUnlock()
+	require.Len(t, missing, 1, "only the changed entry is sent")
+	exchangeDigests(ns2, ns1)
+	grouter.Flush()
+	require.Equal(t, []address.Address{2}, ns2.Lookup("hostname"))
+
+	// once in sync, nothing more is sent
+	ns2.RLock()
+	missing = ns1.missing(name2, ns2.digest())
+	ns2.RUnlock()
+	require.Len(t, missing, 0)
+}
+
+func TestRestartedSeq(t *testing.T) {
+	name1, _ := mesh.PeerNameFromString("01:00:00:02:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	ns1, ns2 := makeNameserver(name1), makeNameserver(name2)
+	ns1.AddEntry("hostname", "c1", name1, address.Address(1))
+	ns1.AddEntry("hostname", "c2", name1, address.Address(2))
+	ns2.entries.merge(ns1.entries)
+
+	// ns1 restarts; it must carry on from where it left off, which
+	// it learns from its peers
+	restarted := makeNameserver(name1)
+	exchangeDigests(ns2, restarted)
+	restarted.AddEntry("hostname", "c3", name1, address.Address(3))
+	restarted.RLock()
+	defer restarted.RUnlock()
+	require.Equal(t, uint64(3), restarted.seq)
+}
+
+// What sendMissing would send from one to the other, delivered
+func deliverMissing(from, to *Nameserver) {
+	to.RLock()
+	digest := to.digest()
+	to.RUnlock()
+	from.RLock()
+	missing := from.missing(to.ourName, digest)
+	from.RUnlock()
+	for _, msg := range (&GossipData{Entries: missing, Timestamp: now(), Protocol: digestProtocol}).Encode() {
+		if _, _, err := to.receiveGossip(from.ourName, msg); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestRestartedIncarnation(t *testing.T) {
+	name1, _ := mesh.PeerNameFromString("01:00:00:02:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	ns1, ns2 := makeNameserver(name1), makeNameserver(name2)
+	ns1.AddEntry("hostname", "c1", name1, address.Address(1))
+	ns1.AddEntry("hostname", "c2", name1, address.Address(2))
+	deliverMissing(ns1, ns2)
+
+	// ns1 restarts, and adds an entry before hearing from ns2, so
+	// numbers it lower than ns2 has seen
+	restarted := makeNameserver(name1)
+	restarted.incarnation = ns1.incarnation + 1
+	restarted.AddEntry("hostname", "c3", name1, address.Address(3))
+
+	// ns2 still takes it, as from a later incarnation
+	deliverMissing(restarted, ns2)
+	require.Equal(t, []address.Address{1, 2, 3}, ns2.Lookup("hostname"))
+
+	// and sends back the entries from before the restart, which
+	// the restarted ns1 no longer has, so deletes
+	deliverMissing(ns2, restarted)
+	deliverMissing(restarted, ns2)
+	require.Equal(t, []address.Address{3}, ns2.Lookup("hostname"))
+	require.Equal(t, []address.Address{3}, restarted.Lookup("hostname"))
+
+	// after which they are in sync
+	ns2.RLock()
+	require.Len(t, ns2.missing(name1, restarted.digest()), 0)
+	ns2.RUnlock()
+	restarted.RLock()
+	require.Len(t, restarted.missing(name2, ns2.digest()), 0)
+	restarted.RUnlock()
+}
+
+func TestLegacyPeerGossip(t *testing.T) {
+	name1, _ := mesh.PeerNameFromString("01:00:00:02:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	ns1 := makeNameserver(name1)
+	ns1.AddEntry("hostname", "c1", name1, address.Address(1))
+	require.Len(t, ns1.Gossip().(*GossipData).Entries, 0)
+
+	// A peer from before digests gossips all its entries, with no
+	// protocol number, and ignores our digests, so from then on we
+	// send all our entries too
+	legacy := Entries{Entry{Hostname: "other", Origin: name2, ContainerID: "c2", Addr: address.Address(2)}}
+	if _, err := ns1.OnGossip((&GossipData{Entries: legacy, Timestamp: now()}).Encode()[0]); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []address.Address{2}, ns1.Lookup("other"))
+	gossip := ns1.Gossip().(*GossipData)
+	require.Len(t, gossip.Entries, 2)
+	require.NotNil(t, gossip.Digest, "peers with digests still get ours")
+}
+
+func makeBenchmarkNameservers(numEntries int) (*Nameserver, *Nameserver) {
+	name1, _ := mesh.PeerNameFromString("01:00:00:02:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	ns1, ns2 := makeNameserver(name1), makeNameserver(name2)
+	for i := 0; i < numEntries; i++ {
+		origin := mesh.PeerName(i%10 + 1)
+		ns1.entries.add(fmt.Sprintf("host%d.weave.local.", i), fmt.Sprintf("container%d", i), origin, address.Address(i))
+		ns1.entries[len(ns1.entries)-1].Seq = uint64(i)
+	}
+	ns2.entries.merge(ns1.entries)
+	return ns1, ns2
+}
+
+// How peers used to gossip: all entries, every time
+func benchmarkSnapshotGossip(b *testing.B, numEntries int) {
+	ns1, ns2 := makeBenchmarkNameservers(numEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ns1.RLock()
+		data := &GossipData{Entries: make(Entries, len(ns1.entries)), Timestamp: now()}
+		copy(data.Entries, ns1.entries)
+		ns1.RUnlock()
+		for _, msg := range data.Encode() {
+			b.SetBytes(int64(len(msg))) // so the output shows how much is sent
+			if _, err := ns2.OnGossip(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func benchmarkDigestGossip(b *testing.B, numEntries int) {
+	ns1, ns2 := makeBenchmarkNameservers(numEntries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, msg := range ns1.Gossip().Encode() {
+			b.SetBytes(int64(len(msg)))
+			if _, err := ns2.OnGossip(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSnapshotGossip1000(b *testing.B)  { benchmarkSnapshotGossip(b, 1000) }
+func BenchmarkSnapshotGossip10000(b *testing.B) { benchmarkSnapshotGossip(b, 10000) }
+func BenchmarkDigestGossip1000(b *testing.B)    { benchmarkDigestGossip(b, 1000) }
+func BenchmarkDigestGossip10000(b *testing.B)   { benchmarkDigestGossip(b, 10000) }
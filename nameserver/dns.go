@@ -2,11 +2,13 @@ package nameserver
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -24,13 +26,35 @@ const (
 	DefaultListenAddress = "0.0.0.0:53"
 	DefaultTTL           = 1
 	DefaultClientTimeout = 5 * time.Second
+
+	// SOA timers, in seconds, for secondary servers; names come and go
+	// with containers, so these are short
+	soaRefresh = 60
+	soaRetry   = 10
+	soaExpire  = 3600
+
+	// records per message in zone transfers
+	transferChunkSize = 100
+
+	// longest chain of CNAMEs we follow
+	maxCNAMEChain = 8
 )
 
 type DNSServer struct {
-	ns      *Nameserver
-	domain  string
-	ttl     uint32
-	address string
+	ns         *Nameserver
+	ttl        uint32
+	address    string
+	nameserver string // our own name, for SOA and NS records
+
+	transferClients []address.CIDR
+
+	queryStats   *queryStats
+	queryLog     *json.Encoder // nil unless query logging is on
+	queryLogLock sync.Mutex    // guards queryLog and identify
+	identify     func(address.Address) string
+
+	tlsUpstreams []*TLSUpstream
+	validator    *validator // nil unless DNSSEC validation is on
 
 	servers   []*dns.Server
 	upstream  *dns.ClientConfig
@@ -49,14 +73,15 @@ func filter(ss []string, s string) []string {
 	return ss
 }
 
-func NewDNSServer(ns *Nameserver, domain, address, effectiveAddress string, ttl uint32, clientTimeout time.Duration) (*DNSServer, error) {
+func NewDNSServer(ns *Nameserver, nameserver, address, effectiveAddress string, ttl uint32, clientTimeout time.Duration) (*DNSServer, error) {
 	s := &DNSServer{
-		ns:        ns,
-		domain:    dns.Fqdn(domain),
-		ttl:       ttl,
-		address:   address,
-		tcpClient: &dns.Client{Net: "tcp", ReadTimeout: clientTimeout},
-		udpClient: &dns.Client{Net: "udp", ReadTimeout: clientTimeout, UDPSize: udpBuffSize},
+		ns:         ns,
+		ttl:        ttl,
+		address:    address,
+		nameserver: dns.Fqdn(nameserver),
+		queryStats: newQueryStats(),
+		tcpClient:  &dns.Client{Net: "tcp", ReadTimeout: clientTimeout},
+		udpClient:  &dns.Client{Net: "udp", ReadTimeout: clientTimeout, UDPSize: udpBuffSize},
 	}
 	var err error
 	if s.upstream, err = dns.ClientConfigFromFile(etcResolvConf); err != nil {
@@ -73,11 +98,31 @@ func NewDNSServer(ns *Nameserver, domain, address, effectiveAddress string, ttl
 func (d *DNSServer) String() string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "WeaveDNS (%s)\n", d.ns.ourName)
-	fmt.Fprintf(&buf, "  listening on %s, for domain %s\n", d.address, d.domain)
+	fmt.Fprintf(&buf, "  listening on %s, for domains %v\n", d.address, d.ns.Domains())
 	fmt.Fprintf(&buf, "  response ttl %d\n", d.ttl)
 	return buf.String()
 }
 
+// AllowTransfers lets clients in the given subnets make zone
+// transfers (AXFR and IXFR) of our domains.
+func (d *DNSServer) AllowTransfers(clients []address.CIDR) {
+	d.transferClients = clients
+	d.ns.keepZoneHistory()
+}
+
+func (d *DNSServer) transferAllowed(client net.Addr) bool {
+	ip := clientIP(client)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range d.transferClients {
+		if cidr.Range().Contains(address.FromIP4(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *DNSServer) listen(address string) error {
 	udpListener, err := net.ListenPacket("udp", address)
 	if err != nil {
@@ -126,38 +171,99 @@ func (d *DNSServer) createMux(client *dns.Client, defaultMaxResponseSize int) *d
 		maxResponseSize: defaultMaxResponseSize,
 		client:          client,
 	}
-	m.HandleFunc(d.domain, h.handleLocal)
-	m.HandleFunc(reverseDNSdomain, h.handleReverse)
-	m.HandleFunc(topDomain, h.handleRecursive)
+	for _, domain := range d.ns.Domains() {
+		domain := domain
+		m.HandleFunc(domain.Name, d.logged(func(w dns.ResponseWriter, req *dns.Msg) {
+			h.handleLocal(domain, w, req)
+		}))
+	}
+	m.HandleFunc(reverseDNSdomain, d.logged(h.handleReverse))
+	m.HandleFunc(topDomain, d.logged(h.handleRecursive))
 	return m
 }
 
-func (h *handler) handleLocal(w dns.ResponseWriter, req *dns.Msg) {
+func (h *handler) handleLocal(domain Domain, w dns.ResponseWriter, req *dns.Msg) {
 	h.ns.debugf("local request: %+v", *req)
 	if len(req.Question) != 1 {
 		h.nameError(w, req)
 		return
 	}
+	if !domain.allowsClient(w.RemoteAddr()) {
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeRefused))
+		return
+	}
 
 	hostname := dns.Fqdn(req.Question[0].Name)
 	if strings.Count(hostname, ".") == 1 {
-		hostname = hostname + h.domain
+		hostname = hostname + domain.Name
+	}
+	if strings.EqualFold(hostname, domain.Name) {
+		h.handleApex(domain, w, req)
+		return
+	}
+	if qtype := req.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeNotAuth))
+		return
+	}
+
+	// Follow CNAMEs as far as they stay within domains the client can
+	// see; beyond that, the client's resolver carries on
+	var (
+		chain []dns.RR
+		name  = req.Question[0].Name
+		seen  = map[string]bool{}
+	)
+	for {
+		target, isCNAME := h.ns.LookupCNAME(hostname)
+		if !isCNAME {
+			break
+		}
+		if seen[strings.ToLower(hostname)] || len(chain) >= maxCNAMEChain {
+			h.ns.infof("CNAME loop at %s", hostname)
+			h.respond(w, h.makeErrorResponse(req, dns.RcodeServerFailure))
+			return
+		}
+		seen[strings.ToLower(hostname)] = true
+		chain = append(chain, h.cnameRecord(name, target))
+		if req.Question[0].Qtype == dns.TypeCNAME {
+			h.respond(w, h.makeResponse(req, chain))
+			return
+		}
+		targetDomain, found := h.ns.domainOf(target)
+		if !found || !targetDomain.allowsClient(w.RemoteAddr()) {
+			h.respond(w, h.makeResponse(req, chain))
+			return
+		}
+		domain, hostname, name = targetDomain, target, target
 	}
 
-	addrs := h.ns.Lookup(hostname)
+	var addrs []address.Address
+	nearestFirst := h.ns.distance != nil
+	if vip, found := h.ns.LookupVIP(hostname); found {
+		addrs = []address.Address{vip}
+	} else if nearestFirst {
+		addrs = h.ns.LookupNearest(hostname)
+	} else {
+		addrs = h.ns.Lookup(hostname)
+	}
 	if len(addrs) == 0 {
-		h.nameError(w, req)
+		// the code is for the last name in the chain (RFC 6604)
+		response := h.makeNegativeResponse(domain, req, dns.RcodeNameError)
+		response.Answer = chain
+		h.respond(w, response)
 		return
 	}
 	// Per RFC4074, if we have an A but another type was requested,
 	// return 'no error' with empty answer section
 	if req.Question[0].Qtype != dns.TypeA {
-		h.respond(w, h.makeResponse(req, nil))
+		response := h.makeNegativeResponse(domain, req, dns.RcodeSuccess)
+		response.Answer = chain
+		h.respond(w, response)
 		return
 	}
 
 	header := dns.RR_Header{
-		Name:   req.Question[0].Name,
+		Name:   name,
 		Rrtype: dns.TypeA,
 		Class:  dns.ClassINET,
 		Ttl:    h.ttl,
@@ -167,9 +273,144 @@ func (h *handler) handleLocal(w dns.ResponseWriter, req *dns.Msg) {
 		ip := addr.IP4()
 		answers[i] = &dns.A{Hdr: header, A: ip}
 	}
-	shuffleAnswers(&answers)
+	if !nearestFirst {
+		shuffleAnswers(&answers)
+	}
 
-	h.respond(w, h.makeResponse(req, answers))
+	h.respond(w, h.makeResponse(req, append(chain, answers...)))
+}
+
+// The domain itself has just the SOA and NS records, so that other
+// servers can delegate to us.
+func (h *handler) handleApex(domain Domain, w dns.ResponseWriter, req *dns.Msg) {
+	switch req.Question[0].Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		h.handleTransfer(domain, w, req)
+	case dns.TypeSOA:
+		h.respond(w, h.makeResponse(req, []dns.RR{h.soaRecord(domain, h.ns.Serial())}))
+	case dns.TypeNS:
+		h.respond(w, h.makeResponse(req, []dns.RR{h.nsRecord(domain)}))
+	default:
+		h.respond(w, h.makeNegativeResponse(domain, req, dns.RcodeSuccess))
+	}
+}
+
+// handleTransfer answers AXFR with the whole zone, and IXFR with the
+// changes since the secondary's serial number if we still have that
+// version of the zone, or else the whole zone (RFC 1995).
+func (h *handler) handleTransfer(domain Domain, w dns.ResponseWriter, req *dns.Msg) {
+	if !h.transferAllowed(w.RemoteAddr()) {
+		h.ns.infof("refusing zone transfer of %s to %s", domain.Name, w.RemoteAddr())
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeRefused))
+		return
+	}
+
+	var (
+		_, isTCP = w.RemoteAddr().(*net.TCPAddr)
+		records  []dns.RR
+	)
+	if req.Question[0].Qtype == dns.TypeIXFR {
+		since, ok := ixfrSerial(req)
+		if !ok {
+			h.respond(w, h.makeErrorResponse(req, dns.RcodeFormatError))
+			return
+		}
+		serial, removed, added, ok := h.ns.zoneChanges(domain, since)
+		switch {
+		case serial == since || !isTCP:
+			// up to date, or asked over UDP, where we only say
+			// what the current version is (RFC 1995 section 2)
+			h.respond(w, h.makeResponse(req, []dns.RR{h.soaRecord(domain, serial)}))
+			return
+		case ok:
+			soa := h.soaRecord(domain, serial)
+			records = append(records, soa, h.soaRecord(domain, since))
+			records = append(records, h.zoneRRs(removed)...)
+			records = append(records, soa)
+			records = append(records, h.zoneRRs(added)...)
+			records = append(records, soa)
+		}
+	} else if !isTCP {
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeFormatError))
+		return
+	}
+	if records == nil {
+		serial, zone := h.ns.zone(domain)
+		soa := h.soaRecord(domain, serial)
+		records = append(records, soa, h.nsRecord(domain))
+		records = append(records, h.zoneRRs(zone)...)
+		records = append(records, soa)
+	}
+
+	h.ns.infof("zone transfer of %s to %s: %d records", domain.Name, w.RemoteAddr(), len(records))
+	for len(records) > 0 {
+		n := transferChunkSize
+		if n > len(records) {
+			n = len(records)
+		}
+		response := &dns.Msg{}
+		response.SetReply(req)
+		response.Authoritative = true
+		response.Compress = true
+		response.Answer = records[:n]
+		records = records[n:]
+		if err := w.WriteMsg(response); err != nil {
+			h.ns.infof("error sending zone transfer: %v", err)
+			return
+		}
+	}
+}
+
+// The secondary's serial number is in the SOA in the authority section
+func ixfrSerial(req *dns.Msg) (uint32, bool) {
+	for _, rr := range req.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+func (d *DNSServer) soaRecord(domain Domain, serial uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: domain.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: d.ttl},
+		Ns:      d.nameserver,
+		Mbox:    "hostmaster." + domain.Name,
+		Serial:  serial,
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  d.ttl,
+	}
+}
+
+func (d *DNSServer) nsRecord(domain Domain) dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: domain.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: d.ttl},
+		Ns:  d.nameserver,
+	}
+}
+
+func (d *DNSServer) zoneRRs(records []zoneRecord) []dns.RR {
+	result := make([]dns.RR, len(records))
+	for i, record := range records {
+		if record.target != "" {
+			result[i] = d.cnameRecord(record.hostname, record.target)
+			continue
+		}
+		result[i] = &dns.A{
+			Hdr: dns.RR_Header{Name: record.hostname, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: d.ttl},
+			A:   record.addr.IP4(),
+		}
+	}
+	return result
+}
+
+func (d *DNSServer) cnameRecord(hostname, target string) dns.RR {
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: hostname, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: d.ttl},
+		Target: target,
+	}
 }
 
 func (h *handler) handleReverse(w dns.ResponseWriter, req *dns.Msg) {
@@ -191,6 +432,10 @@ func (h *handler) handleReverse(w dns.ResponseWriter, req *dns.Msg) {
 		h.handleRecursive(w, req)
 		return
 	}
+	if domain, found := h.ns.domainOf(hostname); found && !domain.allowsClient(w.RemoteAddr()) {
+		h.nameError(w, req)
+		return
+	}
 
 	header := dns.RR_Header{
 		Name:   req.Question[0].Name,
@@ -213,20 +458,37 @@ func (h *handler) handleRecursive(w dns.ResponseWriter, req *dns.Msg) {
 	if len(req.Question) == 1 {
 		hostname := dns.Fqdn(req.Question[0].Name)
 		if strings.Count(hostname, ".") == 1 {
-			h.handleLocal(w, req)
+			h.handleLocal(h.searchDomain(w.RemoteAddr()), w, req)
 			return
 		}
 	}
 
-	for _, server := range h.upstream.Servers {
+	for _, server := range h.forwarders() {
 		reqCopy := req.Copy()
 		reqCopy.Id = dns.Id()
-		response, _, err := h.client.Exchange(reqCopy, fmt.Sprintf("%s:%s", server, h.upstream.Port))
+		if h.validator != nil {
+			setDNSSECOK(reqCopy)
+		}
+		response, err := server.exchange(reqCopy, h.client)
 		if (err != nil && err != dns.ErrTruncated) || response == nil {
 			h.ns.debugf("error trying %s: %v", server, err)
 			continue
 		}
+		if h.validator != nil && response.Truncated {
+			stripTruncated(response)
+		} else if h.validator != nil {
+			secure, err := h.validator.validate(response)
+			if err != nil {
+				h.ns.infof("bogus answer from %s to %s: %v", server, req.Question[0].Name, err)
+				continue
+			}
+			response.AuthenticatedData = secure
+			if !wantsDNSSEC(req) {
+				stripDNSSEC(req, response)
+			}
+		}
 		response.Id = req.Id
+		noteUpstream(w, server.String())
 		if h.responseTooBig(req, response) {
 			response.Compress = true
 		}
@@ -262,6 +524,15 @@ func (h *handler) makeResponse(req *dns.Msg, answers []dns.RR) *dns.Msg {
 	return response
 }
 
+// Negative answers for names in our domains carry the SOA, so that
+// resolvers know how long they can cache them (RFC 2308)
+func (h *handler) makeNegativeResponse(domain Domain, req *dns.Msg, code int) *dns.Msg {
+	response := h.makeErrorResponse(req, code)
+	response.Authoritative = true
+	response.Ns = []dns.RR{h.soaRecord(domain, h.ns.Serial())}
+	return response
+}
+
 func (h *handler) makeErrorResponse(req *dns.Msg, code int) *dns.Msg {
 	response := &dns.Msg{}
 	response.SetReply(req)
@@ -285,6 +556,18 @@ func (h *handler) nameError(w dns.ResponseWriter, req *dns.Msg) {
 	h.respond(w, h.makeErrorResponse(req, dns.RcodeNameError))
 }
 
+// searchDomain picks the domain for unqualified names: the first one
+// the client can see
+func (h *handler) searchDomain(client net.Addr) Domain {
+	domains := h.ns.Domains()
+	for _, domain := range domains {
+		if domain.allowsClient(client) {
+			return domain
+		}
+	}
+	return domains[0]
+}
+
 func (h *handler) getMaxResponseSize(req *dns.Msg) int {
 	if opt := req.IsEdns0(); opt != nil {
 		return int(opt.UDPSize())
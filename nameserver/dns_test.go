@@ -1,6 +1,7 @@
 package nameserver
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
@@ -16,10 +17,14 @@ import (
 )
 
 func startServer(t *testing.T, upstream *dns.ClientConfig) (*DNSServer, *Nameserver, int, int) {
+	return startServerWithDomains(t, upstream, []Domain{{Name: "weave.local."}})
+}
+
+func startServerWithDomains(t *testing.T, upstream *dns.ClientConfig, domains []Domain) (*DNSServer, *Nameserver, int, int) {
 	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
 	require.Nil(t, err)
-	nameserver := New(peername, "", func(mesh.PeerName) bool { return true })
-	dnsserver, err := NewDNSServer(nameserver, "weave.local.", "0.0.0.0:0", "", 30, 5*time.Second)
+	nameserver := New(peername, domains, func(mesh.PeerName) bool { return true })
+	dnsserver, err := NewDNSServer(nameserver, "ns.example.com.", "0.0.0.0:0", "", 30, 5*time.Second)
 	require.Nil(t, err)
 	udpPort := dnsserver.servers[0].PacketConn.LocalAddr().(*net.UDPAddr).Port
 	tcpPort := dnsserver.servers[1].Listener.Addr().(*net.TCPAddr).Port
@@ -76,6 +81,201 @@ func TestTruncation(t *testing.T) {
 	}
 }
 
+func TestDomains(t *testing.T) {
+	var domains []Domain
+	for _, s := range []string{"private.local=10.0.0.0/8", "tenant.local=127.0.0.0/8", "weave.local"} {
+		domain, err := ParseDomain(s)
+		require.NoError(t, err)
+		domains = append(domains, domain)
+	}
+	dnsserver, nameserver, udpPort, _ := startServerWithDomains(t, nil, domains)
+	defer dnsserver.Stop()
+	nameserver.AddEntry("foo.tenant.local.", "c1", nameserver.ourName, address.Address(1))
+	nameserver.AddEntry("foo.private.local.", "c2", nameserver.ourName, address.Address(2))
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion(name, qtype)
+		response, _, err := (&dns.Client{Net: "udp"}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		return response
+	}
+
+	response := query("weave.local.", dns.TypeSOA)
+	require.Len(t, response.Answer, 1)
+	soa := response.Answer[0].(*dns.SOA)
+	require.Equal(t, "ns.example.com.", soa.Ns)
+	require.Equal(t, nameserver.Serial(), soa.Serial)
+
+	response = query("weave.local.", dns.TypeNS)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "ns.example.com.", response.Answer[0].(*dns.NS).Ns)
+
+	response = query("missing.weave.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, response.Rcode)
+	require.True(t, response.Authoritative)
+	require.Len(t, response.Ns, 1, "negative answers carry the SOA")
+
+	response = query("foo.tenant.local.", dns.TypeA)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, address.Address(1).IP4(), response.Answer[0].(*dns.A).A)
+
+	response = query("foo.private.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeRefused, response.Rcode, "client is not in the domain's subnet")
+
+	response = query("foo.", dns.TypeA)
+	require.Len(t, response.Answer, 1, "unqualified names are in the first domain the client can see")
+	require.Equal(t, address.Address(1).IP4(), response.Answer[0].(*dns.A).A)
+}
+
+func TestCNAMEChasing(t *testing.T) {
+	dnsserver, nameserver, udpPort, _ := startServer(t, nil)
+	defer dnsserver.Stop()
+	nameserver.AddEntry("postgres-1.weave.local.", "c1", nameserver.ourName, address.Address(1))
+	nameserver.AddEntry("*.app.weave.local.", "c2", nameserver.ourName, address.Address(2))
+	nameserver.AddCNAME("db.weave.local.", "", nameserver.ourName, "postgres-1.weave.local.")
+	nameserver.AddCNAME("primary.weave.local.", "", nameserver.ourName, "db.weave.local.")
+	nameserver.AddCNAME("dangling.weave.local.", "", nameserver.ourName, "missing.weave.local.")
+	nameserver.AddCNAME("external.weave.local.", "", nameserver.ourName, "example.com.")
+	nameserver.AddCNAME("loop1.weave.local.", "", nameserver.ourName, "loop2.weave.local.")
+	nameserver.AddCNAME("loop2.weave.local.", "", nameserver.ourName, "loop1.weave.local.")
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion(name, qtype)
+		response, _, err := (&dns.Client{Net: "udp"}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		return response
+	}
+
+	response := query("primary.weave.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 3)
+	require.Equal(t, "db.weave.local.", response.Answer[0].(*dns.CNAME).Target)
+	require.Equal(t, "postgres-1.weave.local.", response.Answer[1].(*dns.CNAME).Target)
+	require.Equal(t, "postgres-1.weave.local.", response.Answer[2].Header().Name)
+	require.Equal(t, address.Address(1).IP4(), response.Answer[2].(*dns.A).A)
+
+	response = query("primary.weave.local.", dns.TypeCNAME)
+	require.Len(t, response.Answer, 1, "a CNAME query gets just the CNAME")
+
+	response = query("tenant1.app.weave.local.", dns.TypeA)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "tenant1.app.weave.local.", response.Answer[0].Header().Name, "wildcard answers are for the name asked")
+
+	response = query("dangling.weave.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, response.Rcode)
+	require.Len(t, response.Answer, 1)
+
+	response = query("external.weave.local.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 1, "the client's resolver follows names outside our domains")
+
+	require.Equal(t, dns.RcodeServerFailure, query("loop1.weave.local.", dns.TypeA).Rcode)
+}
+
+type lineWriter chan []byte
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestQueryLog(t *testing.T) {
+	dnsserver, nameserver, udpPort, _ := startServer(t, nil)
+	defer dnsserver.Stop()
+	client, err := address.ParseIP("127.0.0.1")
+	require.NoError(t, err)
+	nameserver.AddEntry("client.weave.local.", "c1", nameserver.ourName, client)
+	nameserver.AddEntry("foo.weave.local.", "c2", nameserver.ourName, address.Address(1))
+	lines := make(lineWriter, 10)
+	dnsserver.SetQueryLog(lines, nil)
+
+	query := func(name string) QueryRecord {
+		request := &dns.Msg{}
+		request.SetQuestion(name, dns.TypeA)
+		_, _, err := (&dns.Client{Net: "udp"}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		var record QueryRecord
+		require.NoError(t, json.Unmarshal(<-lines, &record))
+		return record
+	}
+
+	record := query("foo.weave.local.")
+	require.Equal(t, "127.0.0.1", record.Client)
+	require.Equal(t, "c1", record.Container, "client is identified by its entry")
+	require.Equal(t, "foo.weave.local.", record.Name)
+	require.Equal(t, "A", record.Type)
+	require.Equal(t, "NOERROR", record.Rcode)
+	require.Equal(t, []string{"0.0.0.1"}, record.Answer)
+
+	record = query("missing.weave.local.")
+	require.Equal(t, "NXDOMAIN", record.Rcode)
+	require.Len(t, record.Answer, 0)
+	query("foo.weave.local.")
+
+	status := dnsserver.QueryStatus(1)
+	require.Equal(t, 3, status.Queries)
+	require.Equal(t, 1, status.NXDomain)
+	require.Equal(t, []NameQueryStatus{{"foo.weave.local.", 2, 0}}, status.Names)
+	require.Equal(t, []ClientQueryStatus{{"127.0.0.1", "c1", 3, 1}}, status.Clients)
+}
+
+func TestZoneTransfer(t *testing.T) {
+	dnsserver, nameserver, _, tcpPort := startServer(t, nil)
+	defer dnsserver.Stop()
+	nameserver.AddEntry("a.weave.local.", "c1", nameserver.ourName, address.Address(1))
+	nameserver.AddEntry("b.weave.local.", "c2", nameserver.ourName, address.Address(2))
+
+	transfer := func(request *dns.Msg) ([]dns.RR, error) {
+		envelopes, err := (&dns.Transfer{}).In(request, fmt.Sprintf("127.0.0.1:%d", tcpPort))
+		require.NoError(t, err)
+		var records []dns.RR
+		for envelope := range envelopes {
+			if envelope.Error != nil {
+				return nil, envelope.Error
+			}
+			records = append(records, envelope.RR...)
+		}
+		return records, nil
+	}
+	summary := func(records []dns.RR, err error) []string {
+		require.NoError(t, err)
+		var result []string
+		for _, rr := range records {
+			switch rr := rr.(type) {
+			case *dns.SOA:
+				result = append(result, fmt.Sprintf("SOA %d", rr.Serial))
+			case *dns.NS:
+				result = append(result, "NS "+rr.Ns)
+			case *dns.A:
+				result = append(result, rr.Hdr.Name+" "+rr.A.String())
+			}
+		}
+		return result
+	}
+
+	request := &dns.Msg{}
+	request.SetAxfr("weave.local.")
+	_, err := transfer(request)
+	require.Error(t, err, "transfers are refused unless allowed")
+
+	localhost, _ := address.ParseCIDR("127.0.0.0/8")
+	dnsserver.AllowTransfers([]address.CIDR{localhost})
+	serial1 := nameserver.Serial()
+	soa1 := fmt.Sprintf("SOA %d", serial1)
+	require.Equal(t, []string{soa1, "NS ns.example.com.", "a.weave.local. 0.0.0.1", "b.weave.local. 0.0.0.2", soa1},
+		summary(transfer(request)))
+
+	nameserver.AddEntry("c.weave.local.", "c3", nameserver.ourName, address.Address(3))
+	nameserver.ContainerDied("c1")
+	soa2 := fmt.Sprintf("SOA %d", nameserver.Serial())
+	request = &dns.Msg{}
+	request.SetIxfr("weave.local.", serial1, "ns.example.com.", "hostmaster.weave.local.")
+	require.Equal(t, []string{soa2, soa1, "a.weave.local. 0.0.0.1", soa2, "c.weave.local. 0.0.0.3", soa2},
+		summary(transfer(request)))
+}
+
 func TestTruncateResponse(t *testing.T) {
 
 	header := dns.RR_Header{
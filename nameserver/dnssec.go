@@ -0,0 +1,634 @@
+package nameserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The DS of the root zone's key signing key, KSK-2017
+const RootTrustAnchor = ". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+// How long we trust keys we have validated for, at most, whatever
+// their TTL says
+const maxKeyCacheTime = time.Hour
+
+var errInsecure = errors.New("zone is not signed")
+
+// validator checks the DNSSEC signatures on answers from upstream
+// servers, following the chain of trust from the trust anchors down,
+// with queries for DS and DNSKEY records made through query.
+type validator struct {
+	sync.Mutex
+	query   func(name string, qtype uint16) (*dns.Msg, error)
+	anchors []*dns.DS
+	zones   map[string]zoneKeys
+	dss     map[string]dsAnswer
+}
+
+// zoneKeys are the validated keys of a zone; none if it is unsigned
+type zoneKeys struct {
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// dsAnswer is an upstream answer to a DS query: the DS records, or
+// the NSEC/NSEC3 records proving there are none
+type dsAnswer struct {
+	response *dns.Msg
+	expires  time.Time
+}
+
+// EnableDNSSEC makes us validate the DNSSEC signatures of answers
+// from upstream servers, against the given trust anchors (DS
+// records), or the root's if none are given. Bogus answers get
+// SERVFAIL.
+func (d *DNSServer) EnableDNSSEC(anchors []string) error {
+	if len(anchors) == 0 {
+		anchors = []string{RootTrustAnchor}
+	}
+	v := &validator{query: d.dnssecQuery, zones: make(map[string]zoneKeys), dss: make(map[string]dsAnswer)}
+	for _, s := range anchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return err
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return fmt.Errorf("trust anchor %q is not a DS record", s)
+		}
+		v.anchors = append(v.anchors, ds)
+	}
+	d.validator = v
+	return nil
+}
+
+// dnssecQuery fetches the records needed to validate an answer, over
+// TCP so that they aren't truncated
+func (d *DNSServer) dnssecQuery(name string, qtype uint16) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(udpBuffSize, true)
+	err := errors.New("no upstream servers")
+	for _, server := range d.forwarders() {
+		var response *dns.Msg
+		if response, err = server.exchange(req, d.tcpClient); err == nil {
+			return response, nil
+		}
+	}
+	return nil, err
+}
+
+// validate checks the answer to a query, returning true if it is
+// signed all the way up to a trust anchor, false if it is from an
+// unsigned zone, or an error if it is bogus
+func (v *validator) validate(response *dns.Msg) (bool, error) {
+	if len(response.Question) != 1 || (response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return false, nil
+	}
+	question := response.Question[0]
+	secure := true
+
+	rrsets, sigs := splitRRsets(response.Answer)
+	for _, rrset := range rrsets {
+		rrsetSecure, err := v.verifyRRset(rrset, sigs[rrsetKey(rrset[0])])
+		if err != nil {
+			return false, err
+		}
+		secure = secure && rrsetSecure
+	}
+	if len(response.Answer) > 0 && response.Rcode == dns.RcodeSuccess && hasAnswer(rrsets, question) {
+		return secure, nil
+	}
+
+	// A negative answer, or a CNAME to a name that doesn't exist:
+	// if the zone is signed, the authority section must prove it
+	rrsets, sigs = splitRRsets(response.Ns)
+	var denials []dns.RR
+	for _, rrset := range rrsets {
+		rrsetSecure, err := v.verifyRRset(rrset, sigs[rrsetKey(rrset[0])])
+		if err != nil {
+			return false, err
+		}
+		if !rrsetSecure {
+			secure = false
+			continue
+		}
+		switch rrset[0].Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			denials = append(denials, rrset...)
+		}
+	}
+	if !secure {
+		return false, nil
+	}
+	name := question.Name
+	if len(response.Answer) > 0 {
+		name = response.Answer[len(response.Answer)-1].Header().Name
+		if cname, ok := response.Answer[len(response.Answer)-1].(*dns.CNAME); ok {
+			name = cname.Target
+		}
+	}
+	if len(denials) == 0 {
+		if zoneSecure, err := v.nameSecure(name); err != nil || zoneSecure {
+			return false, fmt.Errorf("negative answer for %s without proof", name)
+		}
+		return false, nil
+	}
+	if !denies(denials, name, question.Qtype, response.Rcode == dns.RcodeNameError) {
+		return false, fmt.Errorf("negative answer for %s not proven by %v", name, denials)
+	}
+	return true, nil
+}
+
+// verifyRRset checks one of the signatures of an RRset. An unsigned
+// RRset is fine if it is in an unsigned zone.
+func (v *validator) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG) (bool, error) {
+	owner := rrset[0].Header().Name
+	if len(sigs) == 0 {
+		if secure, err := v.nameSecure(owner); err != nil || secure {
+			return false, fmt.Errorf("no signature for %s %s", owner, dns.TypeToString[rrset[0].Header().Rrtype])
+		}
+		return false, nil
+	}
+	var lastErr error
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, owner) {
+			lastErr = fmt.Errorf("%s cannot sign %s", sig.SignerName, owner)
+			continue
+		}
+		keys, err := v.keys(sig.SignerName)
+		if err == errInsecure {
+			return false, nil
+		} else if err != nil {
+			lastErr = err
+			continue
+		}
+		if lastErr = verifyWith(sig, keys, rrset); lastErr == nil {
+			return true, nil
+		}
+	}
+	return false, lastErr
+}
+
+func verifyWith(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) error {
+	if !sig.ValidityPeriod(time.Now()) {
+		return fmt.Errorf("signature on %s has expired or is not yet valid", sig.Hdr.Name)
+	}
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrset) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("bad signature on %s %s", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+}
+
+// keys returns the validated keys of zone, or errInsecure if the zone
+// is unsigned
+func (v *validator) keys(zone string) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if _, found := v.closestAnchor(zone); !found {
+		return nil, errInsecure
+	}
+	v.Lock()
+	cached, found := v.zones[zone]
+	v.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		if cached.keys == nil {
+			return nil, errInsecure
+		}
+		return cached.keys, nil
+	}
+
+	var (
+		dss []*dns.DS
+		ttl uint32
+		err error
+	)
+	for _, anchor := range v.anchors {
+		if strings.EqualFold(anchor.Hdr.Name, zone) {
+			dss = append(dss, anchor)
+		}
+	}
+	if dss == nil {
+		if dss, ttl, err = v.ds(zone); err == errInsecure {
+			v.cache(zone, nil, uint32(maxKeyCacheTime/time.Second))
+			return nil, err
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		keys    []*dns.DNSKEY
+		keySigs []*dns.RRSIG
+	)
+	for _, rr := range response.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				keySigs = append(keySigs, rr)
+			}
+		}
+	}
+	// the key set must be signed by a key the parent vouches for
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, ds := range dss {
+			if key.KeyTag() == ds.KeyTag && key.Algorithm == ds.Algorithm {
+				if ours := key.ToDS(ds.DigestType); ours != nil && strings.EqualFold(ours.Digest, ds.Digest) {
+					trusted = append(trusted, key)
+				}
+			}
+		}
+	}
+	rrset := make([]dns.RR, len(keys))
+	for i, key := range keys {
+		rrset[i] = key
+	}
+	for _, sig := range keySigs {
+		if verifyWith(sig, trusted, rrset) == nil {
+			if ttl == 0 || keys[0].Hdr.Ttl < ttl {
+				ttl = keys[0].Hdr.Ttl
+			}
+			v.cache(zone, keys, ttl)
+			return keys, nil
+		}
+	}
+	return nil, fmt.Errorf("no trusted key for %s", zone)
+}
+
+func (v *validator) cache(zone string, keys []*dns.DNSKEY, ttl uint32) {
+	expiry := time.Duration(ttl) * time.Second
+	if expiry > maxKeyCacheTime {
+		expiry = maxKeyCacheTime
+	}
+	v.Lock()
+	v.zones[zone] = zoneKeys{keys, time.Now().Add(expiry)}
+	v.Unlock()
+}
+
+// ds returns the validated DS records of zone from its parent, or
+// errInsecure if the parent is unsigned or proves there are none
+func (v *validator) ds(zone string) ([]*dns.DS, uint32, error) {
+	response, err := v.queryDS(zone)
+	if err != nil {
+		return nil, 0, err
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("DS query for %s failed: %s", zone, dns.RcodeToString[response.Rcode])
+	}
+	rrsets, sigs := splitRRsets(response.Answer)
+	for _, rrset := range rrsets {
+		if rrset[0].Header().Rrtype != dns.TypeDS || !strings.EqualFold(rrset[0].Header().Name, zone) {
+			continue
+		}
+		secure, err := v.verifyParentRRset(zone, rrset, sigs[rrsetKey(rrset[0])])
+		if err != nil {
+			return nil, 0, err
+		} else if !secure {
+			return nil, 0, errInsecure
+		}
+		var dss []*dns.DS
+		for _, rr := range rrset {
+			dss = append(dss, rr.(*dns.DS))
+		}
+		return dss, rrset[0].Header().Ttl, nil
+	}
+
+	// no DS: the zone is unsigned if the parent is, or proves it
+	rrsets, sigs = splitRRsets(response.Ns)
+	var denials []dns.RR
+	for _, rrset := range rrsets {
+		if t := rrset[0].Header().Rrtype; t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+		secure, err := v.verifyParentRRset(zone, rrset, sigs[rrsetKey(rrset[0])])
+		if err != nil {
+			return nil, 0, err
+		} else if !secure {
+			return nil, 0, errInsecure
+		}
+		denials = append(denials, rrset...)
+	}
+	if len(denials) > 0 && denies(denials, zone, dns.TypeDS, false) {
+		return nil, 0, errInsecure
+	}
+	parent, err := v.parentSecure(zone)
+	if err != nil {
+		return nil, 0, err
+	}
+	if parent {
+		return nil, 0, fmt.Errorf("no DS for %s, and no proof there is none", zone)
+	}
+	return nil, 0, errInsecure
+}
+
+// verifyParentRRset checks an RRset that must be signed by a zone
+// above zone; with no signature, it is fine if that zone is unsigned
+func (v *validator) verifyParentRRset(zone string, rrset []dns.RR, sigs []*dns.RRSIG) (bool, error) {
+	if len(sigs) == 0 {
+		if secure, err := v.parentSecure(zone); err != nil || secure {
+			return false, fmt.Errorf("no signature for %s %s", zone, dns.TypeToString[rrset[0].Header().Rrtype])
+		}
+		return false, nil
+	}
+	for _, sig := range sigs {
+		if strings.EqualFold(sig.SignerName, zone) {
+			return false, fmt.Errorf("%s signed by itself", zone)
+		}
+	}
+	return v.verifyRRset(rrset, sigs)
+}
+
+// parentSecure finds whether the zone above zone is signed
+func (v *validator) parentSecure(zone string) (bool, error) {
+	if zone == "." {
+		return false, nil // there is nothing above the root
+	}
+	labels := dns.SplitDomainName(zone)
+	return v.nameSecure(dns.Fqdn(strings.Join(labels[1:], ".")))
+}
+
+// nameSecure finds whether name is in a signed zone, by walking down
+// from the closest trust anchor looking for zone cuts. At each cut,
+// the parent either has a DS for the child, or a signed proof that it
+// has none, making the child and all below it unsigned. Names outside
+// every trust anchor are unsigned as far as we can tell.
+func (v *validator) nameSecure(name string) (bool, error) {
+	anchor, found := v.closestAnchor(name)
+	if !found {
+		return false, nil
+	}
+	if _, err := v.keys(anchor); err == errInsecure {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(anchor) - 1; i >= 0; i-- {
+		candidate := strings.ToLower(dns.Fqdn(strings.Join(labels[i:], ".")))
+		v.Lock()
+		cached, found := v.zones[candidate]
+		v.Unlock()
+		if found && time.Now().Before(cached.expires) {
+			if cached.keys == nil {
+				return false, nil
+			}
+			continue
+		}
+		response, err := v.queryDS(candidate)
+		if err != nil {
+			return false, err
+		}
+		if response.Rcode == dns.RcodeNameError {
+			break // nothing further down, so no more zone cuts
+		}
+		if !isDelegation(response, candidate) {
+			continue
+		}
+		if _, err := v.keys(candidate); err == errInsecure {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// closestAnchor finds the trust anchor nearest above name, if any
+func (v *validator) closestAnchor(name string) (string, bool) {
+	closest, found := "", false
+	for _, anchor := range v.anchors {
+		if dns.IsSubDomain(anchor.Hdr.Name, name) && (!found || dns.CountLabel(anchor.Hdr.Name) > dns.CountLabel(closest)) {
+			closest, found = strings.ToLower(anchor.Hdr.Name), true
+		}
+	}
+	return closest, found
+}
+
+// queryDS asks for the DS records of zone, remembering the answer,
+// whether the records or the proof there are none, for its TTL
+func (v *validator) queryDS(zone string) (*dns.Msg, error) {
+	v.Lock()
+	cached, found := v.dss[zone]
+	v.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached.response, nil
+	}
+	response, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	if response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError {
+		if ttl := minTTL(response); ttl > 0 {
+			expiry := time.Duration(ttl) * time.Second
+			if expiry > maxKeyCacheTime {
+				expiry = maxKeyCacheTime
+			}
+			v.Lock()
+			v.dss[zone] = dsAnswer{response, time.Now().Add(expiry)}
+			v.Unlock()
+		}
+	}
+	return response, nil
+}
+
+func minTTL(response *dns.Msg) uint32 {
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, rrs := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, rr := range rrs {
+			if t := rr.Header().Ttl; !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	return ttl
+}
+
+// isDelegation tells from the answer to a DS query whether name is a
+// zone cut: there is a DS for it, or the NSEC/NSEC3 for it shows NS
+// records, which it can only have at a cut
+func isDelegation(response *dns.Msg, name string) bool {
+	for _, rr := range response.Answer {
+		if rr.Header().Rrtype == dns.TypeDS && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	for _, rr := range response.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(rr.Hdr.Name, name) && hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) && hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA) {
+				return true
+			}
+			if rr.Cover(name) && rr.Flags&1 == 1 {
+				return true // opt-out: may be an unsigned delegation
+			}
+		case *dns.SOA:
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				return true // the child answered, so there is a cut
+			}
+		}
+	}
+	return false
+}
+
+// denies checks that the NSEC or NSEC3 records prove that name has no
+// records of type qtype, or doesn't exist at all
+func denies(denials []dns.RR, name string, qtype uint16, nxdomain bool) bool {
+	for _, rr := range denials {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if !nxdomain && strings.EqualFold(rr.Hdr.Name, name) && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			if nsecCovers(rr, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if !nxdomain && rr.Match(name) && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			if rr.Cover(name) && (nxdomain || qtype == dns.TypeDS && rr.Flags&1 == 1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	if canonicalCompare(nsec.NextDomain, nsec.Hdr.Name) <= 0 {
+		// the last NSEC in the zone wraps round to the apex
+		return canonicalCompare(nsec.Hdr.Name, name) < 0 || canonicalCompare(name, nsec.NextDomain) < 0
+	}
+	return canonicalCompare(nsec.Hdr.Name, name) < 0 && canonicalCompare(name, nsec.NextDomain) < 0
+}
+
+// canonicalCompare orders names as RFC 4034 section 6.1 does: by
+// their labels, lower-cased, from the right
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, bt := range bitmap {
+		if bt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnswer(rrsets [][]dns.RR, question dns.Question) bool {
+	for _, rrset := range rrsets {
+		if t := rrset[0].Header().Rrtype; t == question.Qtype || question.Qtype == dns.TypeANY {
+			return true
+		}
+	}
+	return false
+}
+
+type rrsetID struct {
+	name  string
+	rtype uint16
+}
+
+func rrsetKey(rr dns.RR) rrsetID {
+	return rrsetID{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+}
+
+// splitRRsets groups records into RRsets, and their signatures by
+// the RRset they cover
+func splitRRsets(rrs []dns.RR) ([][]dns.RR, map[rrsetID][]*dns.RRSIG) {
+	var (
+		rrsets [][]dns.RR
+		index  = make(map[rrsetID]int)
+		sigs   = make(map[rrsetID][]*dns.RRSIG)
+	)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetID{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKey(rr)
+		if i, found := index[key]; found {
+			rrsets[i] = append(rrsets[i], rr)
+		} else {
+			index[key] = len(rrsets)
+			rrsets = append(rrsets, []dns.RR{rr})
+		}
+	}
+	return rrsets, sigs
+}
+
+// We ask upstream servers for DNSSEC records, to validate answers
+func setDNSSECOK(req *dns.Msg) {
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+		return
+	}
+	req.SetEdns0(udpBuffSize, true)
+}
+
+func wantsDNSSEC(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// Clients that didn't ask for DNSSEC records don't get them, nor EDNS
+// if they didn't use it
+func stripDNSSEC(req, response *dns.Msg) {
+	strip := func(rrs []dns.RR, types ...uint16) []dns.RR {
+		result := rrs[:0]
+	next:
+		for _, rr := range rrs {
+			for _, t := range types {
+				if rr.Header().Rrtype == t {
+					continue next
+				}
+			}
+			result = append(result, rr)
+		}
+		return result
+	}
+	response.Answer = strip(response.Answer, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3)
+	response.Ns = strip(response.Ns, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3)
+	if req.IsEdns0() == nil {
+		response.Extra = strip(response.Extra, dns.TypeOPT)
+	}
+}
+
+// A truncated response can't be validated, so clients get nothing
+// from it but the TC bit, which tells them to retry over TCP
+func stripTruncated(response *dns.Msg) {
+	response.AuthenticatedData = false
+	response.Answer, response.Ns, response.Extra = nil, nil, nil
+}
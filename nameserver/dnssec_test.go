@@ -0,0 +1,323 @@
+package nameserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type testKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestKey(t *testing.T, zone string) testKey {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	return testKey{key, priv.(crypto.Signer)}
+}
+
+func (k testKey) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	now := uint32(time.Now().Unix())
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  k.key.Algorithm,
+		Expiration: now + 3600,
+		Inception:  now - 3600,
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+	}
+	require.NoError(t, sig.Sign(k.priv, rrset))
+	return append(rrset, sig)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
+
+func testQuestion(name string, qtype uint16) dns.Question {
+	return dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+}
+
+type testAnswer struct {
+	rcode  int
+	answer []dns.RR
+	ns     []dns.RR
+}
+
+// A signed root with a signed zone example. and an unsigned zone
+// insecure., as a recursive resolver would answer for them, and the
+// DSes of the root and example. to use as trust anchors
+func signedUpstream(t *testing.T) (dns.HandlerFunc, *dns.DS, *dns.DS) {
+	root, example := newTestKey(t, "."), newTestKey(t, "example.")
+	rootSOA := mustRR(t, ". 3600 IN SOA ns. hostmaster. 1 60 10 3600 60")
+	exampleSOA := mustRR(t, "example. 3600 IN SOA ns.example. hostmaster.example. 1 60 10 3600 60")
+	exampleDS := example.key.ToDS(dns.SHA256)
+	exampleDS.Hdr.Ttl = 3600
+
+	badSig := example.sign(t, mustRR(t, "bad.example. 3600 IN A 10.0.0.3"))[1]
+	answers := map[dns.Question]testAnswer{
+		testQuestion(".", dns.TypeDNSKEY):        {answer: root.sign(t, root.key)},
+		testQuestion("example.", dns.TypeDS):     {answer: root.sign(t, exampleDS)},
+		testQuestion("example.", dns.TypeDNSKEY): {answer: example.sign(t, example.key)},
+		testQuestion("www.example.", dns.TypeA):  {answer: example.sign(t, mustRR(t, "www.example. 3600 IN A 10.0.0.1"))},
+		testQuestion("bad.example.", dns.TypeA):  {answer: []dns.RR{mustRR(t, "bad.example. 3600 IN A 10.0.0.2"), badSig}},
+		testQuestion("missing.example.", dns.TypeA): {
+			rcode: dns.RcodeNameError,
+			ns: append(example.sign(t, exampleSOA),
+				example.sign(t, mustRR(t, "bad.example. 60 IN NSEC www.example. A RRSIG NSEC"))...),
+		},
+		testQuestion("insecure.", dns.TypeDS): {
+			ns: append(root.sign(t, rootSOA),
+				root.sign(t, mustRR(t, "insecure. 60 IN NSEC . NS RRSIG NSEC"))...),
+		},
+		testQuestion("www.insecure.", dns.TypeA):   {answer: []dns.RR{mustRR(t, "www.insecure. 3600 IN A 10.0.0.4")}},
+		testQuestion("forged.example.", dns.TypeA): {answer: []dns.RR{mustRR(t, "forged.example. 3600 IN A 10.0.0.5")}},
+	}
+
+	handler := func(w dns.ResponseWriter, req *dns.Msg) {
+		response := &dns.Msg{}
+		response.SetReply(req)
+		question := req.Question[0]
+		question.Name = strings.ToLower(question.Name)
+		if answer, found := answers[question]; found {
+			response.Rcode, response.Answer, response.Ns = answer.rcode, answer.answer, answer.ns
+		} else {
+			response.Rcode = dns.RcodeNameError
+		}
+		if opt := req.IsEdns0(); opt != nil {
+			response.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		w.WriteMsg(response)
+	}
+	anchor := root.key.ToDS(dns.SHA256)
+	return handler, anchor, exampleDS
+}
+
+func startUpstream(t *testing.T, handler dns.HandlerFunc) (*dns.Server, string) {
+	udpListener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, _ := net.SplitHostPort(udpListener.LocalAddr().String())
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	udpServer := &dns.Server{PacketConn: udpListener, Handler: handler}
+	go udpServer.ActivateAndServe()
+	go (&dns.Server{Listener: tcpListener, Handler: handler}).ActivateAndServe()
+	return udpServer, port
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	handler, anchor, _ := signedUpstream(t)
+	upstream, port := startUpstream(t, handler)
+	defer upstream.Shutdown()
+	dnsserver, _, udpPort, _ := startServer(t, &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: port})
+	defer dnsserver.Stop()
+	require.NoError(t, dnsserver.EnableDNSSEC([]string{anchor.String()}))
+	query := dnssecQuerier(t, udpPort)
+
+	response := query("www.example.", true)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.True(t, response.AuthenticatedData)
+	require.Len(t, response.Answer, 2, "the client asked for signatures")
+
+	response = query("www.example.", false)
+	require.True(t, response.AuthenticatedData)
+	require.Len(t, response.Answer, 1, "the client didn't ask for signatures")
+	require.Nil(t, response.IsEdns0())
+
+	response = query("missing.example.", false)
+	require.Equal(t, dns.RcodeNameError, response.Rcode)
+	require.True(t, response.AuthenticatedData)
+
+	response = query("www.insecure.", false)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.False(t, response.AuthenticatedData, "the zone is unsigned")
+	require.Len(t, response.Answer, 1)
+
+	require.Equal(t, dns.RcodeServerFailure, query("bad.example.", false).Rcode, "bad signature")
+	require.Equal(t, dns.RcodeServerFailure, query("forged.example.", false).Rcode, "missing signature")
+}
+
+func dnssecQuerier(t *testing.T, udpPort int) func(string, bool) *dns.Msg {
+	return func(name string, do bool) *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion(name, dns.TypeA)
+		if do {
+			request.SetEdns0(4096, true)
+		}
+		response, _, err := (&dns.Client{Net: "udp"}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+		require.NoError(t, err)
+		return response
+	}
+}
+
+func TestDNSSECTruncated(t *testing.T) {
+	handler, anchor, _ := signedUpstream(t)
+	// over UDP, www.example. comes back truncated, with whatever
+	// records fitted, which can't be validated
+	truncating := func(w dns.ResponseWriter, req *dns.Msg) {
+		if _, isUDP := w.RemoteAddr().(*net.UDPAddr); !isUDP || req.Question[0].Name != "www.example." {
+			handler(w, req)
+			return
+		}
+		response := &dns.Msg{}
+		response.SetReply(req)
+		response.Truncated = true
+		response.AuthenticatedData = true
+		response.Answer = []dns.RR{mustRR(t, "www.example. 3600 IN A 10.0.0.6")}
+		w.WriteMsg(response)
+	}
+	upstream, port := startUpstream(t, truncating)
+	defer upstream.Shutdown()
+	dnsserver, _, udpPort, _ := startServer(t, &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: port})
+	defer dnsserver.Stop()
+	require.NoError(t, dnsserver.EnableDNSSEC([]string{anchor.String()}))
+
+	request := &dns.Msg{}
+	request.SetQuestion("www.example.", dns.TypeA)
+	request.SetEdns0(4096, true)
+	response, _, err := (&dns.Client{Net: "udp"}).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+	require.Equal(t, dns.ErrTruncated, err)
+	require.True(t, response.Truncated)
+	require.False(t, response.AuthenticatedData)
+	require.Empty(t, response.Answer)
+	require.Empty(t, response.Ns)
+}
+
+func TestDNSSECNonRootAnchor(t *testing.T) {
+	handler, _, anchor := signedUpstream(t)
+	upstream, port := startUpstream(t, handler)
+	defer upstream.Shutdown()
+	dnsserver, _, udpPort, _ := startServer(t, &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: port})
+	defer dnsserver.Stop()
+	require.NoError(t, dnsserver.EnableDNSSEC([]string{anchor.String()}))
+	query := dnssecQuerier(t, udpPort)
+
+	response := query("www.example.", false)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.True(t, response.AuthenticatedData)
+	require.Equal(t, dns.RcodeServerFailure, query("forged.example.", false).Rcode, "missing signature")
+
+	// outside the anchored zone, answers are insecure, not bogus
+	response = query("www.insecure.", false)
+	require.Equal(t, dns.RcodeSuccess, response.Rcode)
+	require.False(t, response.AuthenticatedData)
+	require.Len(t, response.Answer, 1)
+}
+
+func TestDNSSECCachesDS(t *testing.T) {
+	handler, anchor, _ := signedUpstream(t)
+	var (
+		lock      sync.Mutex
+		dsQueries int
+	)
+	countDS := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return dsQueries
+	}
+	upstream, port := startUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Qtype == dns.TypeDS {
+			lock.Lock()
+			dsQueries++
+			lock.Unlock()
+		}
+		handler(w, req)
+	})
+	defer upstream.Shutdown()
+	dnsserver, _, udpPort, _ := startServer(t, &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: port})
+	defer dnsserver.Stop()
+	require.NoError(t, dnsserver.EnableDNSSEC([]string{anchor.String()}))
+	query := dnssecQuerier(t, udpPort)
+
+	require.Equal(t, dns.RcodeSuccess, query("www.insecure.", false).Rcode)
+	queried := countDS()
+	require.NotZero(t, queried)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, dns.RcodeSuccess, query("www.insecure.", false).Rcode)
+	}
+	require.Equal(t, queried, countDS(), "DS and NSEC answers are cached")
+}
+
+func startTLSUpstream(t *testing.T, handler dns.HandlerFunc) (*dns.Server, string, []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+	})
+	require.NoError(t, err)
+	server := &dns.Server{Listener: listener, Handler: handler}
+	go server.ActivateAndServe()
+	return server, listener.Addr().String(), pin[:]
+}
+
+func TestTLSUpstream(t *testing.T) {
+	handler, _, _ := signedUpstream(t)
+	upstream, addr, pin := startTLSUpstream(t, handler)
+	defer upstream.Shutdown()
+	dnsserver, _, udpPort, _ := startServer(t, nil)
+	defer dnsserver.Stop()
+
+	query := func() *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion("www.example.", dns.TypeA)
+		response, _, err := (&dns.Client{Net: "udp"}).Exchange(request, "127.0.0.1:"+strconv.Itoa(udpPort))
+		require.NoError(t, err)
+		return response
+	}
+
+	_, err := ParseTLSUpstream(addr)
+	require.Error(t, err, "a TLS upstream must be authenticated somehow")
+
+	u, err := ParseTLSUpstream(addr + ",pin=" + base64.StdEncoding.EncodeToString(pin))
+	require.NoError(t, err)
+	dnsserver.SetTLSUpstreams([]*TLSUpstream{u})
+	for i := 0; i < 2; i++ { // the second time, on the same connection
+		response := query()
+		require.Equal(t, dns.RcodeSuccess, response.Rcode)
+		require.Len(t, response.Answer, 2)
+	}
+
+	wrongPin := sha256.Sum256([]byte("some other key"))
+	u, err = ParseTLSUpstream(addr + ",pin=" + base64.StdEncoding.EncodeToString(wrongPin[:]))
+	require.NoError(t, err)
+	dnsserver.SetTLSUpstreams([]*TLSUpstream{u})
+	require.Equal(t, dns.RcodeServerFailure, query().Rcode)
+}
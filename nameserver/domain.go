@@ -0,0 +1,113 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Domain is a zone weaveDNS is authoritative for. A domain may be
+// tied to a subnet, typically that of a network: then only addresses
+// in the subnet can be registered in it, and only clients in the
+// subnet can look names up in it, so tenants on different networks
+// get separate namespaces.
+type Domain struct {
+	Name   string
+	Subnet *address.CIDR
+}
+
+// ParseDomain parses a domain given as "name" or "name=subnet"
+func ParseDomain(s string) (Domain, error) {
+	parts := strings.SplitN(s, "=", 2)
+	domain := Domain{Name: dns.Fqdn(parts[0])}
+	if _, ok := dns.IsDomainName(domain.Name); !ok || domain.Name == "." {
+		return Domain{}, fmt.Errorf("invalid domain name %q", parts[0])
+	}
+	if len(parts) == 2 {
+		subnet, err := address.ParseCIDR(parts[1])
+		if err != nil {
+			return Domain{}, err
+		}
+		if !subnet.IsSubnet() {
+			return Domain{}, fmt.Errorf("%s is not a subnet for domain %s", parts[1], domain.Name)
+		}
+		domain.Subnet = &subnet
+	}
+	return domain, nil
+}
+
+func (d Domain) String() string {
+	if d.Subnet == nil {
+		return d.Name
+	}
+	return fmt.Sprintf("%s=%s", d.Name, d.Subnet)
+}
+
+func (d Domain) contains(hostname string) bool {
+	return dns.IsSubDomain(d.Name, hostname)
+}
+
+// allows returns true if addr may be registered in, or look up
+// names in, this domain
+func (d Domain) allows(addr address.Address) bool {
+	return d.Subnet == nil || d.Subnet.Range().Contains(addr)
+}
+
+func (d Domain) allowsClient(client net.Addr) bool {
+	if d.Subnet == nil {
+		return true
+	}
+	ip := clientIP(client)
+	return ip != nil && d.allows(address.FromIP4(ip))
+}
+
+func clientIP(client net.Addr) net.IP {
+	switch client := client.(type) {
+	case *net.UDPAddr:
+		return client.IP.To4()
+	case *net.TCPAddr:
+		return client.IP.To4()
+	}
+	return nil
+}
+
+// Domains returns the domains we serve; the first is the default,
+// used for unqualified names.
+func (n *Nameserver) Domains() []Domain {
+	return n.domains
+}
+
+// domainOf returns the most specific of our domains containing hostname
+func (n *Nameserver) domainOf(hostname string) (Domain, bool) {
+	var (
+		best  Domain
+		found bool
+	)
+	for _, domain := range n.domains {
+		if domain.contains(hostname) && (!found || dns.CountLabel(domain.Name) > dns.CountLabel(best.Name)) {
+			best, found = domain, true
+		}
+	}
+	return best, found
+}
+
+// Serial is the SOA serial number of our domains. It increases with
+// every change, and is based on the time so that it keeps increasing
+// across restarts.
+func (n *Nameserver) Serial() uint32 {
+	n.RLock()
+	defer n.RUnlock()
+	return n.serial
+}
+
+func nextSerial(serial uint32) uint32 {
+	if t := uint32(time.Now().Unix()); t > serial {
+		return t
+	}
+	return serial + 1
+}
@@ -19,10 +19,15 @@ type Entry struct {
 	ContainerID string
 	Origin      mesh.PeerName
 	Addr        address.Address
+	Target      string // canonical name, if this is a CNAME entry
 	Hostname    string // as supplied
 	lHostname   string // lowercased (not exported, so not encoded by gob)
 	Version     int
-	Tombstone   int64 // timestamp of when it was deleted
+	Incarnation int64  // of the origin when it made the last change
+	Seq         uint64 // origin's sequence number for the last change
+	Tombstone   int64  // timestamp of when it was deleted
+	Unhealthy   bool   // container is failing its Docker health check
+	received    int64  // our timestamp of when we learnt it was deleted (not encoded by gob)
 }
 
 type Entries []Entry
@@ -49,11 +54,12 @@ func (e1 Entry) equal(e2 Entry) bool {
 	return e1.ContainerID == e2.ContainerID &&
 		e1.Origin == e2.Origin &&
 		e1.Addr == e2.Addr &&
+		e1.Target == e2.Target &&
 		e1.Hostname == e2.Hostname
 }
 
 func (e1 *Entry) less(e2 *Entry) bool {
-	// Entries are kept sorted by Hostname, Origin, ContainerID then address
+	// Entries are kept sorted by Hostname, Origin, ContainerID, address then target
 	switch {
 	case e1.Hostname != e2.Hostname:
 		return e1.Hostname < e2.Hostname
@@ -64,13 +70,16 @@ func (e1 *Entry) less(e2 *Entry) bool {
 	case e1.ContainerID != e2.ContainerID:
 		return e1.ContainerID < e2.ContainerID
 
-	default:
+	case e1.Addr != e2.Addr:
 		return e1.Addr < e2.Addr
+
+	default:
+		return e1.Target < e2.Target
 	}
 }
 
 func (e1 *Entry) insensitiveLess(e2 *Entry) bool {
-	// Entries are kept sorted by Hostname, Origin, ContainerID then address
+	// Entries are kept sorted by Hostname, Origin, ContainerID, address then target
 	e1Hostname, e2Hostname := e1.lHostname, e2.lHostname
 	switch {
 	case e1Hostname != e2Hostname:
@@ -82,26 +91,48 @@ func (e1 *Entry) insensitiveLess(e2 *Entry) bool {
 	case e1.ContainerID != e2.ContainerID:
 		return e1.ContainerID < e2.ContainerID
 
-	default:
+	case e1.Addr != e2.Addr:
 		return e1.Addr < e2.Addr
+
+	default:
+		return e1.Target < e2.Target
 	}
 }
 
 // returns true to indicate a change
 func (e1 *Entry) merge(e2 *Entry) bool {
 	// we know container id, origin, add and hostname are equal
-	if e2.Version > e1.Version {
+	later := (OriginDigest{Incarnation: e1.Incarnation, Seq: e1.Seq}).before(e2.Incarnation, e2.Seq)
+	if later {
+		// not a change as such, but we need it to compare digests
+		e1.Incarnation, e1.Seq = e2.Incarnation, e2.Seq
+	}
+	// The origin may restart and make a different change under the
+	// same version, so the one it made last wins
+	if e2.Version > e1.Version ||
+		(e2.Version == e1.Version && later && (e2.Tombstone != e1.Tombstone || e2.Unhealthy != e1.Unhealthy)) {
 		e1.Version = e2.Version
-		e1.Tombstone = e2.Tombstone
-		return true
-	} else if e2.Version == e1.Version && e2.Tombstone > e1.Tombstone {
-		e1.Tombstone = e2.Tombstone
+		e1.setTombstone(e2.Tombstone)
+		e1.Unhealthy = e2.Unhealthy
 		return true
 	}
 	return false
 }
 
+func (e1 *Entry) setTombstone(tombstone int64) {
+	switch {
+	case tombstone == 0:
+		e1.received = 0
+	case e1.Tombstone == 0 || e1.received == 0:
+		e1.received = now()
+	}
+	e1.Tombstone = tombstone
+}
+
 func (e1 *Entry) String() string {
+	if e1.Target != "" {
+		return fmt.Sprintf("%s -> CNAME %s", e1.Hostname, e1.Target)
+	}
 	return fmt.Sprintf("%s -> %s", e1.Hostname, e1.Addr.String())
 }
 
@@ -113,7 +144,17 @@ func (e1 *Entry) tombstone() bool {
 	if e1.Tombstone > 0 {
 		return false
 	}
-	e1.Tombstone = now()
+	e1.setTombstone(now())
+	e1.Version++
+	return true
+}
+
+// returns true to indicate a change
+func (e1 *Entry) setHealthy(healthy bool) bool {
+	if e1.Tombstone > 0 || e1.Unhealthy == !healthy {
+		return false
+	}
+	e1.Unhealthy = !healthy
 	e1.Version++
 	return true
 }
@@ -142,16 +183,24 @@ func (es *Entries) checkAndPanic() *Entries {
 }
 
 func (es *Entries) add(hostname, containerid string, origin mesh.PeerName, addr address.Address) Entry {
+	return es.insert(Entry{Hostname: hostname, lHostname: strings.ToLower(hostname),
+		Origin: origin, ContainerID: containerid, Addr: addr})
+}
+
+func (es *Entries) addCNAME(hostname, containerid string, origin mesh.PeerName, target string) Entry {
+	return es.insert(Entry{Hostname: hostname, lHostname: strings.ToLower(hostname),
+		Origin: origin, ContainerID: containerid, Target: target})
+}
+
+func (es *Entries) insert(entry Entry) Entry {
 	defer es.checkAndPanic().checkAndPanic()
 
-	entry := Entry{Hostname: hostname, lHostname: strings.ToLower(hostname),
-		Origin: origin, ContainerID: containerid, Addr: addr}
 	i := sort.Search(len(*es), func(i int) bool {
 		return !(*es)[i].insensitiveLess(&entry)
 	})
 	if i < len(*es) && (*es)[i].equal(entry) {
 		if (*es)[i].Tombstone > 0 {
-			(*es)[i].Tombstone = 0
+			(*es)[i].setTombstone(0)
 			(*es)[i].Version++
 		}
 	} else {
@@ -178,6 +227,9 @@ func (es *Entries) merge(incoming Entries) Entries {
 				newEntries = append(newEntries, entry)
 			}
 		} else {
+			if entry.Tombstone > 0 {
+				entry.received = now()
+			}
 			*es = append(*es, Entry{})
 			copy((*es)[i+1:], (*es)[i:])
 			(*es)[i] = entry
@@ -188,6 +240,21 @@ func (es *Entries) merge(incoming Entries) Entries {
 	return newEntries
 }
 
+// update our own entries for which f returns true, returning those
+// that changed
+func (es *Entries) update(ourname mesh.PeerName, f func(*Entry) bool) Entries {
+	defer es.checkAndPanic().checkAndPanic()
+
+	updated := Entries{}
+	for i, e := range *es {
+		if e.Origin == ourname && f(&e) {
+			(*es)[i] = e
+			updated = append(updated, e)
+		}
+	}
+	return updated
+}
+
 // f returning true means keep the entry.
 func (es *Entries) tombstone(ourname mesh.PeerName, f func(*Entry) bool) Entries {
 	defer es.checkAndPanic().checkAndPanic()
@@ -265,12 +332,26 @@ func (es Entries) addLowercase() {
 type GossipData struct {
 	Timestamp int64
 	Entries
+	VIPs     VIPs
+	Sender   mesh.PeerName
+	Digest   Digest // in periodic gossip, instead of all our entries
+	Protocol int    // digestProtocol, or zero from peers without digests
 }
 
 func (g *GossipData) Merge(o mesh.GossipData) mesh.GossipData {
 	other := o.(*GossipData)
 	gossip := g.copy()
 	gossip.Entries.merge(other.Entries)
+	if gossip.VIPs == nil && len(other.VIPs) > 0 {
+		gossip.VIPs = VIPs{}
+	}
+	gossip.VIPs.merge(other.VIPs)
+	if other.Digest != nil {
+		gossip.Sender, gossip.Digest = other.Sender, other.Digest
+	}
+	if other.Protocol < gossip.Protocol {
+		gossip.Protocol = other.Protocol
+	}
 	if gossip.Timestamp < other.Timestamp {
 		gossip.Timestamp = other.Timestamp
 	}
@@ -298,7 +379,8 @@ func (g *GossipData) Encode() [][]byte {
 }
 
 func (g *GossipData) copy() *GossipData {
-	g2 := &GossipData{Timestamp: g.Timestamp, Entries: make(Entries, len(g.Entries))}
+	g2 := &GossipData{Timestamp: g.Timestamp, Entries: make(Entries, len(g.Entries)), VIPs: g.VIPs.copy(),
+		Sender: g.Sender, Digest: g.Digest, Protocol: g.Protocol}
 	copy(g2.Entries, g.Entries)
 	return g2
 }
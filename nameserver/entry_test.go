@@ -36,7 +36,7 @@ func TestAdd(t *testing.T) {
 
 	entries.tombstone(mesh.UnknownPeerName, func(e *Entry) bool { return e.Hostname == "A" })
 	expected = l(Entries{
-		Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0), Version: 1, Tombstone: 1234},
+		Entry{Hostname: "A", Origin: mesh.UnknownPeerName, Addr: address.Address(0), Version: 1, Tombstone: 1234, received: 1234},
 	})
 	require.Equal(t, entries, expected)
 
@@ -83,23 +83,30 @@ func TestTombstone(t *testing.T) {
 	})
 	expected := l(Entries{
 		Entry{Hostname: "A"},
-		Entry{Hostname: "B", Version: 1, Tombstone: 1234},
+		Entry{Hostname: "B", Version: 1, Tombstone: 1234, received: 1234},
 	})
 	require.Equal(t, expected, es)
 
-	// Now try a merge including two entries which differ only in tombstone
+	// Now try a merge including two entries which differ only in
+	// tombstone; the origin's timestamp doesn't decide between them
 	e2 := make(Entries, len(es))
 	copy(e2, es)
-	e2[1].Tombstone = 5555
+	e2[1].Tombstone, e2[1].received = 5555, 0
+	require.Equal(t, Entries{}, es.merge(e2))
+	require.Equal(t, expected, es)
 
+	// but the origin's later change does, and we keep our own
+	// timestamp for when we learnt of the tombstone
+	now = func() int64 { return 2345 }
+	e2[1].Seq = 1
 	diff := es.merge(e2)
 
 	expected2 := l(Entries{
 		Entry{Hostname: "A"},
-		Entry{Hostname: "B", Version: 1, Tombstone: 5555},
+		Entry{Hostname: "B", Version: 1, Seq: 1, Tombstone: 5555, received: 1234},
 	})
 	require.Equal(t, expected2, es)
-	expectedDiff := l(Entries{Entry{Hostname: "B", Version: 1, Tombstone: 5555}})
+	expectedDiff := l(Entries{Entry{Hostname: "B", Version: 1, Seq: 1, Tombstone: 5555}})
 	require.Equal(t, expectedDiff, diff)
 }
 
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/miekg/dns"
@@ -19,7 +21,7 @@ func (n *Nameserver) badRequest(w http.ResponseWriter, err error) {
 
 func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 	router.Methods("GET").Path("/domain").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, n.domain)
+		fmt.Fprint(w, n.domains[0].Name)
 	})
 
 	router.Methods("PUT").Path("/name/{container}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -35,8 +37,13 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 			return
 		}
 
-		if !dns.IsSubDomain(n.domain, hostname) {
-			n.infof("Ignoring registration %s %s %s (not a subdomain of %s)", hostname, ipStr, container, n.domain)
+		domain, found := n.domainOf(hostname)
+		if !found {
+			n.infof("Ignoring registration %s %s %s (not in any of our domains)", hostname, ipStr, container)
+			return
+		}
+		if !domain.allows(ip) {
+			n.infof("Ignoring registration %s %s %s (not in the subnet of %s)", hostname, ipStr, container, domain)
 			return
 		}
 
@@ -45,6 +52,9 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 		if r.FormValue("check-alive") == "true" && dockerCli != nil && dockerCli.IsContainerNotRunning(container) {
 			n.infof("container '%s' is not running: removing", container)
 			n.Delete(hostname, container, ipStr, ip)
+		} else if dockerCli != nil {
+			// The container may have become unhealthy before now
+			n.checkHealth(dockerCli.IsContainerHealthy, container)
 		}
 
 		w.WriteHeader(204)
@@ -81,6 +91,53 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 	router.Methods("DELETE").Path("/name/{container}").HandlerFunc(deleteHandler)
 	router.Methods("DELETE").Path("/name").HandlerFunc(deleteHandler)
 
+	router.Methods("PUT").Path("/cname").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			hostname = dns.Fqdn(r.FormValue("fqdn"))
+			target   = r.FormValue("target")
+		)
+		if _, found := n.domainOf(hostname); !found {
+			n.badRequest(w, fmt.Errorf("%s is not in any of our domains", hostname))
+			return
+		}
+		if _, ok := dns.IsDomainName(target); !ok || target == "" {
+			n.badRequest(w, fmt.Errorf("invalid CNAME target %q", target))
+			return
+		}
+		n.AddCNAME(hostname, r.FormValue("container"), n.ourName, dns.Fqdn(target))
+		w.WriteHeader(204)
+	})
+
+	router.Methods("DELETE").Path("/cname").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.DeleteCNAME(dns.Fqdn(r.FormValue("fqdn")))
+		w.WriteHeader(204)
+	})
+
+	router.Methods("PUT").Path("/vip").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname := dns.Fqdn(r.FormValue("fqdn"))
+		if _, found := n.domainOf(hostname); !found {
+			n.badRequest(w, fmt.Errorf("%s is not in any of our domains", hostname))
+			return
+		}
+		addr, err := n.CreateVIP(hostname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, addr)
+	})
+
+	router.Methods("DELETE").Path("/vip").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.DeleteVIP(dns.Fqdn(r.FormValue("fqdn")))
+		w.WriteHeader(204)
+	})
+
+	router.Methods("GET").Path("/vip").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewEncoder(w).Encode(n.VIPStatus()); err != nil {
+			n.badRequest(w, fmt.Errorf("Error marshalling response: %v", err))
+		}
+	})
+
 	router.Methods("GET").Path("/name").Headers("Accept", "application/json").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		n.RLock()
 		defer n.RUnlock()
@@ -89,3 +146,48 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 		}
 	})
 }
+
+// HandleHTTP serves our domains as RFC 1035 zone files, for feeding
+// into other DNS servers.
+func (d *DNSServer) HandleHTTP(router *mux.Router) {
+	router.Methods("GET").Path("/zone").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domains := d.ns.Domains()
+		domain, found := domains[0], true
+		if name := r.FormValue("domain"); name != "" {
+			found = false
+			for _, candidate := range domains {
+				if strings.EqualFold(candidate.Name, dns.Fqdn(name)) {
+					domain, found = candidate, true
+				}
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("%s is not one of our domains", r.FormValue("domain")), http.StatusNotFound)
+			return
+		}
+
+		serial, records := d.ns.zone(domain)
+		w.Header().Set("Content-Type", "text/dns")
+		fmt.Fprintf(w, "$ORIGIN %s\n$TTL %d\n", domain.Name, d.ttl)
+		fmt.Fprintln(w, d.soaRecord(domain, serial))
+		fmt.Fprintln(w, d.nsRecord(domain))
+		for _, rr := range d.zoneRRs(records) {
+			fmt.Fprintln(w, rr)
+		}
+	})
+
+	router.Methods("GET").Path("/queries").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		top := 20
+		if s := r.FormValue("top"); s != "" {
+			var err error
+			if top, err = strconv.Atoi(s); err != nil || top < 0 {
+				d.ns.badRequest(w, fmt.Errorf("invalid top %q", s))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(d.QueryStatus(top)); err != nil {
+			d.ns.badRequest(w, fmt.Errorf("Error marshalling response: %v", err))
+		}
+	})
+}
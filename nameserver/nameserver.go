@@ -1,7 +1,9 @@
 package nameserver
 
 import (
-	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -9,19 +11,26 @@ import (
 	"github.com/weaveworks/mesh"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/db"
 	"github.com/weaveworks/weave/net/address"
 )
 
 const (
-	// Tombstones do not need to survive long periods of peer disconnection, as
-	// we delete entries for disconnected peers.  Therefore they just need to hang
-	// around to account for propagation delay through gossip.  We do need them
-	// to hang around longer than the allowed clock skew (defined next).  30mins
-	// tombstone timeout allows for 15mins max clock skew.
-	tombstoneTimeout = time.Minute * 30
+	// How often we look for tombstones that every peer has seen, and
+	// so can be deleted
+	tombstoneCheckInterval = time.Minute
 
-	// Maximum age of acceptable gossip messages (to account for clock skew)
-	gossipWindow = int64(tombstoneTimeout/time.Second) / 2
+	// Tombstones are deleted this many seconds after we learn of them
+	// even if some peer has not acknowledged them, so that they cannot
+	// pile up while peers come and go.  It is counted by our own
+	// clock, so the origin's clock doesn't matter.
+	maxTombstoneAge = 24 * 60 * 60
+
+	// We don't need synchronised clocks, but report peers whose gossip
+	// is timestamped more than this many seconds away from our own
+	// time, since that usually means a misconfigured host
+	maxClockSkew = 15 * 60
 
 	// Used by prog/weaver/main.go and proxy/create_container_interceptor.go
 	DefaultDomain = "weave.local."
@@ -35,18 +44,44 @@ const (
 type Nameserver struct {
 	sync.RWMutex
 	ourName     mesh.PeerName
-	domain      string
+	domains     []Domain
+	serial      uint32
+	zoneHistory []zoneVersion
+	incarnation int64  // when we started, to tell our changes from those before
+	seq         uint64 // of the last change to our own entries
 	gossip      mesh.Gossip
 	entries     Entries
+	vips        VIPs
 	isKnownPeer func(mesh.PeerName) bool
+	distance    func(mesh.PeerName) int
+	peerDigests map[mesh.PeerName]Digest // the last we heard from each peer
+	legacySeen  time.Time                // when we last heard from a peer without digests
+	clockSkews  map[mesh.PeerName]int64
 	quit        chan struct{}
+
+	// The addresses of our named containers, to their container IDs,
+	// kept up to date so that callers on the data path needn't scan
+	// the entries
+	localAddrs         map[address.Address]string
+	localAddrsWatchers []func([]address.Address)
+
+	balancerLock sync.Mutex
+	balancer     Balancer
+	vipLock      sync.Mutex // serialises creating and deleting VIPs
+	vipAllocator VIPAllocator
+	vipDB        db.DB
 }
 
-func New(ourName mesh.PeerName, domain string, isKnownPeer func(mesh.PeerName) bool) *Nameserver {
+func New(ourName mesh.PeerName, domains []Domain, isKnownPeer func(mesh.PeerName) bool) *Nameserver {
 	return &Nameserver{
 		ourName:     ourName,
-		domain:      dns.Fqdn(domain),
+		domains:     domains,
+		serial:      nextSerial(0),
+		incarnation: time.Now().UnixNano(),
+		vips:        VIPs{},
 		isKnownPeer: isKnownPeer,
+		peerDigests: make(map[mesh.PeerName]Digest),
+		clockSkews:  make(map[mesh.PeerName]int64),
 		quit:        make(chan struct{}),
 	}
 }
@@ -55,9 +90,15 @@ func (n *Nameserver) SetGossip(gossip mesh.Gossip) {
 	n.gossip = gossip
 }
 
+// SetDistance makes DNS answers list addresses on nearer peers
+// first; distance gives the number of hops to a peer.
+func (n *Nameserver) SetDistance(distance func(mesh.PeerName) int) {
+	n.distance = distance
+}
+
 func (n *Nameserver) Start() {
 	go func() {
-		ticker := time.Tick(tombstoneTimeout)
+		ticker := time.Tick(tombstoneCheckInterval)
 		for {
 			select {
 			case <-n.quit:
@@ -80,39 +121,195 @@ func (n *Nameserver) broadcastEntries(es ...Entry) {
 	n.gossip.GossipBroadcast(&GossipData{
 		Entries:   Entries(es),
 		Timestamp: now(),
+		Protocol:  digestProtocol,
 	})
 }
 
 func (n *Nameserver) AddEntry(hostname, containerid string, origin mesh.PeerName, addr address.Address) {
 	n.Lock()
 	n.infof("adding entry for %s: %s -> %s", containerid, hostname, addr.String())
-	entry := n.entries.add(hostname, containerid, origin, addr)
+	entries := Entries{n.entries.add(hostname, containerid, origin, addr)}
+	n.stamp(entries)
 	n.Unlock()
-	n.broadcastEntries(entry)
+	n.broadcastEntries(entries...)
+	n.changed()
+}
+
+// AddCNAME makes hostname an alias of target. Any other target we
+// had for hostname is deleted, so that an alias can be moved just by
+// adding it again.
+func (n *Nameserver) AddCNAME(hostname, containerid string, origin mesh.PeerName, target string) {
+	n.Lock()
+	n.infof("adding CNAME for %s: %s -> %s", containerid, hostname, target)
+	entries := n.entries.tombstone(n.ourName, func(e *Entry) bool {
+		return e.Target != "" && e.Target != target && strings.EqualFold(e.Hostname, hostname)
+	})
+	entries = append(entries, n.entries.addCNAME(hostname, containerid, origin, target))
+	n.stamp(entries)
+	n.Unlock()
+	n.broadcastEntries(entries...)
+	n.changed()
+}
+
+// DeleteCNAME deletes our CNAME for hostname
+func (n *Nameserver) DeleteCNAME(hostname string) {
+	n.Lock()
+	n.infof("deleting CNAME for %s", hostname)
+	entries := n.entries.tombstone(n.ourName, func(e *Entry) bool {
+		return e.Target != "" && strings.EqualFold(e.Hostname, hostname)
+	})
+	n.stamp(entries)
+	n.Unlock()
+	n.broadcastEntries(entries...)
+	n.changed()
+}
+
+// matching returns the entries for hostname, or if it has none, for
+// the wildcard that covers it: "*." followed by its closest ancestor
+// that has a wildcard, unless an ancestor in between has entries of
+// its own (RFC 4592). Must be called with a lock held.
+func (n *Nameserver) matching(hostname string) Entries {
+	entries := n.entries.lookup(hostname)
+	if hasLive(entries) {
+		return entries
+	}
+	labels := dns.SplitDomainName(hostname)
+	for i := 1; i < len(labels); i++ {
+		ancestor := dns.Fqdn(strings.Join(labels[i:], "."))
+		if wildcard := n.entries.lookup("*." + ancestor); hasLive(wildcard) {
+			return wildcard
+		}
+		if hasLive(n.entries.lookup(ancestor)) {
+			break
+		}
+	}
+	return entries
+}
+
+func hasLive(entries Entries) bool {
+	for _, e := range entries {
+		if e.Tombstone == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// cname returns the target of the first live CNAME entry; a name with
+// a CNAME has no addresses.
+func cname(entries Entries) (string, bool) {
+	for _, e := range entries {
+		if e.Tombstone == 0 && e.Target != "" {
+			return e.Target, true
+		}
+	}
+	return "", false
+}
+
+// LookupCNAME returns the canonical name hostname is an alias of, if
+// it is one
+func (n *Nameserver) LookupCNAME(hostname string) (string, bool) {
+	n.RLock()
+	defer n.RUnlock()
+	return cname(n.matching(hostname))
 }
 
 func (n *Nameserver) Lookup(hostname string) []address.Address {
 	n.RLock()
 	defer n.RUnlock()
 
-	entries := n.entries.lookup(hostname)
-	result := []address.Address{}
+	result := live(n.matching(hostname))
+	n.debugf("lookup %s -> %s", hostname, &result)
+	return result
+}
+
+// LookupNearest is like Lookup, but orders the addresses by the
+// distance to the peer they are on: our own first, then those of
+// directly connected peers, and so on. Addresses at the same distance
+// are in random order, so load is still spread among them.
+func (n *Nameserver) LookupNearest(hostname string) []address.Address {
+	n.RLock()
+	entries := liveEntries(n.matching(hostname))
+	n.RUnlock()
+
+	for i := range entries {
+		j := rand.Intn(i + 1)
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	sort.Stable(byDistance{entries, n.peerDistances(entries)})
+
+	result := make([]address.Address, len(entries))
+	for i, e := range entries {
+		result[i] = e.Addr
+	}
+	n.debugf("lookup nearest %s -> %s", hostname, &result)
+	return result
+}
+
+func (n *Nameserver) peerDistances(entries Entries) map[mesh.PeerName]int {
+	distances := map[mesh.PeerName]int{n.ourName: 0}
 	for _, e := range entries {
-		if e.Tombstone > 0 {
-			continue
+		if _, found := distances[e.Origin]; !found && n.distance != nil {
+			distances[e.Origin] = n.distance(e.Origin)
 		}
+	}
+	return distances
+}
+
+type byDistance struct {
+	entries   Entries
+	distances map[mesh.PeerName]int
+}
+
+func (b byDistance) Len() int      { return len(b.entries) }
+func (b byDistance) Swap(i, j int) { b.entries[i], b.entries[j] = b.entries[j], b.entries[i] }
+func (b byDistance) Less(i, j int) bool {
+	return b.distances[b.entries[i].Origin] < b.distances[b.entries[j].Origin]
+}
+
+// live returns the addresses of entries that haven't been deleted,
+// leaving out those of unhealthy containers unless there's nothing
+// else.
+func live(entries Entries) []address.Address {
+	result := []address.Address{}
+	for _, e := range liveEntries(entries) {
 		result = append(result, e.Addr)
 	}
-	n.debugf("lookup %s -> %s", hostname, &result)
 	return result
 }
 
+func liveEntries(entries Entries) Entries {
+	healthy, all := Entries{}, Entries{}
+	if _, isCNAME := cname(entries); isCNAME {
+		return all
+	}
+	for _, e := range entries {
+		if e.Tombstone > 0 || e.Target != "" {
+			continue
+		}
+		all = append(all, e)
+		if !e.Unhealthy {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		return all
+	}
+	return healthy
+}
+
 func (n *Nameserver) ReverseLookup(ip address.Address) (string, error) {
 	n.RLock()
 	defer n.RUnlock()
 
+	for _, vip := range n.vips {
+		if !vip.Deleted && vip.Addr == ip {
+			return vip.Hostname, nil
+		}
+	}
+
 	match, err := n.entries.first(func(e *Entry) bool {
-		return e.Tombstone == 0 && e.Addr == ip
+		return e.Tombstone == 0 && e.Target == "" && e.Addr == ip
 	})
 	if err != nil {
 		return "", err
@@ -121,9 +318,102 @@ func (n *Nameserver) ReverseLookup(ip address.Address) (string, error) {
 	return match.Hostname, nil
 }
 
+// HasLocalAddress says whether addr is that of a container on this
+// peer with a name
+func (n *Nameserver) HasLocalAddress(addr address.Address) bool {
+	n.RLock()
+	defer n.RUnlock()
+	_, found := n.localAddrs[addr]
+	return found
+}
+
+// OnLocalAddressesChange calls f with the addresses of the containers
+// on this peer with names, now and whenever they change.  f is called
+// with our lock held, so that it sees the changes in order, and must
+// not call back into the nameserver.
+func (n *Nameserver) OnLocalAddressesChange(f func([]address.Address)) {
+	n.Lock()
+	defer n.Unlock()
+	n.localAddrsWatchers = append(n.localAddrsWatchers, f)
+	f(n.localAddresses())
+}
+
+// Called with the lock held
+func (n *Nameserver) localAddresses() []address.Address {
+	addrs := make([]address.Address, 0, len(n.localAddrs))
+	for addr := range n.localAddrs {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Called with the lock held; returns whether they changed
+func (n *Nameserver) updateLocalAddrs() bool {
+	localAddrs := make(map[address.Address]string)
+	for _, e := range n.entries {
+		if e.Origin == n.ourName && e.Tombstone == 0 && e.Target == "" {
+			localAddrs[e.Addr] = e.ContainerID
+		}
+	}
+	changed := len(localAddrs) != len(n.localAddrs)
+	for addr, ident := range localAddrs {
+		if existing, found := n.localAddrs[addr]; !found || existing != ident {
+			changed = true
+		}
+	}
+	n.localAddrs = localAddrs
+	return changed
+}
+
 func (n *Nameserver) ContainerStarted(ident string)   {}
 func (n *Nameserver) ContainerDestroyed(ident string) {}
 
+func (n *Nameserver) ContainerHealthChanged(ident string, healthy bool) {
+	n.Lock()
+	entries := n.entries.update(n.ourName, func(e *Entry) bool {
+		if e.ContainerID == ident && e.setHealthy(healthy) {
+			n.infof("container %s healthy: %t; updating entry %s", ident, healthy, e.String())
+			return true
+		}
+		return false
+	})
+	n.stamp(entries)
+	n.Unlock()
+	n.broadcastEntries(entries...)
+	n.changed()
+}
+
+// CheckHealth asks Docker about the health of the containers we have
+// entries for, since we only hear about changes to it, and would
+// otherwise miss those made before we were watching.
+func (n *Nameserver) CheckHealth(dockerCli *docker.Client) {
+	n.checkAllHealth(dockerCli.IsContainerHealthy)
+}
+
+func (n *Nameserver) checkAllHealth(isHealthy func(ident string) (bool, error)) {
+	n.RLock()
+	idents := make(map[string]struct{})
+	for _, e := range n.entries {
+		if e.Origin == n.ourName && e.Tombstone == 0 {
+			idents[e.ContainerID] = struct{}{}
+		}
+	}
+	n.RUnlock()
+	for ident := range idents {
+		n.checkHealth(isHealthy, ident)
+	}
+}
+
+func (n *Nameserver) checkHealth(isHealthy func(ident string) (bool, error), ident string) {
+	healthy, err := isHealthy(ident)
+	if err != nil {
+		// e.g. weave:expose, which isn't a container
+		n.debugf("unable to check health of container %s: %s", ident, err)
+		return
+	}
+	n.ContainerHealthChanged(ident, healthy)
+}
+
 func (n *Nameserver) ContainerDied(ident string) {
 	n.Lock()
 	entries := n.entries.tombstone(n.ourName, func(e *Entry) bool {
@@ -133,17 +423,22 @@ func (n *Nameserver) ContainerDied(ident string) {
 		}
 		return false
 	})
+	n.stamp(entries)
 	n.Unlock()
 	n.broadcastEntries(entries...)
+	n.changed()
 }
 
 func (n *Nameserver) PeerGone(peer mesh.PeerName) {
 	n.infof("peer %s gone", peer.String())
 	n.Lock()
-	defer n.Unlock()
 	n.entries.filter(func(e *Entry) bool {
 		return e.Origin != peer
 	})
+	delete(n.peerDigests, peer)
+	delete(n.clockSkews, peer)
+	n.Unlock()
+	n.changed()
 }
 
 func (n *Nameserver) Delete(hostname, containerid, ipStr string, ip address.Address) {
@@ -165,41 +460,107 @@ func (n *Nameserver) Delete(hostname, containerid, ipStr string, ip address.Addr
 		n.infof("tombstoning entry %v", e)
 		return true
 	})
+	n.stamp(entries)
 	n.Unlock()
 	n.broadcastEntries(entries...)
+	n.changed()
 }
 
+// changed is called after every update to entries or VIPs
+func (n *Nameserver) changed() {
+	n.Lock()
+	n.serial = nextSerial(n.serial)
+	n.recordZoneVersion()
+	if n.updateLocalAddrs() {
+		addrs := n.localAddresses()
+		for _, f := range n.localAddrsWatchers {
+			f(addrs)
+		}
+	}
+	n.Unlock()
+	n.syncBalancer()
+}
+
+// A tombstone is only needed until every peer has seen it, which we
+// can tell from their digests. Peers we don't hear from directly are
+// covered by the peers we do, since they keep the tombstone until
+// their own neighbours have seen it. Digests from peers that have
+// left the mesh are dropped, so they don't hold tombstones forever,
+// and in case some peer never catches up, tombstones we have held for
+// maxTombstoneAge go anyway.
 func (n *Nameserver) deleteTombstones() {
+	n.RLock()
+	var peers []mesh.PeerName
+	for peer := range n.peerDigests {
+		peers = append(peers, peer)
+	}
+	n.RUnlock()
+	// isKnownPeer is called without our lock held, as in receiveGossip
+	var gone []mesh.PeerName
+	for _, peer := range peers {
+		if !n.isKnownPeer(peer) {
+			gone = append(gone, peer)
+		}
+	}
+
 	n.Lock()
 	defer n.Unlock()
-	now := time.Now().Unix()
+	for _, peer := range gone {
+		delete(n.peerDigests, peer)
+	}
+	ours := n.digest()
+	oldest := now() - maxTombstoneAge
 	n.entries.filter(func(e *Entry) bool {
-		return e.Tombstone == 0 || now-e.Tombstone <= int64(tombstoneTimeout/time.Second)
+		return e.Tombstone == 0 || (e.received > oldest && !n.seenByAll(e, ours))
 	})
 }
 
+// seenByAll returns true if every peer we exchange digests with has
+// caught up with the change to e from its origin, and agrees with us
+// on what that origin's live entries are. Must be called with a lock
+// held.
+func (n *Nameserver) seenByAll(e *Entry, ours Digest) bool {
+	for _, digest := range n.peerDigests {
+		if theirs := digest[e.Origin]; theirs.before(e.Incarnation, e.Seq) || theirs.Checksum != ours[e.Origin].Checksum {
+			return false
+		}
+	}
+	return true
+}
+
 func (n *Nameserver) Gossip() mesh.GossipData {
 	n.RLock()
 	defer n.RUnlock()
 	gossip := &GossipData{
-		Entries:   make(Entries, len(n.entries)),
+		Sender:    n.ourName,
+		Digest:    n.digest(),
+		VIPs:      n.vips.copy(),
 		Timestamp: now(),
+		Protocol:  digestProtocol,
+	}
+	if time.Since(n.legacySeen) < legacyGossipTimeout {
+		gossip.Entries = make(Entries, len(n.entries))
+		copy(gossip.Entries, n.entries)
 	}
-	copy(gossip.Entries, n.entries)
 	return gossip
 }
 
+// Entries a peer was missing, in reply to our digest
 func (n *Nameserver) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
-	return nil
+	_, _, err := n.receiveGossip(sender, msg)
+	return err
 }
 
-func (n *Nameserver) receiveGossip(msg []byte) (mesh.GossipData, mesh.GossipData, error) {
+func (n *Nameserver) receiveGossip(sender mesh.PeerName, msg []byte) (mesh.GossipData, mesh.GossipData, error) {
 	var gossip GossipData
 	if err := gossip.Decode(msg); err != nil {
 		return nil, nil, err
 	}
-	if delta := gossip.Timestamp - now(); delta > gossipWindow || delta < -gossipWindow {
-		return nil, nil, fmt.Errorf("clock skew of %d detected", delta)
+	if gossip.Sender != mesh.UnknownPeerName {
+		sender = gossip.Sender
+	}
+	if sender != mesh.UnknownPeerName && sender != n.ourName {
+		n.noteClockSkew(sender, gossip.Timestamp-now())
 	}
 
 	// Filter to remove entries from unknown peers, done before we take
@@ -211,20 +572,32 @@ func (n *Nameserver) receiveGossip(msg []byte) (mesh.GossipData, mesh.GossipData
 	var overriddenEntries []Entry
 	n.Lock()
 
+	if gossip.Protocol < digestProtocol {
+		if time.Since(n.legacySeen) >= legacyGossipTimeout {
+			n.infof("heard from a peer without digests; gossiping all entries")
+		}
+		n.legacySeen = time.Now()
+	}
+
 	// Check entries claiming to originate from us against our current data
 	gossip.Entries.filter(func(e *Entry) bool {
 		if e.Origin == n.ourName {
+			n.noteSeq(e.Seq)
 			if ourEntry, ok := n.entries.findEqual(e); ok {
 				if ourEntry.Version < e.Version ||
-					(ourEntry.Version == e.Version && ourEntry.Tombstone != e.Tombstone) {
+					(ourEntry.Version == e.Version && (ourEntry.Tombstone != e.Tombstone || ourEntry.Unhealthy != e.Unhealthy)) {
 					// Take our version of the data, but make the version higher than the incoming
 					nextVersion := e.Version + 1
 					*e = *ourEntry
 					e.Version = nextVersion
+					n.stampEntry(e)
 					overriddenEntries = append(overriddenEntries, *e)
 				}
 			} else { // We have no entry matching the one that came in with us as Origin
-				if e.tombstone() {
+				// Tombstones from before we restarted are stamped
+				// afresh too, so peers know we have seen them
+				if e.tombstone() || e.Incarnation < n.incarnation {
+					n.stampEntry(e)
 					overriddenEntries = append(overriddenEntries, *e)
 				}
 			}
@@ -233,29 +606,55 @@ func (n *Nameserver) receiveGossip(msg []byte) (mesh.GossipData, mesh.GossipData
 	})
 
 	newEntries := n.entries.merge(gossip.Entries)
+	newVIPs, releasedVIPs := n.mergeVIPs(gossip.VIPs)
 	n.Unlock() // unlock before attempting to broadcast
 
+	n.releaseVIPs(releasedVIPs...)
+
 	// Note that all overriddenEntries have been merged into our entries, either
 	// because we forced the version higher or because they were missing before.
 	n.broadcastEntries(overriddenEntries...)
 
-	if len(newEntries) > 0 {
-		return &GossipData{Entries: newEntries, Timestamp: now()}, &gossip, nil
+	if gossip.Digest != nil && sender != n.ourName {
+		n.Lock()
+		n.peerDigests[sender] = gossip.Digest
+		n.Unlock()
+		n.sendMissing(sender, gossip.Digest)
+	}
+
+	if len(newEntries) > 0 || len(newVIPs) > 0 {
+		n.changed()
+		return &GossipData{Entries: newEntries, VIPs: newVIPs, Timestamp: now(), Protocol: digestProtocol}, &gossip, nil
 	}
 	return nil, &gossip, nil
 }
 
+// Gossip from peers with skewed clocks is merged just the same, since
+// nothing depends on the timestamps, but we report the skew.
+func (n *Nameserver) noteClockSkew(peer mesh.PeerName, skew int64) {
+	n.Lock()
+	defer n.Unlock()
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		if _, found := n.clockSkews[peer]; !found {
+			n.errorf("clock of peer %s is %d seconds away from ours", peer, skew)
+		}
+		n.clockSkews[peer] = skew
+	} else {
+		delete(n.clockSkews, peer)
+	}
+}
+
 // merge received data into state and return "everything new I've
 // just learnt", or nil if nothing in the received data was new
 func (n *Nameserver) OnGossip(msg []byte) (mesh.GossipData, error) {
-	newEntries, _, err := n.receiveGossip(msg)
+	newEntries, _, err := n.receiveGossip(mesh.UnknownPeerName, msg)
 	return newEntries, err
 }
 
 // merge received data into state and return a representation of
 // the received data, for further propagation
-func (n *Nameserver) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.GossipData, error) {
-	_, entries, err := n.receiveGossip(msg)
+func (n *Nameserver) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	_, entries, err := n.receiveGossip(sender, msg)
 	return entries, err
 }
 
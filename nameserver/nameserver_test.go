@@ -17,7 +17,7 @@ import (
 )
 
 func makeNameserver(name mesh.PeerName) *Nameserver {
-	return New(name, "", func(mesh.PeerName) bool { return true })
+	return New(name, []Domain{{Name: DefaultDomain}}, func(mesh.PeerName) bool { return true })
 }
 
 func makeNetwork(size int) ([]*Nameserver, *gossip.TestRouter) {
@@ -236,6 +236,32 @@ func TestContainerAndPeerDeath(t *testing.T) {
 	require.Equal(t, []address.Address{}, nameserver.Lookup("hostname"))
 }
 
+func TestLocalAddresses(t *testing.T) {
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	nameserver := makeNameserver(peername)
+	othername, err := mesh.PeerNameFromString("01:00:00:02:00:00")
+	require.Nil(t, err)
+
+	nameserver.AddEntry("hostname", "c1", peername, address.Address(1))
+	var local []address.Address
+	nameserver.OnLocalAddressesChange(func(addrs []address.Address) { local = addrs })
+	require.Equal(t, []address.Address{1}, local)
+
+	// only our own containers' addresses count
+	nameserver.AddEntry("hostname", "c2", othername, address.Address(2))
+	require.Equal(t, []address.Address{1}, local)
+	require.False(t, nameserver.HasLocalAddress(2))
+
+	nameserver.AddEntry("other", "c3", peername, address.Address(3))
+	require.Len(t, local, 2)
+	require.True(t, nameserver.HasLocalAddress(3))
+
+	nameserver.ContainerDied("c1")
+	require.Equal(t, []address.Address{3}, local)
+	require.False(t, nameserver.HasLocalAddress(1))
+}
+
 func TestTombstoneDeletion(t *testing.T) {
 	oldNow := now
 	defer func() { now = oldNow }()
@@ -244,25 +270,234 @@ func TestTombstoneDeletion(t *testing.T) {
 	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
 	require.Nil(t, err)
 	nameserver := makeNameserver(peername)
+	othername, err := mesh.PeerNameFromString("01:00:00:02:00:00")
+	require.Nil(t, err)
+	other := makeNameserver(othername)
 
 	nameserver.AddEntry("hostname", "containerid", peername, address.Address(0))
 	require.Equal(t, []address.Address{0}, nameserver.Lookup("hostname"))
+	exchangeDigests(other, nameserver)
 
 	nameserver.deleteTombstones()
 	require.Equal(t, []address.Address{0}, nameserver.Lookup("hostname"))
 
 	nameserver.Delete("hostname", "containerid", "", address.Address(0))
 	require.Equal(t, []address.Address{}, nameserver.Lookup("hostname"))
-	require.Equal(t, l(Entries{Entry{
+	tombstoned := l(Entries{Entry{
 		ContainerID: "containerid",
 		Origin:      peername,
 		Addr:        address.Address(0),
 		Hostname:    "hostname",
 		Version:     1,
+		Incarnation: nameserver.incarnation,
+		Seq:         2,
 		Tombstone:   1234,
-	}}), nameserver.entries)
+		received:    1234,
+	}})
+	require.Equal(t, tombstoned, nameserver.entries)
+
+	// other hasn't seen the tombstone yet, however much time passes,
+	// up to maxTombstoneAge
+	now = func() int64 { return 1234 + maxTombstoneAge - 1 }
+	nameserver.deleteTombstones()
+	require.Equal(t, tombstoned, nameserver.entries)
+
+	nameserver.RLock()
+	missing := nameserver.missing(othername, other.digest())
+	nameserver.RUnlock()
+	other.receiveGossip(peername, (&GossipData{Entries: missing, Timestamp: now()}).Encode()[0])
+	exchangeDigests(other, nameserver)
+	nameserver.deleteTombstones()
+	require.Equal(t, Entries{}, nameserver.entries)
+}
+
+// A tombstone which some peer will never acknowledge
+func unacknowledgedTombstone(t *testing.T) (*Nameserver, mesh.PeerName) {
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	nameserver := makeNameserver(peername)
+	othername, err := mesh.PeerNameFromString("01:00:00:02:00:00")
+	require.Nil(t, err)
+	other := makeNameserver(othername)
+
+	nameserver.AddEntry("hostname", "containerid", peername, address.Address(0))
+	exchangeDigests(other, nameserver)
+	nameserver.Delete("hostname", "containerid", "", address.Address(0))
+	nameserver.deleteTombstones()
+	require.Len(t, nameserver.entries, 1)
+	return nameserver, othername
+}
+
+func TestTombstoneDeletionAfterPeerLeaves(t *testing.T) {
+	nameserver, othername := unacknowledgedTombstone(t)
+
+	// other leaves the mesh without mesh telling us it is gone
+	nameserver.isKnownPeer = func(peer mesh.PeerName) bool { return peer != othername }
+	nameserver.deleteTombstones()
+	require.Equal(t, Entries{}, nameserver.entries)
+	require.NotContains(t, nameserver.peerDigests, othername)
+}
+
+func TestTombstoneMaxAge(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	now = func() int64 { return 1234 }
 
-	now = func() int64 { return 1234 + int64(tombstoneTimeout/time.Second) + 1 }
+	nameserver, _ := unacknowledgedTombstone(t)
+	now = func() int64 { return 1234 + maxTombstoneAge }
 	nameserver.deleteTombstones()
 	require.Equal(t, Entries{}, nameserver.entries)
 }
+
+func TestTombstoneMaxAgeByOurClock(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	now = func() int64 { return 1234 }
+
+	// a tombstone from a peer whose clock is far behind ours
+	origin, err := mesh.PeerNameFromString("01:00:00:02:00:00")
+	require.Nil(t, err)
+	other := makeNameserver(origin)
+	other.AddEntry("hostname", "containerid", origin, address.Address(0))
+	other.Delete("hostname", "containerid", "", address.Address(0))
+
+	now = func() int64 { return 1234 + 2*maxTombstoneAge }
+	nameserver, _ := unacknowledgedTombstone(t)
+	other.RLock()
+	tombstoned := other.entries
+	other.RUnlock()
+	nameserver.receiveGossip(origin, (&GossipData{Entries: tombstoned, Timestamp: 1234}).Encode()[0])
+	nameserver.deleteTombstones()
+	require.Len(t, nameserver.entries, 2)
+
+	now = func() int64 { return 1234 + 3*maxTombstoneAge }
+	nameserver.deleteTombstones()
+	require.Equal(t, Entries{}, nameserver.entries)
+}
+
+func TestClockSkew(t *testing.T) {
+	nameservers, grouter := makeNetwork(2)
+	defer stopNetwork(nameservers, grouter)
+	ns1, ns2 := nameservers[0], nameservers[1]
+
+	oldNow := now
+	now = func() int64 { return oldNow() + 2*maxClockSkew }
+	ns1.AddEntry("hostname", "c1", ns1.ourName, address.Address(1))
+	now = oldNow
+	grouter.Flush()
+
+	require.Equal(t, []address.Address{1}, ns2.Lookup("hostname"), "gossip is not dropped")
+	ns2.RLock()
+	defer ns2.RUnlock()
+	require.Contains(t, ns2.clockSkews, ns1.ourName)
+}
+
+func TestHealth(t *testing.T) {
+	nameservers, grouter := makeNetwork(2)
+	defer stopNetwork(nameservers, grouter)
+	ns1, ns2 := nameservers[0], nameservers[1]
+
+	ns1.AddEntry("hostname", "c1", ns1.ourName, address.Address(1))
+	ns1.AddEntry("hostname", "c2", ns1.ourName, address.Address(2))
+
+	ns1.ContainerHealthChanged("c1", false)
+	grouter.Flush()
+	require.Equal(t, []address.Address{2}, ns1.Lookup("hostname"))
+	require.Equal(t, []address.Address{2}, ns2.Lookup("hostname"), "health is gossiped")
+
+	ns1.ContainerHealthChanged("c2", false)
+	grouter.Flush()
+	require.Equal(t, []address.Address{1, 2}, ns2.Lookup("hostname"), "all unhealthy, so return them all")
+
+	ns1.ContainerHealthChanged("c1", true)
+	grouter.Flush()
+	require.Equal(t, []address.Address{1}, ns2.Lookup("hostname"))
+}
+
+func TestCheckHealth(t *testing.T) {
+	nameservers, grouter := makeNetwork(2)
+	defer stopNetwork(nameservers, grouter)
+	ns1, ns2 := nameservers[0], nameservers[1]
+
+	// c1 became unhealthy before we were watching, and c3 isn't a
+	// container at all
+	isHealthy := func(ident string) (bool, error) {
+		switch ident {
+		case "c1":
+			return false, nil
+		case "c3":
+			return false, fmt.Errorf("no such container")
+		}
+		return true, nil
+	}
+	ns1.AddEntry("hostname", "c1", ns1.ourName, address.Address(1))
+	ns1.AddEntry("hostname", "c2", ns1.ourName, address.Address(2))
+	ns1.AddEntry("hostname", "c3", ns1.ourName, address.Address(3))
+	ns1.checkAllHealth(isHealthy)
+	grouter.Flush()
+	require.Equal(t, []address.Address{2, 3}, ns1.Lookup("hostname"))
+	require.Equal(t, []address.Address{2, 3}, ns2.Lookup("hostname"), "health is gossiped")
+
+	// A container registered while unhealthy
+	ns1.AddEntry("other", "c2", ns1.ourName, address.Address(4))
+	ns1.AddEntry("other", "c1", ns1.ourName, address.Address(5))
+	ns1.checkHealth(isHealthy, "c1")
+	require.Equal(t, []address.Address{4}, ns1.Lookup("other"))
+}
+
+func TestLookupNearest(t *testing.T) {
+	nameservers, grouter := makeNetwork(4)
+	defer stopNetwork(nameservers, grouter)
+	ns1 := nameservers[0]
+	distances := map[mesh.PeerName]int{nameservers[1].ourName: 2, nameservers[2].ourName: 1}
+	ns1.SetDistance(func(name mesh.PeerName) int { return distances[name] })
+
+	for i, ns := range nameservers[:3] {
+		ns.AddEntry("hostname", fmt.Sprintf("c%d", i), ns.ourName, address.Address(i+1))
+	}
+	grouter.Flush()
+	require.Equal(t, []address.Address{1, 3, 2}, ns1.LookupNearest("hostname"))
+
+	// addresses at the same distance come back in either order
+	nameservers[3].AddEntry("hostname", "c3", nameservers[3].ourName, address.Address(4))
+	distances[nameservers[3].ourName] = 1
+	grouter.Flush()
+	result := ns1.LookupNearest("hostname")
+	require.Equal(t, address.Address(1), result[0])
+	require.Equal(t, address.Address(2), result[3])
+	middle := addrs(result[1:3])
+	sort.Sort(middle)
+	require.Equal(t, addrs{3, 4}, middle)
+}
+
+func TestWildcardsAndCNAMEs(t *testing.T) {
+	nameservers, grouter := makeNetwork(2)
+	defer stopNetwork(nameservers, grouter)
+	ns1, ns2 := nameservers[0], nameservers[1]
+
+	ns1.AddEntry("*.app.weave.local.", "c1", ns1.ourName, address.Address(1))
+	ns1.AddEntry("admin.app.weave.local.", "c2", ns1.ourName, address.Address(2))
+	ns1.AddCNAME("db.weave.local.", "", ns1.ourName, "postgres-1.weave.local.")
+	grouter.Flush()
+
+	require.Equal(t, []address.Address{1}, ns2.Lookup("tenant1.app.weave.local."))
+	require.Equal(t, []address.Address{2}, ns2.Lookup("admin.app.weave.local."), "names that exist don't match the wildcard")
+	require.Equal(t, []address.Address{}, ns2.Lookup("x.admin.app.weave.local."), "nor do names below them")
+	require.Equal(t, []address.Address{}, ns2.Lookup("app.weave.local."))
+
+	target, found := ns2.LookupCNAME("DB.weave.local.")
+	require.True(t, found)
+	require.Equal(t, "postgres-1.weave.local.", target)
+	require.Equal(t, []address.Address{}, ns2.Lookup("db.weave.local."))
+
+	// moving the alias replaces the old target
+	ns1.AddCNAME("db.weave.local.", "", ns1.ourName, "postgres-2.weave.local.")
+	grouter.Flush()
+	target, _ = ns2.LookupCNAME("db.weave.local.")
+	require.Equal(t, "postgres-2.weave.local.", target)
+
+	ns1.DeleteCNAME("db.weave.local.")
+	grouter.Flush()
+	_, found = ns2.LookupCNAME("db.weave.local.")
+	require.False(t, found)
+}
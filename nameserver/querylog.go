@@ -0,0 +1,241 @@
+package nameserver
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Past this many names or clients, we stop tracking new ones, so that
+// a client asking for random names can't make us use unbounded memory
+const maxTrackedQueryKeys = 10000
+
+// QueryRecord is a line of the query log
+type QueryRecord struct {
+	Time      time.Time
+	Client    string
+	Container string `json:",omitempty"`
+	Name      string
+	Type      string
+	Rcode     string
+	Answer    []string `json:",omitempty"`
+	LatencyMs float64
+	Upstream  string `json:",omitempty"`
+}
+
+type queryCounts struct {
+	Queries  int
+	NXDomain int
+}
+
+func (c *queryCounts) add(rcode int) {
+	c.Queries++
+	if rcode == dns.RcodeNameError {
+		c.NXDomain++
+	}
+}
+
+// queryStats counts queries and NXDOMAIN answers, by name and by client
+type queryStats struct {
+	sync.Mutex
+	total   queryCounts
+	names   map[string]*queryCounts
+	clients map[address.Address]*queryCounts
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{
+		names:   make(map[string]*queryCounts),
+		clients: make(map[address.Address]*queryCounts),
+	}
+}
+
+func (s *queryStats) add(name string, client address.Address, rcode int) {
+	s.Lock()
+	defer s.Unlock()
+	s.total.add(rcode)
+	name = strings.ToLower(name)
+	if counts, found := s.names[name]; found {
+		counts.add(rcode)
+	} else if len(s.names) < maxTrackedQueryKeys {
+		s.names[name] = &queryCounts{}
+		s.names[name].add(rcode)
+	}
+	if counts, found := s.clients[client]; found {
+		counts.add(rcode)
+	} else if len(s.clients) < maxTrackedQueryKeys {
+		s.clients[client] = &queryCounts{}
+		s.clients[client].add(rcode)
+	}
+}
+
+// loggingWriter remembers what we answered, and where from, for the
+// query log
+type loggingWriter struct {
+	dns.ResponseWriter
+	response *dns.Msg
+	upstream string
+}
+
+func (w *loggingWriter) WriteMsg(m *dns.Msg) error {
+	w.response = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func noteUpstream(w dns.ResponseWriter, server string) {
+	if lw, ok := w.(*loggingWriter); ok {
+		lw.upstream = server
+	}
+}
+
+// SetQueryLog makes us write a JSON line to out for every query.
+// Clients are identified by the nameserver's entries, or else by
+// identify, which may be nil. identify is called for every query, so
+// mustn't wait on anything.
+func (d *DNSServer) SetQueryLog(out io.Writer, identify func(address.Address) string) {
+	d.queryLogLock.Lock()
+	defer d.queryLogLock.Unlock()
+	d.queryLog = json.NewEncoder(out)
+	d.identify = identify
+}
+
+func (d *DNSServer) logged(f dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		start := time.Now()
+		lw := &loggingWriter{ResponseWriter: w}
+		f(lw, req)
+		latency := time.Since(start)
+		if len(req.Question) != 1 || lw.response == nil {
+			return
+		}
+
+		var client address.Address
+		if ip := clientIP(w.RemoteAddr()); ip != nil {
+			client = address.FromIP4(ip)
+		}
+		question := req.Question[0]
+		d.queryStats.add(question.Name, client, lw.response.Rcode)
+		d.queryLogLock.Lock()
+		queryLog, identify := d.queryLog, d.identify
+		d.queryLogLock.Unlock()
+		if queryLog == nil {
+			return
+		}
+
+		record := QueryRecord{
+			Time:      start,
+			Client:    client.String(),
+			Container: d.container(client, identify),
+			Name:      question.Name,
+			Type:      dns.TypeToString[question.Qtype],
+			Rcode:     dns.RcodeToString[lw.response.Rcode],
+			LatencyMs: float64(latency) / float64(time.Millisecond),
+			Upstream:  lw.upstream,
+		}
+		for _, rr := range lw.response.Answer {
+			record.Answer = append(record.Answer, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+		d.queryLogLock.Lock()
+		defer d.queryLogLock.Unlock()
+		if err := queryLog.Encode(record); err != nil {
+			d.ns.errorf("unable to write query log: %s", err)
+		}
+	}
+}
+
+func (d *DNSServer) container(addr address.Address, identify func(address.Address) string) string {
+	if ident := d.ns.containerOf(addr); ident != "" {
+		return ident
+	}
+	if identify != nil {
+		return identify(addr)
+	}
+	return ""
+}
+
+func (n *Nameserver) containerOf(addr address.Address) string {
+	n.RLock()
+	defer n.RUnlock()
+	return n.localAddrs[addr]
+}
+
+type NameQueryStatus struct {
+	Name     string
+	Queries  int
+	NXDomain int
+}
+
+type ClientQueryStatus struct {
+	Client    string
+	Container string `json:",omitempty"`
+	Queries   int
+	NXDomain  int
+}
+
+type QueryStatus struct {
+	Queries  int
+	NXDomain int
+	Names    []NameQueryStatus
+	Clients  []ClientQueryStatus
+}
+
+// QueryStatus reports the top names asked for, and the top clients
+// asking, with how many of their queries got NXDOMAIN
+func (d *DNSServer) QueryStatus(top int) QueryStatus {
+	d.queryStats.Lock()
+	status := QueryStatus{Queries: d.queryStats.total.Queries, NXDomain: d.queryStats.total.NXDomain}
+	for name, counts := range d.queryStats.names {
+		status.Names = append(status.Names, NameQueryStatus{name, counts.Queries, counts.NXDomain})
+	}
+	for client, counts := range d.queryStats.clients {
+		status.Clients = append(status.Clients, ClientQueryStatus{Client: client.String(), Queries: counts.Queries, NXDomain: counts.NXDomain})
+	}
+	d.queryStats.Unlock()
+
+	sort.Sort(namesByQueries(status.Names))
+	if len(status.Names) > top {
+		status.Names = status.Names[:top]
+	}
+	sort.Sort(clientsByQueries(status.Clients))
+	if len(status.Clients) > top {
+		status.Clients = status.Clients[:top]
+	}
+	d.queryLogLock.Lock()
+	identify := d.identify
+	d.queryLogLock.Unlock()
+	for i := range status.Clients {
+		if addr, err := address.ParseIP(status.Clients[i].Client); err == nil {
+			status.Clients[i].Container = d.container(addr, identify)
+		}
+	}
+	return status
+}
+
+type namesByQueries []NameQueryStatus
+
+func (ns namesByQueries) Len() int      { return len(ns) }
+func (ns namesByQueries) Swap(i, j int) { ns[i], ns[j] = ns[j], ns[i] }
+func (ns namesByQueries) Less(i, j int) bool {
+	if ns[i].Queries != ns[j].Queries {
+		return ns[i].Queries > ns[j].Queries
+	}
+	return ns[i].Name < ns[j].Name
+}
+
+type clientsByQueries []ClientQueryStatus
+
+func (cs clientsByQueries) Len() int      { return len(cs) }
+func (cs clientsByQueries) Swap(i, j int) { cs[i], cs[j] = cs[j], cs[i] }
+func (cs clientsByQueries) Less(i, j int) bool {
+	if cs[i].Queries != cs[j].Queries {
+		return cs[i].Queries > cs[j].Queries
+	}
+	return cs[i].Client < cs[j].Client
+}
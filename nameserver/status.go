@@ -2,10 +2,20 @@ package nameserver
 
 type Status struct {
 	Domain   string
+	Domains  []string
 	Upstream []string
 	Address  string
 	TTL      uint32
 	Entries  []EntryStatus
+	VIPs     []VIPStatus `json:"VIPs,omitempty"`
+
+	// peers whose clocks are well away from ours
+	ClockSkews []ClockSkewStatus `json:"ClockSkews,omitempty"`
+}
+
+type ClockSkewStatus struct {
+	Peer    string
+	Seconds int64
 }
 
 type EntryStatus struct {
@@ -13,8 +23,10 @@ type EntryStatus struct {
 	Origin      string
 	ContainerID string
 	Address     string
+	Target      string `json:"Target,omitempty"`
 	Version     int
 	Tombstone   int64
+	Unhealthy   bool
 }
 
 func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
@@ -22,9 +34,20 @@ func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
 		return nil
 	}
 
+	vips := ns.VIPStatus()
+	var domains []string
+	for _, domain := range ns.Domains() {
+		domains = append(domains, domain.String())
+	}
+
 	ns.RLock()
 	defer ns.RUnlock()
 
+	var skews []ClockSkewStatus
+	for peer, skew := range ns.clockSkews {
+		skews = append(skews, ClockSkewStatus{peer.String(), skew})
+	}
+
 	var entryStatusSlice []EntryStatus
 	for _, entry := range ns.entries {
 		entryStatusSlice = append(entryStatusSlice, EntryStatus{
@@ -32,14 +55,27 @@ func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
 			entry.Origin.String(),
 			entry.ContainerID,
 			entry.Addr.String(),
+			entry.Target,
 			entry.Version,
-			entry.Tombstone})
+			entry.Tombstone,
+			entry.Unhealthy})
+	}
+
+	upstream := dnsServer.upstream.Servers
+	if len(dnsServer.tlsUpstreams) > 0 {
+		upstream = nil
+		for _, u := range dnsServer.tlsUpstreams {
+			upstream = append(upstream, u.String())
+		}
 	}
 
 	return &Status{
-		dnsServer.domain,
-		dnsServer.upstream.Servers,
+		domains[0],
+		domains,
+		upstream,
 		dnsServer.address,
 		dnsServer.ttl,
-		entryStatusSlice}
+		entryStatusSlice,
+		vips,
+		skews}
 }
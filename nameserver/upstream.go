@@ -0,0 +1,188 @@
+package nameserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultTLSPort = "853"
+
+// forwarder is an upstream server we forward queries to
+type forwarder interface {
+	exchange(req *dns.Msg, client *dns.Client) (*dns.Msg, error)
+	String() string
+}
+
+// plainUpstream is a server from resolv.conf, asked over UDP or TCP,
+// the same as the client asked us
+type plainUpstream string
+
+func (u plainUpstream) exchange(req *dns.Msg, client *dns.Client) (*dns.Msg, error) {
+	response, _, err := client.Exchange(req, string(u))
+	return response, err
+}
+
+func (u plainUpstream) String() string {
+	return string(u)
+}
+
+// TLSUpstream is a DNS-over-TLS server (RFC 7858). Its certificate
+// must be valid for ServerName, if that is given, and its public key
+// must be one of Pins, if those are given; at least one of the two
+// is required.
+type TLSUpstream struct {
+	Address    string
+	ServerName string
+	Pins       [][]byte // SHA-256 digests of SubjectPublicKeyInfo
+
+	timeout time.Duration
+	idle    chan *dns.Conn
+}
+
+// ParseTLSUpstream parses "address[:port][,name=<server name>][,pin=<base64 SHA-256 of the public key>]...",
+// where pin may be repeated.
+func ParseTLSUpstream(s string) (*TLSUpstream, error) {
+	parts := strings.Split(s, ",")
+	u := &TLSUpstream{Address: parts[0]}
+	if _, _, err := net.SplitHostPort(u.Address); err != nil {
+		u.Address = net.JoinHostPort(u.Address, defaultTLSPort)
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option %q for TLS upstream %s", part, u.Address)
+		}
+		switch kv[0] {
+		case "name":
+			u.ServerName = kv[1]
+		case "pin":
+			pin, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q for TLS upstream %s: must be a base64 SHA-256 digest", kv[1], u.Address)
+			}
+			u.Pins = append(u.Pins, pin)
+		default:
+			return nil, fmt.Errorf("unknown option %q for TLS upstream %s", kv[0], u.Address)
+		}
+	}
+	if u.ServerName == "" && len(u.Pins) == 0 {
+		return nil, fmt.Errorf("TLS upstream %s needs a server name or a pin to authenticate it", u.Address)
+	}
+	return u, nil
+}
+
+func (u *TLSUpstream) String() string {
+	return "tls://" + u.Address
+}
+
+// Connections are kept open between queries, as RFC 7858 recommends,
+// since setting one up costs several round trips. A query on a
+// connection the server has since closed is retried on a new one.
+func (u *TLSUpstream) exchange(req *dns.Msg, _ *dns.Client) (*dns.Msg, error) {
+	var conn *dns.Conn
+	select {
+	case conn = <-u.idle:
+		if response, err := u.exchangeOn(conn, req); err == nil {
+			return response, nil
+		}
+	default:
+	}
+	conn, err := u.dial()
+	if err != nil {
+		return nil, err
+	}
+	return u.exchangeOn(conn, req)
+}
+
+func (u *TLSUpstream) exchangeOn(conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	conn.SetDeadline(time.Now().Add(u.timeout))
+	if err := conn.WriteMsg(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response, err := conn.ReadMsg()
+	if err == nil && response.Id != req.Id {
+		err = dns.ErrId
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return response, nil
+}
+
+func (u *TLSUpstream) dial() (*dns.Conn, error) {
+	config := &tls.Config{ServerName: u.ServerName}
+	if u.ServerName == "" {
+		// we have no name to check the certificate against, so
+		// the pins are all that authenticate the server
+		config.InsecureSkipVerify = true
+	}
+	tcpConn, err := net.DialTimeout("tcp", u.Address, u.timeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(tcpConn, config)
+	tlsConn.SetDeadline(time.Now().Add(u.timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	if err := u.checkPins(tlsConn.ConnectionState()); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: tlsConn}, nil
+}
+
+func (u *TLSUpstream) checkPins(state tls.ConnectionState) error {
+	if len(u.Pins) == 0 {
+		return nil
+	}
+	for _, cert := range state.PeerCertificates {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range u.Pins {
+			if bytes.Equal(pin, digest[:]) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("certificate of %s does not match any pin", u.Address)
+}
+
+// SetTLSUpstreams makes us forward queries to the given DNS-over-TLS
+// servers, rather than those in resolv.conf
+func (d *DNSServer) SetTLSUpstreams(upstreams []*TLSUpstream) {
+	d.tlsUpstreams = upstreams
+	for _, u := range upstreams {
+		u.timeout = d.tcpClient.ReadTimeout
+		u.idle = make(chan *dns.Conn, 1)
+	}
+}
+
+func (d *DNSServer) forwarders() []forwarder {
+	var result []forwarder
+	if len(d.tlsUpstreams) > 0 {
+		for _, u := range d.tlsUpstreams {
+			result = append(result, u)
+		}
+		return result
+	}
+	for _, server := range d.upstream.Servers {
+		result = append(result, plainUpstream(net.JoinHostPort(server, d.upstream.Port)))
+	}
+	return result
+}
@@ -0,0 +1,312 @@
+package nameserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/db"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Our own VIPs are persisted, since their addresses are allocated by
+// IPAM, which persists its allocations; otherwise they would leak
+// across restarts.
+const vipsIdent = "nameserver-vips"
+
+// VIP is a stable virtual IP for a service name. Lookups of the name
+// return just the VIP, and every peer load-balances connections to it
+// across the live entries for that name.
+type VIP struct {
+	Hostname string
+	Addr     address.Address
+	Origin   mesh.PeerName
+	Version  int
+	Deleted  bool
+}
+
+// VIPs are keyed by lowercased hostname
+type VIPs map[string]VIP
+
+// returns true if v2 should replace v1
+func (v1 *VIP) supersededBy(v2 *VIP) bool {
+	switch {
+	case v2.Version != v1.Version:
+		return v2.Version > v1.Version
+	case v2.Deleted != v1.Deleted:
+		return v2.Deleted
+	default:
+		return v2.Origin > v1.Origin
+	}
+}
+
+func (v1 *VIP) String() string {
+	return fmt.Sprintf("%s -> %s", v1.Hostname, v1.Addr.String())
+}
+
+// merge incoming into vs, returning whatever was new to us
+func (vs VIPs) merge(incoming VIPs) VIPs {
+	newVIPs := VIPs{}
+	for key, vip := range incoming {
+		if existing, found := vs[key]; found && !existing.supersededBy(&vip) {
+			continue
+		}
+		vs[key] = vip
+		newVIPs[key] = vip
+	}
+	return newVIPs
+}
+
+func (vs VIPs) copy() VIPs {
+	if vs == nil {
+		return nil
+	}
+	vs2 := make(VIPs, len(vs))
+	for key, vip := range vs {
+		vs2[key] = vip
+	}
+	return vs2
+}
+
+// Balancer is the data plane for VIPs: it sends connections for each
+// VIP to one of its backends.
+type Balancer interface {
+	// Sync makes the balancer's state match the given VIPs and
+	// backends, as dotted-quad addresses; VIPs not mentioned are
+	// removed.
+	Sync(backends map[string][]string) error
+}
+
+// VIPAllocator hands out addresses for VIPs, usually from IPAM
+type VIPAllocator interface {
+	AllocateVIP(hostname string) (address.Address, error)
+	ReleaseVIP(hostname string, addr address.Address) error
+}
+
+// SetBalancer enables VIPs, restoring our own from db if it is not
+// nil.
+func (n *Nameserver) SetBalancer(balancer Balancer, allocator VIPAllocator, db db.DB) {
+	n.balancer = balancer
+	n.vipAllocator = allocator
+	n.vipDB = db
+	if db == nil {
+		return
+	}
+	var persisted VIPs
+	if _, err := db.Load(vipsIdent, &persisted); err != nil {
+		n.errorf("unable to load persisted VIPs: %s", err)
+		return
+	}
+	n.Lock()
+	for key, vip := range persisted {
+		if vip.Origin == n.ourName {
+			n.infof("restored VIP %s", vip.String())
+			n.vips.merge(VIPs{key: vip})
+		}
+	}
+	n.Unlock()
+	n.changed()
+}
+
+// CreateVIP gives hostname a VIP, or returns the one it has already
+func (n *Nameserver) CreateVIP(hostname string) (address.Address, error) {
+	key := strings.ToLower(hostname)
+	// Held while we allocate, so that two calls for the same hostname
+	// don't both allocate an address
+	n.vipLock.Lock()
+	defer n.vipLock.Unlock()
+
+	n.RLock()
+	existing, found := n.vips[key]
+	n.RUnlock()
+	if found && !existing.Deleted {
+		return existing.Addr, nil
+	}
+	if n.vipAllocator == nil {
+		return 0, fmt.Errorf("unable to create VIP for %s: IP address allocation is disabled", hostname)
+	}
+	addr, err := n.vipAllocator.AllocateVIP(hostname)
+	if err != nil {
+		return 0, err
+	}
+
+	n.Lock()
+	if existing, found = n.vips[key]; found && !existing.Deleted {
+		// another peer's VIP arrived by gossip while we were allocating
+		n.Unlock()
+		n.releaseVIPs(VIP{Hostname: hostname, Addr: addr})
+		return existing.Addr, nil
+	}
+	vip := VIP{Hostname: hostname, Addr: addr, Origin: n.ourName, Version: existing.Version + 1}
+	n.vips[key] = vip
+	n.infof("created VIP %s", vip.String())
+	n.persistVIPs()
+	n.Unlock()
+
+	n.broadcastVIPs(VIPs{key: vip})
+	n.changed()
+	return addr, nil
+}
+
+// DeleteVIP deletes the VIP of hostname. Its address is released by
+// the peer that allocated it, when the deletion reaches it.
+func (n *Nameserver) DeleteVIP(hostname string) {
+	key := strings.ToLower(hostname)
+	n.vipLock.Lock()
+	defer n.vipLock.Unlock()
+
+	n.Lock()
+	vip, found := n.vips[key]
+	if !found || vip.Deleted {
+		n.Unlock()
+		return
+	}
+	released := vip
+	vip.Deleted = true
+	vip.Version++
+	n.vips[key] = vip
+	n.infof("deleted VIP %s", vip.String())
+	n.persistVIPs()
+	n.Unlock()
+
+	n.broadcastVIPs(VIPs{key: vip})
+	n.changed()
+	if released.Origin == n.ourName {
+		n.releaseVIPs(released)
+	}
+}
+
+// mergeVIPs merges incoming into our VIPs, returning what was new to
+// us, and those of our own VIPs whose addresses are no longer in use,
+// because they have been deleted or replaced by another peer's for
+// the same hostname. Must be called with the lock held.
+func (n *Nameserver) mergeVIPs(incoming VIPs) (newVIPs VIPs, released []VIP) {
+	ours := make(map[string]VIP)
+	for key := range incoming {
+		if vip, found := n.vips[key]; found && vip.Origin == n.ourName && !vip.Deleted {
+			ours[key] = vip
+		}
+	}
+	newVIPs = n.vips.merge(incoming)
+	for key, vip := range ours {
+		if current := n.vips[key]; current.Deleted || current.Origin != n.ourName || current.Addr != vip.Addr {
+			released = append(released, vip)
+		}
+	}
+	if len(released) > 0 {
+		n.persistVIPs()
+	}
+	return newVIPs, released
+}
+
+// releaseVIPs gives the addresses of vips back to IPAM
+func (n *Nameserver) releaseVIPs(vips ...VIP) {
+	if n.vipAllocator == nil {
+		return
+	}
+	for _, vip := range vips {
+		if err := n.vipAllocator.ReleaseVIP(vip.Hostname, vip.Addr); err != nil {
+			n.infof("unable to release VIP %s: %s", vip.String(), err)
+		}
+	}
+}
+
+// Must be called with a lock held
+func (n *Nameserver) persistVIPs() {
+	if n.vipDB == nil {
+		return
+	}
+	ours := VIPs{}
+	for key, vip := range n.vips {
+		if vip.Origin == n.ourName && !vip.Deleted {
+			ours[key] = vip
+		}
+	}
+	if err := n.vipDB.Save(vipsIdent, ours); err != nil {
+		n.errorf("unable to persist VIPs: %s", err)
+	}
+}
+
+// LookupVIP returns the VIP of hostname, if it has one
+func (n *Nameserver) LookupVIP(hostname string) (address.Address, bool) {
+	n.RLock()
+	defer n.RUnlock()
+	vip, found := n.vips[strings.ToLower(hostname)]
+	return vip.Addr, found && !vip.Deleted
+}
+
+func (n *Nameserver) broadcastVIPs(vs VIPs) {
+	if n.gossip == nil || len(vs) == 0 {
+		return
+	}
+	n.gossip.GossipBroadcast(&GossipData{VIPs: vs, Timestamp: now()})
+}
+
+// Must be called with a lock held
+func (n *Nameserver) vipBackends() map[address.Address][]address.Address {
+	backends := map[address.Address][]address.Address{}
+	for _, vip := range n.vips {
+		if vip.Deleted {
+			continue
+		}
+		backends[vip.Addr] = live(n.entries.lookup(vip.Hostname))
+	}
+	return backends
+}
+
+// syncBalancer tells the balancer about any changes to VIPs or their
+// backends; called after every update, since it's cheap to compute.
+func (n *Nameserver) syncBalancer() {
+	if n.balancer == nil {
+		return
+	}
+	// serialise, so the balancer never goes back to an older state
+	n.balancerLock.Lock()
+	defer n.balancerLock.Unlock()
+	n.RLock()
+	backends := make(map[string][]string)
+	for vip, addrs := range n.vipBackends() {
+		backends[vip.String()] = []string{}
+		for _, addr := range addrs {
+			backends[vip.String()] = append(backends[vip.String()], addr.String())
+		}
+	}
+	n.RUnlock()
+	if err := n.balancer.Sync(backends); err != nil {
+		n.errorf("unable to update load balancer: %s", err)
+	}
+}
+
+type VIPStatus struct {
+	Hostname string
+	Address  string
+	Origin   string
+	Backends []string
+}
+
+func (n *Nameserver) VIPStatus() []VIPStatus {
+	n.RLock()
+	defer n.RUnlock()
+	backends := n.vipBackends()
+	statuses := []VIPStatus{}
+	for _, vip := range n.vips {
+		if vip.Deleted {
+			continue
+		}
+		status := VIPStatus{Hostname: vip.Hostname, Address: vip.Addr.String(), Origin: vip.Origin.String()}
+		for _, addr := range backends[vip.Addr] {
+			status.Backends = append(status.Backends, addr.String())
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Sort(vipStatusByHostname(statuses))
+	return statuses
+}
+
+type vipStatusByHostname []VIPStatus
+
+func (vs vipStatusByHostname) Len() int           { return len(vs) }
+func (vs vipStatusByHostname) Swap(i, j int)      { vs[i], vs[j] = vs[j], vs[i] }
+func (vs vipStatusByHostname) Less(i, j int) bool { return vs[i].Hostname < vs[j].Hostname }
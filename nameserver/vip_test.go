@@ -0,0 +1,194 @@
+package nameserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+type mockAllocator struct {
+	sync.Mutex
+	next      address.Address
+	allocated map[address.Address]bool
+}
+
+func (a *mockAllocator) AllocateVIP(hostname string) (address.Address, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.allocated == nil {
+		a.allocated = make(map[address.Address]bool)
+	}
+	a.next++
+	a.allocated[a.next] = true
+	return a.next, nil
+}
+
+func (a *mockAllocator) ReleaseVIP(hostname string, addr address.Address) error {
+	a.Lock()
+	defer a.Unlock()
+	if !a.allocated[addr] {
+		return fmt.Errorf("%s not allocated", addr)
+	}
+	delete(a.allocated, addr)
+	return nil
+}
+
+func (a *mockAllocator) count() int {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.allocated)
+}
+
+type mockBalancer struct {
+	sync.Mutex
+	backends map[string][]string
+}
+
+func (b *mockBalancer) Sync(backends map[string][]string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.backends = backends
+	return nil
+}
+
+func (b *mockBalancer) get(vip address.Address) ([]string, bool) {
+	b.Lock()
+	defer b.Unlock()
+	backends, found := b.backends[vip.String()]
+	return backends, found
+}
+
+type mockDB map[string][]byte
+
+func (d mockDB) Load(ident string, data interface{}) (bool, error) {
+	buf, found := d[ident]
+	if !found {
+		return false, nil
+	}
+	return true, gob.NewDecoder(bytes.NewReader(buf)).Decode(data)
+}
+
+func (d mockDB) Save(ident string, data interface{}) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(data); err != nil {
+		return err
+	}
+	d[ident] = buf.Bytes()
+	return nil
+}
+
+func TestVIPs(t *testing.T) {
+	nameservers, grouter := makeNetwork(2)
+	defer stopNetwork(nameservers, grouter)
+	ns1, ns2 := nameservers[0], nameservers[1]
+	balancer1, balancer2 := &mockBalancer{}, &mockBalancer{}
+	allocator1 := &mockAllocator{next: 100}
+	ns1.SetBalancer(balancer1, allocator1, nil)
+	ns2.SetBalancer(balancer2, &mockAllocator{next: 200}, nil)
+
+	ns1.AddEntry("svc.weave.local.", "c1", ns1.ourName, address.Address(1))
+	ns2.AddEntry("svc.weave.local.", "c2", ns2.ourName, address.Address(2))
+	vip, err := ns1.CreateVIP("Svc.weave.local.")
+	require.NoError(t, err)
+	grouter.Flush()
+
+	again, err := ns2.CreateVIP("svc.weave.local.")
+	require.NoError(t, err)
+	require.Equal(t, vip, again, "VIP is shared across peers")
+
+	for _, check := range []struct {
+		ns       *Nameserver
+		balancer *mockBalancer
+	}{{ns1, balancer1}, {ns2, balancer2}} {
+		found, ok := check.ns.LookupVIP("svc.weave.local.")
+		require.True(t, ok)
+		require.Equal(t, vip, found)
+		hostname, err := check.ns.ReverseLookup(vip)
+		require.NoError(t, err)
+		require.Equal(t, "Svc.weave.local.", hostname)
+		backends, _ := check.balancer.get(vip)
+		require.Equal(t, fmt.Sprint([]address.Address{1, 2}), fmt.Sprint(backends))
+	}
+
+	ns2.ContainerDied("c2")
+	grouter.Flush()
+	backends, _ := balancer1.get(vip)
+	require.Equal(t, fmt.Sprint([]address.Address{1}), fmt.Sprint(backends), "dead container no longer a backend")
+
+	require.Equal(t, 1, allocator1.count())
+	ns2.DeleteVIP("svc.weave.local.")
+	grouter.Flush()
+	_, ok := ns1.LookupVIP("svc.weave.local.")
+	require.False(t, ok)
+	_, found := balancer1.get(vip)
+	require.False(t, found)
+	require.Equal(t, 0, allocator1.count(), "deleting on another peer releases the address on its origin")
+}
+
+func TestConcurrentCreateVIP(t *testing.T) {
+	nameservers, grouter := makeNetwork(1)
+	defer stopNetwork(nameservers, grouter)
+	ns := nameservers[0]
+	allocator := &mockAllocator{}
+	ns.SetBalancer(&mockBalancer{}, allocator, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ns.CreateVIP("svc.weave.local.")
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, allocator.count())
+}
+
+func TestVIPCreatedOnTwoPeers(t *testing.T) {
+	nameservers, grouter := makeNetwork(2)
+	defer stopNetwork(nameservers, grouter)
+	ns1, ns2 := nameservers[0], nameservers[1]
+	allocator1, allocator2 := &mockAllocator{next: 100}, &mockAllocator{next: 200}
+	ns1.SetBalancer(&mockBalancer{}, allocator1, nil)
+	ns2.SetBalancer(&mockBalancer{}, allocator2, nil)
+
+	// before either hears of the other's
+	_, err := ns1.CreateVIP("svc.weave.local.")
+	require.NoError(t, err)
+	_, err = ns2.CreateVIP("svc.weave.local.")
+	require.NoError(t, err)
+	grouter.Flush()
+
+	vip1, _ := ns1.LookupVIP("svc.weave.local.")
+	vip2, _ := ns2.LookupVIP("svc.weave.local.")
+	require.Equal(t, vip1, vip2)
+	require.Equal(t, 1, allocator1.count()+allocator2.count(), "the losing peer releases its address")
+}
+
+func TestPersistedVIPs(t *testing.T) {
+	db := mockDB{}
+	nameservers, grouter := makeNetwork(1)
+	ns := nameservers[0]
+	allocator := &mockAllocator{}
+	ns.SetBalancer(&mockBalancer{}, allocator, db)
+	vip, err := ns.CreateVIP("svc.weave.local.")
+	require.NoError(t, err)
+	stopNetwork(nameservers, grouter)
+
+	// a restart, with the same peer name and IPAM allocations
+	restarted := makeNameserver(ns.ourName)
+	restarted.SetBalancer(&mockBalancer{}, allocator, db)
+	found, ok := restarted.LookupVIP("svc.weave.local.")
+	require.True(t, ok)
+	require.Equal(t, vip, found)
+
+	restarted.DeleteVIP("svc.weave.local.")
+	require.Equal(t, 0, allocator.count())
+}
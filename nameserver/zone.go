@@ -0,0 +1,137 @@
+package nameserver
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// How many past versions of the zone we keep, to answer incremental
+// zone transfers. Secondaries further behind get the whole zone.
+const maxZoneHistory = 32
+
+// zoneRecord is an A record, or a CNAME record if target is set, as
+// we would answer a lookup
+type zoneRecord struct {
+	hostname string
+	addr     address.Address
+	target   string
+}
+
+type zoneRecords map[zoneRecord]struct{}
+
+type zoneVersion struct {
+	serial  uint32
+	records zoneRecords
+}
+
+// Keep past versions of the zone from now on, so that secondaries can
+// ask for just what has changed.
+func (n *Nameserver) keepZoneHistory() {
+	n.Lock()
+	defer n.Unlock()
+	if n.zoneHistory == nil {
+		n.zoneHistory = []zoneVersion{{n.serial, n.zoneRecords()}}
+	}
+}
+
+// Must be called with the write lock held
+func (n *Nameserver) recordZoneVersion() {
+	if n.zoneHistory == nil {
+		return
+	}
+	n.zoneHistory = append(n.zoneHistory, zoneVersion{n.serial, n.zoneRecords()})
+	if len(n.zoneHistory) > maxZoneHistory {
+		n.zoneHistory = n.zoneHistory[len(n.zoneHistory)-maxZoneHistory:]
+	}
+}
+
+// zoneRecords returns the records for every name, just as lookups
+// would answer them: the live entries, or the VIP if there is one.
+// Must be called with a lock held.
+func (n *Nameserver) zoneRecords() zoneRecords {
+	records := zoneRecords{}
+	for i := 0; i < len(n.entries); {
+		j := i + 1
+		for j < len(n.entries) && n.entries[j].lHostname == n.entries[i].lHostname {
+			j++
+		}
+		hostname := n.entries[i].Hostname
+		if vip, found := n.vips[n.entries[i].lHostname]; found && !vip.Deleted {
+			records[zoneRecord{hostname, vip.Addr, ""}] = struct{}{}
+		} else if target, isCNAME := cname(n.entries[i:j]); isCNAME {
+			records[zoneRecord{hostname, 0, target}] = struct{}{}
+		} else {
+			for _, addr := range live(n.entries[i:j]) {
+				records[zoneRecord{hostname, addr, ""}] = struct{}{}
+			}
+		}
+		i = j
+	}
+	return records
+}
+
+// zone returns the records in domain, and the current serial number
+func (n *Nameserver) zone(domain Domain) (uint32, []zoneRecord) {
+	n.RLock()
+	defer n.RUnlock()
+	return n.serial, n.inDomain(domain, n.zoneRecords())
+}
+
+// zoneChanges returns the records removed from and added to domain
+// since the given serial number. It returns false if we don't have
+// that version of the zone any more.
+func (n *Nameserver) zoneChanges(domain Domain, since uint32) (serial uint32, removed, added []zoneRecord, ok bool) {
+	n.RLock()
+	defer n.RUnlock()
+	for _, version := range n.zoneHistory {
+		if version.serial != since {
+			continue
+		}
+		current := n.zoneHistory[len(n.zoneHistory)-1]
+		return current.serial,
+			n.inDomain(domain, difference(version.records, current.records)),
+			n.inDomain(domain, difference(current.records, version.records)),
+			true
+	}
+	return n.serial, nil, nil, false
+}
+
+func difference(a, b zoneRecords) zoneRecords {
+	result := zoneRecords{}
+	for record := range a {
+		if _, found := b[record]; !found {
+			result[record] = struct{}{}
+		}
+	}
+	return result
+}
+
+// inDomain picks out the records belonging to domain, leaving out
+// those in more specific domains of our own. Must be called with a
+// lock held.
+func (n *Nameserver) inDomain(domain Domain, records zoneRecords) []zoneRecord {
+	var result []zoneRecord
+	for record := range records {
+		if best, found := n.domainOf(record.hostname); found && strings.EqualFold(best.Name, domain.Name) {
+			result = append(result, record)
+		}
+	}
+	sort.Sort(byHostname(result))
+	return result
+}
+
+type byHostname []zoneRecord
+
+func (rs byHostname) Len() int      { return len(rs) }
+func (rs byHostname) Swap(i, j int) { rs[i], rs[j] = rs[j], rs[i] }
+func (rs byHostname) Less(i, j int) bool {
+	if rs[i].hostname != rs[j].hostname {
+		return rs[i].hostname < rs[j].hostname
+	}
+	if rs[i].addr != rs[j].addr {
+		return rs[i].addr < rs[j].addr
+	}
+	return rs[i].target < rs[j].target
+}
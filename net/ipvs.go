@@ -0,0 +1,207 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// the bridge's port to the router, through which other peers'
+	// containers are reached
+	routerPortName = "vethwe-bridge"
+
+	// IPVS services are keyed by firewall mark, so that a VIP covers
+	// every port and protocol
+	firstVIPMark = 0x5700
+)
+
+// IPVSBalancer load-balances connections to VIPs across their
+// backends with the kernel's IPVS. Every peer balances connections
+// from its own containers: each VIP is added to the weave bridge,
+// and ebtables rules stop other peers seeing ARP for it. Connections
+// are masqueraded so replies come back through us. VIPs and backends
+// are given as dotted-quad strings.
+//
+// The iptables rules are managed with go-iptables. IPVS is set up
+// with ipvsadm, since the vendored netlink package doesn't speak
+// IPVS's generic netlink family, and the ARP rules with ebtables,
+// which has no netlink interface at all.
+type IPVSBalancer struct {
+	sync.Mutex
+	ipt        *iptables.IPTables
+	bridgeName string
+	marks      map[string]int
+	backends   map[string][]string
+	nextMark   int
+}
+
+func NewIPVSBalancer(bridgeName string) (*IPVSBalancer, error) {
+	// IPVS has to create conntrack entries for masquerading to work
+	if err := sysctl("net/ipv4/vs/conntrack", "1"); err != nil {
+		return nil, fmt.Errorf("unable to enable IPVS conntrack (is the ip_vs module loaded?): %s", err)
+	}
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, err
+	}
+	return &IPVSBalancer{
+		ipt:        ipt,
+		bridgeName: bridgeName,
+		marks:      make(map[string]int),
+		backends:   make(map[string][]string),
+		nextMark:   firstVIPMark,
+	}, nil
+}
+
+func (b *IPVSBalancer) Sync(backends map[string][]string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	var firstErr error
+	note := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for vip := range b.marks {
+		if _, found := backends[vip]; !found {
+			note(b.removeVIP(vip))
+		}
+	}
+	for vip, addrs := range backends {
+		if _, found := b.marks[vip]; !found {
+			if err := b.addVIP(vip); err != nil {
+				note(err)
+				continue
+			}
+		}
+		note(b.setBackends(vip, addrs))
+	}
+	return firstErr
+}
+
+func (b *IPVSBalancer) addVIP(vip string) error {
+	if ip := net.ParseIP(vip); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid VIP %q", vip)
+	}
+	mark := b.nextMark
+	b.nextMark++
+	if err := b.vipAddr(netlink.AddrAdd, vip); err != nil {
+		return fmt.Errorf("unable to add VIP %s to %s: %s", vip, b.bridgeName, err)
+	}
+	b.marks[vip] = mark
+	b.backends[vip] = nil
+	err := run("ipvsadm", "-A", "-f", strconv.Itoa(mark), "-s", "rr")
+	for _, rule := range vipRules(vip, mark) {
+		if err != nil {
+			break
+		}
+		err = b.apply("-A", rule)
+	}
+	if err != nil {
+		b.removeVIP(vip) // clean up whatever we managed to add, so we can try again
+	}
+	return err
+}
+
+func (b *IPVSBalancer) removeVIP(vip string) error {
+	mark := b.marks[vip]
+	delete(b.marks, vip)
+	delete(b.backends, vip)
+	var firstErr error
+	note := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	note(run("ipvsadm", "-D", "-f", strconv.Itoa(mark)))
+	for _, rule := range vipRules(vip, mark) {
+		note(b.apply("-D", rule))
+	}
+	note(b.vipAddr(netlink.AddrDel, vip))
+	return firstErr
+}
+
+func (b *IPVSBalancer) setBackends(vip string, addrs []string) error {
+	mark := strconv.Itoa(b.marks[vip])
+	current := make(map[string]bool)
+	for _, addr := range b.backends[vip] {
+		current[addr] = true
+	}
+	wanted := make(map[string]bool)
+	for _, addr := range addrs {
+		wanted[addr] = true
+	}
+	var firstErr error
+	for addr := range current {
+		if !wanted[addr] {
+			if err := run("ipvsadm", "-d", "-f", mark, "-r", addr); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	for addr := range wanted {
+		if !current[addr] {
+			if err := run("ipvsadm", "-a", "-f", mark, "-r", addr, "-m"); err != nil && firstErr == nil {
+				firstErr = err
+				delete(wanted, addr)
+			}
+		}
+	}
+	b.backends[vip] = nil
+	for addr := range wanted {
+		b.backends[vip] = append(b.backends[vip], addr)
+	}
+	return firstErr
+}
+
+func (b *IPVSBalancer) vipAddr(op func(netlink.Link, *netlink.Addr) error, vip string) error {
+	link, err := netlink.LinkByName(b.bridgeName)
+	if err != nil {
+		return err
+	}
+	return op(link, &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(vip).To4(), Mask: net.CIDRMask(32, 32)}})
+}
+
+type rule struct {
+	ebtables     bool
+	table, chain string
+	args         []string
+}
+
+// apply appends ("-A") or deletes ("-D") a rule
+func (b *IPVSBalancer) apply(op string, r rule) error {
+	switch {
+	case r.ebtables:
+		return run("ebtables", append([]string{"-t", r.table, op, r.chain}, r.args...)...)
+	case op == "-A":
+		return b.ipt.Append(r.table, r.chain, r.args...)
+	default:
+		return b.ipt.Delete(r.table, r.chain, r.args...)
+	}
+}
+
+func vipRules(vip string, mark int) []rule {
+	dst := vip + "/32"
+	markStr := strconv.Itoa(mark)
+	return []rule{
+		{false, "mangle", "PREROUTING", []string{"-d", dst, "-j", "MARK", "--set-mark", markStr}},
+		{false, "nat", "POSTROUTING", []string{"-m", "mark", "--mark", markStr, "-j", "MASQUERADE"}},
+		{true, "filter", "INPUT", []string{"-i", routerPortName, "-p", "ARP", "--arp-ip-dst", vip, "-j", "DROP"}},
+		{true, "filter", "FORWARD", []string{"-o", routerPortName, "-p", "ARP", "--arp-ip-dst", vip, "-j", "DROP"}},
+		{true, "filter", "OUTPUT", []string{"-o", routerPortName, "-p", "ARP", "--arp-ip-src", vip, "-j", "DROP"}},
+	}
+}
+
+func run(command string, args ...string) error {
+	if out, err := exec.Command(command, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %v: %s: %s", command, args, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package networks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func (r *Registry) badRequest(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusBadRequest)
+	r.infof("%v", err)
+}
+
+func (r *Registry) HandleHTTP(router *mux.Router) {
+	router.Methods("PUT").Path("/network/{id}").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := mux.Vars(req)["id"]
+		subnet, err := address.ParseCIDR(req.FormValue("subnet"))
+		if err != nil {
+			r.badRequest(w, err)
+			return
+		}
+		if !subnet.IsSubnet() {
+			r.badRequest(w, fmt.Errorf("%s is not a subnet address", subnet))
+			return
+		}
+		options := map[string]string{}
+		for _, option := range req.Form["option"] {
+			kv := strings.SplitN(option, "=", 2)
+			if len(kv) != 2 {
+				r.badRequest(w, fmt.Errorf("invalid option %q", option))
+				return
+			}
+			options[kv[0]] = kv[1]
+		}
+		if err := r.Create(id, subnet, options); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	router.Methods("DELETE").Path("/network/{id}").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.Delete(mux.Vars(req)["id"])
+		w.WriteHeader(204)
+	})
+
+	router.Methods("GET").Path("/network").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewEncoder(w).Encode(r.Status()); err != nil {
+			r.badRequest(w, fmt.Errorf("Error marshalling response: %v", err))
+		}
+	})
+
+	router.Methods("GET").Path("/network/{id}").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		network, found := r.Lookup(mux.Vars(req)["id"])
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(network.status()); err != nil {
+			r.badRequest(w, fmt.Errorf("Error marshalling response: %v", err))
+		}
+	})
+}
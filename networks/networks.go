@@ -0,0 +1,340 @@
+package networks
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/db"
+	"github.com/weaveworks/weave/net/address"
+)
+
+const (
+	dbKey = "networks"
+
+	// How long we keep deleted networks, for the deletion to reach
+	// every peer, before forgetting them
+	tombstoneLifetime      = 24 * time.Hour
+	tombstoneCheckInterval = time.Hour
+)
+
+// Network is a Docker network created with the weave driver. Each
+// one gets its own subnet, and containers only see broadcasts from
+// their own network.
+type Network struct {
+	ID        string
+	Subnet    address.CIDR
+	Options   map[string]string // driver options given at creation
+	Origin    mesh.PeerName
+	Version   int
+	Deleted   bool
+	DeletedAt int64 // Unix time
+}
+
+func (n1 *Network) expired(now time.Time) bool {
+	return n1.Deleted && now.Sub(time.Unix(n1.DeletedAt, 0)) > tombstoneLifetime
+}
+
+// returns true if n2 should replace n1
+func (n1 *Network) supersededBy(n2 *Network) bool {
+	switch {
+	case n2.Version != n1.Version:
+		return n2.Version > n1.Version
+	case n2.Deleted != n1.Deleted:
+		return n2.Deleted
+	default:
+		return n2.Origin > n1.Origin
+	}
+}
+
+func (n1 *Network) String() string {
+	return fmt.Sprintf("%.12s %s", n1.ID, n1.Subnet)
+}
+
+type Networks map[string]Network
+
+// merge incoming into ns, returning whatever was new to us
+func (ns Networks) merge(incoming Networks) Networks {
+	newNetworks := Networks{}
+	for id, network := range incoming {
+		if existing, found := ns[id]; found && !existing.supersededBy(&network) {
+			continue
+		}
+		ns[id] = network
+		newNetworks[id] = network
+	}
+	return newNetworks
+}
+
+func (ns Networks) copy() Networks {
+	ns2 := make(Networks, len(ns))
+	for id, network := range ns {
+		ns2[id] = network
+	}
+	return ns2
+}
+
+// Registry keeps track of the networks created through the plugin on
+// any peer, persists them and gossips them around the cluster.
+type Registry struct {
+	sync.RWMutex
+	ourName  mesh.PeerName
+	gossip   mesh.Gossip
+	db       db.DB
+	networks Networks
+	quit     chan struct{}
+}
+
+func New(ourName mesh.PeerName, db db.DB) *Registry {
+	r := &Registry{
+		ourName:  ourName,
+		db:       db,
+		networks: Networks{},
+		quit:     make(chan struct{}),
+	}
+	if db != nil {
+		if _, err := db.Load(dbKey, &r.networks); err != nil {
+			r.errorf("unable to load persisted networks: %s", err)
+		}
+	}
+	return r
+}
+
+func (r *Registry) SetGossip(gossip mesh.Gossip) {
+	r.gossip = gossip
+}
+
+func (r *Registry) Start() {
+	go func() {
+		ticker := time.Tick(tombstoneCheckInterval)
+		for {
+			select {
+			case <-r.quit:
+				return
+			case <-ticker:
+				r.deleteTombstones(time.Now())
+			}
+		}
+	}()
+}
+
+func (r *Registry) Stop() {
+	r.quit <- struct{}{}
+}
+
+func (r *Registry) deleteTombstones(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	deleted := false
+	for id, network := range r.networks {
+		if network.expired(now) {
+			r.debugf("forgetting deleted network %s", network.String())
+			delete(r.networks, id)
+			deleted = true
+		}
+	}
+	if deleted {
+		r.persist()
+	}
+}
+
+// Create records a network, or confirms that an identical one exists
+// already; libnetwork asks every peer that uses a global network to
+// create it.
+func (r *Registry) Create(id string, subnet address.CIDR, options map[string]string) error {
+	r.Lock()
+	existing, found := r.networks[id]
+	if found && !existing.Deleted {
+		r.Unlock()
+		if existing.Subnet != subnet || !equalOptions(existing.Options, options) {
+			return fmt.Errorf("network %.12s already exists with subnet %s, options %v", id, existing.Subnet, existing.Options)
+		}
+		return nil
+	}
+	for _, other := range r.networks {
+		if !other.Deleted && other.Subnet.Range().Overlaps(subnet.Range()) {
+			r.Unlock()
+			return fmt.Errorf("subnet %s of network %.12s overlaps with network %s", subnet, id, other.String())
+		}
+	}
+	network := Network{ID: id, Subnet: subnet, Options: options, Origin: r.ourName, Version: existing.Version + 1}
+	r.networks[id] = network
+	r.infof("created network %s", network.String())
+	r.persist()
+	r.Unlock()
+	r.broadcast(Networks{id: network})
+	return nil
+}
+
+func equalOptions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, found := b[key]; !found || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Registry) Delete(id string) {
+	r.Lock()
+	network, found := r.networks[id]
+	if !found || network.Deleted {
+		r.Unlock()
+		return
+	}
+	network.Deleted = true
+	network.DeletedAt = time.Now().Unix()
+	network.Version++
+	network.Origin = r.ourName
+	r.networks[id] = network
+	r.infof("deleted network %s", network.String())
+	r.persist()
+	r.Unlock()
+	r.broadcast(Networks{id: network})
+}
+
+func (r *Registry) Lookup(id string) (Network, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	network, found := r.networks[id]
+	return network, found && !network.Deleted
+}
+
+// Live returns the networks that have not been deleted, ordered by ID.
+func (r *Registry) Live() []Network {
+	r.RLock()
+	defer r.RUnlock()
+	live := []Network{}
+	for _, network := range r.networks {
+		if !network.Deleted {
+			live = append(live, network)
+		}
+	}
+	sort.Sort(byID(live))
+	return live
+}
+
+type byID []Network
+
+func (ns byID) Len() int           { return len(ns) }
+func (ns byID) Swap(i, j int)      { ns[i], ns[j] = ns[j], ns[i] }
+func (ns byID) Less(i, j int) bool { return ns[i].ID < ns[j].ID }
+
+// Must be called with lock held
+func (r *Registry) persist() {
+	if r.db == nil {
+		return
+	}
+	if err := r.db.Save(dbKey, r.networks); err != nil {
+		r.errorf("unable to persist networks: %s", err)
+	}
+}
+
+func (r *Registry) broadcast(ns Networks) {
+	if r.gossip == nil || len(ns) == 0 {
+		return
+	}
+	r.gossip.GossipBroadcast(&GossipData{Networks: ns})
+}
+
+func (r *Registry) receiveGossip(msg []byte) (Networks, *GossipData, error) {
+	var gossip GossipData
+	if err := gossip.Decode(msg); err != nil {
+		return nil, nil, err
+	}
+	r.Lock()
+	defer r.Unlock()
+	// Don't bring back networks we have already forgotten
+	now := time.Now()
+	for id, network := range gossip.Networks {
+		if _, found := r.networks[id]; !found && network.expired(now) {
+			delete(gossip.Networks, id)
+		}
+	}
+	newNetworks := r.networks.merge(gossip.Networks)
+	if len(newNetworks) > 0 {
+		for _, network := range newNetworks {
+			r.debugf("learnt network %s (deleted: %t)", network.String(), network.Deleted)
+		}
+		r.persist()
+	}
+	return newNetworks, &gossip, nil
+}
+
+// mesh.Gossiper implementation
+
+func (r *Registry) Gossip() mesh.GossipData {
+	r.RLock()
+	defer r.RUnlock()
+	return &GossipData{Networks: r.networks.copy()}
+}
+
+func (r *Registry) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+// merge received data into state and return "everything new I've
+// just learnt", or nil if nothing in the received data was new
+func (r *Registry) OnGossip(msg []byte) (mesh.GossipData, error) {
+	newNetworks, _, err := r.receiveGossip(msg)
+	if err != nil || len(newNetworks) == 0 {
+		return nil, err
+	}
+	return &GossipData{Networks: newNetworks}, nil
+}
+
+// merge received data into state and return a representation of
+// the received data, for further propagation
+func (r *Registry) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	_, gossip, err := r.receiveGossip(msg)
+	if err != nil {
+		return nil, err
+	}
+	return gossip, nil
+}
+
+type GossipData struct {
+	Networks
+}
+
+func (g *GossipData) Merge(o mesh.GossipData) mesh.GossipData {
+	gossip := &GossipData{Networks: g.Networks.copy()}
+	gossip.Networks.merge(o.(*GossipData).Networks)
+	return gossip
+}
+
+func (g *GossipData) Decode(msg []byte) error {
+	return gob.NewDecoder(bytes.NewReader(msg)).Decode(g)
+}
+
+func (g *GossipData) Encode() [][]byte {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(g); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+// Logging
+
+func (r *Registry) infof(fmt string, args ...interface{}) {
+	r.logf(common.Log.Infof, fmt, args...)
+}
+func (r *Registry) debugf(fmt string, args ...interface{}) {
+	r.logf(common.Log.Debugf, fmt, args...)
+}
+func (r *Registry) errorf(fmt string, args ...interface{}) {
+	r.logf(common.Log.Errorf, fmt, args...)
+}
+func (r *Registry) logf(f func(string, ...interface{}), fmt string, args ...interface{}) {
+	f("[networks %s] "+fmt, append([]interface{}{r.ourName}, args...)...)
+}
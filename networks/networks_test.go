@@ -0,0 +1,95 @@
+package networks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+func parseCIDR(t *testing.T, s string) address.CIDR {
+	cidr, err := address.ParseCIDR(s)
+	require.NoError(t, err)
+	return cidr
+}
+
+func TestCreateDelete(t *testing.T) {
+	r := New(mesh.PeerName(1), nil)
+	subnet := parseCIDR(t, "10.32.1.0/24")
+
+	require.NoError(t, r.Create("net1", subnet, nil))
+	require.NoError(t, r.Create("net1", subnet, nil), "re-creating an identical network")
+	require.Error(t, r.Create("net1", parseCIDR(t, "10.32.2.0/24"), nil), "re-creating with a different subnet")
+	require.Error(t, r.Create("net1", subnet, map[string]string{"mtu": "1400"}), "re-creating with different options")
+	require.Error(t, r.Create("net2", parseCIDR(t, "10.32.0.0/16"), nil), "overlapping subnet")
+
+	network, found := r.Lookup("net1")
+	require.True(t, found)
+	require.Equal(t, 1, network.Version)
+
+	r.Delete("net1")
+	_, found = r.Lookup("net1")
+	require.False(t, found)
+	require.Len(t, r.Live(), 0)
+
+	require.NoError(t, r.Create("net2", parseCIDR(t, "10.32.0.0/16"), nil), "subnet no longer in use")
+}
+
+func TestMerge(t *testing.T) {
+	subnet := parseCIDR(t, "10.32.1.0/24")
+	ns := Networks{"net1": {ID: "net1", Subnet: subnet, Origin: 1, Version: 1}}
+
+	newNetworks := ns.merge(Networks{"net1": {ID: "net1", Subnet: subnet, Origin: 2, Version: 1, Deleted: true}})
+	require.Len(t, newNetworks, 1, "deletion wins at equal version")
+	require.True(t, ns["net1"].Deleted)
+
+	newNetworks = ns.merge(Networks{"net1": {ID: "net1", Subnet: subnet, Origin: 1, Version: 1}})
+	require.Len(t, newNetworks, 0, "stale creation ignored")
+	require.True(t, ns["net1"].Deleted)
+
+	newNetworks = ns.merge(Networks{
+		"net1": {ID: "net1", Subnet: subnet, Origin: 1, Version: 2},
+		"net2": {ID: "net2", Subnet: parseCIDR(t, "10.32.2.0/24"), Origin: 2, Version: 1},
+	})
+	require.Len(t, newNetworks, 2)
+	require.False(t, ns["net1"].Deleted)
+}
+
+func TestGossipRoundTrip(t *testing.T) {
+	r1 := New(mesh.PeerName(1), nil)
+	r2 := New(mesh.PeerName(2), nil)
+	require.NoError(t, r1.Create("net1", parseCIDR(t, "10.32.1.0/24"), nil))
+
+	for _, msg := range r1.Gossip().Encode() {
+		_, err := r2.OnGossipBroadcast(r1.ourName, msg)
+		require.NoError(t, err)
+	}
+	network, found := r2.Lookup("net1")
+	require.True(t, found)
+	require.Equal(t, parseCIDR(t, "10.32.1.0/24"), network.Subnet)
+	require.Equal(t, r1.ourName, network.Origin)
+}
+
+func TestTombstoneExpiry(t *testing.T) {
+	r := New(mesh.PeerName(1), nil)
+	require.NoError(t, r.Create("net1", parseCIDR(t, "10.32.1.0/24"), nil))
+	r.Delete("net1")
+	tombstone := r.networks["net1"]
+
+	r.deleteTombstones(time.Now())
+	require.Contains(t, r.networks, "net1", "tombstone kept while peers may not have heard of it")
+	r.deleteTombstones(time.Now().Add(tombstoneLifetime + time.Minute))
+	require.NotContains(t, r.networks, "net1")
+
+	// a peer that hasn't forgotten it yet doesn't bring it back
+	tombstone.DeletedAt -= int64((tombstoneLifetime + time.Minute).Seconds())
+	gossip := &GossipData{Networks: Networks{"net1": tombstone}}
+	for _, msg := range gossip.Encode() {
+		_, err := r.OnGossipBroadcast(mesh.PeerName(2), msg)
+		require.NoError(t, err)
+	}
+	require.NotContains(t, r.networks, "net1")
+}
@@ -0,0 +1,24 @@
+package networks
+
+type NetworkStatus struct {
+	ID      string
+	Subnet  string
+	Options map[string]string
+	Origin  string
+	Version int
+}
+
+func (n *Network) status() NetworkStatus {
+	return NetworkStatus{n.ID, n.Subnet.String(), n.Options, n.Origin.String(), n.Version}
+}
+
+func (r *Registry) Status() []NetworkStatus {
+	if r == nil {
+		return nil
+	}
+	statuses := []NetworkStatus{}
+	for _, network := range r.Live() {
+		statuses = append(statuses, network.status())
+	}
+	return statuses
+}
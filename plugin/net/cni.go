@@ -4,7 +4,9 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"os"
 
 	"github.com/appc/cni/pkg/ipam"
 	"github.com/appc/cni/pkg/skel"
@@ -92,17 +94,39 @@ func (c *CNIPlugin) CmdAdd(args *skel.CmdArgs) error {
 		id = fmt.Sprintf("%x", data)
 	}
 
-	if err := weavenet.AttachContainer(ns, id, args.IfName, conf.BrName, conf.MTU, false, []*net.IPNet{&result.IP4.IP}); err != nil {
+	mtu := conf.MTU
+	if mtu == 0 {
+		// If the router can't say, the interface gets the bridge's MTU
+		mtu, _ = c.weave.MTU()
+	}
+	if err := weavenet.AttachContainer(ns, id, args.IfName, conf.BrName, mtu, false, []*net.IPNet{&result.IP4.IP}); err != nil {
 		return err
 	}
 	if err := weavenet.WithNetNSLink(ns, args.IfName, func(link netlink.Link) error {
+		mtu = link.Attrs().MTU
 		return setupRoutes(link, args.IfName, result.IP4.IP, result.IP4.Gateway, result.IP4.Routes)
 	}); err != nil {
 		return fmt.Errorf("error setting up routes: %s", err)
 	}
 
 	result.DNS = conf.DNS
-	return result.Print()
+	return printResult(os.Stdout, result, mtu)
+}
+
+// CNI results have no field for the MTU of the interface, so we add
+// one
+type resultWithMTU struct {
+	*types.Result
+	MTU int `json:"mtu,omitempty"`
+}
+
+func printResult(w io.Writer, result *types.Result, mtu int) error {
+	data, err := json.MarshalIndent(resultWithMTU{result, mtu}, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
 }
 
 func setupRoutes(link netlink.Link, name string, ipnet net.IPNet, gw net.IP, routes []types.Route) error {
@@ -0,0 +1,32 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/appc/cni/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintResult(t *testing.T) {
+	result := &types.Result{IP4: &types.IPConfig{
+		IP:      net.IPNet{IP: net.IPv4(10, 32, 0, 5).To4(), Mask: net.CIDRMask(12, 32)},
+		Gateway: net.IPv4(10, 32, 0, 1).To4(),
+	}}
+	decode := func(mtu int) map[string]interface{} {
+		buf := &bytes.Buffer{}
+		require.NoError(t, printResult(buf, result, mtu))
+		var printed map[string]interface{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &printed))
+		return printed
+	}
+
+	printed := decode(1376)
+	require.Equal(t, float64(1376), printed["mtu"])
+	require.Equal(t, "10.32.0.5/12", printed["ip4"].(map[string]interface{})["ip"])
+
+	_, found := decode(0)["mtu"]
+	require.False(t, found, "mtu given when not known")
+}
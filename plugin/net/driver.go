@@ -2,10 +2,10 @@ package plugin
 
 import (
 	"fmt"
+	"net"
 	"sync"
 
 	"github.com/docker/libnetwork/drivers/remote/api"
-	"github.com/docker/libnetwork/types"
 
 	"github.com/vishvananda/netlink"
 	weaveapi "github.com/weaveworks/weave/api"
@@ -18,15 +18,19 @@ import (
 type driver struct {
 	scope            string
 	noMulticastRoute bool
+	weave            *weaveapi.Client
 	sync.RWMutex
-	endpoints map[string]struct{}
+	endpoints map[string]*endpointSettings
+	isolated  map[string]bool // endpoints whose veths we isolated
 }
 
 func New(client *docker.Client, weave *weaveapi.Client, scope string, noMulticastRoute bool) (skel.Driver, error) {
 	driver := &driver{
 		noMulticastRoute: noMulticastRoute,
 		scope:            scope,
-		endpoints:        make(map[string]struct{}),
+		weave:            weave,
+		endpoints:        make(map[string]*endpointSettings),
+		isolated:         make(map[string]bool),
 	}
 
 	_, err := NewWatcher(client, weave, driver)
@@ -49,11 +53,39 @@ func (driver *driver) GetCapabilities() (*api.GetCapabilityResponse, error) {
 
 func (driver *driver) CreateNetwork(create *api.CreateNetworkRequest) error {
 	driver.logReq("CreateNetwork", create, create.NetworkID)
+	if len(create.IPv4Data) == 0 || create.IPv4Data[0].Pool == nil {
+		return driver.error("CreateNetwork", "no IPv4 subnet given for network %s", create.NetworkID)
+	}
+	options, err := networkOptions(create.Options)
+	if err != nil {
+		return driver.error("CreateNetwork", "%s", err)
+	}
+	// Traffic between peers is encrypted, or not, for all networks
+	// alike, so a network can only be encrypted if all traffic is
+	if encrypted, err := boolOption(options, encryptedOption, false); err != nil {
+		return driver.error("CreateNetwork", "%s", err)
+	} else if encrypted {
+		if all, err := driver.weave.Encrypted(); err != nil {
+			return driver.error("CreateNetwork", "unable to tell whether traffic is encrypted: %s", err)
+		} else if !all {
+			return driver.error("CreateNetwork", "option %s needs all traffic between peers to be encrypted: launch weave with a password and no trusted subnets", encryptedOption)
+		}
+	}
+	// check the options now, rather than fail on every endpoint
+	if _, err := newEndpointSettings(driver.noMulticastRoute, options, nil); err != nil {
+		return driver.error("CreateNetwork", "%s", err)
+	}
+	if err := driver.weave.CreateNetwork(create.NetworkID, create.IPv4Data[0].Pool, options); err != nil {
+		return driver.error("CreateNetwork", "unable to register network: %s", err)
+	}
 	return nil
 }
 
 func (driver *driver) DeleteNetwork(delete *api.DeleteNetworkRequest) error {
 	driver.logReq("DeleteNetwork", delete, delete.NetworkID)
+	if err := driver.weave.DeleteNetwork(delete.NetworkID); err != nil {
+		return driver.error("DeleteNetwork", "unable to deregister network: %s", err)
+	}
 	return nil
 }
 
@@ -64,10 +96,22 @@ func (driver *driver) CreateEndpoint(create *api.CreateEndpointRequest) (*api.Cr
 	if create.Interface == nil {
 		return nil, driver.error("CreateEndpoint", "Not supported: creating an interface from within CreateEndpoint")
 	}
+	settings, err := driver.newEndpointSettings(create.NetworkID, create.Options)
+	if err != nil {
+		return nil, driver.error("CreateEndpoint", "%s", err)
+	}
+	resp := &api.CreateEndpointResponse{}
+	if ip, _, err := net.ParseCIDR(create.Interface.Address); err == nil {
+		settings.Address = ip.String()
+	}
+	if create.Interface.MacAddress != "" {
+		settings.MacAddress = create.Interface.MacAddress
+	} else if settings.MacAddress != "" {
+		resp.Interface = &api.EndpointInterface{MacAddress: settings.MacAddress}
+	}
 	driver.Lock()
-	driver.endpoints[endID] = struct{}{}
+	driver.endpoints[endID] = settings
 	driver.Unlock()
-	resp := &api.CreateEndpointResponse{}
 
 	driver.logRes("CreateEndpoint", resp)
 	return resp, nil
@@ -81,38 +125,91 @@ func (driver *driver) DeleteEndpoint(deleteReq *api.DeleteEndpointRequest) error
 	return nil
 }
 
+// newEndpointSettings combines the options the network was created
+// with and those given for the endpoint.
+func (driver *driver) newEndpointSettings(networkID string, options map[string]interface{}) (*endpointSettings, error) {
+	var networkOptions map[string]string
+	if network, err := driver.weave.LookupNetwork(networkID); err != nil {
+		driver.warn("CreateEndpoint", "unable to find network %s, so using default settings: %s", networkID, err)
+	} else {
+		networkOptions = network.Options
+	}
+	return newEndpointSettings(driver.noMulticastRoute, networkOptions, options)
+}
+
 func (driver *driver) HasEndpoint(endpointID string) bool {
-	driver.Lock()
-	_, found := driver.endpoints[endpointID]
-	driver.Unlock()
+	_, found := driver.endpointSettings(endpointID)
 	return found
 }
 
+func (driver *driver) endpointSettings(endpointID string) (*endpointSettings, bool) {
+	driver.RLock()
+	defer driver.RUnlock()
+	settings, found := driver.endpoints[endpointID]
+	return settings, found
+}
+
 func (driver *driver) EndpointInfo(req *api.EndpointInfoRequest) (*api.EndpointInfoResponse, error) {
 	driver.logReq("EndpointInfo", req, req.EndpointID)
-	return &api.EndpointInfoResponse{Value: map[string]interface{}{}}, nil
+	settings, found := driver.endpointSettings(req.EndpointID)
+	if !found {
+		return &api.EndpointInfoResponse{Value: map[string]interface{}{}}, nil
+	}
+	return &api.EndpointInfoResponse{Value: settings.info()}, nil
 }
 
 func (driver *driver) JoinEndpoint(j *api.JoinRequest) (*api.JoinResponse, error) {
 	driver.logReq("JoinEndpoint", j, fmt.Sprintf("%s:%s to %s", j.NetworkID, j.EndpointID, j.SandboxKey))
 
+	settings, found := driver.endpointSettings(j.EndpointID)
+	if !found { // we may have been restarted since the endpoint was created
+		var err error
+		if settings, err = driver.newEndpointSettings(j.NetworkID, j.Options); err != nil {
+			return nil, driver.error("JoinEndpoint", "%s", err)
+		}
+	}
+
 	name, peerName := vethPair(j.EndpointID)
-	if _, err := weavenet.CreateAndAttachVeth(name, peerName, weavenet.WeaveBridgeName, 0, nil); err != nil {
+	var setMac func(peer netlink.Link) error
+	if settings.MacAddress != "" {
+		setMac = func(peer netlink.Link) error {
+			mac, err := net.ParseMAC(settings.MacAddress)
+			if err != nil {
+				return err
+			}
+			return netlink.LinkSetHardwareAddr(peer, mac)
+		}
+	}
+	mtu := settings.MTU
+	if mtu == 0 {
+		var err error
+		if mtu, err = driver.weave.MTU(); err != nil {
+			driver.warn("JoinEndpoint", "unable to get MTU from router, so using that of the bridge: %s", err)
+		}
+	}
+	if _, err := weavenet.CreateAndAttachVeth(name, peerName, weavenet.WeaveBridgeName, mtu, setMac); err != nil {
 		return nil, driver.error("JoinEndpoint", "%s", err)
 	}
 
+	// Networks created before weave kept track of them are not isolated
+	if network, err := driver.weave.LookupNetwork(j.NetworkID); err != nil {
+		driver.warn("JoinEndpoint", "unable to find network %s, so not isolating endpoint: %s", j.NetworkID, err)
+	} else {
+		if err := driver.isolate(name, peerName, j.NetworkID, network.Subnet, settings.Address); err != nil {
+			netlink.LinkDel(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}})
+			return nil, driver.error("JoinEndpoint", "unable to isolate endpoint: %s", err)
+		}
+		driver.Lock()
+		driver.isolated[j.EndpointID] = true
+		driver.Unlock()
+	}
+
 	response := &api.JoinResponse{
 		InterfaceName: &api.InterfaceName{
 			SrcName:   peerName,
 			DstPrefix: weavenet.VethName,
 		},
-	}
-	if !driver.noMulticastRoute {
-		multicastRoute := api.StaticRoute{
-			Destination: "224.0.0.0/4",
-			RouteType:   types.CONNECTED,
-		}
-		response.StaticRoutes = append(response.StaticRoutes, multicastRoute)
+		StaticRoutes: settings.routes(),
 	}
 	driver.logRes("JoinEndpoint", response)
 	return response, nil
@@ -126,9 +223,39 @@ func (driver *driver) LeaveEndpoint(leave *api.LeaveRequest) error {
 	if err := netlink.LinkDel(veth); err != nil {
 		driver.warn("LeaveEndpoint", "unable to delete veth: %s", err)
 	}
+
+	driver.Lock()
+	isolated := driver.isolated[leave.EndpointID]
+	delete(driver.isolated, leave.EndpointID)
+	driver.Unlock()
+	// we may have been restarted since the endpoint joined, so try
+	// regardless, but then it may not have been isolated at all
+	if err := unisolateEndpoint(name); err != nil && isolated {
+		driver.warn("LeaveEndpoint", "unable to remove isolation rules: %s", err)
+	}
 	return nil
 }
 
+// isolate confines the endpoint with the veth name, whose container
+// end is peerName, to its network
+func (driver *driver) isolate(name, peerName, networkID, subnet, addr string) error {
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return err
+	}
+	if addr == "" {
+		driver.warn("JoinEndpoint", "no address known for %s, so only checking its traffic is from subnet %s", peerName, subnet)
+		addr = subnet
+	}
+	return isolateEndpoint(&isolation{
+		ifName: name,
+		mac:    peer.Attrs().HardwareAddr.String(),
+		addr:   addr,
+		subnet: subnet,
+		mark:   networkMark(networkID),
+	})
+}
+
 func (driver *driver) DiscoverNew(disco *api.DiscoveryNotification) error {
 	driver.logReq("DiscoverNew", disco, "")
 	return nil
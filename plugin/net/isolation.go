@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os/exec"
+)
+
+// Containers on different networks share the weave bridge, so to give
+// each network its own broadcast domain every endpoint's veth gets an
+// ebtables chain of its own, through which frames from and to it are
+// passed:
+//  - frames from the endpoint must carry its own MAC and IP address,
+//    so that a container cannot pass itself off as one on another
+//    network, and are marked with the endpoint's network;
+//  - frames to the endpoint are dropped unless they are ARP or IPv4
+//    from its network's subnet, or, for any other protocol, carry
+//    the mark of its network, i.e. come from an endpoint of the same
+//    network on this host.
+// Traffic routed via the host is not bridged, so unaffected.
+
+// Network marks go in the top half of the mark, leaving the bottom
+// half for the marks the router puts on VIP traffic
+const networkMarkMask = 0xffff0000
+
+type isolation struct {
+	ifName string
+	mac    string
+	addr   string // the endpoint's own address, or its subnet if we don't know that
+	subnet string
+	mark   uint32
+}
+
+func networkMark(networkID string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(networkID))
+	return (h.Sum32() | 0x8000) << 16
+}
+
+func isolationChain(ifName string) string {
+	return "WEAVE-" + ifName
+}
+
+func (iso *isolation) rules() [][]string {
+	mark := fmt.Sprintf("%#x", iso.mark)
+	return [][]string{
+		{"-i", iso.ifName, "-s", "!", iso.mac, "-j", "DROP"},
+		{"-i", iso.ifName, "-p", "IPv4", "--ip-src", "!", iso.addr, "-j", "DROP"},
+		{"-i", iso.ifName, "-p", "ARP", "--arp-ip-src", "!", iso.addr, "-j", "DROP"},
+		{"-i", iso.ifName, "-p", "ARP", "--arp-mac-src", "!", iso.mac, "-j", "DROP"},
+		{"-i", iso.ifName, "-j", "mark", "--mark-set", mark, "--mark-target", "RETURN"},
+		{"-o", iso.ifName, "-p", "ARP", "--arp-ip-src", "!", iso.subnet, "-j", "DROP"},
+		{"-o", iso.ifName, "-p", "IPv4", "--ip-src", "!", iso.subnet, "-j", "DROP"},
+		{"-o", iso.ifName, "-p", "ARP", "-j", "RETURN"},
+		{"-o", iso.ifName, "-p", "IPv4", "-j", "RETURN"},
+		{"-o", iso.ifName, "--mark", "!", fmt.Sprintf("%s/%#x", mark, networkMarkMask), "-j", "DROP"},
+	}
+}
+
+func isolateEndpoint(iso *isolation) error {
+	// clear out anything left behind by an endpoint with the same name
+	unisolateEndpoint(iso.ifName)
+
+	chain := isolationChain(iso.ifName)
+	err := ebtables("-N", chain, "-P", "RETURN")
+	for _, rule := range iso.rules() {
+		if err != nil {
+			break
+		}
+		err = ebtables(append([]string{"-A", chain}, rule...)...)
+	}
+	if err == nil {
+		err = ebtables("-A", "FORWARD", "-i", iso.ifName, "-j", chain)
+	}
+	if err == nil {
+		err = ebtables("-A", "FORWARD", "-o", iso.ifName, "-j", chain)
+	}
+	if err != nil {
+		unisolateEndpoint(iso.ifName)
+	}
+	return err
+}
+
+func unisolateEndpoint(ifName string) error {
+	chain := isolationChain(ifName)
+	var firstErr error
+	for _, args := range [][]string{
+		{"-D", "FORWARD", "-i", ifName, "-j", chain},
+		{"-D", "FORWARD", "-o", ifName, "-j", chain},
+		{"-F", chain},
+		{"-X", chain},
+	} {
+		if err := ebtables(args...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func ebtables(args ...string) error {
+	if out, err := exec.Command("ebtables", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ebtables %v: %s: %s", args, err, out)
+	}
+	return nil
+}
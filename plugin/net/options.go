@@ -0,0 +1,167 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/types"
+)
+
+// Options accepted by `docker network create -o`; those in
+// endpointOptions may be overridden per endpoint. encryptedOption is
+// only accepted when the router encrypts all traffic, since
+// encryption is for the whole router.
+const (
+	encryptedOption      = "encrypted"
+	mtuOption            = "mtu"
+	multicastRouteOption = "multicast-route"
+	staticRoutesOption   = "static-routes"
+	macAddressOption     = "mac-address"
+	dnsOption            = "dns-registration"
+)
+
+var endpointOptions = []string{mtuOption, multicastRouteOption, staticRoutesOption, macAddressOption, dnsOption}
+
+type endpointSettings struct {
+	MTU             int
+	MulticastRoute  bool
+	StaticRoutes    []api.StaticRoute
+	MacAddress      string
+	DNSRegistration bool
+	Address         string // given by libnetwork when the endpoint is created
+}
+
+// networkOptions extracts the `-o` options, which libnetwork passes
+// as generic data, as strings.
+func networkOptions(options map[string]interface{}) (map[string]string, error) {
+	result := map[string]string{}
+	generic, ok := options[netlabel.GenericData].(map[string]interface{})
+	if !ok {
+		return result, nil
+	}
+	for key, value := range generic {
+		switch value := value.(type) {
+		case string:
+			result[key] = value
+		case bool:
+			result[key] = strconv.FormatBool(value)
+		default:
+			return nil, fmt.Errorf("invalid value for option %s: %v", key, value)
+		}
+	}
+	return result, nil
+}
+
+// newEndpointSettings works out the settings of an endpoint from the
+// options of its network, overridden by any of the endpoint's own.
+func newEndpointSettings(noMulticastRoute bool, network map[string]string, endpoint map[string]interface{}) (*endpointSettings, error) {
+	options := map[string]string{}
+	for key, value := range network {
+		if key != macAddressOption {
+			options[key] = value
+		}
+	}
+	for _, key := range endpointOptions {
+		if value, found := endpoint[key]; found {
+			options[key] = fmt.Sprint(value)
+		}
+	}
+
+	settings := &endpointSettings{MulticastRoute: !noMulticastRoute, DNSRegistration: true}
+	var err error
+	if value, found := options[mtuOption]; found {
+		if settings.MTU, err = strconv.Atoi(value); err != nil || settings.MTU < 68 || settings.MTU > 65535 {
+			return nil, fmt.Errorf("invalid value for option %s: %q", mtuOption, value)
+		}
+	}
+	if settings.MulticastRoute, err = boolOption(options, multicastRouteOption, settings.MulticastRoute); err != nil {
+		return nil, err
+	}
+	if settings.DNSRegistration, err = boolOption(options, dnsOption, settings.DNSRegistration); err != nil {
+		return nil, err
+	}
+	if value, found := options[staticRoutesOption]; found {
+		if settings.StaticRoutes, err = parseStaticRoutes(value); err != nil {
+			return nil, err
+		}
+	}
+	if value, found := options[macAddressOption]; found {
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for option %s: %s", macAddressOption, err)
+		}
+		settings.MacAddress = mac.String()
+	}
+	return settings, nil
+}
+
+// boolOption looks up an option, which is true if given with no value.
+func boolOption(options map[string]string, key string, def bool) (bool, error) {
+	value, found := options[key]
+	if !found {
+		return def, nil
+	}
+	switch value {
+	case "", "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid value for option %s: %q", key, value)
+}
+
+// parseStaticRoutes parses a comma-separated list of destinations,
+// each either directly connected ("10.1.0.0/16") or via a gateway
+// ("10.1.0.0/16@10.32.0.1").
+func parseStaticRoutes(value string) ([]api.StaticRoute, error) {
+	var routes []api.StaticRoute
+	for _, route := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(route), "@", 2)
+		_, dest, err := net.ParseCIDR(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid static route %q: %s", route, err)
+		}
+		staticRoute := api.StaticRoute{Destination: dest.String(), RouteType: types.CONNECTED}
+		if len(parts) == 2 {
+			nextHop := net.ParseIP(parts[1])
+			if nextHop == nil {
+				return nil, fmt.Errorf("invalid static route %q: bad gateway address", route)
+			}
+			staticRoute.RouteType = types.NEXTHOP
+			staticRoute.NextHop = nextHop.String()
+		}
+		routes = append(routes, staticRoute)
+	}
+	return routes, nil
+}
+
+func (settings *endpointSettings) routes() []api.StaticRoute {
+	var routes []api.StaticRoute
+	if settings.MulticastRoute {
+		routes = append(routes, api.StaticRoute{Destination: "224.0.0.0/4", RouteType: types.CONNECTED})
+	}
+	return append(routes, settings.StaticRoutes...)
+}
+
+// info is what we report to libnetwork's EndpointOperInfo
+func (settings *endpointSettings) info() map[string]interface{} {
+	var routes []string
+	for _, route := range settings.StaticRoutes {
+		if route.NextHop != "" {
+			routes = append(routes, route.Destination+"@"+route.NextHop)
+		} else {
+			routes = append(routes, route.Destination)
+		}
+	}
+	return map[string]interface{}{
+		mtuOption:            settings.MTU,
+		multicastRouteOption: settings.MulticastRoute,
+		staticRoutesOption:   strings.Join(routes, ","),
+		macAddressOption:     settings.MacAddress,
+		dnsOption:            settings.DNSRegistration,
+	}
+}
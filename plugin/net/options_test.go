@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkOptions(t *testing.T) {
+	options, err := networkOptions(map[string]interface{}{})
+	require.NoError(t, err)
+	require.Empty(t, options)
+
+	options, err = networkOptions(map[string]interface{}{netlabel.GenericData: map[string]interface{}{
+		mtuOption:            "1410",
+		multicastRouteOption: false,
+		dnsOption:            "",
+	}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{mtuOption: "1410", multicastRouteOption: "false", dnsOption: ""}, options)
+
+	_, err = networkOptions(map[string]interface{}{netlabel.GenericData: map[string]interface{}{mtuOption: 1410}})
+	require.Error(t, err)
+}
+
+func TestEndpointSettings(t *testing.T) {
+	defaults := func(f func(*endpointSettings)) *endpointSettings {
+		settings := &endpointSettings{MulticastRoute: true, DNSRegistration: true}
+		if f != nil {
+			f(settings)
+		}
+		return settings
+	}
+	for _, tc := range []struct {
+		name             string
+		noMulticastRoute bool
+		network          map[string]string
+		endpoint         map[string]interface{}
+		expected         *endpointSettings // nil if the options are invalid
+	}{
+		{name: "defaults", expected: defaults(nil)},
+		{name: "--no-multicast-route", noMulticastRoute: true,
+			expected: defaults(func(s *endpointSettings) { s.MulticastRoute = false })},
+
+		{name: "mtu", network: map[string]string{mtuOption: "1410"},
+			expected: defaults(func(s *endpointSettings) { s.MTU = 1410 })},
+		{name: "mtu not a number", network: map[string]string{mtuOption: "big"}},
+		{name: "mtu too small", network: map[string]string{mtuOption: "67"}},
+		{name: "mtu too big", network: map[string]string{mtuOption: "65536"}},
+
+		{name: "multicast-route with no value", noMulticastRoute: true, network: map[string]string{multicastRouteOption: ""},
+			expected: defaults(nil)},
+		{name: "multicast-route false", network: map[string]string{multicastRouteOption: "false"},
+			expected: defaults(func(s *endpointSettings) { s.MulticastRoute = false })},
+		{name: "multicast-route invalid", network: map[string]string{multicastRouteOption: "maybe"}},
+
+		{name: "static-routes", network: map[string]string{staticRoutesOption: "10.1.2.3/16, 10.2.0.0/16@10.32.0.1"},
+			expected: defaults(func(s *endpointSettings) {
+				s.StaticRoutes = []api.StaticRoute{
+					{Destination: "10.1.0.0/16", RouteType: types.CONNECTED},
+					{Destination: "10.2.0.0/16", RouteType: types.NEXTHOP, NextHop: "10.32.0.1"},
+				}
+			})},
+		{name: "static-routes without prefix length", network: map[string]string{staticRoutesOption: "10.1.0.0"}},
+		{name: "static-routes bad gateway", network: map[string]string{staticRoutesOption: "10.1.0.0/16@gateway"}},
+
+		{name: "mac-address", endpoint: map[string]interface{}{macAddressOption: "02:42:AC:11:00:02"},
+			expected: defaults(func(s *endpointSettings) { s.MacAddress = "02:42:ac:11:00:02" })},
+		{name: "mac-address of network ignored", network: map[string]string{macAddressOption: "02:42:ac:11:00:02"},
+			expected: defaults(nil)},
+		{name: "mac-address invalid", endpoint: map[string]interface{}{macAddressOption: "02:42"}},
+
+		{name: "dns-registration false", network: map[string]string{dnsOption: "false"},
+			expected: defaults(func(s *endpointSettings) { s.DNSRegistration = false })},
+		{name: "dns-registration invalid", network: map[string]string{dnsOption: "no"}},
+
+		{name: "endpoint overrides network",
+			network:  map[string]string{mtuOption: "1410", multicastRouteOption: "true", dnsOption: "false"},
+			endpoint: map[string]interface{}{mtuOption: 1300, multicastRouteOption: false, dnsOption: true},
+			expected: defaults(func(s *endpointSettings) { s.MTU, s.MulticastRoute = 1300, false })},
+		{name: "endpoint override invalid", network: map[string]string{mtuOption: "1410"},
+			endpoint: map[string]interface{}{mtuOption: "none"}},
+		{name: "unknown endpoint options ignored", endpoint: map[string]interface{}{"colour": "blue"},
+			expected: defaults(nil)},
+	} {
+		settings, err := newEndpointSettings(tc.noMulticastRoute, tc.network, tc.endpoint)
+		if tc.expected == nil {
+			require.Error(t, err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.expected, settings, tc.name)
+	}
+}
+
+func TestEndpointSettingsInfo(t *testing.T) {
+	settings, err := newEndpointSettings(false, map[string]string{staticRoutesOption: "10.1.0.0/16,10.2.0.0/16@10.32.0.1"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "10.1.0.0/16,10.2.0.0/16@10.32.0.1", settings.info()[staticRoutesOption])
+	require.Equal(t, []api.StaticRoute{
+		{Destination: "224.0.0.0/4", RouteType: types.CONNECTED},
+		{Destination: "10.1.0.0/16", RouteType: types.CONNECTED},
+		{Destination: "10.2.0.0/16", RouteType: types.NEXTHOP, NextHop: "10.32.0.1"},
+	}, settings.routes())
+}
@@ -34,7 +34,7 @@ func (w *watcher) ContainerStarted(id string) {
 	}
 	// check that it's on our network, via the endpointID
 	for _, net := range info.NetworkSettings.Networks {
-		if w.driver.HasEndpoint(net.EndpointID) {
+		if settings, found := w.driver.endpointSettings(net.EndpointID); found && settings.DNSRegistration {
 			fqdn := fmt.Sprintf("%s.%s", info.Config.Hostname, info.Config.Domainname)
 			if err := w.weave.RegisterWithDNS(id, fqdn, net.IPAddress); err != nil {
 				w.driver.warn("ContainerStarted", "unable to register %s with weaveDNS: %s", id, err)
@@ -49,3 +49,5 @@ func (w *watcher) ContainerDied(id string) {
 }
 
 func (w *watcher) ContainerDestroyed(id string) {}
+
+func (w *watcher) ContainerHealthChanged(id string, healthy bool) {}
@@ -34,6 +34,7 @@ func main() {
 		meshAddress      string
 		logLevel         string
 		noMulticastRoute bool
+		managed          bool
 	)
 
 	flag.BoolVar(&justVersion, "version", false, "print version and exit")
@@ -43,6 +44,7 @@ func main() {
 	flag.StringVar(&address, "socket", "/run/docker/plugins/weave.sock", "socket on which to listen")
 	flag.StringVar(&meshAddress, "meshsocket", "/run/docker/plugins/weavemesh.sock", "socket on which to listen in mesh mode")
 	flag.BoolVar(&noMulticastRoute, "no-multicast-route", false, "do not add a multicast route to network endpoints")
+	flag.BoolVar(&managed, "managed", false, "run as a Docker managed plugin, starting the router too")
 
 	flag.Parse()
 
@@ -75,7 +77,11 @@ func main() {
 	Log.Println("Weave plugin", version, "Command line options:", os.Args[1:])
 	Log.Info(dockerClient.Info())
 
-	err = run(dockerClient, weave, address, meshAddress, noMulticastRoute)
+	if managed {
+		err = runManaged(dockerClient, weave, address, noMulticastRoute)
+	} else {
+		err = run(dockerClient, weave, address, meshAddress, noMulticastRoute)
+	}
 	if err != nil {
 		Log.Fatal(err)
 	}
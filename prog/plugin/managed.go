@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	weaveapi "github.com/weaveworks/weave/api"
+	"github.com/weaveworks/weave/common/docker"
+)
+
+// When running as a Docker managed plugin there is no 'weave launch'
+// to start the router for us, so we do it ourselves. Docker passes
+// the plugin settings in the environment.
+const (
+	weaveScript    = "/home/weave/weave"
+	weaverExe      = "/home/weave/weaver"
+	routerDBPrefix = "/var/lib/weave/weave"
+
+	defaultIPRange = "10.32.0.0/12"
+)
+
+type managedConfig struct {
+	password         string
+	peers            []string
+	ipRange          string
+	noMulticastRoute bool
+	// Docker asks for both network and IPAM drivers on the one socket
+	scope    string
+	withIPAM bool
+}
+
+func managedConfigFromEnv() managedConfig {
+	config := managedConfig{
+		password:         os.Getenv("WEAVE_PASSWORD"),
+		peers:            strings.Fields(os.Getenv("WEAVE_PEERS")),
+		ipRange:          os.Getenv("IPALLOC_RANGE"),
+		noMulticastRoute: os.Getenv("WEAVE_MULTICAST") == "0",
+		scope:            "local",
+		withIPAM:         true,
+	}
+	if config.ipRange == "" {
+		config.ipRange = defaultIPRange
+	}
+	return config
+}
+
+func runManaged(dockerClient *docker.Client, weave *weaveapi.Client, address string, noMulticastRoute bool) error {
+	config := managedConfigFromEnv()
+	noMulticastRoute = noMulticastRoute || config.noMulticastRoute
+	router, err := startRouter(config)
+	if err != nil {
+		return err
+	}
+	defer router.Process.Signal(syscall.SIGTERM)
+
+	endChan := make(chan error, 2)
+	go func() {
+		endChan <- fmt.Errorf("router exited: %v", router.Wait())
+	}()
+	if err := waitForRouter(weave, endChan); err != nil {
+		return err
+	}
+
+	listener, err := listenAndServe(dockerClient, weave, address, noMulticastRoute, endChan, config.scope, config.withIPAM)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(address)
+	defer listener.Close()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, os.Kill, syscall.SIGTERM)
+
+	select {
+	case sig := <-sigChan:
+		Log.Debugf("Caught signal %s; shutting down", sig)
+		return nil
+	case err := <-endChan:
+		return err
+	}
+}
+
+// startRouter sets up the weave bridge and starts the router with
+// the plugin's settings.
+func startRouter(config managedConfig) (*exec.Cmd, error) {
+	out, err := exec.Command(weaveScript, "--local", "plugin-router-args").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up weave bridge: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	router := routerCommand(config, strings.Fields(lines[len(lines)-1]))
+	Log.Println("Starting router with arguments", router.Args[1:])
+	router.Stdout = os.Stdout
+	router.Stderr = os.Stderr
+	if err := router.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start router: %s", err)
+	}
+	return router, nil
+}
+
+// routerCommand adds the plugin's settings to the arguments for the
+// bridge from `weave plugin-router-args`. The password, if any, is
+// passed on in WEAVE_PASSWORD, so it doesn't show up in the process
+// list.
+func routerCommand(config managedConfig, bridgeArgs []string) *exec.Cmd {
+	args := append(bridgeArgs,
+		"--ipalloc-range", config.ipRange,
+		"--http-addr", fmt.Sprintf("%s:%d", weaveapi.WeaveHTTPHost, weaveapi.WeaveHTTPPort),
+		"--db-prefix", routerDBPrefix)
+	args = append(args, config.peers...)
+
+	router := exec.Command(weaverExe, args...)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "WEAVE_PASSWORD=") {
+			router.Env = append(router.Env, env)
+		}
+	}
+	if config.password != "" {
+		router.Env = append(router.Env, "WEAVE_PASSWORD="+config.password)
+	}
+	return router
+}
+
+func waitForRouter(weave *weaveapi.Client, endChan <-chan error) error {
+	for {
+		if _, err := weave.Status(); err == nil {
+			return nil
+		}
+		select {
+		case err := <-endChan:
+			return err
+		case <-time.After(time.Second):
+		}
+	}
+}
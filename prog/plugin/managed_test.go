@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setEnv(t *testing.T, env map[string]string) func() {
+	old := make(map[string]string)
+	for key, value := range env {
+		old[key] = os.Getenv(key)
+		require.NoError(t, os.Setenv(key, value))
+	}
+	return func() {
+		for key, value := range old {
+			os.Setenv(key, value)
+		}
+	}
+}
+
+func TestManagedConfigDefaults(t *testing.T) {
+	defer setEnv(t, map[string]string{"WEAVE_PASSWORD": "", "WEAVE_PEERS": "", "IPALLOC_RANGE": "", "WEAVE_MULTICAST": ""})()
+	config := managedConfigFromEnv()
+	require.Equal(t, managedConfig{peers: []string{}, ipRange: defaultIPRange, scope: "local", withIPAM: true}, config)
+
+	router := routerCommand(config, nil)
+	require.Equal(t, []string{weaverExe,
+		"--ipalloc-range", defaultIPRange,
+		"--http-addr", "127.0.0.1:6784",
+		"--db-prefix", routerDBPrefix}, router.Args)
+	for _, env := range router.Env {
+		require.NotContains(t, env, "WEAVE_PASSWORD=")
+	}
+}
+
+func TestManagedConfig(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		"WEAVE_PASSWORD":  "s3cret",
+		"WEAVE_PEERS":     " 192.168.48.12  192.168.48.13\n",
+		"IPALLOC_RANGE":   "10.2.0.0/16",
+		"WEAVE_MULTICAST": "0",
+	})()
+	config := managedConfigFromEnv()
+	require.Equal(t, managedConfig{
+		password:         "s3cret",
+		peers:            []string{"192.168.48.12", "192.168.48.13"},
+		ipRange:          "10.2.0.0/16",
+		noMulticastRoute: true,
+		scope:            "local",
+		withIPAM:         true,
+	}, config)
+
+	router := routerCommand(config, []string{"--port", "6783", "--datapath", "datapath"})
+	require.Equal(t, []string{weaverExe, "--port", "6783", "--datapath", "datapath",
+		"--ipalloc-range", "10.2.0.0/16",
+		"--http-addr", "127.0.0.1:6784",
+		"--db-prefix", routerDBPrefix,
+		"192.168.48.12", "192.168.48.13"}, router.Args)
+	for _, arg := range router.Args {
+		require.NotContains(t, arg, "s3cret", "password in the process list")
+	}
+	var passwords []string
+	for _, env := range router.Env {
+		if strings.HasPrefix(env, "WEAVE_PASSWORD=") {
+			passwords = append(passwords, env)
+		}
+	}
+	require.Equal(t, []string{"WEAVE_PASSWORD=s3cret"}, passwords)
+}
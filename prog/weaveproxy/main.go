@@ -49,6 +49,9 @@ func main() {
 	mflag.BoolVar(&withDNS, []string{"#-with-dns", "#w"}, false, "option removed")
 	mflag.BoolVar(&c.WithoutDNS, []string{"-without-dns"}, false, "instruct created containers to never use weaveDNS as their nameserver")
 	mflag.BoolVar(&c.NoMulticastRoute, []string{"-no-multicast-route"}, false, "do not add a multicast route via the weave interface when attaching containers")
+	mflag.StringVar(&c.AuthzPolicyFile, []string{"-authz-policy"}, "", "JSON file of rules restricting which API calls each TLS client certificate may make")
+	mflag.StringVar(&c.ConfigFile, []string{"-config-file"}, "", "JSON file of settings overriding the command line, re-read on SIGHUP or POST /reload, which need it")
+	mflag.StringVar(&c.AuditLogFile, []string{"-audit-log"}, "", "file to which a JSON record of every proxied API call is appended")
 	mflag.Parse()
 
 	if justVersion {
@@ -79,5 +82,6 @@ func main() {
 	p.AttachExistingContainers()
 	go p.Serve(listeners)
 	go p.ListenAndServeStatus("/home/weave/status.sock")
+	go common.ReloadOnSignal(p.Reload)
 	common.SignalHandlerLoop()
 }
@@ -16,6 +16,7 @@ import (
 	"github.com/weaveworks/weave/ipam"
 	"github.com/weaveworks/weave/nameserver"
 	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/networks"
 	weave "github.com/weaveworks/weave/router"
 )
 
@@ -154,8 +155,23 @@ var statusTemplate = defTemplate("status", `\
   PeerDiscovery: {{printState .Router.PeerDiscovery}}
         Targets: {{len .Router.Targets}}
     Connections: {{len .Router.Connections}}{{with printConnectionCounts .Router.Connections}} ({{.}}){{end}}
+{{range .Router.Relays}}\
+        NATPath: to {{.Name}}({{.NickName}}) {{.State}}{{if .Via}}, relayed via {{.Via}}({{.ViaNickName}}){{end}}
+{{end}}\
+{{if .Router.MTU}}\
+            MTU: {{.Router.MTU}}
+{{end}}\
+{{range .Router.MTUMismatches}}\
+    MTUMismatch: path MTU to {{.Name}}({{.NickName}}) is only {{.PMTU}}
+{{end}}\
+{{range .Router.TrafficClasses}}\
+   TrafficClass: {{.Name}} (priority {{.Priority}}{{if .Rate}}, rate {{.Rate}}{{end}}): \
+{{.Frames}} frames sent, {{.Dropped}} dropped
+{{end}}\
           Peers: {{len .Router.Peers}}{{with printPeerConnectionCounts .Router.Peers}} (with {{.}} connections){{end}}
  TrustedSubnets: {{printList .Router.TrustedSubnets}}
+    ARPBindings: {{.Router.ARP.Bindings}} ({{.Router.ARP.Answered}} requests answered, \
+{{.Router.ARP.Suppressed}} suppressed, {{.Router.ARP.Flooded}} flooded)
 {{if .IPAM}}\
 
         Service: ipam
@@ -182,10 +198,25 @@ var statusTemplate = defTemplate("status", `\
 {{if .DNS}}\
 
         Service: dns
+{{if gt (len .DNS.Domains) 1}}\
+        Domains: {{printList .DNS.Domains}}
+{{else}}\
          Domain: {{.DNS.Domain}}
+{{end}}\
        Upstream: {{printList .DNS.Upstream}}
             TTL: {{.DNS.TTL}}
         Entries: {{countDNSEntries .DNS.Entries}}
+{{if .DNS.VIPs}}\
+           VIPs: {{len .DNS.VIPs}}
+{{end}}\
+{{range .DNS.ClockSkews}}\
+        WARNING: clock of peer {{.Peer}} is {{.Seconds}}s away from ours
+{{end}}\
+{{end}}\
+{{if .Networks}}\
+
+        Service: networks
+       Networks: {{len .Networks}}
 {{end}}\
 `)
 
@@ -216,8 +247,20 @@ var dnsEntriesTemplate = defTemplate("dnsEntries", `\
 {{range .DNS.Entries}}\
 {{if eq .Tombstone 0}}\
 {{$hostname := trimSuffix .Hostname $domain}}\
-{{printf "%-12v" $hostname}} {{printf "%-15v" .Address}} {{printf "%12.12v" .ContainerID}} {{.Origin}}
+{{printf "%-12v" $hostname}} {{if .Target}}{{printf "%-15v" (printf "-> %v" .Target)}}{{else}}{{printf "%-15v" .Address}}{{end}} {{printf "%12.12v" .ContainerID}} {{.Origin}}
+{{end}}\
+{{end}}\
+`)
+
+var vipsTemplate = defTemplate("vipsTemplate", `\
+{{range .DNS.VIPs}}\
+{{printf "%-24v" .Hostname}} {{printf "%-15v" .Address}} {{printList .Backends}}
 {{end}}\
+`)
+
+var networksTemplate = defTemplate("networksTemplate", `\
+{{range .Networks}}\
+{{printf "%12.12v" .ID}} {{.Subnet}}
 {{end}}\
 `)
 
@@ -261,16 +304,18 @@ type WeaveStatus struct {
 	Router       *weave.NetworkRouterStatus `json:"Router,omitempty"`
 	IPAM         *ipam.Status               `json:"IPAM,omitempty"`
 	DNS          *nameserver.Status         `json:"DNS,omitempty"`
+	Networks     []networks.NetworkStatus   `json:"Networks,omitempty"`
 }
 
-func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) {
+func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, netRegistry *networks.Registry) {
 	status := func() WeaveStatus {
 		return WeaveStatus{
 			version,
 			versionCheck(),
 			weave.NewNetworkRouterStatus(router),
 			ipam.NewStatus(allocator, defaultSubnet),
-			nameserver.NewStatus(ns, dnsserver)}
+			nameserver.NewStatus(ns, dnsserver),
+			netRegistry.Status()}
 	}
 	muxRouter.Methods("GET").Path("/report").Headers("Accept", "application/json").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -319,4 +364,6 @@ func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRout
 	defHandler("/status/peers", peersTemplate)
 	defHandler("/status/dns", dnsEntriesTemplate)
 	defHandler("/status/ipam", ipamTemplate)
+	defHandler("/status/networks", networksTemplate)
+	defHandler("/status/vips", vipsTemplate)
 }
@@ -9,6 +9,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,11 +21,13 @@ import (
 	"github.com/weaveworks/go-checkpoint"
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/common/mflagext"
 	"github.com/weaveworks/weave/db"
 	"github.com/weaveworks/weave/ipam"
 	"github.com/weaveworks/weave/nameserver"
 	weavenet "github.com/weaveworks/weave/net"
 	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/networks"
 	weave "github.com/weaveworks/weave/router"
 )
 
@@ -44,11 +47,19 @@ type ipamConfig struct {
 }
 
 type dnsConfig struct {
-	Domain                 string
+	Domains                []string
+	Nameserver             string
 	ListenAddress          string
 	TTL                    int
 	ClientTimeout          time.Duration
 	EffectiveListenAddress string
+	VIPs                   bool
+	AnswerOrder            string
+	TransferClients        []string
+	QueryLog               string
+	TLSUpstreams           []string
+	DNSSEC                 bool
+	TrustAnchors           []string
 }
 
 const (
@@ -159,6 +170,8 @@ func main() {
 		logLevel           string
 		prof               string
 		bufSzMB            int
+		captureMethod      string
+		captureFanout      int
 		noDiscovery        bool
 		httpAddr           string
 		ipamConfig         ipamConfig
@@ -169,6 +182,9 @@ func main() {
 		datapathName       string
 		trustedSubnetStr   string
 		dbPrefix           string
+		multipathAddrs     []string
+		trafficClasses     []string
+		trafficClassLabel  string
 
 		defaultDockerHost = "unix:///var/run/docker.sock"
 	)
@@ -191,6 +207,9 @@ func main() {
 	mflag.IntVar(&config.ConnLimit, []string{"#connlimit", "#-connlimit", "-conn-limit"}, 30, "connection limit (0 for unlimited)")
 	mflag.BoolVar(&noDiscovery, []string{"#nodiscovery", "#-nodiscovery", "-no-discovery"}, false, "disable peer discovery")
 	mflag.IntVar(&bufSzMB, []string{"#bufsz", "-bufsz"}, 8, "capture buffer size in MB")
+	mflag.StringVar(&captureMethod, []string{"-capture"}, "pcap", "how to capture/inject on --iface (pcap or afpacket)")
+	mflag.IntVar(&captureFanout, []string{"-capture-fanout"}, 1, "number of sockets to spread capturing across, with --capture=afpacket")
+	mflag.IntVar(&networkConfig.MTU, []string{"-mtu"}, 0, "MTU of the overlay network, to check against the path MTU of each connection (unchecked if 0)")
 	mflag.StringVar(&httpAddr, []string{"#httpaddr", "#-httpaddr", "-http-addr"}, "", "address to bind HTTP interface to (disabled if blank, absolute path indicates unix domain socket)")
 	mflag.StringVar(&ipamConfig.Mode, []string{"-ipalloc-init"}, "", "allocator initialisation strategy (consensus, seed or observer)")
 	mflag.StringVar(&ipamConfig.IPRangeCIDR, []string{"#iprange", "#-iprange", "-ipalloc-range"}, "", "IP address range reserved for automatic allocation, in CIDR notation")
@@ -198,12 +217,23 @@ func main() {
 	mflag.IntVar(&ipamConfig.PeerCount, []string{"#initpeercount", "#-initpeercount", "-init-peer-count"}, 0, "number of peers in network (for IP address allocation)")
 	mflag.StringVar(&dockerAPI, []string{"#api", "#-api", "-docker-api"}, defaultDockerHost, "Docker API endpoint")
 	mflag.BoolVar(&noDNS, []string{"-no-dns"}, false, "disable DNS server")
-	mflag.StringVar(&dnsConfig.Domain, []string{"-dns-domain"}, nameserver.DefaultDomain, "local domain to server requests for")
+	mflagext.ListVar(&dnsConfig.Domains, []string{"-dns-domain"}, []string{nameserver.DefaultDomain}, "local domain to serve requests for, optionally as <domain>=<subnet> to limit it to that subnet; may be repeated, and the first is the default")
+	mflag.StringVar(&dnsConfig.Nameserver, []string{"-dns-nameserver"}, "", "name of this DNS server, as given in SOA and NS records (defaults to hostname)")
 	mflag.StringVar(&dnsConfig.ListenAddress, []string{"-dns-listen-address"}, nameserver.DefaultListenAddress, "address to listen on for DNS requests")
 	mflag.IntVar(&dnsConfig.TTL, []string{"-dns-ttl"}, nameserver.DefaultTTL, "TTL for DNS request from our domain")
 	mflag.DurationVar(&dnsConfig.ClientTimeout, []string{"-dns-fallback-timeout"}, nameserver.DefaultClientTimeout, "timeout for fallback DNS requests")
 	mflag.StringVar(&dnsConfig.EffectiveListenAddress, []string{"-dns-effective-listen-address"}, "", "address DNS will actually be listening, after Docker port mapping")
+	mflag.BoolVar(&dnsConfig.VIPs, []string{"-dns-vips"}, false, "allow services to have load-balanced virtual IPs")
+	mflagext.ListVar(&dnsConfig.TransferClients, []string{"-dns-allow-transfer"}, nil, "subnet, in CIDR notation, of secondary DNS servers allowed zone transfers; may be repeated")
+	mflag.StringVar(&dnsConfig.AnswerOrder, []string{"-dns-answer-order"}, "random", "order of addresses in DNS answers: 'random', or 'topology' for those on nearer peers first")
+	mflag.StringVar(&dnsConfig.QueryLog, []string{"-dns-query-log"}, "", "file to log every DNS query to, one JSON object per line; '-' for standard output")
+	mflagext.ListVar(&dnsConfig.TLSUpstreams, []string{"-dns-upstream-tls"}, nil, "DNS-over-TLS server to forward queries to instead of those in resolv.conf, as <address>[:port][,name=<server name>][,pin=<base64 SHA-256 of public key>]; may be repeated")
+	mflag.BoolVar(&dnsConfig.DNSSEC, []string{"-dns-dnssec"}, false, "validate DNSSEC signatures on forwarded answers, and answer SERVFAIL to bogus ones")
+	mflagext.ListVar(&dnsConfig.TrustAnchors, []string{"-dns-trust-anchor"}, nil, "DS record to trust for DNSSEC validation, instead of the root's; may be repeated")
 	mflag.StringVar(&datapathName, []string{"-datapath"}, "", "ODP datapath name")
+	mflagext.ListVar(&multipathAddrs, []string{"-multipath-addr"}, nil, "local address to send overlay traffic from on a path of its own; may be repeated, to spread traffic across several paths")
+	mflagext.ListVar(&trafficClasses, []string{"-traffic-class"}, nil, "traffic class, as <name>[,priority=<0-7>][,rate=<rate>][,dscp=<n>[:<n>...]], with the rate in bits per second (e.g. 10mbit); may be repeated")
+	mflag.StringVar(&trafficClassLabel, []string{"-traffic-class-label"}, "works.weave.traffic-class", "label giving the traffic class of a container")
 	mflag.StringVar(&trustedSubnetStr, []string{"-trusted-subnets"}, "", "comma-separated list of trusted subnets in CIDR notation")
 	mflag.StringVar(&dbPrefix, []string{"-db-prefix"}, "/weavedb/weave", "pathname/prefix of filename to store data")
 
@@ -245,9 +275,22 @@ func main() {
 		networkConfig.PacketLogging = nopPacketLogging{}
 	}
 
-	overlay, bridge := createOverlay(datapathName, ifaceName, config.Host, config.Port, bufSzMB)
+	if len(trafficClasses) > 0 {
+		networkConfig.TrafficClasses = createTrafficClasses(trafficClasses)
+	}
+
+	overlay, bridge := createOverlay(datapathName, ifaceName, captureMethod, captureFanout, config.Host, config.Port, bufSzMB, multipathAddrs, networkConfig.TrafficClasses)
 	networkConfig.Bridge = bridge
 
+	if networkConfig.MTU != 0 {
+		if networkConfig.MTU < 576 || networkConfig.MTU > 65535 {
+			Log.Fatalf("Invalid --mtu %d: must be between 576 and 65535", networkConfig.MTU)
+		}
+		if iface := bridge.Interface(); iface != nil && iface.MTU < networkConfig.MTU {
+			Log.Fatalf("--mtu %d exceeds the MTU %d of interface %s", networkConfig.MTU, iface.MTU, iface.Name)
+		}
+	}
+
 	name := peerName(routerName, bridge.Interface())
 
 	if nickName == "" {
@@ -302,6 +345,13 @@ func main() {
 		ids, err := dockerCli.AllContainerIDs()
 		checkFatal(err)
 		allocator.PruneOwned(ids)
+		allocator.OnOwnedChange(func(owners map[address.Address]string) {
+			addrs := make([]address.Address, 0, len(owners))
+			for addr := range owners {
+				addrs = append(addrs, addr)
+			}
+			router.SetLocalAddresses("ipam", addrs)
+		})
 	}
 
 	var (
@@ -310,13 +360,52 @@ func main() {
 	)
 	if !noDNS {
 		ns, dnsserver = createDNSServer(dnsConfig, router.Router, isKnownPeer)
+		switch dnsConfig.AnswerOrder {
+		case "random":
+		case "topology":
+			ns.SetDistance(router.PeerDistance)
+		default:
+			Log.Fatalf("Unknown DNS answer order %q: must be 'random' or 'topology'", dnsConfig.AnswerOrder)
+		}
+		if dnsConfig.VIPs {
+			enableVIPs(ns, allocator, defaultSubnet, db)
+		}
+		if dnsConfig.QueryLog != "" {
+			enableQueryLog(dnsserver, dnsConfig.QueryLog, allocator)
+		}
 		observeContainers(ns)
+		if dockerCli != nil {
+			ns.CheckHealth(dockerCli)
+		}
+		ns.OnLocalAddressesChange(func(addrs []address.Address) {
+			router.SetLocalAddresses("dns", addrs)
+		})
 		ns.Start()
 		defer ns.Stop()
 		dnsserver.ActivateAndServe()
 		defer dnsserver.Stop()
 	}
 
+	if networkConfig.TrafficClasses != nil && trafficClassLabel != "" && dockerCli != nil {
+		var ipRange address.CIDR
+		if allocator != nil {
+			ipRange, err = ipam.ParseCIDRSubnet(ipamConfig.IPRangeCIDR)
+			checkFatal(err)
+		}
+		observer := weave.NewTrafficClassObserver(dockerCli, allocator, ipRange, networkConfig.TrafficClasses, trafficClassLabel)
+		observeContainers(observer)
+		ids, err := dockerCli.AllContainerIDs()
+		checkFatal(err)
+		for _, id := range ids {
+			observer.ContainerStarted(id)
+		}
+	}
+
+	netRegistry := networks.New(router.Ourself.Peer.Name, db)
+	netRegistry.SetGossip(router.NewGossip("networks", netRegistry))
+	netRegistry.Start()
+	defer netRegistry.Stop()
+
 	router.Start()
 	if errors := router.InitiateConnections(peers, false); len(errors) > 0 {
 		Log.Fatal(common.ErrorMessages(errors))
@@ -332,9 +421,11 @@ func main() {
 		}
 		if ns != nil {
 			ns.HandleHTTP(muxRouter, dockerCli)
+			dnsserver.HandleHTTP(muxRouter)
 		}
+		netRegistry.HandleHTTP(muxRouter)
 		router.HandleHTTP(muxRouter)
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver)
+		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, netRegistry)
 		http.Handle("/", common.LoggingHTTPHandler(muxRouter))
 		Log.Println("Listening for HTTP control messages on", httpAddr)
 		go listenAndServeHTTP(httpAddr)
@@ -383,7 +474,7 @@ func (nopPacketLogging) LogPacket(string, weave.PacketKey) {
 func (nopPacketLogging) LogForwardPacket(string, weave.ForwardPacketKey) {
 }
 
-func createOverlay(datapathName string, ifaceName string, host string, port int, bufSzMB int) (weave.NetworkOverlay, weave.Bridge) {
+func createOverlay(datapathName string, ifaceName string, captureMethod string, captureFanout int, host string, port int, bufSzMB int, multipathAddrs []string, classes *weave.TrafficClasses) (weave.NetworkOverlay, weave.Bridge) {
 	overlay := weave.NewOverlaySwitch()
 	var bridge weave.Bridge
 	switch {
@@ -392,21 +483,43 @@ func createOverlay(datapathName string, ifaceName string, host string, port int,
 	case datapathName != "":
 		iface, err := weavenet.EnsureInterface(datapathName)
 		checkFatal(err)
-		fastdp, err := weave.NewFastDatapath(iface, port)
+		fastdp, err := weave.NewFastDatapath(iface, port, classes)
 		checkFatal(err)
 		bridge = fastdp.Bridge()
 		overlay.Add("fastdp", fastdp.Overlay())
 	case ifaceName != "":
 		iface, err := weavenet.EnsureInterface(ifaceName)
 		checkFatal(err)
-		bridge, err = weave.NewPcap(iface, bufSzMB*1024*1024) // bufsz flag is in MB
+		bufSz := bufSzMB * 1024 * 1024 // bufsz flag is in MB
+		switch captureMethod {
+		case "pcap":
+			bridge, err = weave.NewPcap(iface, bufSz)
+		case "afpacket":
+			bridge, err = weave.NewAFPacket(iface, bufSz, captureFanout)
+		default:
+			Log.Fatalf("Unknown --capture method %q: must be pcap or afpacket", captureMethod)
+		}
 		checkFatal(err)
 	default:
 		bridge = weave.NullBridge{}
 	}
-	sleeve := weave.NewSleeveOverlay(host, port)
+	// Overlays are preferred in the order they are added, and
+	// multipath uses sleeve encapsulation, so it comes after fastdp
+	if len(multipathAddrs) > 0 {
+		var addrs []net.IP
+		for _, s := range multipathAddrs {
+			addr := net.ParseIP(s)
+			if addr == nil || addr.To4() == nil {
+				Log.Fatalf("Invalid --multipath-addr %q: must be an IPv4 address", s)
+			}
+			addrs = append(addrs, addr.To4())
+		}
+		overlay.Add("multipath", weave.NewMultipathOverlay(addrs, port, classes))
+	}
+	sleeve := weave.NewSleeveOverlay(host, port, classes)
 	overlay.Add("sleeve", sleeve)
 	overlay.SetCompatOverlay(sleeve)
+	overlay.Add("tcp", weave.NewTCPOverlay())
 	return overlay, bridge
 }
 
@@ -444,14 +557,55 @@ func createAllocator(router *weave.NetworkRouter, config ipamConfig, db db.DB, i
 }
 
 func createDNSServer(config dnsConfig, router *mesh.Router, isKnownPeer func(mesh.PeerName) bool) (*nameserver.Nameserver, *nameserver.DNSServer) {
-	ns := nameserver.New(router.Ourself.Peer.Name, config.Domain, isKnownPeer)
+	var domains []nameserver.Domain
+	for _, s := range config.Domains {
+		domain, err := nameserver.ParseDomain(s)
+		if err != nil {
+			Log.Fatal("Unable to parse --dns-domain: ", err)
+		}
+		domains = append(domains, domain)
+	}
+	nsName := config.Nameserver
+	if nsName == "" {
+		hostname, err := os.Hostname()
+		checkFatal(err)
+		nsName = hostname
+	}
+	ns := nameserver.New(router.Ourself.Peer.Name, domains, isKnownPeer)
 	router.Peers.OnGC(func(peer *mesh.Peer) { ns.PeerGone(peer.Name) })
 	ns.SetGossip(router.NewGossip("nameserver", ns))
-	dnsserver, err := nameserver.NewDNSServer(ns, config.Domain, config.ListenAddress,
+	dnsserver, err := nameserver.NewDNSServer(ns, nsName, config.ListenAddress,
 		config.EffectiveListenAddress, uint32(config.TTL), config.ClientTimeout)
 	if err != nil {
 		Log.Fatal("Unable to start dns server: ", err)
 	}
+	var transferClients []address.CIDR
+	for _, s := range config.TransferClients {
+		cidr, err := address.ParseCIDR(s)
+		if err != nil {
+			Log.Fatal("Unable to parse --dns-allow-transfer: ", err)
+		}
+		transferClients = append(transferClients, cidr)
+	}
+	if len(transferClients) > 0 {
+		dnsserver.AllowTransfers(transferClients)
+	}
+	var tlsUpstreams []*nameserver.TLSUpstream
+	for _, s := range config.TLSUpstreams {
+		upstream, err := nameserver.ParseTLSUpstream(s)
+		if err != nil {
+			Log.Fatal("Unable to parse --dns-upstream-tls: ", err)
+		}
+		tlsUpstreams = append(tlsUpstreams, upstream)
+	}
+	if len(tlsUpstreams) > 0 {
+		dnsserver.SetTLSUpstreams(tlsUpstreams)
+	}
+	if config.DNSSEC {
+		if err := dnsserver.EnableDNSSEC(config.TrustAnchors); err != nil {
+			Log.Fatal("Unable to parse --dns-trust-anchor: ", err)
+		}
+	}
 	listenAddr := config.ListenAddress
 	if config.EffectiveListenAddress != "" {
 		listenAddr = config.EffectiveListenAddress
@@ -460,6 +614,76 @@ func createDNSServer(config dnsConfig, router *mesh.Router, isKnownPeer func(mes
 	return ns, dnsserver
 }
 
+func enableVIPs(ns *nameserver.Nameserver, allocator *ipam.Allocator, subnet address.CIDR, vipDB db.DB) {
+	if allocator == nil {
+		Log.Fatal("--dns-vips requires IP address allocation")
+	}
+	balancer, err := weavenet.NewIPVSBalancer(weavenet.WeaveBridgeName)
+	checkFatal(err)
+	ns.SetBalancer(balancer, &vipAllocator{allocator, subnet}, vipDB)
+}
+
+func enableQueryLog(dnsserver *nameserver.DNSServer, path string, allocator *ipam.Allocator) {
+	out := os.Stdout
+	if path != "-" {
+		var err error
+		out, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			Log.Fatal("Unable to open DNS query log: ", err)
+		}
+	}
+	var identify func(address.Address) string
+	if allocator != nil {
+		// the allocator pushes its owners to us, so that queries
+		// don't wait on it
+		var (
+			lock   sync.RWMutex
+			owners map[address.Address]string
+		)
+		allocator.OnOwnedChange(func(o map[address.Address]string) {
+			lock.Lock()
+			owners = o
+			lock.Unlock()
+		})
+		identify = func(addr address.Address) string {
+			lock.RLock()
+			defer lock.RUnlock()
+			return owners[addr]
+		}
+	}
+	dnsserver.SetQueryLog(out, identify)
+}
+
+func createTrafficClasses(specs []string) *weave.TrafficClasses {
+	var classes []*weave.TrafficClass
+	for _, spec := range specs {
+		class, err := weave.ParseTrafficClass(spec)
+		if err != nil {
+			Log.Fatal("Invalid --traffic-class: ", err)
+		}
+		classes = append(classes, class)
+	}
+	trafficClasses, err := weave.NewTrafficClasses(classes)
+	if err != nil {
+		Log.Fatal("Invalid --traffic-class: ", err)
+	}
+	return trafficClasses
+}
+
+// VIPs are allocated to a pseudo-container per service name
+type vipAllocator struct {
+	allocator *ipam.Allocator
+	subnet    address.CIDR
+}
+
+func (v *vipAllocator) AllocateVIP(hostname string) (address.Address, error) {
+	return v.allocator.Allocate("weave:vip:"+hostname, v.subnet, false, func() bool { return false })
+}
+
+func (v *vipAllocator) ReleaseVIP(hostname string, addr address.Address) error {
+	return v.allocator.Free("weave:vip:"+hostname, addr)
+}
+
 // Pick a quorum size based on the number of peer addresses.
 func determineQuorum(initPeerCountFlag int, router *weave.NetworkRouter) uint {
 	if initPeerCountFlag > 0 {
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes one proxied Docker API call.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Identity  string    `json:"identity"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Action    string    `json:"action"`
+	Container string    `json:"container,omitempty"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AuditLog writes AuditRecords as one JSON object per line.
+type AuditLog struct {
+	sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(f), nil
+}
+
+func NewAuditLog(w io.WriteCloser) *AuditLog {
+	return &AuditLog{w: w, enc: json.NewEncoder(w)}
+}
+
+func (l *AuditLog) Record(record AuditRecord) {
+	l.Lock()
+	defer l.Unlock()
+	if err := l.enc.Encode(record); err != nil {
+		Log.Warningf("Error writing audit log: %s", err)
+	}
+}
+
+func (l *AuditLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.w.Close()
+}
+
+// statusRecorder remembers the status of the response written
+// through it, while still allowing the proxy to flush and hijack.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	if w.status == 0 {
+		// doRawStream always answers 200 on the hijacked connection
+		w.status = http.StatusOK
+	}
+	return hj.Hijack()
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+)
+
+const anonymousIdentity = "anonymous"
+
+var containerPathRegexp = regexp.MustCompile("^(/v[0-9\\.]*)?/containers/([^/]+)(/.*)?$")
+
+// AuthzPolicy is the set of rules, loaded from a JSON file, governing
+// which Docker API calls each client may make through the proxy.
+type AuthzPolicy struct {
+	Rules []AuthzRule `json:"rules"`
+}
+
+// AuthzRule applies to clients whose identity (the common name of
+// their TLS client certificate, or "anonymous") matches Identity. All
+// patterns are shell patterns as understood by path.Match.
+type AuthzRule struct {
+	Identity string   `json:"identity"`
+	Allow    []string `json:"allow"`
+	Deny     []string `json:"deny"`
+	Images   []string `json:"images"`
+}
+
+type ErrForbidden struct {
+	Identity, Action, Reason string
+}
+
+func (err *ErrForbidden) Error() string {
+	return fmt.Sprintf("%s is not authorized to perform %s: %s", err.Identity, err.Action, err.Reason)
+}
+
+func LoadAuthzPolicy(filename string) (*AuthzPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read authorization policy: %v", err)
+	}
+	var policy AuthzPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("Couldn't parse authorization policy %s: %v", filename, err)
+	}
+	for _, rule := range policy.Rules {
+		patterns := []string{rule.Identity}
+		patterns = append(patterns, rule.Allow...)
+		patterns = append(patterns, rule.Deny...)
+		patterns = append(patterns, rule.Images...)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid pattern %q in authorization policy %s: %v", pattern, filename, err)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// Authorize checks a request against the policy; image is only
+// consulted for container creation, and may be empty otherwise.
+func (policy *AuthzPolicy) Authorize(identity, action, image string) error {
+	for _, rule := range policy.Rules {
+		if !matchAny([]string{rule.Identity}, identity) {
+			continue
+		}
+		switch {
+		case matchAny(rule.Deny, action):
+			return &ErrForbidden{identity, action, "denied by policy"}
+		case !matchAny(rule.Allow, action):
+			return &ErrForbidden{identity, action, "not allowed by policy"}
+		case action == "containers:create" && len(rule.Images) > 0 && !matchAny(rule.Images, image):
+			return &ErrForbidden{identity, action, fmt.Sprintf("image %q not allowed by policy", image)}
+		}
+		return nil
+	}
+	return &ErrForbidden{identity, action, "no matching rule"}
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIdentity returns the common name of the verified client
+// certificate presented with the request, if any.
+func requestIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName == "" {
+		return anonymousIdentity
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// apiRoutes name the Docker API calls by the routes they take; the
+// first route matching a request's method and path names it, with
+// the resource and operation it matched.
+var apiRoutes = []struct {
+	method  string // any, if empty
+	pattern *regexp.Regexp
+	action  string
+}{
+	{"DELETE", dockerAPIEndpoint("(?P<resource>containers|volumes|networks)/[^/]+"), "${resource}:delete"},
+	{"DELETE", dockerAPIEndpoint("images/.+"), "images:delete"},
+	{"", dockerAPIEndpoint("(?P<resource>_ping|version|info|events|auth|build|commit|volumes|networks)"), "${resource}"},
+	{"", dockerAPIEndpoint("containers/(?P<op>json|create)"), "containers:${op}"},
+	{"", dockerAPIEndpoint("images/(?P<op>json|create|load|search|get)"), "images:${op}"},
+	{"", dockerAPIEndpoint("(?P<resource>volumes|networks)/create"), "${resource}:create"},
+	{"", dockerAPIEndpoint("containers/[^/]+/attach/ws"), "containers:attach"},
+	{"", dockerAPIEndpoint("containers/[^/]+/(?P<op>json|top|logs|changes|export|stats|resize|start|stop|restart|kill|pause|unpause|attach|wait|copy|archive|exec|rename|update)"), "containers:${op}"},
+	{"", dockerAPIEndpoint("images/.+/(?P<op>json|history|push|tag|get)"), "images:${op}"},
+	{"", dockerAPIEndpoint("exec/[^/]+/(?P<op>start|resize|json)"), "exec:${op}"},
+	{"", dockerAPIEndpoint("networks/[^/]+/(?P<op>connect|disconnect)"), "networks:${op}"},
+	{"", dockerAPIEndpoint("(?P<resource>volumes|networks)/[^/]+"), "${resource}:inspect"},
+}
+
+const unknownAction = "unknown"
+
+// cleanPath gives the canonical form of a request path, which is the
+// one the proxy authorizes and forwards, so that e.g.
+// "/containers/x/exec/." can't pass for anything but an exec.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return path.Clean(p)
+}
+
+// apiAction names the Docker API call made by a request as
+// "<resource>:<operation>", e.g. "containers:create", "containers:exec",
+// "exec:start" or "images:json". Deletions are "<resource>:delete",
+// and requests taking no route we know of are "unknown".
+func apiAction(r *http.Request) string {
+	p := cleanPath(r.URL.Path)
+	for _, route := range apiRoutes {
+		if route.method != "" && route.method != r.Method {
+			continue
+		}
+		if subs := route.pattern.FindStringSubmatchIndex(p); subs != nil {
+			return string(route.pattern.ExpandString(nil, route.action, p, subs))
+		}
+	}
+	return unknownAction
+}
+
+// requestImage returns the image named in a container creation
+// request, leaving the request body intact.
+func requestImage(r *http.Request) (string, error) {
+	container := jsonObject{}
+	if err := unmarshalRequestBody(r, &container); err != nil {
+		return "", err
+	}
+	return container.String("Image")
+}
+
+// requestContainer returns the container id or name a request refers
+// to, if any.
+func requestContainer(r *http.Request) string {
+	if containerCreateRegexp.MatchString(r.URL.Path) {
+		return r.URL.Query().Get("name")
+	}
+	if subs := containerPathRegexp.FindStringSubmatch(cleanPath(r.URL.Path)); subs != nil && subs[2] != "json" {
+		return subs[2]
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIAction(t *testing.T) {
+	tests := []struct {
+		method, path, action string
+	}{
+		{"POST", "/v1.21/containers/create", "containers:create"},
+		{"POST", "/containers/abc/start", "containers:start"},
+		{"POST", "/v1.21/containers/abc/exec", "containers:exec"},
+		{"POST", "/v1.21/exec/def/start", "exec:start"},
+		{"GET", "/v1.21/containers/json", "containers:json"},
+		{"DELETE", "/v1.21/containers/abc", "containers:delete"},
+		{"GET", "/_ping", "_ping"},
+		{"POST", "/containers/abc/exec/.", "containers:exec"},
+		{"POST", "/v1.21/containers/abc/start/../exec", "containers:exec"},
+		{"POST", "/v1.21/containers/abc/attach/ws", "containers:attach"},
+		{"POST", "/v1.21/containers/abc/exec/start", "unknown"},
+		{"POST", "/v1.21/images/registry.local/app/push", "images:push"},
+		{"DELETE", "/v1.21/images/registry.local/app", "images:delete"},
+		{"GET", "/v1.21/volumes/abc", "volumes:inspect"},
+		{"POST", "/v1.21/networks/def/connect", "networks:connect"},
+		{"GET", "/v1.21/nonsense", "unknown"},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, test.path, nil)
+		require.NoError(t, err)
+		require.Equal(t, test.action, apiAction(r), test.path)
+	}
+}
+
+func TestRequestContainer(t *testing.T) {
+	for path, container := range map[string]string{
+		"/v1.21/containers/create?name=foo": "foo",
+		"/v1.21/containers/abc/start":       "abc",
+		"/v1.21/containers/abc":             "abc",
+		"/v1.21/containers/json":            "",
+		"/v1.21/exec/def/start":             "",
+		"/v1.21/containers/abc/../def/exec": "def",
+	} {
+		r, err := http.NewRequest("POST", path, nil)
+		require.NoError(t, err)
+		require.Equal(t, container, requestContainer(r), path)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	policy := &AuthzPolicy{Rules: []AuthzRule{
+		{Identity: "ci", Allow: []string{"containers:*"}, Deny: []string{"containers:exec"}, Images: []string{"registry.local/*"}},
+		{Identity: "admin", Allow: []string{"*"}},
+	}}
+
+	require.NoError(t, policy.Authorize("ci", "containers:create", "registry.local/app"))
+	require.NoError(t, policy.Authorize("ci", "containers:start", ""))
+	require.Error(t, policy.Authorize("ci", "containers:create", "busybox"))
+	require.Error(t, policy.Authorize("ci", "containers:exec", ""))
+	require.Error(t, policy.Authorize("ci", "exec:start", ""))
+	require.NoError(t, policy.Authorize("admin", "containers:exec", ""))
+	require.NoError(t, policy.Authorize("admin", "containers:create", "busybox"))
+	require.Error(t, policy.Authorize(anonymousIdentity, "_ping", ""))
+
+	r, err := http.NewRequest("POST", "/v1.21/containers/abc/exec/.", nil)
+	require.NoError(t, err)
+	require.Error(t, policy.Authorize("ci", apiAction(r), ""))
+}
+
+func TestCreateContainerID(t *testing.T) {
+	i := &createContainerInterceptor{proxy: &Proxy{auditLog: &AuditLog{}}}
+	resp := &http.Response{
+		StatusCode:       http.StatusCreated,
+		TransferEncoding: []string{"chunked"},
+		Body:             ioutil.NopCloser(strings.NewReader(`{"Id":"e90e34656806","Warnings":[]}`)),
+	}
+	require.NoError(t, i.InterceptResponse(resp))
+	require.Equal(t, "e90e34656806", i.containerID)
+
+	// the response is passed on whole
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Id":"e90e34656806","Warnings":[]}`, string(body))
+	require.Nil(t, resp.TransferEncoding)
+}
@@ -14,7 +14,12 @@ var (
 	ErrNoCommandSpecified = errors.New("No command specified")
 )
 
-type createContainerInterceptor struct{ proxy *Proxy }
+type createContainerInterceptor struct {
+	proxy *Proxy
+
+	// the id of the container created, for the audit log
+	containerID string
+}
 
 // ErrNoSuchImage replaces docker.NoSuchImage, which does not contain the image
 // name, which in turn breaks docker clients post 1.7.0 since they expect the
@@ -150,24 +155,39 @@ func (i *createContainerInterceptor) setHostname(container jsonObject, name, dns
 }
 
 func (i *createContainerInterceptor) InterceptResponse(r *http.Response) error {
-	return nil
+	if i.proxy.auditLog == nil || r.StatusCode != http.StatusCreated {
+		return nil
+	}
+
+	created := jsonObject{}
+	if err := unmarshalResponseBody(r, &created); err != nil {
+		return err
+	}
+	id, err := created.String("Id")
+	if err != nil {
+		return err
+	}
+	i.containerID = id
+
+	return marshalResponseBody(r, created)
 }
 
 func (i *createContainerInterceptor) containerHostname(r *http.Request, container jsonObject) (hostname string, err error) {
 	hostname = r.URL.Query().Get("name")
-	if i.proxy.Config.HostnameFromLabel != "" {
-		hostname, err = i.hostnameFromLabel(hostname, container)
+	if labelKey := i.proxy.config().HostnameFromLabel; labelKey != "" {
+		hostname, err = i.hostnameFromLabel(hostname, labelKey, container)
 	}
-	hostname = i.proxy.hostnameMatchRegexp.ReplaceAllString(hostname, i.proxy.HostnameReplacement)
+	hostnameMatchRegexp, hostnameReplacement := i.proxy.hostnameMatch()
+	hostname = hostnameMatchRegexp.ReplaceAllString(hostname, hostnameReplacement)
 	return
 }
 
-func (i *createContainerInterceptor) hostnameFromLabel(hostname string, container jsonObject) (string, error) {
+func (i *createContainerInterceptor) hostnameFromLabel(hostname, labelKey string, container jsonObject) (string, error) {
 	labels, err := container.Object("Labels")
 	if err != nil {
 		return "", err
 	}
-	label, err := labels.String(i.proxy.Config.HostnameFromLabel)
+	label, err := labels.String(labelKey)
 	if err != nil {
 		return "", err
 	}
@@ -11,7 +11,7 @@ func (i *inspectContainerInterceptor) InterceptRequest(r *http.Request) error {
 }
 
 func (i *inspectContainerInterceptor) InterceptResponse(r *http.Response) error {
-	if !i.proxy.RewriteInspect || r.StatusCode != 200 {
+	if !i.proxy.config().RewriteInspect || r.StatusCode != 200 {
 		return nil
 	}
 
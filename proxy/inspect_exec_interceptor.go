@@ -11,7 +11,7 @@ func (i *inspectExecInterceptor) InterceptRequest(r *http.Request) error {
 }
 
 func (i *inspectExecInterceptor) InterceptResponse(r *http.Response) error {
-	if !i.proxy.RewriteInspect {
+	if !i.proxy.config().RewriteInspect {
 		return nil
 	}
 
@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"bytes"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -64,6 +63,9 @@ type Config struct {
 	NoMulticastRoute    bool
 	DockerBridge        string
 	DockerHost          string
+	AuthzPolicyFile     string
+	AuditLogFile        string
+	ConfigFile          string
 }
 
 type wait struct {
@@ -75,6 +77,7 @@ type wait struct {
 type Proxy struct {
 	sync.Mutex
 	Config
+	initialConfig          Config
 	client                 *docker.Client
 	dockerBridgeIP         string
 	hostnameMatchRegexp    *regexp.Regexp
@@ -84,6 +87,8 @@ type Proxy struct {
 	normalisedAddrs        []string
 	waiters                map[*http.Request]*wait
 	attachJobs             map[string]*attachJob
+	authzPolicy            *AuthzPolicy
+	auditLog               *AuditLog
 	quit                   chan struct{}
 }
 
@@ -130,8 +135,20 @@ func NewProxy(c Config) (*Proxy, error) {
 		quit:       make(chan struct{}),
 	}
 
-	if err := p.TLSConfig.LoadCerts(); err != nil {
-		Log.Fatalf("Could not configure tls for proxy: %s", err)
+	p.initialConfig = c
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	if p.authzPolicy != nil && !p.TLSConfig.Verify {
+		Log.Warning("Authorization policy is enabled without --tlsverify; all clients will be anonymous")
+	}
+
+	if c.AuditLogFile != "" {
+		auditLog, err := OpenAuditLog(c.AuditLogFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open audit log: %s", err)
+		}
+		p.auditLog = auditLog
 	}
 
 	// We pin the protocol version to 1.18 (which corresponds to
@@ -158,12 +175,6 @@ func NewProxy(c Config) (*Proxy, error) {
 		p.dockerBridgeIP = netDevs[0].CIDRs[0].IP.String()
 	}
 
-	p.hostnameMatchRegexp, err = regexp.Compile(c.HostnameMatch)
-	if err != nil {
-		err := fmt.Errorf("Incorrect hostname match '%s': %s", c.HostnameMatch, err.Error())
-		return nil, err
-	}
-
 	if err = p.findWeaveWaitVolumes(); err != nil {
 		return nil, err
 	}
@@ -225,11 +236,44 @@ func (proxy *Proxy) findVolume(v string) (string, error) {
 
 func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	Log.Infof("%s %s", r.Method, r.URL)
+	r.URL.Path = cleanPath(r.URL.Path)
+	identity, action, container := requestIdentity(r), apiAction(r), requestContainer(r)
+	var authzErr error
+	if proxy.auditLog != nil {
+		recorder := &statusRecorder{ResponseWriter: w}
+		w = recorder
+		defer func() {
+			record := AuditRecord{
+				Time:      time.Now().UTC(),
+				Identity:  identity,
+				Remote:    r.RemoteAddr,
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Action:    action,
+				Container: container,
+				Status:    recorder.status,
+			}
+			if authzErr != nil {
+				record.Error = authzErr.Error()
+			}
+			proxy.auditLog.Record(record)
+		}()
+	}
+	if authzErr = proxy.authorize(r, identity, action); authzErr != nil {
+		Log.Warning(authzErr)
+		http.Error(w, authzErr.Error(), http.StatusForbidden)
+		return
+	}
+
 	path := r.URL.Path
-	var i interceptor
+	var (
+		i      interceptor
+		create *createContainerInterceptor
+	)
 	switch {
 	case containerCreateRegexp.MatchString(path):
-		i = &createContainerInterceptor{proxy}
+		create = &createContainerInterceptor{proxy: proxy}
+		i = create
 	case containerStartRegexp.MatchString(path):
 		i = &startContainerInterceptor{proxy}
 	case containerInspectRegexp.MatchString(path):
@@ -242,6 +286,26 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		i = &nullInterceptor{}
 	}
 	proxy.Intercept(i, w, r)
+	if create != nil && create.containerID != "" {
+		container = create.containerID
+	}
+}
+
+func (proxy *Proxy) authorize(r *http.Request, identity, action string) error {
+	proxy.Lock()
+	policy := proxy.authzPolicy
+	proxy.Unlock()
+	if policy == nil {
+		return nil
+	}
+	var image string
+	if containerCreateRegexp.MatchString(r.URL.Path) {
+		var err error
+		if image, err = requestImage(r); err != nil {
+			return err
+		}
+	}
+	return policy.Authorize(identity, action, image)
 }
 
 func (proxy *Proxy) Listen() []net.Listener {
@@ -301,7 +365,9 @@ func (proxy *Proxy) ListenAndServeStatus(socket string) {
 	if err != nil {
 		Log.Fatalf("ListenAndServeStatus failed: %s", err)
 	}
-	handler := http.HandlerFunc(proxy.StatusHTTP)
+	handler := http.NewServeMux()
+	handler.HandleFunc("/reload", proxy.ReloadHTTP)
+	handler.HandleFunc("/", proxy.StatusHTTP)
 	if err := (&http.Server{Handler: handler}).Serve(listener); err != nil {
 		Log.Fatalf("ListenAndServeStatus failed: %s", err)
 	}
@@ -356,7 +422,7 @@ func (proxy *Proxy) listen(protoAndAddr string) (net.Listener, string, error) {
 			return nil, "", err
 		}
 		if proxy.TLSConfig.IsEnabled() {
-			listener = tls.NewListener(listener, proxy.TLSConfig.Config)
+			listener = &tlsListener{listener, proxy}
 		}
 
 	case "unix":
@@ -478,8 +544,9 @@ func (proxy *Proxy) waitForStartByIdent(ident string) error {
 	return nil
 }
 
-func (proxy *Proxy) ContainerDied(ident string)      {}
-func (proxy *Proxy) ContainerDestroyed(ident string) {}
+func (proxy *Proxy) ContainerDied(ident string)                        {}
+func (proxy *Proxy) ContainerDestroyed(ident string)                   {}
+func (proxy *Proxy) ContainerHealthChanged(ident string, healthy bool) {}
 
 // Check if this container needs to be attached, if so then attach it,
 // and return nil on success or not needed.
@@ -545,7 +612,7 @@ func (proxy *Proxy) weaveCIDRs(networkMode string, env []string) ([]string, erro
 			return strings.Fields(e[11:]), nil
 		}
 	}
-	if proxy.NoDefaultIPAM {
+	if proxy.config().NoDefaultIPAM {
 		return nil, ErrNoDefaultIPAM
 	}
 	return nil, nil
@@ -696,4 +763,7 @@ func (proxy *Proxy) Stop() {
 	for _, j := range proxy.attachJobs {
 		j.Stop()
 	}
+	if proxy.auditLog != nil {
+		proxy.auditLog.Close()
+	}
 }
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+)
+
+// reloadableConfig holds the settings that Reload may change without
+// restarting the proxy. They are read from Config.ConfigFile; any
+// setting not mentioned there keeps its command-line value.
+type reloadableConfig struct {
+	HostnameFromLabel   string `json:"hostname-from-label"`
+	HostnameMatch       string `json:"hostname-match"`
+	HostnameReplacement string `json:"hostname-replacement"`
+	NoDefaultIPAM       bool   `json:"no-default-ipalloc"`
+	RewriteInspect      bool   `json:"rewrite-inspect"`
+}
+
+func (proxy *Proxy) readConfigFile() (reloadableConfig, error) {
+	settings := reloadableConfig{
+		HostnameFromLabel:   proxy.initialConfig.HostnameFromLabel,
+		HostnameMatch:       proxy.initialConfig.HostnameMatch,
+		HostnameReplacement: proxy.initialConfig.HostnameReplacement,
+		NoDefaultIPAM:       proxy.initialConfig.NoDefaultIPAM,
+		RewriteInspect:      proxy.initialConfig.RewriteInspect,
+	}
+	if proxy.initialConfig.ConfigFile == "" {
+		return settings, nil
+	}
+	data, err := ioutil.ReadFile(proxy.initialConfig.ConfigFile)
+	if err != nil {
+		return settings, fmt.Errorf("Couldn't read config file: %v", err)
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, fmt.Errorf("Couldn't parse config file %s: %v", proxy.initialConfig.ConfigFile, err)
+	}
+	return settings, nil
+}
+
+// Reload re-reads the config file, TLS certificates and authorization
+// policy. The new settings apply to subsequent requests and
+// connections; requests in flight, including hijacked streams, are
+// unaffected. If anything fails to load, nothing is changed. Without
+// a config file there would be no way to change the settings, so
+// Reload fails rather than quietly keep the command-line ones.
+func (proxy *Proxy) Reload() error {
+	if proxy.initialConfig.ConfigFile == "" {
+		return fmt.Errorf("Nothing to reload: the proxy was launched without --config-file")
+	}
+	return proxy.load()
+}
+
+// load reads the settings, TLS certificates and authorization policy,
+// and puts them in force if they are all good
+func (proxy *Proxy) load() error {
+	settings, err := proxy.readConfigFile()
+	if err != nil {
+		return err
+	}
+	hostnameMatchRegexp, err := regexp.Compile(settings.HostnameMatch)
+	if err != nil {
+		return fmt.Errorf("Incorrect hostname match '%s': %s", settings.HostnameMatch, err.Error())
+	}
+
+	tlsConfig := proxy.initialConfig.TLSConfig
+	if err := tlsConfig.LoadCerts(); err != nil {
+		return fmt.Errorf("Could not configure tls for proxy: %s", err)
+	}
+
+	var policy *AuthzPolicy
+	if proxy.initialConfig.AuthzPolicyFile != "" {
+		if policy, err = LoadAuthzPolicy(proxy.initialConfig.AuthzPolicyFile); err != nil {
+			return err
+		}
+	}
+
+	proxy.Lock()
+	proxy.HostnameFromLabel = settings.HostnameFromLabel
+	proxy.HostnameMatch = settings.HostnameMatch
+	proxy.HostnameReplacement = settings.HostnameReplacement
+	proxy.NoDefaultIPAM = settings.NoDefaultIPAM
+	proxy.RewriteInspect = settings.RewriteInspect
+	proxy.TLSConfig = tlsConfig
+	proxy.hostnameMatchRegexp = hostnameMatchRegexp
+	proxy.authzPolicy = policy
+	proxy.Unlock()
+
+	Log.Infof("Reloaded configuration: %+v", settings)
+	return nil
+}
+
+func (proxy *Proxy) ReloadHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := proxy.Reload(); err != nil {
+		Log.Errorf("Reload failed: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "reloaded")
+}
+
+// config returns a snapshot of the current configuration, which may
+// change under our feet when reloaded.
+func (proxy *Proxy) config() Config {
+	proxy.Lock()
+	defer proxy.Unlock()
+	return proxy.Config
+}
+
+func (proxy *Proxy) hostnameMatch() (*regexp.Regexp, string) {
+	proxy.Lock()
+	defer proxy.Unlock()
+	return proxy.hostnameMatchRegexp, proxy.HostnameReplacement
+}
+
+// tlsListener wraps each accepted connection with the proxy's current
+// TLS configuration, so reloaded certificates take effect for new
+// connections while established ones carry on undisturbed.
+type tlsListener struct {
+	net.Listener
+	proxy *Proxy
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.proxy.config().TLSConfig.Config), nil
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newReloadTestProxy(t *testing.T, c Config) *Proxy {
+	if c.HostnameMatch == "" {
+		c.HostnameMatch, c.HostnameReplacement = "^(.*)$", "$1"
+	}
+	proxy := &Proxy{Config: c, initialConfig: c}
+	require.NoError(t, proxy.load())
+	return proxy
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+}
+
+// writeTestCert writes a self-signed certificate with the given
+// serial number, and its key
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	writeTestFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+}
+
+func TestReloadNeedsConfigFile(t *testing.T) {
+	proxy := newReloadTestProxy(t, Config{})
+	require.Error(t, proxy.Reload())
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weaveproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "proxy.json")
+	writeTestFile(t, configFile, `{"hostname-match": "^aws-(.*)$", "hostname-replacement": "app-$1"}`)
+
+	proxy := newReloadTestProxy(t, Config{ConfigFile: configFile, NoDefaultIPAM: true})
+	match, replacement := proxy.hostnameMatch()
+	require.Equal(t, "^aws-(.*)$", match.String())
+	require.Equal(t, "app-$1", replacement)
+	require.True(t, proxy.config().NoDefaultIPAM, "settings not in the file keep their command-line values")
+
+	// a bad regexp leaves everything as it was
+	writeTestFile(t, configFile, `{"hostname-match": "(", "hostname-replacement": "other-$1", "rewrite-inspect": true}`)
+	require.Error(t, proxy.Reload())
+	match, replacement = proxy.hostnameMatch()
+	require.Equal(t, "^aws-(.*)$", match.String())
+	require.Equal(t, "app-$1", replacement)
+	require.False(t, proxy.config().RewriteInspect)
+
+	writeTestFile(t, configFile, `{"hostname-match": "^gce-(.*)$", "hostname-replacement": "other-$1", "rewrite-inspect": true}`)
+	require.NoError(t, proxy.Reload())
+	match, replacement = proxy.hostnameMatch()
+	require.Equal(t, "^gce-(.*)$", match.String())
+	require.Equal(t, "other-$1", replacement)
+	require.True(t, proxy.config().RewriteInspect)
+}
+
+func TestReloadCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weaveproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "proxy.json")
+	writeTestFile(t, configFile, `{}`)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	proxy := newReloadTestProxy(t, Config{ConfigFile: configFile,
+		TLSConfig: TLSConfig{Enabled: true, Cert: certFile, Key: keyFile}})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	tlsListener := &tlsListener{listener, proxy}
+	go func() {
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	// the serial number of the certificate a new connection gets
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	require.Equal(t, int64(1), serial())
+
+	// bad certificates leave the old ones in place
+	writeTestFile(t, certFile, "not a certificate")
+	require.Error(t, proxy.Reload())
+	require.Equal(t, int64(1), serial())
+
+	writeTestCert(t, certFile, keyFile, 2)
+	require.NoError(t, proxy.Reload())
+	require.Equal(t, int64(2), serial())
+}
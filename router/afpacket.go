@@ -0,0 +1,355 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// AFPacket is a Bridge that captures frames through AF_PACKET
+// sockets with TPACKET_V3 receive rings, which the kernel fills a
+// block of frames at a time, so that one poll can be followed by
+// many frames without further system calls.  With fanout, several
+// sockets share the capturing, the kernel spreading frames across
+// them by flow, each with its own goroutine.  Injected frames are
+// written in batches with sendmmsg.
+
+const (
+	afPacketFrameSize = 1 << 16
+	// a multiple of both the page size and the frame size
+	afPacketBlockSize = 1 << 20
+	// milliseconds the kernel may hold on to a partly filled block
+	afPacketBlockTimeout = 1
+	// the most frames written with one system call
+	afPacketWriteBatch = 64
+)
+
+// From linux/if_packet.h
+const (
+	packetVersion          = 10
+	packetFanout           = 18
+	packetFanoutHash       = 0
+	packetFanoutFlagDefrag = 0x8000
+	tpacketV3              = 2
+	tpStatusKernel         = 0
+	tpStatusUser           = 1
+)
+
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+type tpacketStatsV3 struct {
+	packets    uint32
+	drops      uint32
+	freezeQCnt uint32
+}
+
+// Only capture frames coming into the bridge, which excludes those
+// we inject ("inbound" in tcpdump's terms)
+var inboundFilter = []syscall.SockFilter{
+	{Code: 0x28, K: 0xfffff004},                     // ldh [pkttype]
+	{Code: 0x15, Jt: 1, K: syscall.PACKET_OUTGOING}, // jeq #outgoing, drop
+	{Code: 0x06, K: 0x40000},                        // ret #262144
+	{Code: 0x06, K: 0},                              // drop: ret #0
+}
+
+var afPacketFanoutGroups uint32
+
+type AFPacket struct {
+	NonDiscardingFlowOp
+
+	iface     *net.Interface
+	bufSz     int
+	fanout    int
+	writeFd   int
+	writeChan chan<- []byte
+
+	mutex sync.Mutex
+	rings []*afPacketRing
+	stats tpacketStatsV3 // accumulated, since reading them resets them
+}
+
+func NewAFPacket(iface *net.Interface, bufSz int, fanout int) (Bridge, error) {
+	if fanout < 1 {
+		return nil, fmt.Errorf("AF_PACKET fanout must be at least 1")
+	}
+
+	// Protocol 0 means this socket receives nothing
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Ifindex: iface.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	writeChan := make(chan []byte, afPacketWriteBatch)
+	p := &AFPacket{iface: iface, bufSz: bufSz, fanout: fanout, writeFd: fd, writeChan: writeChan}
+	go p.write(writeChan)
+	return p, nil
+}
+
+func (p *AFPacket) StartConsumingPackets(consumer BridgeConsumer) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.rings != nil {
+		panic("already consuming")
+	}
+
+	// The fanout group id only has to be unique among the sockets
+	// on this host
+	group := uint32(os.Getpid()+int(atomic.AddUint32(&afPacketFanoutGroups, 1))) & 0xffff
+	// The flags take the top bit, so the option only fits an int
+	// as an int32
+	fanoutArg := int(int32(group | (packetFanoutHash|packetFanoutFlagDefrag)<<16))
+	for i := 0; i < p.fanout; i++ {
+		ring, err := newAFPacketRing(p.iface, p.bufSz/p.fanout)
+		if err == nil && p.fanout > 1 {
+			err = syscall.SetsockoptInt(ring.fd, syscall.SOL_PACKET, packetFanout, fanoutArg)
+		}
+		if err != nil {
+			for _, ring := range p.rings {
+				ring.close()
+			}
+			p.rings = nil
+			return err
+		}
+		p.rings = append(p.rings, ring)
+	}
+
+	for _, ring := range p.rings {
+		go ring.sniff(consumer)
+	}
+	return nil
+}
+
+func (p *AFPacket) Interface() *net.Interface {
+	return p.iface
+}
+
+func (p *AFPacket) String() string {
+	return fmt.Sprint(p.iface.Name, " (via AF_PACKET)")
+}
+
+func (p *AFPacket) InjectPacket(PacketKey) FlowOp {
+	return p
+}
+
+func (p *AFPacket) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	// The frame is written asynchronously, and our caller may
+	// reuse it
+	frameCopy := make([]byte, len(frame))
+	copy(frameCopy, frame)
+	p.writeChan <- frameCopy
+}
+
+func (p *AFPacket) write(writeChan <-chan []byte) {
+	frames := make([][]byte, 0, afPacketWriteBatch)
+	for frame := range writeChan {
+		frames = append(frames[:0], frame)
+	batch:
+		for len(frames) < afPacketWriteBatch {
+			select {
+			case frame := <-writeChan:
+				frames = append(frames, frame)
+			default:
+				break batch
+			}
+		}
+		// On error, skip the frame that failed and carry on with
+		// the rest
+		for pending := frames; len(pending) > 0; {
+			sent, err := sendmmsg(p.writeFd, pending, nil, nil)
+			if err == nil {
+				break
+			}
+			checkWarn(err)
+			pending = pending[sent+1:]
+		}
+	}
+}
+
+func (p *AFPacket) Stats() map[string]int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.rings == nil {
+		return nil
+	}
+	for _, ring := range p.rings {
+		stats, err := ring.stats()
+		if err != nil {
+			return nil
+		}
+		p.stats.packets += stats.packets
+		p.stats.drops += stats.drops
+		p.stats.freezeQCnt += stats.freezeQCnt
+	}
+	return map[string]int{
+		"PacketsReceived": int(p.stats.packets),
+		"PacketsDropped":  int(p.stats.drops),
+		"QueueFreezes":    int(p.stats.freezeQCnt),
+	}
+}
+
+type afPacketRing struct {
+	fd        int
+	buf       []byte
+	numBlocks int
+}
+
+func newAFPacketRing(iface *net.Interface, bufSz int) (*afPacketRing, error) {
+	// We don't give a protocol until we bind, so that we don't
+	// receive frames from other interfaces in the meantime
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	ring := &afPacketRing{fd: fd, numBlocks: bufSz / afPacketBlockSize}
+	if ring.numBlocks < 2 {
+		ring.numBlocks = 2
+	}
+	if err := ring.setup(iface); err != nil {
+		ring.close()
+		return nil, err
+	}
+	return ring, nil
+}
+
+func (ring *afPacketRing) setup(iface *net.Interface) error {
+	if err := syscall.SetsockoptInt(ring.fd, syscall.SOL_PACKET, packetVersion, tpacketV3); err != nil {
+		return err
+	}
+	if err := syscall.AttachLsf(ring.fd, inboundFilter); err != nil {
+		return err
+	}
+
+	req := tpacketReq3{
+		blockSize:    afPacketBlockSize,
+		blockNr:      uint32(ring.numBlocks),
+		frameSize:    afPacketFrameSize,
+		frameNr:      uint32(ring.numBlocks * afPacketBlockSize / afPacketFrameSize),
+		retireBlkTov: afPacketBlockTimeout,
+	}
+	// The syscall package can only set struct options given as a
+	// string, and on some architectures (e.g. 386) setsockopt is
+	// not a system call of its own to make directly
+	reqBytes := (*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))[:]
+	if err := syscall.SetsockoptString(ring.fd, syscall.SOL_PACKET, syscall.PACKET_RX_RING, string(reqBytes)); err != nil {
+		return err
+	}
+
+	buf, err := syscall.Mmap(ring.fd, 0, ring.numBlocks*afPacketBlockSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	ring.buf = buf
+
+	return syscall.Bind(ring.fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  iface.Index,
+	})
+}
+
+func (ring *afPacketRing) close() {
+	if ring.buf != nil {
+		checkWarn(syscall.Munmap(ring.buf))
+	}
+	checkWarn(syscall.Close(ring.fd))
+}
+
+func htons(x uint16) uint16 {
+	return x<<8 | x>>8
+}
+
+// Field accessors for struct tpacket_block_desc and struct
+// tpacket3_hdr, which are in native byte order
+func nativeUint32(buf []byte, offset int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&buf[offset]))
+}
+
+func nativeUint16(buf []byte, offset int) uint16 {
+	return *(*uint16)(unsafe.Pointer(&buf[offset]))
+}
+
+func (ring *afPacketRing) sniff(consumer BridgeConsumer) {
+	dec := NewEthernetDecoder()
+
+	for block := 0; ; block = (block + 1) % ring.numBlocks {
+		desc := ring.buf[block*afPacketBlockSize : (block+1)*afPacketBlockSize]
+		status := nativeUint32(desc, 8)
+		for atomic.LoadUint32(status)&tpStatusUser == 0 {
+			checkFatal(ring.poll())
+		}
+
+		numPkts := int(*nativeUint32(desc, 12))
+		offset := int(*nativeUint32(desc, 16))
+		for i := 0; i < numPkts; i++ {
+			hdr := desc[offset:]
+			snapLen := int(*nativeUint32(hdr, 12))
+			mac := int(nativeUint16(hdr, 24))
+			ring.handleFrame(hdr[mac:mac+snapLen], dec, consumer)
+			offset += int(*nativeUint32(hdr, 0))
+		}
+
+		// hand the block back to the kernel
+		atomic.StoreUint32(status, tpStatusKernel)
+	}
+}
+
+func (ring *afPacketRing) handleFrame(frame []byte, dec *EthernetDecoder, consumer BridgeConsumer) {
+	dec.DecodeLayers(frame)
+	if len(dec.decoded) == 0 {
+		return
+	}
+
+	if fop := consumer(dec.PacketKey()); !fop.Discards() {
+		// We are handing over the frame to forwarders, so we
+		// need to make a copy of it, as the kernel will reuse
+		// the block once we are done with it
+		frameCopy := make([]byte, len(frame))
+		copy(frameCopy, frame)
+		fop.Process(frameCopy, dec, false)
+	}
+}
+
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+const (
+	pollIn  = 0x1
+	pollErr = 0x8
+)
+
+// Wait for the kernel to hand us a block
+func (ring *afPacketRing) poll() error {
+	fds := pollFd{fd: int32(ring.fd), events: pollIn | pollErr}
+	_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds)), 1, 0, 0, 0, 0)
+	if errno != 0 && errno != syscall.EINTR {
+		return errno
+	}
+	return nil
+}
+
+func (ring *afPacketRing) stats() (tpacketStatsV3, error) {
+	var stats tpacketStatsV3
+	size := uint32(unsafe.Sizeof(stats))
+	err := getsockopt(ring.fd, syscall.SOL_PACKET, syscall.PACKET_STATISTICS, unsafe.Pointer(&stats), &size)
+	return stats, err
+}
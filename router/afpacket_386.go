@@ -0,0 +1,17 @@
+package router
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// On 386, the socket calls all go through socketcall(2)
+const socketcallGetsockopt = 15
+
+func getsockopt(fd, level, opt int, val unsafe.Pointer, vallen *uint32) error {
+	args := [5]uintptr{uintptr(fd), uintptr(level), uintptr(opt), uintptr(val), uintptr(unsafe.Pointer(vallen))}
+	if _, _, errno := syscall.Syscall(syscall.SYS_SOCKETCALL, socketcallGetsockopt, uintptr(unsafe.Pointer(&args)), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
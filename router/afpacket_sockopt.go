@@ -0,0 +1,16 @@
+// +build !386
+
+package router
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func getsockopt(fd, level, opt int, val unsafe.Pointer, vallen *uint32) error {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(val), uintptr(unsafe.Pointer(vallen)), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// ARP suppression
+//
+// Every peer learns the MACs of its local containers' IPv4 addresses
+// from the ARP requests and announcements they broadcast, and gossips
+// these bindings to the other peers.  Since containers can put
+// whatever they like in their ARP packets, only addresses that IPAM
+// or the nameserver say are given to local containers are learnt.  When a local container asks
+// for an address bound to a MAC on another peer, we answer the
+// request ourselves rather than flooding it to every peer.  Requests
+// for addresses on this peer are not flooded either, since the
+// bridge has already delivered them locally.
+//
+// Whenever there is any doubt - an address claimed by more than one
+// peer or local MAC, or a MAC we don't know to be at the peer
+// claiming it - the request is flooded as before.
+//
+// Only ARP frames are looked at.  Fast datapath cannot make flows for
+// them, since we must see each one, but other broadcasts get flows as
+// before.  A flow for the broadcasts from a MAC catches its ARP
+// requests too, so these are flooded by the kernel until it expires.
+
+var broadcastMAC = MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// The bindings of one peer, which are only ever changed by that peer
+// and are replaced wholesale when they change
+type peerBindings struct {
+	Version  int64 // from the owner's clock; only compared with itself
+	Bindings map[address.Address]MAC
+}
+
+type arpGossipData map[mesh.PeerName]*peerBindings
+
+func (g arpGossipData) Merge(other mesh.GossipData) mesh.GossipData {
+	result := arpGossipData{}
+	for name, bindings := range g {
+		result[name] = bindings
+	}
+	result.merge(other.(arpGossipData), mesh.UnknownPeerName)
+	return result
+}
+
+// merge in newer bindings, except those of ourName, returning what
+// was new
+func (g arpGossipData) merge(other arpGossipData, ourName mesh.PeerName) arpGossipData {
+	updated := arpGossipData{}
+	for name, bindings := range other {
+		if name == ourName {
+			continue
+		}
+		if existing, found := g[name]; !found || existing.Version < bindings.Version {
+			g[name] = bindings
+			updated[name] = bindings
+		}
+	}
+	return updated
+}
+
+func (g arpGossipData) Encode() [][]byte {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(g); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+type arpSuppressor struct {
+	sync.Mutex
+	router     *NetworkRouter
+	ourName    mesh.PeerName
+	gossip     mesh.Gossip
+	bindings   arpGossipData
+	local      map[string]map[address.Address]struct{} // by source
+	disputed   map[address.Address][2]MAC              // local IPs claimed by two local MACs
+	answered   int
+	suppressed int
+	flooded    int
+}
+
+func newARPSuppressor(router *NetworkRouter, ourName mesh.PeerName) *arpSuppressor {
+	return &arpSuppressor{
+		router:   router,
+		ourName:  ourName,
+		bindings: arpGossipData{ourName: &peerBindings{Version: time.Now().UnixNano()}},
+		local:    make(map[string]map[address.Address]struct{}),
+		disputed: make(map[address.Address][2]MAC),
+	}
+}
+
+// Update our own bindings with f, called with the lock held, and
+// broadcast them if f reports a change
+func (arp *arpSuppressor) update(f func(map[address.Address]MAC) bool) {
+	arp.Lock()
+	ours := arp.bindings[arp.ourName]
+	bindings := make(map[address.Address]MAC, len(ours.Bindings))
+	for ip, mac := range ours.Bindings {
+		bindings[ip] = mac
+	}
+	if !f(bindings) {
+		arp.Unlock()
+		return
+	}
+	version := time.Now().UnixNano()
+	if version <= ours.Version {
+		version = ours.Version + 1
+	}
+	ours = &peerBindings{Version: version, Bindings: bindings}
+	arp.bindings[arp.ourName] = ours
+	arp.Unlock()
+
+	if arp.gossip != nil {
+		arp.gossip.GossipBroadcast(arpGossipData{arp.ourName: ours})
+	}
+}
+
+// setLocalAddresses replaces the addresses a source, e.g. IPAM, says
+// are given to local containers.  The sources push them to us, since
+// learning happens on the capture path, which mustn't wait on them.
+func (arp *arpSuppressor) setLocalAddresses(source string, addrs []address.Address) {
+	set := make(map[address.Address]struct{}, len(addrs))
+	for _, addr := range addrs {
+		set[addr] = struct{}{}
+	}
+	arp.Lock()
+	defer arp.Unlock()
+	arp.local[source] = set
+}
+
+func (arp *arpSuppressor) isLocalAddress(ip address.Address) bool {
+	arp.Lock()
+	defer arp.Unlock()
+	for _, set := range arp.local {
+		if _, found := set[ip]; found {
+			return true
+		}
+	}
+	return false
+}
+
+func (arp *arpSuppressor) learn(ip address.Address, mac MAC) {
+	arp.Lock()
+	existing, found := arp.bindings[arp.ourName].Bindings[ip]
+	arp.Unlock()
+	if found && existing == mac {
+		return
+	}
+	if !arp.isLocalAddress(ip) {
+		return
+	}
+	ourself := arp.router.Ourself.Peer
+	arp.update(func(bindings map[address.Address]MAC) bool {
+		existing, found := bindings[ip]
+		switch _, disputed := arp.disputed[ip]; {
+		case disputed || found && existing == mac:
+			return false
+		case found && arp.router.Macs.Lookup(net.HardwareAddr(existing[:])) == ourself:
+			// another local MAC still claims it, so we can't
+			// tell which is right until one of them goes
+			log.Println("Local IP", ip, "claimed by both", existing, "and", mac)
+			arp.disputed[ip] = [2]MAC{existing, mac}
+			delete(bindings, ip)
+			return true
+		}
+		log.Println("Discovered local IP", ip, "at", mac)
+		bindings[ip] = mac
+		return true
+	})
+}
+
+// forget the bindings of a local MAC we haven't seen for a while
+func (arp *arpSuppressor) forget(mac MAC) {
+	arp.update(func(bindings map[address.Address]MAC) bool {
+		for ip, macs := range arp.disputed {
+			if macs[0] == mac || macs[1] == mac {
+				delete(arp.disputed, ip)
+			}
+		}
+		changed := false
+		for ip, boundMAC := range bindings {
+			if boundMAC == mac {
+				delete(bindings, ip)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+func (arp *arpSuppressor) peerGone(name mesh.PeerName) {
+	arp.Lock()
+	delete(arp.bindings, name)
+	arp.Unlock()
+}
+
+// lookup returns the MAC bound to ip, and the peer that claims it,
+// provided no other peer claims ip
+func (arp *arpSuppressor) lookup(ip address.Address) (MAC, mesh.PeerName, bool) {
+	arp.Lock()
+	defer arp.Unlock()
+	var (
+		mac   MAC
+		owner mesh.PeerName
+		found bool
+	)
+	for name, bindings := range arp.bindings {
+		if boundMAC, ok := bindings.Bindings[ip]; ok {
+			if found {
+				return MAC{}, mesh.UnknownPeerName, false
+			}
+			mac, owner, found = boundMAC, name, true
+		}
+	}
+	return mac, owner, found
+}
+
+func (arp *arpSuppressor) count(counter *int) {
+	arp.Lock()
+	(*counter)++
+	arp.Unlock()
+}
+
+// handle a broadcast frame captured from the local bridge, returning
+// true if it need not be flooded to other peers
+func (arp *arpSuppressor) handle(dec *EthernetDecoder) bool {
+	if dec.Eth.EthernetType != layers.EthernetTypeARP {
+		return false
+	}
+	var request layers.ARP
+	if err := request.DecodeFromBytes(dec.Eth.Payload, gopacket.NilDecodeFeedback); err != nil ||
+		request.AddrType != layers.LinkTypeEthernet || request.Protocol != layers.EthernetTypeIPv4 ||
+		request.HwAddressSize != 6 || request.ProtAddressSize != 4 {
+		return false
+	}
+
+	var senderMAC MAC
+	copy(senderMAC[:], request.SourceHwAddress)
+	senderIP := address.FromIP4(request.SourceProtAddress)
+	targetIP := address.FromIP4(request.DstProtAddress)
+	ourself := arp.router.Ourself.Peer
+
+	if senderIP != 0 && bytes.Equal(request.SourceHwAddress, dec.Eth.SrcMAC) &&
+		arp.router.Macs.Lookup(request.SourceHwAddress) == ourself {
+		arp.learn(senderIP, senderMAC)
+	}
+
+	// Announcements and probes are for everyone to hear
+	if request.Operation != layers.ARPRequest || senderIP == 0 || senderIP == targetIP {
+		return false
+	}
+
+	mac, owner, found := arp.lookup(targetIP)
+	if !found {
+		arp.count(&arp.flooded)
+		return false
+	}
+	switch peer := arp.router.Macs.Lookup(net.HardwareAddr(mac[:])); {
+	case peer == nil || peer.Name != owner:
+		arp.count(&arp.flooded)
+		return false
+	case peer == ourself:
+		arp.count(&arp.suppressed)
+		return true
+	}
+
+	reply, err := makeARPReply(&request, mac)
+	if err != nil {
+		log.Error("Unable to construct ARP reply: ", err)
+		arp.count(&arp.flooded)
+		return false
+	}
+	arp.router.PacketLogging.LogPacket("Answering ARP", PacketKey{SrcMAC: mac, DstMAC: senderMAC})
+	if fop := arp.router.Bridge.InjectPacket(PacketKey{SrcMAC: mac, DstMAC: senderMAC}); fop != nil {
+		// dec belongs to the request, which our caller may
+		// still be processing, so the reply gets its own
+		replyDec := NewEthernetDecoder()
+		replyDec.DecodeLayers(reply)
+		fop.Process(reply, replyDec, false)
+	}
+	arp.Lock()
+	arp.answered++
+	arp.suppressed++
+	arp.Unlock()
+	return true
+}
+
+func makeARPReply(request *layers.ARP, mac MAC) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       mac[:],
+			DstMAC:       request.SourceHwAddress,
+			EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   mac[:],
+			SourceProtAddress: request.DstProtAddress,
+			DstHwAddress:      request.SourceHwAddress,
+			DstProtAddress:    request.SourceProtAddress})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// An arpFlowOp looks at captured ARP broadcasts before flooding them
+type arpFlowOp struct {
+	NonDiscardingFlowOp
+	arp   *arpSuppressor
+	flood FlowOp
+}
+
+// Other broadcasts are just flooded
+func (op arpFlowOp) forFrame(frame []byte) FlowOp {
+	if isARP(frame) {
+		return nil
+	}
+	return op.flood
+}
+
+func isARP(frame []byte) bool {
+	return len(frame) >= 14 && layers.EthernetType(binary.BigEndian.Uint16(frame[12:14])) == layers.EthernetTypeARP
+}
+
+func (op arpFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	if !op.arp.handle(dec) {
+		op.flood.Process(frame, dec, broadcast)
+	}
+}
+
+// mesh.Gossiper implementation
+
+func (arp *arpSuppressor) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+func (arp *arpSuppressor) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	return arp.receive(msg)
+}
+
+func (arp *arpSuppressor) Gossip() mesh.GossipData {
+	arp.Lock()
+	defer arp.Unlock()
+	result := arpGossipData{}
+	for name, bindings := range arp.bindings {
+		result[name] = bindings
+	}
+	return result
+}
+
+func (arp *arpSuppressor) OnGossip(msg []byte) (mesh.GossipData, error) {
+	return arp.receive(msg)
+}
+
+func (arp *arpSuppressor) receive(msg []byte) (mesh.GossipData, error) {
+	var gossip arpGossipData
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&gossip); err != nil {
+		return nil, err
+	}
+	arp.Lock()
+	updated := arp.bindings.merge(gossip, arp.ourName)
+	arp.Unlock()
+	if len(updated) == 0 {
+		return nil, nil
+	}
+	return updated, nil
+}
+
+type ARPStatus struct {
+	Bindings   int
+	Answered   int
+	Suppressed int
+	Flooded    int
+}
+
+func NewARPStatus(arp *arpSuppressor) ARPStatus {
+	arp.Lock()
+	defer arp.Unlock()
+	count := 0
+	for _, bindings := range arp.bindings {
+		count += len(bindings.Bindings)
+	}
+	return ARPStatus{count, arp.answered, arp.suppressed, arp.flooded}
+}
@@ -0,0 +1,197 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+var (
+	arpTestLocalMAC  = MAC{0x02, 0, 0, 0, 0, 1}
+	arpTestOtherMAC  = MAC{0x02, 0, 0, 0, 0, 2}
+	arpTestRemoteMAC = MAC{0x02, 0, 0, 0, 0, 3}
+	arpTestLocalIP   = net.IPv4(10, 32, 0, 1).To4()
+	arpTestRemoteIP  = net.IPv4(10, 40, 0, 1).To4()
+)
+
+type nopPacketLogging struct{}
+
+func (nopPacketLogging) LogPacket(string, PacketKey)               {}
+func (nopPacketLogging) LogForwardPacket(string, ForwardPacketKey) {}
+
+// A bridge that keeps the frames injected into it
+type capturingBridge struct {
+	NullBridge
+	frames [][]byte
+}
+
+func (bridge *capturingBridge) InjectPacket(PacketKey) FlowOp {
+	return capturingFlowOp{bridge}
+}
+
+type capturingFlowOp struct {
+	bridge *capturingBridge
+}
+
+func (op capturingFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	op.bridge.frames = append(op.bridge.frames, frame)
+}
+
+func (capturingFlowOp) Discards() bool { return false }
+
+func newARPTestSuppressor(localIPs ...net.IP) (*arpSuppressor, *capturingBridge) {
+	ourself := &mesh.Peer{Name: 1}
+	bridge := &capturingBridge{}
+	router := &NetworkRouter{
+		Router:        &mesh.Router{Ourself: &mesh.LocalPeer{Peer: ourself}},
+		Macs:          NewMacCache(time.Minute, nil),
+		PacketLogging: nopPacketLogging{},
+		Bridge:        bridge,
+	}
+	router.Macs.Add(net.HardwareAddr(arpTestLocalMAC[:]), ourself)
+	router.Macs.Add(net.HardwareAddr(arpTestOtherMAC[:]), ourself)
+	arp := newARPSuppressor(router, ourself.Name)
+	var addrs []address.Address
+	for _, local := range localIPs {
+		addrs = append(addrs, address.FromIP4(local))
+	}
+	arp.setLocalAddresses("test", addrs)
+	return arp, bridge
+}
+
+func arpFrame(t *testing.T, op uint16, srcMAC MAC, srcIP, dstIP net.IP) (*EthernetDecoder, []byte) {
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{
+			SrcMAC:       srcMAC[:],
+			DstMAC:       broadcastMAC[:],
+			EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         op,
+			SourceHwAddress:   srcMAC[:],
+			SourceProtAddress: srcIP,
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    dstIP}))
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(buf.Bytes())
+	return dec, buf.Bytes()
+}
+
+func arpRequest(t *testing.T, srcMAC MAC, srcIP, dstIP net.IP) *EthernetDecoder {
+	dec, _ := arpFrame(t, layers.ARPRequest, srcMAC, srcIP, dstIP)
+	return dec
+}
+
+func (arp *arpSuppressor) localBinding(ip net.IP) (MAC, bool) {
+	arp.Lock()
+	defer arp.Unlock()
+	mac, found := arp.bindings[arp.ourName].Bindings[address.FromIP4(ip)]
+	return mac, found
+}
+
+func TestARPLearnsOnlyLocalAddresses(t *testing.T) {
+	arp, _ := newARPTestSuppressor()
+	arp.handle(arpRequest(t, arpTestLocalMAC, arpTestLocalIP, arpTestRemoteIP))
+	_, found := arp.localBinding(arpTestLocalIP)
+	require.False(t, found, "nothing says the address is local")
+
+	arp, _ = newARPTestSuppressor(arpTestLocalIP)
+	arp.handle(arpRequest(t, arpTestLocalMAC, arpTestLocalIP, arpTestRemoteIP))
+	mac, found := arp.localBinding(arpTestLocalIP)
+	require.True(t, found)
+	require.Equal(t, arpTestLocalMAC, mac)
+
+	// a container claiming an address that isn't its
+	spoofed := net.IPv4(10, 32, 0, 9).To4()
+	arp.handle(arpRequest(t, arpTestOtherMAC, spoofed, arpTestRemoteIP))
+	_, found = arp.localBinding(spoofed)
+	require.False(t, found)
+}
+
+func TestARPDisputedAddress(t *testing.T) {
+	arp, _ := newARPTestSuppressor(arpTestLocalIP)
+	arp.handle(arpRequest(t, arpTestLocalMAC, arpTestLocalIP, arpTestRemoteIP))
+	arp.handle(arpRequest(t, arpTestOtherMAC, arpTestLocalIP, arpTestRemoteIP))
+	_, found := arp.localBinding(arpTestLocalIP)
+	require.False(t, found, "two local MACs claim the address")
+	arp.handle(arpRequest(t, arpTestLocalMAC, arpTestLocalIP, arpTestRemoteIP))
+	_, found = arp.localBinding(arpTestLocalIP)
+	require.False(t, found, "still disputed")
+
+	// once one of them has gone, the other gets it
+	arp.forget(arpTestOtherMAC)
+	arp.handle(arpRequest(t, arpTestLocalMAC, arpTestLocalIP, arpTestRemoteIP))
+	mac, found := arp.localBinding(arpTestLocalIP)
+	require.True(t, found)
+	require.Equal(t, arpTestLocalMAC, mac)
+}
+
+func TestARPAnswersFromGossip(t *testing.T) {
+	arp, bridge := newARPTestSuppressor(arpTestLocalIP)
+	remote := &mesh.Peer{Name: 2}
+	arp.router.Macs.Add(net.HardwareAddr(arpTestRemoteMAC[:]), remote)
+	_, err := arp.receive(arpGossipData{remote.Name: &peerBindings{
+		Version:  1,
+		Bindings: map[address.Address]MAC{address.FromIP4(arpTestRemoteIP): arpTestRemoteMAC},
+	}}.Encode()[0])
+	require.NoError(t, err)
+
+	require.True(t, arp.handle(arpRequest(t, arpTestLocalMAC, arpTestLocalIP, arpTestRemoteIP)))
+	require.Len(t, bridge.frames, 1)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(bridge.frames[0])
+	var reply layers.ARP
+	require.NoError(t, reply.DecodeFromBytes(dec.Eth.Payload, gopacket.NilDecodeFeedback))
+	require.Equal(t, uint16(layers.ARPReply), reply.Operation)
+	require.Equal(t, arpTestRemoteMAC[:], []byte(reply.SourceHwAddress))
+	require.Equal(t, []byte(arpTestRemoteIP), []byte(reply.SourceProtAddress))
+	require.Equal(t, arpTestLocalMAC[:], []byte(reply.DstHwAddress))
+
+	// an address nobody has claimed is flooded
+	require.False(t, arp.handle(arpRequest(t, arpTestLocalMAC, arpTestLocalIP, net.IPv4(10, 40, 0, 2).To4())))
+	// as is one claimed by a MAC we don't know to be at the peer
+	arp.router.Macs.Delete(remote)
+	require.False(t, arp.handle(arpRequest(t, arpTestLocalMAC, arpTestLocalIP, arpTestRemoteIP)))
+	// announcements are for everyone to hear
+	dec, _ = arpFrame(t, layers.ARPReply, arpTestLocalMAC, arpTestLocalIP, arpTestLocalIP)
+	require.False(t, arp.handle(dec))
+
+	status := NewARPStatus(arp)
+	require.Equal(t, ARPStatus{Bindings: 2, Answered: 1, Suppressed: 1, Flooded: 2}, status)
+}
+
+func TestARPGossipMerge(t *testing.T) {
+	ours := arpGossipData{1: &peerBindings{Version: 5}, 2: &peerBindings{Version: 5}}
+	updated := ours.merge(arpGossipData{
+		1: &peerBindings{Version: 9},
+		2: &peerBindings{Version: 4},
+		3: &peerBindings{Version: 1},
+	}, 1)
+	require.Equal(t, arpGossipData{3: &peerBindings{Version: 1}}, updated)
+	require.Equal(t, int64(5), ours[1].Version, "nobody else changes our bindings")
+	require.Equal(t, int64(5), ours[2].Version, "older bindings are ignored")
+}
+
+func TestARPFlowOpOnlyTakesARP(t *testing.T) {
+	arp, _ := newARPTestSuppressor()
+	flood := &recordingFlowOp{}
+	op := arpFlowOp{arp: arp, flood: flood}
+	_, arpBytes := arpFrame(t, layers.ARPRequest, arpTestLocalMAC, arpTestLocalIP, arpTestRemoteIP)
+	require.Equal(t, []FlowOp{op}, FlattenFlowOpFor(op, arpBytes))
+
+	ipBytes := make([]byte, len(arpBytes))
+	copy(ipBytes, arpBytes)
+	ipBytes[12], ipBytes[13] = 0x08, 0x00
+	require.Equal(t, []FlowOp{flood}, FlattenFlowOpFor(NewMultiFlowOp(true, op), ipBytes))
+}
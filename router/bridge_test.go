@@ -0,0 +1,174 @@
+package router
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Benchmarks comparing how fast the bridges capture frames.  They
+// need to be run as root, since each bridge gets a veth pair of its
+// own, e.g.
+//
+//     sudo go test -run XXX -bench Capture ./router
+//
+// The bridges can't be shut down, so each veth pair is kept for all
+// the runs of its benchmark, and deleted once they are all done.
+
+const (
+	// Frames sent but not yet captured, kept below what the
+	// capture buffers hold, so that none are dropped
+	benchWindow = 4096
+	benchBufSz  = 8 * 1024 * 1024
+)
+
+var benchSrcMAC = MAC{0x02, 0, 0, 0, 0, 1}
+
+func BenchmarkCapturePcap(b *testing.B) {
+	benchmarkCapture(b, "vethwbpcap", func(iface *net.Interface) (Bridge, error) {
+		return NewPcap(iface, benchBufSz)
+	})
+}
+
+func BenchmarkCaptureAFPacket(b *testing.B) {
+	benchmarkCapture(b, "vethwbafp", func(iface *net.Interface) (Bridge, error) {
+		return NewAFPacket(iface, benchBufSz, 1)
+	})
+}
+
+func BenchmarkCaptureAFPacketFanout(b *testing.B) {
+	benchmarkCapture(b, "vethwbfanout", func(iface *net.Interface) (Bridge, error) {
+		return NewAFPacket(iface, benchBufSz, runtime.NumCPU())
+	})
+}
+
+type captureBench struct {
+	fd       int
+	received int64
+}
+
+var captureBenches = make(map[string]*captureBench)
+
+func TestMain(m *testing.M) {
+	os.Exit(func() int {
+		defer deleteCaptureBenchVeths()
+		return m.Run()
+	}())
+}
+
+func deleteCaptureBenchVeths() {
+	for vethName := range captureBenches {
+		// Deleting one end of a veth pair deletes the other
+		if link, err := netlink.LinkByName(vethName); err == nil {
+			netlink.LinkDel(link)
+		}
+	}
+}
+
+func benchmarkCapture(b *testing.B, vethName string, newBridge func(*net.Interface) (Bridge, error)) {
+	if os.Getuid() != 0 {
+		b.Skip("must be run as root")
+	}
+
+	bench, found := captureBenches[vethName]
+	if !found {
+		bench = newCaptureBench(b, vethName, newBridge)
+		captureBenches[vethName] = bench
+	}
+
+	// A UDP/IPv4 frame, which the bridges decode in full
+	frame := make([]byte, 14+20+8+1000)
+	copy(frame, []byte{0x02, 0, 0, 0, 0, 2})
+	copy(frame[6:], benchSrcMAC[:])
+	frame[12], frame[13] = 0x08, 0x00
+	frame[14], frame[23] = 0x45, syscall.IPPROTO_UDP
+	ipLen := len(frame) - 14
+	frame[16], frame[17] = byte(ipLen>>8), byte(ipLen)
+	batch := make([][]byte, afPacketWriteBatch)
+	for i := range batch {
+		batch[i] = frame
+	}
+
+	atomic.StoreInt64(&bench.received, 0)
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += len(batch) {
+		deadline := time.Now().Add(time.Second)
+		for int64(sent)-atomic.LoadInt64(&bench.received) > benchWindow {
+			if time.Now().After(deadline) {
+				b.Fatalf("frames lost: captured %d of %d", atomic.LoadInt64(&bench.received), sent)
+			}
+			runtime.Gosched()
+		}
+		if b.N-sent < len(batch) {
+			batch = batch[:b.N-sent]
+		}
+		if _, err := sendmmsg(bench.fd, batch, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&bench.received) < int64(b.N) {
+		if time.Now().After(deadline) {
+			b.Fatalf("frames lost: captured %d of %d", atomic.LoadInt64(&bench.received), b.N)
+		}
+		runtime.Gosched()
+	}
+}
+
+func newCaptureBench(b *testing.B, vethName string, newBridge func(*net.Interface) (Bridge, error)) *captureBench {
+	peerName := vethName + "p"
+	if _, err := net.InterfaceByName(vethName); err != nil {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: vethName}, PeerName: peerName}
+		if err := netlink.LinkAdd(veth); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, name := range []string{vethName, peerName} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	iface, err := net.InterfaceByName(vethName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bridge, err := newBridge(iface)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bench := &captureBench{}
+	err = bridge.StartConsumingPackets(func(key PacketKey) FlowOp {
+		if key.SrcMAC == benchSrcMAC {
+			atomic.AddInt64(&bench.received, 1)
+		}
+		return DiscardingFlowOp{}
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// We send the frames from the other end of the veth pair
+	peer, err := net.InterfaceByName(peerName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if bench.fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0); err != nil {
+		b.Fatal(err)
+	}
+	if err := syscall.Bind(bench.fd, &syscall.SockaddrLinklayer{Ifindex: peer.Index}); err != nil {
+		b.Fatal(err)
+	}
+	return bench
+}
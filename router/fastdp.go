@@ -60,7 +60,7 @@ type FastDatapath struct {
 	forwarders map[mesh.PeerName]*fastDatapathForwarder
 }
 
-func NewFastDatapath(iface *net.Interface, port int) (*FastDatapath, error) {
+func NewFastDatapath(iface *net.Interface, port int, classes *TrafficClasses) (*FastDatapath, error) {
 	dpif, err := odp.NewDpif()
 	if err != nil {
 		return nil, err
@@ -115,6 +115,14 @@ func NewFastDatapath(iface *net.Interface, port int) (*FastDatapath, error) {
 		return nil, err
 	}
 
+	// Traffic classes only apply to the main vxlan vport, which
+	// carries the traffic to all peers using the usual port
+	if classes != nil {
+		if _, err := newVxlanShaper(vxlanVportName(port+1), classes); err != nil {
+			return nil, err
+		}
+	}
+
 	// need to lock before we might receive events
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
@@ -417,7 +425,7 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 	}
 
 	vxlanVportID, err := fastdp.dp.CreateVport(
-		odp.NewVxlanVportSpec(fmt.Sprintf("vxlan-%d", udpPort), uint16(udpPort)))
+		odp.NewVxlanVportSpec(vxlanVportName(udpPort), uint16(udpPort)))
 	if err != nil {
 		return 0, err
 	}
@@ -469,6 +477,10 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 	return vxlanVportID, nil
 }
 
+func vxlanVportName(udpPort int) string {
+	return fmt.Sprintf("vxlan-%d", udpPort)
+}
+
 func (fastdp *FastDatapath) extractPeers(tunnelID [8]byte) (*mesh.Peer, *mesh.Peer) {
 	vni := binary.BigEndian.Uint64(tunnelID[:])
 	srcPeer := fastdp.peers.FetchByShortID(mesh.PeerShortID(vni & 0xfff))
@@ -508,6 +520,8 @@ type fastDatapathForwarder struct {
 	heartbeatTimer    *time.Timer
 	heartbeatTimeout  *time.Timer
 	ackedHeartbeat    bool
+	echoHeartbeats    bool
+	monitor           linkMonitor
 	stopChan          chan struct{}
 	stopped           bool
 
@@ -559,6 +573,7 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 		establishedChan: make(chan struct{}),
 		errorChan:       make(chan error, 1),
 	}
+	_, fwd.echoHeartbeats = params.Features[heartbeatEchoFeature]
 
 	return fwd, err
 }
@@ -671,6 +686,10 @@ func (fwd *fastDatapathForwarder) sendHeartbeat() {
 	}
 	fwd.lock.RUnlock()
 
+	if fwd.echoHeartbeats {
+		fwd.monitor.heartbeatSent()
+	}
+
 	if fop := fwd.Forward(pk); fop != nil {
 		fop.Process(buf, dec, false)
 	}
@@ -678,6 +697,7 @@ func (fwd *fastDatapathForwarder) sendHeartbeat() {
 
 const (
 	FastDatapathHeartbeatAck = iota
+	FastDatapathHeartbeatEcho
 )
 
 func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender *net.UDPAddr) {
@@ -713,6 +733,10 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender
 		fwd.handleError(fwd.sendControlMsg(FastDatapathHeartbeatAck, nil))
 	}
 
+	if fwd.echoHeartbeats {
+		fwd.handleError(fwd.sendControlMsg(FastDatapathHeartbeatEcho, nil))
+	}
+
 	// we can receive a heartbeat before Confirm() has set up
 	// heartbeatTimeout
 	if fwd.heartbeatTimeout != nil {
@@ -728,6 +752,9 @@ func (fwd *fastDatapathForwarder) ControlMessage(tag byte, msg []byte) {
 	case FastDatapathHeartbeatAck:
 		fwd.handleHeartbeatAck()
 
+	case FastDatapathHeartbeatEcho:
+		fwd.monitor.heartbeatEchoed()
+
 	default:
 		log.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
 	}
@@ -737,6 +764,18 @@ func (fwd *fastDatapathForwarder) DisplayName() string {
 	return "fastdp"
 }
 
+func (fwd *fastDatapathForwarder) LinkQuality() (LinkQuality, bool) {
+	return fwd.monitor.LinkQuality()
+}
+
+// Heartbeats are as large as the datapath MTU allows, so once one has
+// been acked, the link is known to carry packets of that size
+func (fwd *fastDatapathForwarder) PMTU() (int, bool) {
+	fwd.lock.RLock()
+	defer fwd.lock.RUnlock()
+	return fwd.fastdp.iface.MTU, fwd.heartbeatInterval == SlowHeartbeat
+}
+
 func (fwd *fastDatapathForwarder) handleHeartbeatAck() {
 	log.Debug(fwd.logPrefix(), "handleHeartbeatAck")
 
@@ -1060,7 +1099,7 @@ func (fastdp *FastDatapath) send(fops FlowOp, frame []byte, lock *fastDatapathLo
 	flow := odp.NewFlowSpec()
 	createFlow := true
 
-	for _, xfop := range FlattenFlowOp(fops) {
+	for _, xfop := range FlattenFlowOpFor(fops, frame) {
 		switch fop := xfop.(type) {
 		case interface {
 			updateFlowSpec(*odp.FlowSpec)
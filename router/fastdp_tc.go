@@ -0,0 +1,103 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// On fast datapath, the kernel forwards frames without them passing
+// through us, so traffic classes are implemented with tc(8) instead:
+// an HTB qdisc on the vxlan device, with an HTB class for each
+// traffic class, and u32 filters choosing between them by source
+// address and DSCP.  The priority of a class decides which gets to
+// use spare capacity first.
+
+const (
+	// What the HTB classes share; we don't know the capacity of
+	// the underlay network
+	tcLinkRate = 10 * 1000 * 1000 * 1000
+	// What each class without a rate limit is guaranteed
+	tcMinRate = 1000 * 1000
+	// Filters by source address come before those by DSCP, as in
+	// TrafficClasses.classify
+	tcSourcePriority = "1"
+	tcDSCPPriority   = "2"
+)
+
+type vxlanShaper struct {
+	sync.Mutex
+	dev     string
+	classes *TrafficClasses
+}
+
+func newVxlanShaper(dev string, classes *TrafficClasses) (*vxlanShaper, error) {
+	shaper := &vxlanShaper{dev: dev, classes: classes}
+	if err := shaper.setup(); err != nil {
+		return nil, err
+	}
+	classes.OnChange(func() { checkWarn(shaper.updateSources()) })
+	return shaper, nil
+}
+
+func tcClassMinor(class int) string {
+	return strconv.FormatInt(int64(class+0x10), 16)
+}
+
+func (shaper *vxlanShaper) setup() error {
+	dev := shaper.dev
+	if err := tc("qdisc", "add", "dev", dev, "root", "handle", "1:", "htb",
+		"default", tcClassMinor(shaper.classes.defaultClass)); err != nil {
+		return err
+	}
+	if err := tc("class", "add", "dev", dev, "parent", "1:", "classid", "1:1",
+		"htb", "rate", formatRate(tcLinkRate)); err != nil {
+		return err
+	}
+	for i, class := range shaper.classes.classes {
+		rate, ceil := uint64(tcMinRate), uint64(tcLinkRate)
+		if class.Rate != 0 {
+			rate, ceil = class.Rate, class.Rate
+		}
+		if err := tc("class", "add", "dev", dev, "parent", "1:1", "classid", "1:"+tcClassMinor(i),
+			"htb", "rate", formatRate(rate), "ceil", formatRate(ceil),
+			"prio", strconv.Itoa(class.Priority)); err != nil {
+			return err
+		}
+		for _, dscp := range class.DSCP {
+			if err := tc("filter", "add", "dev", dev, "parent", "1:", "protocol", "ip",
+				"prio", tcDSCPPriority, "u32", "match", "ip", "dsfield", fmt.Sprintf("%#x", dscp<<2), "0xfc",
+				"flowid", "1:"+tcClassMinor(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return shaper.updateSources()
+}
+
+// Replace the filters by source address with those for the current
+// classes of source addresses
+func (shaper *vxlanShaper) updateSources() error {
+	shaper.Lock()
+	defer shaper.Unlock()
+
+	// This fails when there are no such filters, which is fine
+	tc("filter", "del", "dev", shaper.dev, "parent", "1:", "protocol", "ip", "prio", tcSourcePriority)
+	for src, class := range shaper.classes.sources() {
+		if err := tc("filter", "add", "dev", shaper.dev, "parent", "1:", "protocol", "ip",
+			"prio", tcSourcePriority, "u32", "match", "ip", "src", net.IP(src[:]).String()+"/32",
+			"flowid", "1:"+tcClassMinor(class)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tc(args ...string) error {
+	if out, err := exec.Command("tc", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("tc %v: %s: %s", args, err, out)
+	}
+	return nil
+}
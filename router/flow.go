@@ -100,3 +100,26 @@ func collectFlowOps(into []FlowOp, fop FlowOp) []FlowOp {
 
 	return append(into, fop)
 }
+
+// A FlowOp that only applies to some frames, and otherwise stands for
+// another FlowOp, which forFrame returns; nil if it applies
+type frameSelectingFlowOp interface {
+	FlowOp
+	forFrame(frame []byte) FlowOp
+}
+
+// Flatten out a FlowOp for a particular frame, replacing any
+// frameSelectingFlowOps with what they stand for
+func FlattenFlowOpFor(fop FlowOp, frame []byte) []FlowOp {
+	var fops []FlowOp
+	for _, op := range FlattenFlowOp(fop) {
+		if sop, ok := op.(frameSelectingFlowOp); ok {
+			if selected := sop.forFrame(frame); selected != nil {
+				fops = append(fops, FlattenFlowOpFor(selected, frame)...)
+				continue
+			}
+		}
+		fops = append(fops, op)
+	}
+	return fops
+}
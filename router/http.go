@@ -26,4 +26,12 @@ func (router *NetworkRouter) HandleHTTP(muxRouter *mux.Router) {
 		router.ForgetConnections(r.Form["peer"])
 	})
 
+	muxRouter.Methods("GET").Path("/mtu").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, router.OverlayMTU())
+	})
+
+	muxRouter.Methods("GET").Path("/encrypted").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, router.Encrypted())
+	})
+
 }
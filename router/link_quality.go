@@ -0,0 +1,74 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// Link quality
+//
+// When both ends of a connection support it, each forwarder echoes
+// the UDP heartbeats it receives back over the control connection.
+// The sender takes the time until the echo arrives as the round trip
+// time, and a heartbeat not echoed by the time it sends the next one
+// as lost.  Both are smoothed, so that one slow or lost heartbeat
+// doesn't change routes.
+
+const (
+	// Connection feature saying that heartbeats will be echoed
+	heartbeatEchoFeature = "HeartbeatEcho"
+	// Weight of each new sample in the averages
+	linkQualitySmoothing = 0.2
+)
+
+// A forwarder which measures the quality of its link
+type linkQualityReporter interface {
+	LinkQuality() (LinkQuality, bool)
+}
+
+type LinkQuality struct {
+	RTT  time.Duration
+	Loss float64 // fraction of heartbeats lost
+}
+
+type linkMonitor struct {
+	sync.Mutex
+	lastSent time.Time
+	echoed   bool
+	echoes   int
+	quality  LinkQuality
+}
+
+// heartbeatSent is called whenever a heartbeat is sent
+func (m *linkMonitor) heartbeatSent() {
+	m.Lock()
+	defer m.Unlock()
+	if !m.lastSent.IsZero() && !m.echoed {
+		m.quality.Loss += linkQualitySmoothing * (1 - m.quality.Loss)
+	}
+	m.lastSent, m.echoed = time.Now(), false
+}
+
+// heartbeatEchoed is called when the remote end echoes a heartbeat
+func (m *linkMonitor) heartbeatEchoed() {
+	m.Lock()
+	defer m.Unlock()
+	if m.lastSent.IsZero() || m.echoed {
+		return
+	}
+	m.echoed = true
+	m.echoes++
+	rtt := time.Since(m.lastSent)
+	if m.echoes == 1 {
+		m.quality.RTT = rtt
+	} else {
+		m.quality.RTT += time.Duration(linkQualitySmoothing * float64(rtt-m.quality.RTT))
+	}
+	m.quality.Loss -= linkQualitySmoothing * m.quality.Loss
+}
+
+func (m *linkMonitor) LinkQuality() (LinkQuality, bool) {
+	m.Lock()
+	defer m.Unlock()
+	return m.quality, m.echoes > 0
+}
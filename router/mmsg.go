@@ -0,0 +1,246 @@
+package router
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Batched socket I/O, with sendmmsg(2) and recvmmsg(2), to save a
+// system call per datagram, and UDP segmentation offload (GSO and
+// GRO), to save the kernel handling each datagram separately, where
+// the kernel supports them (4.18 and 5.0 onwards).
+
+const (
+	// The most messages we send or receive with one system call
+	udpBatchSize = 64
+	// The most bytes of messages we collect before sending them
+	udpBatchBytes = 2 * MaxUDPPacketSize
+
+	// From linux/udp.h
+	udpSegment = 103
+	udpGRO     = 104
+	// The most datagrams the kernel will split a GSO send into
+	udpMaxSegments = 64
+)
+
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// sendmmsg sends each of msgs as a datagram, to addr if it is not
+// nil, retrying until they have all gone, and returning how many did
+// go in case of error.  Where segSizes is given, and segSizes[i] is
+// not zero, msgs[i] is sent with GSO, for the kernel to split into
+// datagrams of that size.
+func sendmmsg(fd int, msgs [][]byte, segSizes []int, addr *syscall.RawSockaddrInet4) (int, error) {
+	hdrs := make([]mmsghdr, len(msgs))
+	iovs := make([]syscall.Iovec, len(msgs))
+	var oob []byte
+	if segSizes != nil {
+		oob = make([]byte, len(msgs)*syscall.CmsgSpace(2))
+	}
+	for i, msg := range msgs {
+		if len(msg) > 0 {
+			iovs[i].Base = &msg[0]
+			iovs[i].SetLen(len(msg))
+			hdrs[i].hdr.Iov = &iovs[i]
+			hdrs[i].hdr.Iovlen = 1
+		}
+		if addr != nil {
+			hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(addr))
+			hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+		}
+		if segSizes != nil && segSizes[i] != 0 {
+			cmsgBuf := oob[i*syscall.CmsgSpace(2) : (i+1)*syscall.CmsgSpace(2)]
+			cmsg := (*syscall.Cmsghdr)(unsafe.Pointer(&cmsgBuf[0]))
+			cmsg.Level = syscall.IPPROTO_UDP
+			cmsg.Type = udpSegment
+			cmsg.SetLen(syscall.CmsgLen(2))
+			*(*uint16)(unsafe.Pointer(&cmsgBuf[syscall.CmsgLen(0)])) = uint16(segSizes[i])
+			hdrs[i].hdr.Control = &cmsgBuf[0]
+			hdrs[i].hdr.SetControllen(len(cmsgBuf))
+		}
+	}
+
+	sent := 0
+	for sent < len(hdrs) {
+		r, _, errno := syscall.Syscall6(sysSendmmsg, uintptr(fd),
+			uintptr(unsafe.Pointer(&hdrs[sent])), uintptr(len(hdrs)-sent), 0, 0, 0)
+		switch {
+		case errno == syscall.EINTR:
+			continue
+		case errno != 0:
+			return sent, errno
+		}
+		sent += int(r)
+	}
+	return sent, nil
+}
+
+// udpBatch collects messages to be sent together.  They are copied
+// into a buffer of its own, since the encryptors reuse theirs.
+type udpBatch struct {
+	buf  []byte
+	msgs [][]byte
+}
+
+// Returns false when there is no room left, and the batch should be
+// sent before adding to it
+func (batch *udpBatch) add(msg []byte) bool {
+	if batch.buf == nil {
+		batch.buf = make([]byte, 0, udpBatchBytes)
+	}
+	if len(batch.msgs) == udpBatchSize || len(batch.buf)+len(msg) > cap(batch.buf) {
+		return false
+	}
+	start := len(batch.buf)
+	batch.buf = append(batch.buf, msg...)
+	batch.msgs = append(batch.msgs, batch.buf[start:])
+	return true
+}
+
+func (batch *udpBatch) reset() {
+	batch.buf = batch.buf[:0]
+	batch.msgs = batch.msgs[:0]
+}
+
+// The batch with each run of messages of the same length, which lie
+// next to each other in the buffer, merged into one message for GSO
+// to split up again.  Also returns the segment size of each merged
+// message (zero for those left alone), and how many of the original
+// messages each stands for.
+func (batch *udpBatch) gsoRuns(maxSegmentSize int) (runs [][]byte, segSizes []int, counts []int) {
+	msgs := batch.msgs
+	for i := 0; i < len(msgs); {
+		size := len(msgs[i])
+		j := i + 1
+		for j < len(msgs) && j-i < udpMaxSegments && len(msgs[j]) == size &&
+			(j-i+1)*size <= MaxUDPPacketSize-UDPOverhead {
+			j++
+		}
+		if j-i > 1 && size <= maxSegmentSize {
+			runs = append(runs, msgs[i][:(j-i)*size])
+			segSizes = append(segSizes, size)
+		} else {
+			j = i + 1
+			runs = append(runs, msgs[i])
+			segSizes = append(segSizes, 0)
+		}
+		counts = append(counts, j-i)
+		i = j
+	}
+	return
+}
+
+// mmsgReader receives batches of datagrams with recvmmsg, into
+// buffers that are reused from one batch to the next.
+type mmsgReader struct {
+	fd    int
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	bufs  [][]byte
+	names []syscall.RawSockaddrInet4
+	oobs  [][]byte
+}
+
+func newMMsgReader(fd int, bufSize int) *mmsgReader {
+	reader := &mmsgReader{
+		fd:    fd,
+		hdrs:  make([]mmsghdr, udpBatchSize),
+		iovs:  make([]syscall.Iovec, udpBatchSize),
+		bufs:  make([][]byte, udpBatchSize),
+		names: make([]syscall.RawSockaddrInet4, udpBatchSize),
+		oobs:  make([][]byte, udpBatchSize),
+	}
+	for i := range reader.hdrs {
+		reader.bufs[i] = make([]byte, bufSize)
+		reader.oobs[i] = make([]byte, syscall.CmsgSpace(4))
+		reader.iovs[i].Base = &reader.bufs[i][0]
+		reader.iovs[i].SetLen(bufSize)
+		reader.hdrs[i].hdr.Iov = &reader.iovs[i]
+		reader.hdrs[i].hdr.Iovlen = 1
+		reader.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&reader.names[i]))
+		reader.hdrs[i].hdr.Control = &reader.oobs[i][0]
+	}
+	return reader
+}
+
+// Wait for at least one datagram, returning how many were received
+func (reader *mmsgReader) read() (int, error) {
+	for i := range reader.hdrs {
+		// the kernel overwrites these with the actual lengths
+		reader.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+		reader.hdrs[i].hdr.SetControllen(len(reader.oobs[i]))
+	}
+	for {
+		r, _, errno := syscall.Syscall6(syscall.SYS_RECVMMSG, uintptr(reader.fd),
+			uintptr(unsafe.Pointer(&reader.hdrs[0])), uintptr(len(reader.hdrs)),
+			syscall.MSG_WAITFORONE, 0, 0)
+		switch {
+		case errno == syscall.EINTR:
+			continue
+		case errno != 0:
+			return 0, errno
+		}
+		return int(r), nil
+	}
+}
+
+// The i'th datagram read, where it came from, and the size of the
+// datagrams GRO coalesced it from (zero if it didn't)
+func (reader *mmsgReader) datagram(i int) ([]byte, *net.UDPAddr, int) {
+	name := &reader.names[i]
+	port := (*[2]byte)(unsafe.Pointer(&name.Port))
+	sender := &net.UDPAddr{
+		IP:   net.IPv4(name.Addr[0], name.Addr[1], name.Addr[2], name.Addr[3]),
+		Port: int(port[0])<<8 | int(port[1]),
+	}
+
+	segSize := groSegmentSize(reader.oobs[i][:reader.hdrs[i].hdr.Controllen])
+	return reader.bufs[i][:reader.hdrs[i].len], sender, segSize
+}
+
+// The segment size in the UDP_GRO control message among oob, if there
+// is one, otherwise zero
+func groSegmentSize(oob []byte) int {
+	segSize := 0
+	for len(oob) >= syscall.CmsgLen(0) {
+		cmsg := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		dataLen := int(cmsg.Len) - syscall.CmsgLen(0)
+		if dataLen < 0 || syscall.CmsgLen(dataLen) > len(oob) {
+			break
+		}
+		if cmsg.Level == syscall.IPPROTO_UDP && cmsg.Type == udpGRO && dataLen >= 4 {
+			segSize = int(*(*int32)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])))
+		}
+		if syscall.CmsgSpace(dataLen) >= len(oob) {
+			break
+		}
+		oob = oob[syscall.CmsgSpace(dataLen):]
+	}
+	return segSize
+}
+
+// Calls f with each of the datagrams that GRO coalesced into buf, of
+// which only the last can be shorter than segSize.  Where segSize is
+// zero, buf is a single datagram.
+func splitGRO(buf []byte, segSize int, f func([]byte)) {
+	for len(buf) > 0 {
+		datagram := buf
+		if segSize > 0 && len(datagram) > segSize {
+			datagram = datagram[:segSize]
+		}
+		buf = buf[len(datagram):]
+		f(datagram)
+	}
+}
+
+func rawSockaddrInet4(addr *net.UDPAddr) *syscall.RawSockaddrInet4 {
+	raw := &syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+	port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+	port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+	copy(raw.Addr[:], addr.IP.To4())
+	return raw
+}
@@ -0,0 +1,4 @@
+package router
+
+// The syscall package lacks SYS_SENDMMSG on 386
+const sysSendmmsg = 345
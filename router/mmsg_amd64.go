@@ -0,0 +1,4 @@
+package router
+
+// The syscall package lacks SYS_SENDMMSG on amd64
+const sysSendmmsg = 307
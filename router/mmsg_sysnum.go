@@ -0,0 +1,7 @@
+// +build !386,!amd64
+
+package router
+
+import "syscall"
+
+const sysSendmmsg = syscall.SYS_SENDMMSG
@@ -0,0 +1,276 @@
+package router
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// A batch of messages of the given sizes, each filled with its index
+func testBatch(sizes ...int) *udpBatch {
+	batch := &udpBatch{}
+	for i, size := range sizes {
+		if !batch.add(bytes.Repeat([]byte{byte(i)}, size)) {
+			panic("batch full")
+		}
+	}
+	return batch
+}
+
+func TestGSORuns(t *testing.T) {
+	batch := testBatch(100, 100, 100, 50, 100, 200, 200)
+	runs, segSizes, counts := batch.gsoRuns(gsoMaxSegmentSize)
+	require.Equal(t, []int{100, 0, 0, 200}, segSizes)
+	require.Equal(t, []int{3, 1, 1, 2}, counts)
+	require.Len(t, runs, 4)
+	// Each run is the messages it stands for, one after another
+	msgs := batch.msgs
+	for i, run := range runs {
+		require.Equal(t, bytes.Join(msgs[:counts[i]], nil), run)
+		msgs = msgs[counts[i]:]
+	}
+
+	// Messages larger than the segment size are left alone
+	_, segSizes, counts = batch.gsoRuns(150)
+	require.Equal(t, []int{100, 0, 0, 0, 0}, segSizes)
+	require.Equal(t, []int{3, 1, 1, 1, 1}, counts)
+
+	// A run cannot be larger than a UDP packet
+	sizes := make([]int, udpBatchSize)
+	for i := range sizes {
+		sizes[i] = 1400
+	}
+	runs, segSizes, counts = testBatch(sizes...).gsoRuns(gsoMaxSegmentSize)
+	require.Equal(t, []int{1400, 1400}, segSizes)
+	require.Equal(t, []int{46, 18}, counts)
+	for _, run := range runs {
+		require.True(t, len(run) <= MaxUDPPacketSize-UDPOverhead, "run of %d bytes", len(run))
+	}
+
+	runs, segSizes, counts = testBatch().gsoRuns(gsoMaxSegmentSize)
+	require.Empty(t, runs)
+	require.Empty(t, segSizes)
+	require.Empty(t, counts)
+}
+
+func TestSplitGRO(t *testing.T) {
+	split := func(buf []byte, segSize int) []int {
+		var lens []int
+		splitGRO(buf, segSize, func(datagram []byte) { lens = append(lens, len(datagram)) })
+		return lens
+	}
+	buf := make([]byte, 250)
+	require.Equal(t, []int{100, 100, 50}, split(buf, 100))
+	require.Equal(t, []int{125, 125}, split(buf, 125))
+	require.Equal(t, []int{250}, split(buf, 250))
+	require.Equal(t, []int{250}, split(buf, 0), "without GRO the buffer is one datagram")
+	require.Empty(t, split(nil, 100))
+}
+
+// A control message, as the kernel would lay it out
+func testCmsg(level, typ int32, data []byte) []byte {
+	buf := make([]byte, syscall.CmsgSpace(len(data)))
+	cmsg := (*syscall.Cmsghdr)(unsafe.Pointer(&buf[0]))
+	cmsg.Level = level
+	cmsg.Type = typ
+	cmsg.SetLen(syscall.CmsgLen(len(data)))
+	copy(buf[syscall.CmsgLen(0):], data)
+	return buf
+}
+
+func testGROCmsg(segSize int32) []byte {
+	data := make([]byte, 4)
+	*(*int32)(unsafe.Pointer(&data[0])) = segSize
+	return testCmsg(syscall.IPPROTO_UDP, udpGRO, data)
+}
+
+func TestGROSegmentSize(t *testing.T) {
+	gro := testGROCmsg(1400)
+	other := testCmsg(syscall.IPPROTO_IP, syscall.IP_TOS, []byte{0x10})
+
+	require.Equal(t, 0, groSegmentSize(nil))
+	require.Equal(t, 1400, groSegmentSize(gro))
+	require.Equal(t, 1400, groSegmentSize(append(append([]byte{}, other...), gro...)))
+	require.Equal(t, 1400, groSegmentSize(append(append([]byte{}, gro...), other...)))
+	require.Equal(t, 0, groSegmentSize(other))
+
+	// Truncated control messages are ignored
+	require.Equal(t, 0, groSegmentSize(gro[:syscall.CmsgLen(0)+2]))
+	require.Equal(t, 0, groSegmentSize(gro[:syscall.CmsgLen(0)-1]))
+	long := append([]byte{}, gro...)
+	(*syscall.Cmsghdr)(unsafe.Pointer(&long[0])).SetLen(len(long) + 8)
+	require.Equal(t, 0, groSegmentSize(long))
+}
+
+// Benchmarks comparing the per-datagram cost of sending and receiving
+// small datagrams one at a time, as the sleeve overlay used to, and
+// in batches, with GSO and GRO where the kernel supports them.
+
+const benchDatagramSize = 100
+
+type benchUDPConn struct {
+	*net.UDPConn
+	file *os.File
+	fd   int
+}
+
+func newBenchUDPConn(b *testing.B) *benchUDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	f, err := conn.File()
+	if err != nil {
+		b.Fatal(err)
+	}
+	fd := int(f.Fd())
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		b.Fatal(err)
+	}
+	return &benchUDPConn{UDPConn: conn, file: f, fd: fd}
+}
+
+func (conn *benchUDPConn) Close() {
+	conn.file.Close()
+	conn.UDPConn.Close()
+}
+
+func benchBatch() *udpBatch {
+	batch := &udpBatch{}
+	for batch.add(make([]byte, benchDatagramSize)) {
+	}
+	return batch
+}
+
+func BenchmarkUDPWrite(b *testing.B) {
+	conn := newBenchUDPConn(b)
+	defer conn.Close()
+	sink := newBenchUDPConn(b)
+	defer sink.Close()
+
+	msg := make([]byte, benchDatagramSize)
+	raddr := sink.LocalAddr().(*net.UDPAddr)
+	b.SetBytes(benchDatagramSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.WriteToUDP(msg, raddr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUDPSendmmsg(b *testing.B) {
+	benchmarkUDPSendmmsg(b, false)
+}
+
+func BenchmarkUDPSendmmsgGSO(b *testing.B) {
+	benchmarkUDPSendmmsg(b, true)
+}
+
+func benchmarkUDPSendmmsg(b *testing.B, gso bool) {
+	conn := newBenchUDPConn(b)
+	defer conn.Close()
+	sink := newBenchUDPConn(b)
+	defer sink.Close()
+	if _, err := syscall.GetsockoptInt(conn.fd, syscall.IPPROTO_UDP, udpSegment); gso && err != nil {
+		b.Skip("UDP GSO not supported: ", err)
+	}
+
+	batch := benchBatch()
+	addr := rawSockaddrInet4(sink.LocalAddr().(*net.UDPAddr))
+	b.SetBytes(benchDatagramSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(batch.msgs) {
+		var err error
+		if gso {
+			runs, segSizes, _ := batch.gsoRuns(gsoMaxSegmentSize)
+			_, err = sendmmsg(conn.fd, runs, segSizes, addr)
+		} else {
+			_, err = sendmmsg(conn.fd, batch.msgs, nil, addr)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Keep sending to conn until told to stop
+func benchUDPSender(b *testing.B, conn *benchUDPConn, gso bool) chan<- struct{} {
+	sender := newBenchUDPConn(b)
+	batch := benchBatch()
+	runs, segSizes, _ := batch.gsoRuns(gsoMaxSegmentSize)
+	if _, err := syscall.GetsockoptInt(sender.fd, syscall.IPPROTO_UDP, udpSegment); !gso || err != nil {
+		runs, segSizes = batch.msgs, nil
+	}
+	addr := rawSockaddrInet4(conn.LocalAddr().(*net.UDPAddr))
+
+	stop := make(chan struct{})
+	go func() {
+		defer sender.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sendmmsg(sender.fd, runs, segSizes, addr)
+		}
+	}()
+	return stop
+}
+
+func BenchmarkUDPRead(b *testing.B) {
+	conn := newBenchUDPConn(b)
+	defer conn.Close()
+	stop := benchUDPSender(b, conn, false)
+	defer close(stop)
+
+	buf := make([]byte, MaxUDPPacketSize)
+	b.SetBytes(benchDatagramSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := conn.ReadFromUDP(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUDPRecvmmsg(b *testing.B) {
+	benchmarkUDPRecvmmsg(b, false)
+}
+
+func BenchmarkUDPRecvmmsgGRO(b *testing.B) {
+	benchmarkUDPRecvmmsg(b, true)
+}
+
+func benchmarkUDPRecvmmsg(b *testing.B, gro bool) {
+	conn := newBenchUDPConn(b)
+	defer conn.Close()
+	if err := syscall.SetsockoptInt(conn.fd, syscall.IPPROTO_UDP, udpGRO, 1); gro && err != nil {
+		b.Skip("UDP GRO not supported: ", err)
+	}
+	stop := benchUDPSender(b, conn, gro)
+	defer close(stop)
+
+	reader := newMMsgReader(conn.fd, MaxUDPPacketSize)
+	b.SetBytes(benchDatagramSize)
+	b.ResetTimer()
+	for received := 0; received < b.N; {
+		n, err := reader.read()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			buf, _, segSize := reader.datagram(i)
+			if segSize == 0 {
+				segSize = len(buf)
+			}
+			received += (len(buf) + segSize - 1) / segSize
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package router
+
+import (
+	"github.com/weaveworks/mesh"
+)
+
+// MTU validation
+//
+// When the overlay MTU is configured explicitly, with --mtu, the
+// containers on the weave bridge will send IP packets of up to that
+// size.  Overlays which discover the path MTU of each link report it
+// here, so that links which cannot carry such packets without
+// fragmentation, or at all, show up in the status.
+
+// A forwarder which discovers the MTU of its link, i.e. the largest
+// IP packet on the overlay network that it can carry unfragmented
+type pmtuReporter interface {
+	PMTU() (int, bool)
+}
+
+type MTUMismatch struct {
+	Name     string
+	NickName string
+	PMTU     int
+}
+
+// The MTU for container interfaces on the overlay network: that
+// configured, or otherwise that of the bridge; zero if not known
+func (router *NetworkRouter) OverlayMTU() int {
+	if router.MTU != 0 {
+		return router.MTU
+	}
+	if iface := router.Bridge.Interface(); iface != nil {
+		return iface.MTU
+	}
+	return 0
+}
+
+// The connections whose discovered path MTU is less than the
+// configured MTU
+func NewMTUMismatchSlice(router *NetworkRouter) []MTUMismatch {
+	if router.MTU == 0 {
+		return nil
+	}
+	neighbours := establishedGraph(mesh.NewStatus(router.Router))[router.Ourself.Name]
+	var slice []MTUMismatch
+	for _, conn := range router.Ourself.ConnectionsTo(neighbours) {
+		if mismatch, found := mtuMismatch(router.MTU, conn.Remote(), conn.(*mesh.LocalConnection).OverlayConn); found {
+			slice = append(slice, mismatch)
+		}
+	}
+	return slice
+}
+
+// Has the overlay connection to remote discovered a path MTU less
+// than mtu?
+func mtuMismatch(mtu int, remote *mesh.Peer, overlayConn mesh.OverlayConnection) (MTUMismatch, bool) {
+	reporter, ok := overlayConn.(pmtuReporter)
+	if !ok {
+		return MTUMismatch{}, false
+	}
+	if pmtu, ok := reporter.PMTU(); ok && pmtu < mtu {
+		return MTUMismatch{remote.Name.String(), remote.NickName, pmtu}, true
+	}
+	return MTUMismatch{}, false
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+type pmtuTestConn struct {
+	mesh.OverlayConnection
+	pmtu  int
+	known bool
+}
+
+func (conn pmtuTestConn) PMTU() (int, bool) {
+	return conn.pmtu, conn.known
+}
+
+func TestMTUMismatch(t *testing.T) {
+	remote := &mesh.Peer{Name: 2}
+	remote.NickName = "two"
+
+	mismatch, found := mtuMismatch(1410, remote, pmtuTestConn{pmtu: 1376, known: true})
+	require.True(t, found)
+	require.Equal(t, MTUMismatch{remote.Name.String(), "two", 1376}, mismatch)
+
+	_, found = mtuMismatch(1410, remote, pmtuTestConn{pmtu: 1410, known: true})
+	require.False(t, found, "path MTU equal to the configured MTU")
+	_, found = mtuMismatch(1410, remote, pmtuTestConn{pmtu: 8950, known: true})
+	require.False(t, found, "path MTU more than the configured MTU")
+	_, found = mtuMismatch(1410, remote, pmtuTestConn{})
+	require.False(t, found, "path MTU not discovered yet")
+	_, found = mtuMismatch(1410, remote, pmtuTestConn{}.OverlayConnection)
+	require.False(t, found, "overlay that doesn't discover path MTUs")
+}
+
+type mtuTestBridge struct {
+	NullBridge
+	mtu int
+}
+
+func (b mtuTestBridge) Interface() *net.Interface {
+	return &net.Interface{MTU: b.mtu}
+}
+
+func TestOverlayMTU(t *testing.T) {
+	require.Equal(t, 1410, (&NetworkRouter{MTU: 1410, Bridge: mtuTestBridge{mtu: 65535}}).OverlayMTU())
+	require.Equal(t, 1376, (&NetworkRouter{Bridge: mtuTestBridge{mtu: 1376}}).OverlayMTU())
+	require.Equal(t, 0, (&NetworkRouter{Bridge: NullBridge{}}).OverlayMTU())
+}
@@ -0,0 +1,495 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/weaveworks/mesh"
+)
+
+// IGMP snooping
+//
+// Every peer acts as IGMP querier on its local bridge, learns from
+// the membership reports of its local containers which IPv4
+// multicast groups they listen to, and gossips the set of groups to
+// the other peers.  A multicast frame is then relayed along the
+// broadcast tree only to next hops that lead to a peer with a
+// listener for its group.
+//
+// Groups are identified by their Ethernet address, so several IP
+// groups can share one; and frames for 224.0.0.x (or anything else
+// with the same Ethernet address), which are link-local control
+// traffic such as IGMP itself, are always flooded.  IGMPv1 and v2
+// membership reports are sent to the group they are for, so every
+// IPv4 multicast frame captured locally goes past the snooper, and
+// the fast datapath can't make flows for them.  A peer we have
+// not heard from yet, e.g. because it runs an older version, is
+// assumed to want everything.
+
+const (
+	igmpQueryInterval = 60 * time.Second
+	igmpMaxResponse   = 10 * time.Second
+	// how long a listener stays a member without reporting
+	igmpMembershipTimeout = 2*igmpQueryInterval + igmpMaxResponse
+)
+
+var allHostsMAC = MAC{0x01, 0x00, 0x5e, 0x00, 0x00, 0x01}
+
+// Can frames to this MAC be pruned, i.e. do they belong to a
+// non-link-local IPv4 multicast group?
+func prunableMulticast(mac MAC) bool {
+	return mac[0] == 0x01 && mac[1] == 0x00 && mac[2] == 0x5e &&
+		!(mac[3] == 0 && mac[4] == 0)
+}
+
+func ipv4Multicast(mac MAC) bool {
+	return mac[0] == 0x01 && mac[1] == 0x00 && mac[2] == 0x5e
+}
+
+func multicastMAC(group net.IP) MAC {
+	group = group.To4()
+	return MAC{0x01, 0x00, 0x5e, group[1] & 0x7f, group[2], group[3]}
+}
+
+// The groups with listeners on one peer, which are only ever changed
+// by that peer and are replaced wholesale when they change.  The
+// version counts the owner's changes, carrying on across restarts
+// from whatever other peers still remember, so it doesn't depend on
+// the owner's clock.
+type peerGroups struct {
+	Incarnation int64 // when the owner started; tells its lives apart
+	Version     int64
+	Groups      []MAC
+	set         map[MAC]bool
+}
+
+func newPeerGroups(incarnation, version int64, groups []MAC) *peerGroups {
+	pg := &peerGroups{Incarnation: incarnation, Version: version, Groups: groups}
+	pg.makeSet()
+	return pg
+}
+
+func (pg *peerGroups) makeSet() {
+	pg.set = make(map[MAC]bool, len(pg.Groups))
+	for _, group := range pg.Groups {
+		pg.set[group] = true
+	}
+}
+
+type multicastGossipData map[mesh.PeerName]*peerGroups
+
+func (g multicastGossipData) Merge(other mesh.GossipData) mesh.GossipData {
+	result := multicastGossipData{}
+	for name, groups := range g {
+		result[name] = groups
+	}
+	result.merge(other.(multicastGossipData), mesh.UnknownPeerName)
+	return result
+}
+
+// merge in newer groups, except those of ourName, returning what was
+// new
+func (g multicastGossipData) merge(other multicastGossipData, ourName mesh.PeerName) multicastGossipData {
+	updated := multicastGossipData{}
+	for name, groups := range other {
+		if name == ourName {
+			continue
+		}
+		if existing, found := g[name]; !found || existing.Version < groups.Version {
+			g[name] = groups
+			updated[name] = groups
+		}
+	}
+	return updated
+}
+
+func (g multicastGossipData) Encode() [][]byte {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(g); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+type multicastSnooper struct {
+	sync.Mutex
+	router  *NetworkRouter
+	ourName mesh.PeerName
+	gossip  mesh.Gossip
+	// Until our first query has been answered we don't know our
+	// listeners, so we keep quiet and other peers send us
+	// everything
+	ready     bool
+	listeners map[MAC]map[MAC]time.Time // group -> local host -> last report
+	groups    multicastGossipData
+}
+
+func newMulticastSnooper(router *NetworkRouter, ourName mesh.PeerName) *multicastSnooper {
+	return &multicastSnooper{
+		router:    router,
+		ourName:   ourName,
+		listeners: make(map[MAC]map[MAC]time.Time),
+		groups:    multicastGossipData{ourName: newPeerGroups(time.Now().UnixNano(), 0, nil)},
+	}
+}
+
+// wanted says whether a frame for group, originating at src, should
+// be relayed to the next hop, i.e. whether the broadcast tree leads
+// through hop to any peer with listeners.
+func (s *multicastSnooper) wanted(src, hop mesh.PeerName, group MAC) bool {
+	if !prunableMulticast(group) {
+		return true
+	}
+	distances := s.router.distances
+	distances.Lock()
+	var reachable []mesh.PeerName
+	for peer := range distances.from(src) {
+		reachable = append(reachable, peer)
+	}
+	distances.Unlock()
+
+	s.Lock()
+	var listening []mesh.PeerName
+	for _, peer := range reachable {
+		if peer == src || peer == s.ourName {
+			continue
+		}
+		if groups, found := s.groups[peer]; found && !groups.set[group] {
+			continue
+		}
+		listening = append(listening, peer)
+	}
+	s.Unlock()
+
+	for _, peer := range listening {
+		if s.router.leadsTo(src, hop, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// Recompute the groups we gossip after the listeners have changed,
+// returning the new groups if they differ and are ready to be
+// broadcast
+func (s *multicastSnooper) updateGroups() *peerGroups {
+	var groups []MAC
+	for group := range s.listeners {
+		groups = append(groups, group)
+	}
+	sort.Sort(macSlice(groups))
+	ours := s.groups[s.ourName]
+	if len(groups) == len(ours.Groups) {
+		same := true
+		for i, group := range groups {
+			same = same && group == ours.Groups[i]
+		}
+		if same {
+			return nil
+		}
+	}
+	return s.setGroups(ours.Version+1, groups)
+}
+
+// Other peers may remember our groups from before we restarted, with
+// a version we haven't got to since; carry on from there so that
+// they take our current groups.  Returns our groups if they need
+// broadcasting again.
+func (s *multicastSnooper) noteGroups(theirs *peerGroups) *peerGroups {
+	ours := s.groups[s.ourName]
+	if theirs.Incarnation == ours.Incarnation || theirs.Version < ours.Version {
+		return nil
+	}
+	return s.setGroups(theirs.Version+1, ours.Groups)
+}
+
+func (s *multicastSnooper) setGroups(version int64, groups []MAC) *peerGroups {
+	ours := newPeerGroups(s.groups[s.ourName].Incarnation, version, groups)
+	s.groups[s.ourName] = ours
+	if !s.ready {
+		return nil
+	}
+	return ours
+}
+
+func (s *multicastSnooper) broadcast(ours *peerGroups) {
+	if ours != nil && s.gossip != nil {
+		s.gossip.GossipBroadcast(multicastGossipData{s.ourName: ours})
+	}
+}
+
+func (s *multicastSnooper) join(group, host MAC) {
+	s.Lock()
+	hosts, found := s.listeners[group]
+	if !found {
+		log.Println("Discovered local listener", host, "for multicast group", group)
+		hosts = make(map[MAC]time.Time)
+		s.listeners[group] = hosts
+	}
+	hosts[host] = time.Now()
+	ours := s.updateGroups()
+	s.Unlock()
+	s.broadcast(ours)
+}
+
+func (s *multicastSnooper) leave(group, host MAC) {
+	s.Lock()
+	if hosts, found := s.listeners[group]; found {
+		delete(hosts, host)
+		if len(hosts) == 0 {
+			delete(s.listeners, group)
+		}
+	}
+	ours := s.updateGroups()
+	s.Unlock()
+	s.broadcast(ours)
+}
+
+func (s *multicastSnooper) expire() {
+	now := time.Now()
+	s.Lock()
+	for group, hosts := range s.listeners {
+		for host, lastReport := range hosts {
+			if now.After(lastReport.Add(igmpMembershipTimeout)) {
+				delete(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			log.Println("Expired multicast group", group)
+			delete(s.listeners, group)
+		}
+	}
+	ours := s.updateGroups()
+	s.Unlock()
+	s.broadcast(ours)
+}
+
+func (s *multicastSnooper) becomeReady() {
+	s.Lock()
+	s.ready = true
+	ours := s.groups[s.ourName]
+	s.Unlock()
+	s.broadcast(ours)
+}
+
+func (s *multicastSnooper) peerGone(name mesh.PeerName) {
+	s.Lock()
+	delete(s.groups, name)
+	s.Unlock()
+}
+
+// Query our local containers periodically; this is what keeps their
+// memberships alive, and lets us find out about them when we start
+func (s *multicastSnooper) run() {
+	s.query()
+	time.AfterFunc(igmpMaxResponse, s.becomeReady)
+	for range time.Tick(igmpQueryInterval) {
+		s.query()
+		s.expire()
+	}
+}
+
+func (s *multicastSnooper) query() {
+	// An address of our own, which is not the bridge's
+	var srcMAC MAC
+	copy(srcMAC[:], s.router.Ourself.NameByte)
+	srcMAC[0] ^= 0x02
+
+	frame, err := makeIGMPQuery(srcMAC)
+	if err != nil {
+		log.Error("Unable to construct IGMP query: ", err)
+		return
+	}
+	if fop := s.router.Bridge.InjectPacket(PacketKey{SrcMAC: srcMAC, DstMAC: allHostsMAC}); fop != nil {
+		dec := NewEthernetDecoder()
+		dec.DecodeLayers(frame)
+		fop.Process(frame, dec, true)
+	}
+}
+
+// An IGMPv3 general query; hosts would fall back to IGMPv2 if we
+// sent an IGMPv2 one
+func makeIGMPQuery(srcMAC MAC) ([]byte, error) {
+	// the group and number of sources are left as zero
+	igmp := make([]byte, 12)
+	igmp[0] = 0x11 // membership query
+	igmp[1] = byte(igmpMaxResponse / (time.Second / 10))
+	igmp[8] = 2 // robustness variable
+	igmp[9] = byte(igmpQueryInterval / time.Second)
+	binary.BigEndian.PutUint16(igmp[2:], inetChecksum(igmp))
+	payload := gopacket.Payload(igmp)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       srcMAC[:],
+			DstMAC:       allHostsMAC[:],
+			EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{
+			Version:  4,
+			TTL:      1,
+			Protocol: layers.IPProtocolIGMP,
+			SrcIP:    net.IPv4zero.To4(),
+			DstIP:    net.IPv4(224, 0, 0, 1).To4()},
+		&payload)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func inetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// snoop on a multicast frame captured from the local bridge, for
+// IGMP membership reports and leaves
+func (s *multicastSnooper) snoop(dec *EthernetDecoder) {
+	if len(dec.decoded) != 2 || dec.IP.Protocol != layers.IPProtocolIGMP {
+		return
+	}
+	var host MAC
+	copy(host[:], dec.Eth.SrcMAC)
+	msg := dec.IP.Payload
+	if len(msg) < 8 {
+		return
+	}
+
+	switch msg[0] {
+	case 0x12, 0x16: // IGMPv1 and v2 membership reports
+		s.join(multicastMAC(net.IP(msg[4:8])), host)
+	case 0x17: // IGMPv2 leave group
+		s.leave(multicastMAC(net.IP(msg[4:8])), host)
+	case 0x22: // IGMPv3 membership report
+		records := int(binary.BigEndian.Uint16(msg[6:8]))
+		msg = msg[8:]
+		for i := 0; i < records && len(msg) >= 8; i++ {
+			recordType, auxLen, sources := msg[0], int(msg[1]), int(binary.BigEndian.Uint16(msg[2:4]))
+			group := multicastMAC(net.IP(msg[4:8]))
+			switch {
+			case recordType == 2 || recordType == 4: // MODE_IS_EXCLUDE, CHANGE_TO_EXCLUDE
+				s.join(group, host)
+			case (recordType == 1 || recordType == 3) && sources == 0: // MODE_IS_INCLUDE, CHANGE_TO_INCLUDE
+				s.leave(group, host)
+			case recordType == 1 || recordType == 3 || recordType == 5: // ALLOW_NEW_SOURCES
+				s.join(group, host)
+			}
+			next := 8 + 4*sources + 4*auxLen
+			if next > len(msg) {
+				break
+			}
+			msg = msg[next:]
+		}
+	}
+}
+
+// An igmpFlowOp looks at captured multicast frames before flooding
+// them
+type igmpFlowOp struct {
+	NonDiscardingFlowOp
+	snooper *multicastSnooper
+	flood   FlowOp
+}
+
+func (op igmpFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	op.snooper.snoop(dec)
+	op.flood.Process(frame, dec, broadcast)
+}
+
+type macSlice []MAC
+
+func (macs macSlice) Len() int           { return len(macs) }
+func (macs macSlice) Swap(i, j int)      { macs[i], macs[j] = macs[j], macs[i] }
+func (macs macSlice) Less(i, j int) bool { return bytes.Compare(macs[i][:], macs[j][:]) < 0 }
+
+// mesh.Gossiper implementation
+
+func (s *multicastSnooper) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+func (s *multicastSnooper) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	return s.receive(msg)
+}
+
+func (s *multicastSnooper) Gossip() mesh.GossipData {
+	s.Lock()
+	defer s.Unlock()
+	result := multicastGossipData{}
+	for name, groups := range s.groups {
+		if name != s.ourName || s.ready {
+			result[name] = groups
+		}
+	}
+	return result
+}
+
+func (s *multicastSnooper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	return s.receive(msg)
+}
+
+func (s *multicastSnooper) receive(msg []byte) (mesh.GossipData, error) {
+	var gossip multicastGossipData
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&gossip); err != nil {
+		return nil, err
+	}
+	for _, groups := range gossip {
+		groups.makeSet()
+	}
+	s.Lock()
+	var ours *peerGroups
+	if theirs, found := gossip[s.ourName]; found {
+		ours = s.noteGroups(theirs)
+	}
+	updated := s.groups.merge(gossip, s.ourName)
+	s.Unlock()
+	s.broadcast(ours)
+	if len(updated) == 0 {
+		return nil, nil
+	}
+	// Flows for multicast frames were made with the old groups
+	s.router.Overlay.(NetworkOverlay).InvalidateRoutes()
+	return updated, nil
+}
+
+type MulticastGroupStatus struct {
+	Group string
+	Peers []string
+}
+
+func NewMulticastStatusSlice(s *multicastSnooper) []MulticastGroupStatus {
+	s.Lock()
+	defer s.Unlock()
+	peers := make(map[MAC][]string)
+	for name, groups := range s.groups {
+		for _, group := range groups.Groups {
+			peers[group] = append(peers[group], name.String())
+		}
+	}
+	var slice []MulticastGroupStatus
+	for group, names := range peers {
+		sort.Strings(names)
+		slice = append(slice, MulticastGroupStatus{group.String(), names})
+	}
+	return slice
+}
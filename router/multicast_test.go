@@ -0,0 +1,150 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	igmpTestHost  = MAC{0x02, 0, 0, 0, 0, 1}
+	igmpTestGroup = net.IPv4(239, 1, 2, 3).To4()
+)
+
+// An IGMP message from igmpTestHost, decoded as if captured
+func igmpFrame(t *testing.T, dst net.IP, igmp []byte) *EthernetDecoder {
+	binary.BigEndian.PutUint16(igmp[2:], inetChecksum(igmp))
+	payload := gopacket.Payload(igmp)
+	dstMAC := multicastMAC(dst)
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf,
+		gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{
+			SrcMAC:       igmpTestHost[:],
+			DstMAC:       dstMAC[:],
+			EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{
+			Version:  4,
+			TTL:      1,
+			Protocol: layers.IPProtocolIGMP,
+			SrcIP:    net.IPv4(10, 32, 0, 1).To4(),
+			DstIP:    dst},
+		&payload))
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(buf.Bytes())
+	return dec
+}
+
+// IGMPv1 and v2 messages: type, max response time, checksum, group
+func igmpV2Message(t *testing.T, typ byte, dst net.IP) *EthernetDecoder {
+	igmp := make([]byte, 8)
+	igmp[0] = typ
+	copy(igmp[4:], igmpTestGroup)
+	return igmpFrame(t, dst, igmp)
+}
+
+// An IGMPv3 report with one group record
+func igmpV3Report(t *testing.T, recordType byte, sources ...net.IP) *EthernetDecoder {
+	igmp := make([]byte, 16+4*len(sources))
+	igmp[0] = 0x22
+	binary.BigEndian.PutUint16(igmp[6:], 1)
+	igmp[8] = recordType
+	binary.BigEndian.PutUint16(igmp[10:], uint16(len(sources)))
+	copy(igmp[12:], igmpTestGroup)
+	for i, source := range sources {
+		copy(igmp[16+4*i:], source.To4())
+	}
+	return igmpFrame(t, net.IPv4(224, 0, 0, 22).To4(), igmp)
+}
+
+func listening(s *multicastSnooper) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, found := s.listeners[multicastMAC(igmpTestGroup)][igmpTestHost]
+	return found && s.groups[s.ourName].set[multicastMAC(igmpTestGroup)]
+}
+
+func TestIGMPv1Join(t *testing.T) {
+	s := newMulticastSnooper(nil, 1)
+	s.snoop(igmpV2Message(t, 0x12, igmpTestGroup))
+	require.True(t, listening(s))
+}
+
+func TestIGMPv2JoinLeave(t *testing.T) {
+	s := newMulticastSnooper(nil, 1)
+	s.snoop(igmpV2Message(t, 0x16, igmpTestGroup))
+	require.True(t, listening(s))
+	s.snoop(igmpV2Message(t, 0x17, net.IPv4(224, 0, 0, 2).To4()))
+	require.False(t, listening(s))
+}
+
+func TestIGMPv3JoinLeave(t *testing.T) {
+	s := newMulticastSnooper(nil, 1)
+	s.snoop(igmpV3Report(t, 4)) // CHANGE_TO_EXCLUDE, i.e. join
+	require.True(t, listening(s))
+	s.snoop(igmpV3Report(t, 3)) // CHANGE_TO_INCLUDE with no sources, i.e. leave
+	require.False(t, listening(s))
+
+	// source-specific
+	s.snoop(igmpV3Report(t, 5, net.IPv4(10, 32, 0, 9)))
+	require.True(t, listening(s))
+	s.snoop(igmpV3Report(t, 1))
+	require.False(t, listening(s))
+}
+
+func TestIGMPSnoopedWhateverTheDestination(t *testing.T) {
+	require.True(t, ipv4Multicast(multicastMAC(igmpTestGroup)))
+	require.True(t, ipv4Multicast(multicastMAC(net.IPv4(224, 0, 0, 22))))
+	require.False(t, ipv4Multicast(broadcastMAC))
+
+	flood := &recordingFlowOp{}
+	s := newMulticastSnooper(nil, 1)
+	igmpFlowOp{snooper: s, flood: flood}.Process(nil, igmpV2Message(t, 0x16, igmpTestGroup), true)
+	require.True(t, listening(s))
+	require.Equal(t, 1, flood.processed)
+}
+
+type recordingFlowOp struct {
+	NonDiscardingFlowOp
+	processed int
+}
+
+func (op *recordingFlowOp) Process([]byte, *EthernetDecoder, bool) {
+	op.processed++
+}
+
+func encodeGroups(g multicastGossipData) []byte {
+	return g.Encode()[0]
+}
+
+func TestMulticastGroupsAfterRestart(t *testing.T) {
+	group := multicastMAC(igmpTestGroup)
+	// what other peers remember of us from before we restarted, with
+	// a clock that was ahead
+	old := newPeerGroups(time.Now().Add(time.Hour).UnixNano(), 7, nil)
+	peer := multicastGossipData{1: old}
+
+	s := newMulticastSnooper(nil, 1)
+	s.ready = true
+	s.snoop(igmpV2Message(t, 0x16, igmpTestGroup))
+	ours := s.Gossip().(multicastGossipData)
+	require.Len(t, peer.merge(ours, 2), 0, "a restarted peer's groups are at first older")
+
+	// we carry on from the version they remember
+	_, err := s.receive(encodeGroups(peer))
+	require.NoError(t, err)
+	ours = s.Gossip().(multicastGossipData)
+	require.Equal(t, int64(8), ours[1].Version)
+	require.Len(t, peer.merge(ours, 2), 1)
+	require.True(t, peer[1].set[group])
+
+	// but not from our own groups being echoed back
+	_, err = s.receive(encodeGroups(ours))
+	require.NoError(t, err)
+	require.Equal(t, int64(8), s.Gossip().(multicastGossipData)[1].Version)
+}
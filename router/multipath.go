@@ -0,0 +1,640 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/weaveworks/mesh"
+)
+
+// MultipathOverlay spreads the traffic to each peer across several
+// paths, each from one of our local addresses to one of the peer's,
+// e.g. on hosts with separately routed uplinks.  Each local address
+// has a sleeve overlay of its own, bound to that address and
+// multipathPortOffset above the router port, so that it doesn't clash
+// with the main sleeve.
+//
+// Both ends advertise their addresses in the connection features.
+// Not every pair of addresses need be able to reach each other, so
+// the end that made the connection probes pairs, with sleeve
+// heartbeats, until each of its addresses has a working path or has
+// tried all the peer's addresses.  It starts by pairing the addresses
+// up in order, and when a path fails to establish, or fails later, it
+// asks the peer to listen for the next pair to try for that address.
+// No address is in more than one path at a time, so there are at most
+// as many paths as the end with fewer addresses has.
+//
+// Frames are assigned to established paths by rendezvous hashing of
+// their flow, so that when a path fails only the flows that were
+// using it move to the others.
+
+const (
+	multipathAddrsFeature = "MultipathAddrs"
+	multipathPortOffset   = 2
+
+	// Paths are numbered by their pair of addresses, and use that as
+	// the tag of their control messages, so we can take this many
+	// addresses from each end, leaving the tags above for the
+	// multipath forwarder's own messages
+	maxMultipathAddrs  = 15
+	multipathProbeTag  = 254 // listen for the path numbered in the message
+	multipathGiveUpTag = 255 // all the paths have failed
+)
+
+type MultipathOverlay struct {
+	addrs []net.IP
+	paths []NetworkOverlay
+}
+
+func NewMultipathOverlay(addrs []net.IP, port int, classes *TrafficClasses) *MultipathOverlay {
+	if len(addrs) > maxMultipathAddrs {
+		log.Warningf("Only using the first %d of %d multipath addresses", maxMultipathAddrs, len(addrs))
+		addrs = addrs[:maxMultipathAddrs]
+	}
+	overlay := &MultipathOverlay{addrs: addrs}
+	for _, addr := range addrs {
+		overlay.paths = append(overlay.paths, NewSleeveOverlay(addr.String(), port+multipathPortOffset, classes))
+	}
+	return overlay
+}
+
+func (mp *MultipathOverlay) AddFeaturesTo(features map[string]string) {
+	addrs := make([]string, len(mp.addrs))
+	for i, addr := range mp.addrs {
+		addrs[i] = addr.String()
+	}
+	features[multipathAddrsFeature] = strings.Join(addrs, " ")
+}
+
+func (mp *MultipathOverlay) Diagnostics() interface{} {
+	diagnostics := make(map[string]interface{})
+	for i, path := range mp.paths {
+		diagnostics[mp.addrs[i].String()] = path.Diagnostics()
+	}
+	return diagnostics
+}
+
+func (mp *MultipathOverlay) InvalidateRoutes() {
+	for _, path := range mp.paths {
+		path.InvalidateRoutes()
+	}
+}
+
+func (mp *MultipathOverlay) InvalidateShortIDs() {
+	for _, path := range mp.paths {
+		path.InvalidateShortIDs()
+	}
+}
+
+func (mp *MultipathOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
+	for _, path := range mp.paths {
+		if err := path.StartConsumingPackets(localPeer, peers, consumer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Each path gets its own session key, so that the paths' nonces
+// can't collide
+func multipathSessionKey(sessionKey *[32]byte, index int) *[32]byte {
+	if sessionKey == nil {
+		return nil
+	}
+	hash := sha256.New()
+	hash.Write(sessionKey[:])
+	fmt.Fprint(hash, "multipath", index)
+	var key [32]byte
+	copy(key[:], hash.Sum(nil))
+	return &key
+}
+
+func (mp *MultipathOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	var remoteAddrs []net.IP
+	for _, s := range strings.Fields(params.Features[multipathAddrsFeature]) {
+		if ip := net.ParseIP(s); ip != nil {
+			remoteAddrs = append(remoteAddrs, ip)
+		}
+	}
+	if len(remoteAddrs) > maxMultipathAddrs {
+		remoteAddrs = remoteAddrs[:maxMultipathAddrs]
+	}
+	if len(mp.addrs) == 0 || len(remoteAddrs) == 0 {
+		return nil, fmt.Errorf("no multipath addresses in common with peer")
+	}
+
+	fwd := newMultipathForwarder(params.RemotePeer, params.Outbound, mp.addrs, remoteAddrs, params.SendControlMessage)
+	fwd.newPath = func(pair int) (OverlayForwarder, error) {
+		local, remote := fwd.addrsOf(pair)
+		pathParams := params
+		pathParams.SendControlMessage = func(tag byte, msg []byte) error {
+			xmsg := make([]byte, len(msg)+1)
+			xmsg[0] = tag
+			copy(xmsg[1:], msg)
+			return params.SendControlMessage(byte(pair), xmsg)
+		}
+		pathParams.LocalAddr = &net.TCPAddr{IP: mp.addrs[local]}
+		if params.RemoteAddr != nil {
+			pathParams.RemoteAddr = &net.TCPAddr{IP: remoteAddrs[remote], Port: params.RemoteAddr.Port + multipathPortOffset}
+		}
+		pathParams.SessionKey = multipathSessionKey(params.SessionKey, pair)
+
+		subConn, err := mp.paths[local].PrepareConnection(pathParams)
+		if err != nil {
+			return nil, err
+		}
+		return subConn.(OverlayForwarder), nil
+	}
+	fwd.start()
+	return fwd, nil
+}
+
+type multipathForwarder struct {
+	remotePeer *mesh.Peer
+
+	// Did we make the connection, and so choose which paths to
+	// probe?
+	outbound    bool
+	localAddrs  []net.IP
+	remoteAddrs []net.IP
+
+	// Makes the forwarder for a path
+	newPath            func(pair int) (OverlayForwarder, error)
+	sendControlMessage func(tag byte, msg []byte) error
+
+	lock sync.Mutex
+
+	// Indexed by path number, i.e. by the index of the connecting
+	// end's address times the number of the other end's addresses,
+	// plus the index of the other end's address
+	paths []subForwarder
+
+	// The paths we have tried, so as not to try them again
+	probed []bool
+
+	confirmed bool
+
+	eventsChan chan subForwarderEvent
+
+	// closed to tell the main goroutine to stop
+	stopChan chan struct{}
+	stopped  bool
+
+	alreadyEstablished bool
+	establishedChan    chan struct{}
+	errorChan          chan error
+}
+
+func newMultipathForwarder(remotePeer *mesh.Peer, outbound bool, localAddrs, remoteAddrs []net.IP, sendControlMessage func(byte, []byte) error) *multipathForwarder {
+	pairs := len(localAddrs) * len(remoteAddrs)
+	return &multipathForwarder{
+		remotePeer:         remotePeer,
+		outbound:           outbound,
+		localAddrs:         localAddrs,
+		remoteAddrs:        remoteAddrs,
+		sendControlMessage: sendControlMessage,
+		paths:              make([]subForwarder, pairs),
+		probed:             make([]bool, pairs),
+		eventsChan:         make(chan subForwarderEvent),
+		stopChan:           make(chan struct{}),
+		establishedChan:    make(chan struct{}),
+		errorChan:          make(chan error, 1),
+	}
+}
+
+// The number of the path between our local address and the remote one
+func (fwd *multipathForwarder) pair(local, remote int) int {
+	if fwd.outbound {
+		return local*len(fwd.remoteAddrs) + remote
+	}
+	return remote*len(fwd.localAddrs) + local
+}
+
+// The indices of our local address and the remote one on a path
+func (fwd *multipathForwarder) addrsOf(pair int) (local, remote int) {
+	if fwd.outbound {
+		return pair / len(fwd.remoteAddrs), pair % len(fwd.remoteAddrs)
+	}
+	return pair % len(fwd.localAddrs), pair / len(fwd.localAddrs)
+}
+
+func (fwd *multipathForwarder) pathName(pair int) string {
+	local, remote := fwd.addrsOf(pair)
+	return fmt.Sprint(fwd.localAddrs[local], "->", fwd.remoteAddrs[remote])
+}
+
+// Both ends start with the addresses paired up in order, so the first
+// paths need no probe messages
+func (fwd *multipathForwarder) start() {
+	fwd.lock.Lock()
+	for i := 0; i < len(fwd.localAddrs) && i < len(fwd.remoteAddrs); i++ {
+		fwd.startPath(fwd.pair(i, i))
+	}
+	if !fwd.inUse(-1, -1) {
+		fwd.fail()
+	}
+	fwd.lock.Unlock()
+	go fwd.run()
+}
+
+// Called with the lock held
+func (fwd *multipathForwarder) startPath(pair int) {
+	fwd.probed[pair] = true
+	path, err := fwd.newPath(pair)
+	if err != nil {
+		log.Infof("Unable to use path %s for connection to %s(%s): %s",
+			fwd.pathName(pair), fwd.remotePeer.Name, fwd.remotePeer.NickName, err)
+		return
+	}
+
+	stopChan := make(chan struct{})
+	go monitorForwarder(pair, fwd.eventsChan, stopChan, path)
+	fwd.paths[pair] = subForwarder{
+		fwd:         path,
+		overlayName: fwd.pathName(pair),
+		stopChan:    stopChan,
+	}
+	if fwd.confirmed {
+		path.Confirm()
+	}
+}
+
+// Called with the lock held
+func (fwd *multipathForwarder) stopPath(pair int) {
+	path := &fwd.paths[pair]
+	if path.fwd != nil {
+		path.fwd = nil
+		path.established = false
+		close(path.stopChan)
+	}
+}
+
+// Is any running path using the local and remote addresses, where
+// -1 stands for any address?  Called with the lock held.
+func (fwd *multipathForwarder) inUse(local, remote int) bool {
+	for pair, path := range fwd.paths {
+		if path.fwd == nil {
+			continue
+		}
+		l, r := fwd.addrsOf(pair)
+		if (local < 0 || l == local) && (remote < 0 || r == remote) {
+			return true
+		}
+	}
+	return false
+}
+
+// probe starts paths from those of our addresses without one, to
+// remote addresses they haven't tried, free ones taken in turn from
+// the one after the last the address paired up with.  Only the end
+// that made the connection probes; it tells the other end to listen
+// for each path first.  Called with the lock held.
+func (fwd *multipathForwarder) probe() {
+	if !fwd.outbound || fwd.stopped {
+		return
+	}
+	for local := range fwd.localAddrs {
+		if fwd.inUse(local, -1) {
+			continue
+		}
+		for i := range fwd.remoteAddrs {
+			remote := (local + i) % len(fwd.remoteAddrs)
+			pair := fwd.pair(local, remote)
+			if fwd.probed[pair] || fwd.inUse(-1, remote) {
+				continue
+			}
+			log.Info(fwd.logPrefix(), "probing path ", fwd.pathName(pair))
+			if err := fwd.sendControlMessage(multipathProbeTag, []byte{byte(pair)}); err != nil {
+				log.Info(fwd.logPrefix(), "unable to probe path ", fwd.pathName(pair), ": ", err)
+			}
+			fwd.startPath(pair)
+			break
+		}
+	}
+}
+
+func (fwd *multipathForwarder) run() {
+loop:
+	for {
+		select {
+		case <-fwd.stopChan:
+			break loop
+
+		case e := <-fwd.eventsChan:
+			switch {
+			case e.established:
+				fwd.established(e.index)
+			case e.err != nil:
+				fwd.error(e.index, e.err)
+			}
+		}
+	}
+
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	fwd.stopPaths()
+}
+
+func (fwd *multipathForwarder) logPrefix() string {
+	return fmt.Sprintf("multipath ->[%s] ", fwd.remotePeer)
+}
+
+func (fwd *multipathForwarder) established(pair int) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	if fwd.paths[pair].fwd == nil {
+		return
+	}
+	fwd.paths[pair].established = true
+	log.Info(fwd.logPrefix(), "path ", fwd.paths[pair].overlayName, " established")
+
+	if !fwd.alreadyEstablished {
+		fwd.alreadyEstablished = true
+		close(fwd.establishedChan)
+	}
+}
+
+func (fwd *multipathForwarder) error(pair int, err error) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	if fwd.paths[pair].fwd == nil {
+		// already replaced by another path
+		return
+	}
+	log.Info(fwd.logPrefix(), "path ", fwd.paths[pair].overlayName, " failed: ", err)
+	fwd.paths[pair].fwd = nil
+	fwd.paths[pair].established = false
+	fwd.probe()
+	fwd.checkWorking()
+}
+
+// The end that made the connection gives up once it has no working
+// paths and none left to probe, and tells the other end, which has
+// no way of knowing what is left to probe.  Called with the lock held.
+func (fwd *multipathForwarder) checkWorking() {
+	if !fwd.outbound || fwd.inUse(-1, -1) {
+		return
+	}
+	if err := fwd.sendControlMessage(multipathGiveUpTag, nil); err != nil {
+		log.Info(fwd.logPrefix(), "unable to tell peer we are giving up: ", err)
+	}
+	fwd.fail()
+}
+
+// Called with the lock held
+func (fwd *multipathForwarder) fail() {
+	select {
+	case fwd.errorChan <- fmt.Errorf("no working paths to %s", fwd.remotePeer):
+	default:
+	}
+}
+
+// Called with the lock held
+func (fwd *multipathForwarder) stopPaths() {
+	for pair := range fwd.paths {
+		fwd.stopPath(pair)
+	}
+}
+
+// The paths to try for a flow, best first: those established, then
+// those merely working, each ordered by rendezvous hash.
+func (fwd *multipathForwarder) pathsFor(flow uint64) []OverlayForwarder {
+	type candidate struct {
+		fwd         OverlayForwarder
+		established bool
+		weight      uint64
+	}
+
+	fwd.lock.Lock()
+	var candidates []candidate
+	for pair, path := range fwd.paths {
+		if path.fwd == nil {
+			continue
+		}
+		candidates = append(candidates, candidate{path.fwd, path.established, rendezvousWeight(flow, pair)})
+	}
+	fwd.lock.Unlock()
+
+	better := func(a, b candidate) bool {
+		if a.established != b.established {
+			return a.established
+		}
+		return a.weight > b.weight
+	}
+	// there are only a handful of paths
+	for i := 1; i < len(candidates); i++ {
+		for j := i; j > 0 && better(candidates[j], candidates[j-1]); j-- {
+			candidates[j], candidates[j-1] = candidates[j-1], candidates[j]
+		}
+	}
+
+	result := make([]OverlayForwarder, len(candidates))
+	for i, c := range candidates {
+		result[i] = c.fwd
+	}
+	return result
+}
+
+func rendezvousWeight(flow uint64, pair int) uint64 {
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[:], flow)
+	buf[8] = byte(pair)
+	hash := fnv.New64a()
+	hash.Write(buf[:])
+	return hash.Sum64()
+}
+
+// flowHash identifies the flow a frame belongs to, so that its frames
+// all take the same path.  For IPv4 that is the addresses, protocol
+// and ports; fragments other than the first have no ports, so for
+// fragmented packets it is just the addresses and protocol.  Frames
+// of other kinds go by their MAC addresses.
+func flowHash(key PacketKey, dec *EthernetDecoder) uint64 {
+	hash := fnv.New64a()
+	if len(dec.decoded) != 2 {
+		hash.Write(key.SrcMAC[:])
+		hash.Write(key.DstMAC[:])
+		return hash.Sum64()
+	}
+
+	hash.Write(dec.IP.SrcIP.To4())
+	hash.Write(dec.IP.DstIP.To4())
+	hash.Write([]byte{byte(dec.IP.Protocol)})
+	if dec.IP.Flags&layers.IPv4MoreFragments != 0 || dec.IP.FragOffset != 0 {
+		return hash.Sum64()
+	}
+	switch dec.IP.Protocol {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolSCTP, layers.IPProtocolUDPLite:
+		if ports := dec.IP.Payload; len(ports) >= 4 {
+			hash.Write(ports[:4])
+		}
+	}
+	return hash.Sum64()
+}
+
+// The path can only be chosen once we can see the frame
+type multipathFlowOp struct {
+	NonDiscardingFlowOp
+	fwd *multipathForwarder
+	key ForwardPacketKey
+}
+
+func (op multipathFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	for _, path := range op.fwd.pathsFor(flowHash(op.key.PacketKey, dec)) {
+		if pathOp := path.Forward(op.key); pathOp != nil {
+			pathOp.Process(frame, dec, broadcast)
+			return
+		}
+	}
+}
+
+func (fwd *multipathForwarder) Forward(pk ForwardPacketKey) FlowOp {
+	return multipathFlowOp{fwd: fwd, key: pk}
+}
+
+func (fwd *multipathForwarder) Confirm() {
+	var paths []OverlayForwarder
+
+	fwd.lock.Lock()
+	fwd.confirmed = true
+	for _, path := range fwd.paths {
+		if path.fwd != nil {
+			paths = append(paths, path.fwd)
+		}
+	}
+	fwd.lock.Unlock()
+
+	for _, path := range paths {
+		path.Confirm()
+	}
+}
+
+func (fwd *multipathForwarder) EstablishedChannel() <-chan struct{} {
+	return fwd.establishedChan
+}
+
+func (fwd *multipathForwarder) ErrorChannel() <-chan error {
+	return fwd.errorChan
+}
+
+func (fwd *multipathForwarder) Stop() {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	if !fwd.stopped {
+		fwd.stopped = true
+		close(fwd.stopChan)
+	}
+	fwd.stopPaths()
+}
+
+func (fwd *multipathForwarder) ControlMessage(tag byte, msg []byte) {
+	switch tag {
+	case multipathProbeTag:
+		if len(msg) == 1 {
+			fwd.listen(int(msg[0]))
+		}
+		return
+	case multipathGiveUpTag:
+		fwd.lock.Lock()
+		fwd.fail()
+		fwd.lock.Unlock()
+		return
+	}
+
+	if len(msg) == 0 {
+		return
+	}
+	var path OverlayForwarder
+	fwd.lock.Lock()
+	if int(tag) < len(fwd.paths) {
+		path = fwd.paths[tag].fwd
+	}
+	fwd.lock.Unlock()
+	if path != nil {
+		path.ControlMessage(msg[0], msg[1:])
+	}
+}
+
+// listen starts the path the other end is about to probe, in place
+// of any other path using our address for it, which it has given up
+// on
+func (fwd *multipathForwarder) listen(pair int) {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+
+	if fwd.outbound || fwd.stopped || pair >= len(fwd.paths) || fwd.paths[pair].fwd != nil {
+		return
+	}
+	local, _ := fwd.addrsOf(pair)
+	for other := range fwd.paths {
+		if l, _ := fwd.addrsOf(other); l == local {
+			fwd.stopPath(other)
+		}
+	}
+	fwd.startPath(pair)
+}
+
+// The average quality of the paths in use
+func (fwd *multipathForwarder) LinkQuality() (LinkQuality, bool) {
+	var (
+		total LinkQuality
+		count int
+	)
+	for _, path := range fwd.establishedPaths() {
+		if reporter, ok := path.(linkQualityReporter); ok {
+			if quality, ok := reporter.LinkQuality(); ok {
+				total.RTT += quality.RTT
+				total.Loss += quality.Loss
+				count++
+			}
+		}
+	}
+	if count == 0 {
+		return LinkQuality{}, false
+	}
+	return LinkQuality{total.RTT / time.Duration(count), total.Loss / float64(count)}, true
+}
+
+// The smallest path MTU of the paths in use, since frames may be
+// sent down any of them
+func (fwd *multipathForwarder) PMTU() (int, bool) {
+	min, found := 0, false
+	for _, path := range fwd.establishedPaths() {
+		if reporter, ok := path.(pmtuReporter); ok {
+			if pmtu, ok := reporter.PMTU(); ok && (!found || pmtu < min) {
+				min, found = pmtu, true
+			}
+		}
+	}
+	return min, found
+}
+
+func (fwd *multipathForwarder) establishedPaths() []OverlayForwarder {
+	var paths []OverlayForwarder
+	fwd.lock.Lock()
+	for _, path := range fwd.paths {
+		if path.fwd != nil && path.established {
+			paths = append(paths, path.fwd)
+		}
+	}
+	fwd.lock.Unlock()
+	return paths
+}
+
+// The number of established paths, out of as many as there could be
+func (fwd *multipathForwarder) DisplayName() string {
+	possible := len(fwd.localAddrs)
+	if len(fwd.remoteAddrs) < possible {
+		possible = len(fwd.remoteAddrs)
+	}
+	return fmt.Sprintf("multipath(%d/%d)", len(fwd.establishedPaths()), possible)
+}
@@ -0,0 +1,299 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+var (
+	multipathTestSrcMAC = MAC{0x02, 0, 0, 0, 0, 1}
+	multipathTestDstMAC = MAC{0x02, 0, 0, 0, 0, 2}
+)
+
+func multipathTestAddrs(prefix byte, n int) []net.IP {
+	var addrs []net.IP
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, net.IPv4(10, prefix, byte(i), 1).To4())
+	}
+	return addrs
+}
+
+// A path that records which frames were sent down it
+type multipathTestPath struct {
+	*fakeForwarder
+	pair   int
+	sentOn *int
+}
+
+func (path *multipathTestPath) Forward(ForwardPacketKey) FlowOp {
+	return multipathTestFlowOp{path}
+}
+
+type multipathTestFlowOp struct {
+	path *multipathTestPath
+}
+
+func (op multipathTestFlowOp) Process([]byte, *EthernetDecoder, bool) {
+	*op.path.sentOn = op.path.pair
+}
+
+func (multipathTestFlowOp) Discards() bool { return false }
+
+type multipathTest struct {
+	*multipathForwarder
+	paths  map[int]*multipathTestPath
+	sent   []byte // the multipath forwarder's own control messages
+	sentOn int
+}
+
+func newMultipathTest(t *testing.T, outbound bool, local, remote int) *multipathTest {
+	test := &multipathTest{paths: make(map[int]*multipathTestPath)}
+	// sendControlMessage and newPath are called with the lock held
+	send := func(tag byte, msg []byte) error {
+		test.sent = append(test.sent, tag)
+		test.sent = append(test.sent, msg...)
+		return nil
+	}
+	test.multipathForwarder = newMultipathForwarder(&mesh.Peer{Name: 2}, outbound,
+		multipathTestAddrs(1, local), multipathTestAddrs(2, remote), send)
+	test.newPath = func(pair int) (OverlayForwarder, error) {
+		path := &multipathTestPath{
+			fakeForwarder: &fakeForwarder{establishedChan: make(chan struct{}), errorChan: make(chan error, 1)},
+			pair:          pair,
+			sentOn:        &test.sentOn,
+		}
+		test.paths[pair] = path
+		return path, nil
+	}
+	test.start()
+	test.Confirm()
+	return test
+}
+
+// The paths' events reach the forwarder asynchronously
+func (test *multipathTest) await(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		test.lock.Lock()
+		done := cond()
+		test.lock.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "timed out waiting for the multipath forwarder")
+}
+
+func (test *multipathTest) running() []int {
+	var pairs []int
+	for pair, path := range test.multipathForwarder.paths {
+		if path.fwd != nil {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+func (test *multipathTest) establish(t *testing.T, pair int) {
+	close(test.paths[pair].establishedChan)
+	test.await(t, func() bool { return test.multipathForwarder.paths[pair].established })
+}
+
+func (test *multipathTest) fail(t *testing.T, pair int, running ...int) {
+	test.paths[pair].errorChan <- fmt.Errorf("timed out waiting for UDP heartbeat")
+	test.await(t, func() bool { return fmt.Sprint(test.running()) == fmt.Sprint(running) })
+}
+
+func TestMultipathPairNumbering(t *testing.T) {
+	outbound := newMultipathForwarder(nil, true, multipathTestAddrs(1, 2), multipathTestAddrs(2, 3), nil)
+	inbound := newMultipathForwarder(nil, false, multipathTestAddrs(2, 3), multipathTestAddrs(1, 2), nil)
+	seen := make(map[int]bool)
+	for local := 0; local < 2; local++ {
+		for remote := 0; remote < 3; remote++ {
+			pair := outbound.pair(local, remote)
+			require.False(t, seen[pair])
+			seen[pair] = true
+			require.Equal(t, pair, inbound.pair(remote, local))
+
+			l, r := outbound.addrsOf(pair)
+			require.Equal(t, []int{local, remote}, []int{l, r})
+			l, r = inbound.addrsOf(pair)
+			require.Equal(t, []int{remote, local}, []int{l, r})
+		}
+	}
+}
+
+func TestMultipathProbesOtherPairs(t *testing.T) {
+	// paths are numbered local*3 + remote
+	test := newMultipathTest(t, true, 2, 3)
+	defer test.Stop()
+	require.Equal(t, []int{0, 4}, test.running())
+	require.True(t, test.paths[0].confirmed)
+	require.Empty(t, test.sent)
+
+	// 10.1.0.1 can't reach 10.2.0.1, and 10.2.1.1 is taken, so it
+	// tries 10.2.2.1
+	test.fail(t, 0, 2, 4)
+	require.Equal(t, []byte{multipathProbeTag, 2}, test.sent)
+	require.True(t, test.paths[2].confirmed)
+	test.establish(t, 2)
+	test.establish(t, 4)
+	require.Equal(t, "multipath(2/2)", test.DisplayName())
+
+	// nothing left for 10.1.0.1 to try while 10.1.1.1 has 10.2.1.1
+	test.sent = nil
+	test.fail(t, 2, 4)
+	require.Empty(t, test.sent)
+	require.Equal(t, "multipath(1/2)", test.DisplayName())
+
+	test.fail(t, 4, 1, 5)
+	require.Equal(t, []byte{multipathProbeTag, 1, multipathProbeTag, 5}, test.sent)
+
+	test.sent = nil
+	test.fail(t, 1, 5)
+	test.fail(t, 5, 3)
+	require.Equal(t, []byte{multipathProbeTag, 3}, test.sent)
+
+	// every pair has been tried
+	test.sent = nil
+	test.fail(t, 3)
+	require.Equal(t, []byte{multipathGiveUpTag}, test.sent)
+	select {
+	case err := <-test.ErrorChannel():
+		require.Error(t, err)
+	default:
+		require.FailNow(t, "multipath forwarder did not fail")
+	}
+}
+
+func TestMultipathListensForProbes(t *testing.T) {
+	// paths are numbered remote*2 + local
+	test := newMultipathTest(t, false, 2, 2)
+	defer test.Stop()
+	require.Equal(t, []int{0, 3}, test.running())
+
+	// the other end gives up on 10.2.1.1 -> 10.1.1.1 and tries
+	// 10.2.0.1 -> 10.1.1.1 instead
+	test.ControlMessage(multipathProbeTag, []byte{1})
+	require.Equal(t, []int{0, 1}, test.running())
+	require.True(t, test.paths[1].confirmed)
+	test.await(t, func() bool { return test.paths[3].isStopped() })
+
+	// the paths' own control messages reach them
+	test.ControlMessage(1, []byte{ProtocolHeartbeatEcho})
+	require.Equal(t, []byte{ProtocolHeartbeatEcho}, test.paths[1].controlMsgs)
+
+	// paths failing on this end don't fail the connection
+	test.fail(t, 0, 1)
+	test.fail(t, 1)
+	select {
+	case <-test.ErrorChannel():
+		require.FailNow(t, "multipath forwarder failed before the other end gave up")
+	default:
+	}
+
+	test.ControlMessage(multipathGiveUpTag, nil)
+	select {
+	case err := <-test.ErrorChannel():
+		require.Error(t, err)
+	default:
+		require.FailNow(t, "multipath forwarder did not fail")
+	}
+}
+
+// A TCP segment from the given port, or a fragment of a UDP datagram
+func multipathTestFrame(t *testing.T, srcPort uint16, payload []byte, fragOffset uint16) (ForwardPacketKey, []byte, *EthernetDecoder) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 32, 0, 1).To4(),
+		DstIP:    net.IPv4(10, 32, 0, 2).To4(),
+	}
+	if fragOffset != 0 {
+		ip.Protocol = layers.IPProtocolUDP
+		ip.Flags = layers.IPv4MoreFragments
+		ip.FragOffset = fragOffset
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, srcPort)
+	binary.BigEndian.PutUint16(ports[2:], 80)
+	body := gopacket.Payload(append(ports, payload...))
+
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{
+			SrcMAC:       multipathTestSrcMAC[:],
+			DstMAC:       multipathTestDstMAC[:],
+			EthernetType: layers.EthernetTypeIPv4},
+		ip, &body))
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(buf.Bytes())
+	key := ForwardPacketKey{PacketKey: dec.PacketKey(), SrcPeer: &mesh.Peer{Name: 1}, DstPeer: &mesh.Peer{Name: 2}}
+	return key, buf.Bytes(), dec
+}
+
+func TestMultipathFlowHash(t *testing.T) {
+	key, _, dec := multipathTestFrame(t, 1000, []byte("hello"), 0)
+	flow := flowHash(key.PacketKey, dec)
+	key, _, dec = multipathTestFrame(t, 1000, []byte("goodbye"), 0)
+	require.Equal(t, flow, flowHash(key.PacketKey, dec))
+	key, _, dec = multipathTestFrame(t, 1001, []byte("hello"), 0)
+	require.NotEqual(t, flow, flowHash(key.PacketKey, dec))
+
+	// the later fragments of a datagram have no ports, so none of
+	// its fragments go by them
+	key, _, dec = multipathTestFrame(t, 1000, []byte("hello"), 1)
+	fragment := flowHash(key.PacketKey, dec)
+	key, _, dec = multipathTestFrame(t, 2000, []byte("hello"), 2)
+	require.Equal(t, fragment, flowHash(key.PacketKey, dec))
+
+	// frames other than IPv4 go by MAC address
+	dec = NewEthernetDecoder()
+	dec.Eth.SrcMAC = multipathTestSrcMAC[:]
+	require.Equal(t, flowHash(key.PacketKey, dec), flowHash(key.PacketKey, dec))
+	require.NotEqual(t, flow, flowHash(key.PacketKey, dec))
+}
+
+func TestMultipathSpreadsFlows(t *testing.T) {
+	test := newMultipathTest(t, true, 2, 2)
+	defer test.Stop()
+	test.establish(t, 0)
+	test.establish(t, 3)
+
+	// flows between the same pair of hosts take both paths
+	sentOn := make(map[uint16]int)
+	for port := uint16(1000); port < 1100; port++ {
+		key, frame, dec := multipathTestFrame(t, port, nil, 0)
+		test.Forward(key).Process(frame, dec, false)
+		sentOn[port] = test.sentOn
+	}
+	counts := make(map[int]int)
+	for _, pair := range sentOn {
+		counts[pair]++
+	}
+	require.Len(t, counts, 2)
+
+	// a flow sticks to its path
+	key, frame, dec := multipathTestFrame(t, 1000, []byte("more"), 0)
+	test.Forward(key).Process(frame, dec, false)
+	require.Equal(t, sentOn[1000], test.sentOn)
+
+	// only the flows on a failed path move
+	test.fail(t, 0, 3)
+	for port, pair := range sentOn {
+		key, frame, dec := multipathTestFrame(t, port, nil, 0)
+		test.Forward(key).Process(frame, dec, false)
+		if pair == 3 {
+			require.Equal(t, 3, test.sentOn)
+		}
+	}
+}
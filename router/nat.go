@@ -0,0 +1,642 @@
+package router
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// NAT traversal
+//
+// A peer behind NAT can connect out to other peers, but their UDP
+// heartbeats to it, sent to the address its TCP connection came
+// from, don't get through.  So whenever a sleeve forwarder hears a
+// heartbeat, it tells the remote peer the address the heartbeat came
+// from, letting every peer learn its public addresses from the peers
+// it is connected to.  If a connection hears no heartbeats for a
+// while, its two ends swap these addresses over the control channel,
+// and both send heartbeats to all of the other's, opening up the NAT
+// mappings on each side ("hole punching").
+//
+// Two peers behind NAT can't make a connection to each other at all.
+// For those, the peer with the lower name picks a rendezvous: a
+// neighbour that is connected to both.  The rendezvous passes on
+// control messages between the two, in which they agree a session
+// key and then punch holes as above, giving a "NAT path" - a sleeve
+// forwarder that isn't part of any mesh connection.  Until the NAT
+// path is established, or if it fails, traffic for the peer is
+// relayed explicitly through the rendezvous.  A failed NAT path is
+// tried again after relayRetryInterval.
+
+const (
+	// Connection feature saying that we take part in hole punching
+	natTraversalFeature = "NATTraversal"
+	// How long to wait for a heartbeat before punching holes
+	punchDelay = 4 * FastHeartbeat
+	// How many of our public addresses to remember
+	maxObservedAddrs = 4
+	// How often to look for peers to make NAT paths to
+	natCheckInterval = 5 * time.Second
+	// How long a NAT path gets to become established
+	natPunchTimeout = 30 * FastHeartbeat
+	// How long traffic is relayed before trying a NAT path again
+	relayRetryInterval = 5 * time.Minute
+)
+
+// The public address a peer saw our heartbeats come from
+func (sleeve *SleeveOverlay) addObservedAddr(addr *net.UDPAddr) {
+	sleeve.lock.Lock()
+	defer sleeve.lock.Unlock()
+	for i, existing := range sleeve.observedAddrs {
+		if udpAddrsEqual(existing, addr) {
+			sleeve.observedAddrs = append(sleeve.observedAddrs[:i], sleeve.observedAddrs[i+1:]...)
+			break
+		}
+	}
+	if len(sleeve.observedAddrs) >= maxObservedAddrs {
+		sleeve.observedAddrs = sleeve.observedAddrs[1:]
+	}
+	sleeve.observedAddrs = append(sleeve.observedAddrs, addr)
+}
+
+// The addresses a peer might reach us at: our local address, for
+// peers behind the same NAT, and those other peers have seen us at
+func (sleeve *SleeveOverlay) candidateAddrs(localIP net.IP) []*net.UDPAddr {
+	sleeve.lock.Lock()
+	defer sleeve.lock.Unlock()
+	addrs := []*net.UDPAddr{{IP: localIP, Port: sleeve.localPort}}
+	for _, addr := range sleeve.observedAddrs {
+		if !udpAddrsEqual(addr, addrs[0]) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func encodeUDPAddrs(addrs []*net.UDPAddr) []byte {
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+	return []byte(strings.Join(strs, " "))
+}
+
+func decodeUDPAddrs(msg []byte) []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	for _, s := range strings.Fields(string(msg)) {
+		if addr, err := net.ResolveUDPAddr("udp4", s); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (sleeve *SleeveOverlay) natTraversal() *natTraversal {
+	return sleeve.nat
+}
+
+// A control message to be passed on to another peer, or, if it is
+// for us, one that has been passed on.  We only pass on messages from
+// the peer at the other end of the connection they came over.
+func (sleeve *SleeveOverlay) handleRelayedControlMsg(from *sleeveForwarder, msg []byte) {
+	dst, src, tag, body, err := decodeRelayedControlMsg(msg)
+	switch {
+	case err != nil:
+		log.Print(from.logPrefix(), err)
+	case from.natPath:
+		// rendezvous are neighbours
+	case dst == sleeve.localPeer.Name:
+		sleeve.nat.handleControlMsg(time.Now(), src, from.remotePeer.Name, tag, body)
+	case src != from.remotePeer.Name:
+		log.Print(from.logPrefix(), "Ignoring control message from ", src, " to ", dst)
+	default:
+		fwd := sleeve.lookupForwarder(dst)
+		if fwd == nil || fwd.natPath || !fwd.natTraversal {
+			log.Debug(from.logPrefix(), "no connection to pass on control message to ", dst)
+			return
+		}
+		if err := fwd.sendControlMsg(ProtocolRelayedControl, msg); err != nil {
+			log.Print(fwd.logPrefix(), err)
+		}
+	}
+}
+
+func (sleeve *SleeveOverlay) sendRelayedControlMsg(via mesh.PeerName, dst *mesh.Peer, tag byte, msg []byte) error {
+	fwd := sleeve.lookupForwarder(via)
+	if fwd == nil || fwd.natPath || !fwd.natTraversal {
+		return fmt.Errorf("no connection to %s to pass on control messages", via)
+	}
+	return fwd.sendControlMsg(ProtocolRelayedControl, encodeRelayedControlMsg(dst, sleeve.localPeer, tag, msg))
+}
+
+// A forwarder for a NAT path, sending from the address our connection
+// to the rendezvous uses
+func (sleeve *SleeveOverlay) newNATForwarder(peer *mesh.Peer, via mesh.PeerName, connUID uint64, sessionKey *[32]byte, outbound bool, sendControlMsg func(byte, []byte) error) (OverlayForwarder, error) {
+	if existing := sleeve.lookupForwarder(peer.Name); existing != nil && !existing.natPath {
+		return nil, fmt.Errorf("already connected to %s", peer)
+	}
+	viaFwd := sleeve.lookupForwarder(via)
+	if viaFwd == nil {
+		return nil, fmt.Errorf("no connection to %s", via)
+	}
+	return sleeve.newForwarder(mesh.OverlayConnectionParams{
+		RemotePeer:         peer,
+		LocalAddr:          &net.TCPAddr{IP: viaFwd.senderDF.localIP},
+		Outbound:           outbound,
+		ConnUID:            connUID,
+		SessionKey:         sessionKey,
+		SendControlMessage: sendControlMsg,
+		Features:           map[string]string{natTraversalFeature: "1"},
+	}, true), nil
+}
+
+// Control messages passed on by a rendezvous carry the names of the
+// peers they are to and from
+func encodeRelayedControlMsg(dst, src *mesh.Peer, tag byte, msg []byte) []byte {
+	buf := make([]byte, 0, 2*NameSize+1+len(msg))
+	buf = append(buf, dst.NameByte...)
+	buf = append(buf, src.NameByte...)
+	buf = append(buf, tag)
+	return append(buf, msg...)
+}
+
+func decodeRelayedControlMsg(msg []byte) (dst, src mesh.PeerName, tag byte, body []byte, err error) {
+	if len(msg) < 2*NameSize+1 {
+		err = fmt.Errorf("relayed control message too short (%d bytes)", len(msg))
+		return
+	}
+	dst = mesh.PeerNameFromBin(msg[:NameSize])
+	src = mesh.PeerNameFromBin(msg[NameSize : 2*NameSize])
+	return dst, src, msg[2*NameSize], msg[2*NameSize+1:], nil
+}
+
+// The NAT path handshake: a request, answered by an accept, each
+// carrying the connection UID the forwarders at both ends use, and
+// the sender's public key for forming the session key
+func encodeNATHandshake(connUID uint64, publicKey *[32]byte) []byte {
+	msg := make([]byte, 8+len(publicKey))
+	binary.BigEndian.PutUint64(msg, connUID)
+	copy(msg[8:], publicKey[:])
+	return msg
+}
+
+func decodeNATHandshake(msg []byte) (uint64, *[32]byte, error) {
+	var publicKey [32]byte
+	if len(msg) != 8+len(publicKey) {
+		return 0, nil, fmt.Errorf("bad NAT handshake message length %d", len(msg))
+	}
+	copy(publicKey[:], msg[8:])
+	return binary.BigEndian.Uint64(msg), &publicKey, nil
+}
+
+// The same as mesh does for connections
+func formSessionKey(remotePublicKey, localPrivateKey *[32]byte, secretKey []byte) *[32]byte {
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, remotePublicKey, localPrivateKey)
+	sessionKey := sha256.Sum256(append(sharedKey[:], secretKey...))
+	return &sessionKey
+}
+
+func randomConnUID() (uint64, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+type natState int
+
+const (
+	natRequested natState = iota // waiting for the peer to accept
+	natPunching                  // waiting for heartbeats to get through
+	natDirect                    // established
+	natRelayed                   // failed, so traffic goes via the rendezvous
+)
+
+func (state natState) String() string {
+	switch state {
+	case natRequested:
+		return "requested"
+	case natPunching:
+		return "punching"
+	case natDirect:
+		return "direct"
+	case natRelayed:
+		return "relayed"
+	}
+	return "unknown"
+}
+
+type natPath struct {
+	peer      *mesh.Peer
+	via       mesh.PeerName // the rendezvous
+	initiator bool
+	state     natState
+	since     time.Time // when the path was requested, or, once relayed, failed
+	connUID   uint64
+
+	// Only kept by the initiator, until the peer accepts
+	privateKey *[32]byte
+
+	fwd      OverlayForwarder
+	stopChan chan struct{} // closed to stop monitoring fwd
+}
+
+// The NAT paths to the peers we have no connection to.  The sending
+// of control messages and the creation of forwarders are left to the
+// overlay.
+type natTraversal struct {
+	ourName  mesh.PeerName
+	password []byte // nil if encryption is disabled
+
+	// Send a control message to peer dst through via
+	send func(via mesh.PeerName, dst *mesh.Peer, tag byte, msg []byte) error
+	// Create a forwarder to a peer, which sends its control messages
+	// with sendControlMsg, using the local address we reach via from
+	newForwarder func(peer *mesh.Peer, via mesh.PeerName, connUID uint64, sessionKey *[32]byte, outbound bool, sendControlMsg func(byte, []byte) error) (OverlayForwarder, error)
+	lookupPeer   func(mesh.PeerName) *mesh.Peer
+	// Called whenever the way traffic goes to a peer changes
+	onChange func()
+
+	lock  sync.Mutex
+	paths map[mesh.PeerName]*natPath
+}
+
+func newNATTraversal() *natTraversal {
+	return &natTraversal{paths: make(map[mesh.PeerName]*natPath)}
+}
+
+func (nat *natTraversal) changed() {
+	if nat.onChange != nil {
+		nat.onChange()
+	}
+}
+
+// Bring the NAT paths into line with the peers we have no connection
+// to, given with the rendezvous to use for each
+func (nat *natTraversal) update(now time.Time, rendezvous map[mesh.PeerName]mesh.PeerName) {
+	var requests []natRequest
+	nat.lock.Lock()
+	changed := false
+	for name, path := range nat.paths {
+		via, found := rendezvous[name]
+		switch {
+		case !found || (path.initiator && via != path.via):
+			// the rendezvous of a path we accepted is the
+			// initiator's choice, so we only drop it if we
+			// have made a connection to the peer
+			nat.stopForwarder(path)
+			delete(nat.paths, name)
+			changed = true
+		case path.state == natRequested || path.state == natPunching:
+			if now.Sub(path.since) >= natPunchTimeout {
+				nat.giveUp(path, now, "timed out")
+				changed = true
+			}
+		case path.state == natRelayed:
+			if now.Sub(path.since) >= relayRetryInterval {
+				// try again, if it's up to us
+				delete(nat.paths, name)
+				changed = true
+			}
+		}
+	}
+	for name, via := range rendezvous {
+		if _, found := nat.paths[name]; found || name < nat.ourName {
+			continue
+		}
+		if path, msg := nat.newRequest(now, name, via); path != nil {
+			nat.paths[name] = path
+			requests = append(requests, natRequest{path.peer, via, msg})
+			changed = true
+		}
+	}
+	nat.lock.Unlock()
+
+	for _, req := range requests {
+		if err := nat.send(req.via, req.peer, ProtocolNATRequest, req.msg); err != nil {
+			// the timeout will take care of it
+			log.Print("NAT path to ", req.peer, " via ", req.via, ": ", err)
+		}
+	}
+	if changed {
+		nat.changed()
+	}
+}
+
+type natRequest struct {
+	peer *mesh.Peer
+	via  mesh.PeerName
+	msg  []byte
+}
+
+func (nat *natTraversal) newRequest(now time.Time, name, via mesh.PeerName) (*natPath, []byte) {
+	peer := nat.lookupPeer(name)
+	if peer == nil {
+		return nil, nil
+	}
+	connUID, err := randomConnUID()
+	if err != nil {
+		log.Print("NAT path to ", peer, ": ", err)
+		return nil, nil
+	}
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Print("NAT path to ", peer, ": ", err)
+		return nil, nil
+	}
+	log.Print("Requesting NAT path to ", peer, " via ", via)
+	path := &natPath{peer: peer, via: via, initiator: true, state: natRequested, since: now, connUID: connUID, privateKey: privateKey}
+	return path, encodeNATHandshake(connUID, publicKey)
+}
+
+// A control message for us, from src, passed on by via
+func (nat *natTraversal) handleControlMsg(now time.Time, src, via mesh.PeerName, tag byte, msg []byte) {
+	switch tag {
+	case ProtocolNATRequest:
+		nat.handleRequest(now, src, via, msg)
+	case ProtocolNATAccept:
+		nat.handleAccept(src, msg)
+	default:
+		nat.lock.Lock()
+		var fwd OverlayForwarder
+		if path := nat.paths[src]; path != nil {
+			fwd = path.fwd
+		}
+		nat.lock.Unlock()
+		if fwd != nil {
+			fwd.ControlMessage(tag, msg)
+		}
+	}
+}
+
+func (nat *natTraversal) handleRequest(now time.Time, src, via mesh.PeerName, msg []byte) {
+	connUID, remoteKey, err := decodeNATHandshake(msg)
+	if err != nil {
+		log.Print("NAT path request from ", src, ": ", err)
+		return
+	}
+	peer := nat.lookupPeer(src)
+	if peer == nil {
+		return
+	}
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Print("NAT path to ", peer, ": ", err)
+		return
+	}
+
+	// A request replaces whatever path we had, since the peer
+	// has given up on it
+	path := &natPath{peer: peer, via: via, state: natPunching, since: now, connUID: connUID}
+	nat.lock.Lock()
+	if old := nat.paths[src]; old != nil {
+		nat.stopForwarder(old)
+	}
+	nat.paths[src] = path
+	nat.lock.Unlock()
+	log.Print("Accepting NAT path from ", peer, " via ", via)
+
+	// The accept has to reach the peer before any control message
+	// from our forwarder
+	if err := nat.send(via, peer, ProtocolNATAccept, encodeNATHandshake(connUID, publicKey)); err != nil {
+		nat.failed(path, now, err)
+		return
+	}
+	nat.startForwarder(path, remoteKey, privateKey, false)
+	nat.changed()
+}
+
+func (nat *natTraversal) handleAccept(src mesh.PeerName, msg []byte) {
+	connUID, remoteKey, err := decodeNATHandshake(msg)
+	if err != nil {
+		log.Print("NAT path accept from ", src, ": ", err)
+		return
+	}
+	nat.lock.Lock()
+	path := nat.paths[src]
+	if path == nil || path.state != natRequested || path.connUID != connUID || path.privateKey == nil {
+		nat.lock.Unlock()
+		return
+	}
+	path.state = natPunching
+	privateKey := path.privateKey
+	path.privateKey = nil
+	nat.lock.Unlock()
+	nat.startForwarder(path, remoteKey, privateKey, true)
+}
+
+func (nat *natTraversal) startForwarder(path *natPath, remoteKey, privateKey *[32]byte, outbound bool) {
+	var sessionKey *[32]byte
+	if nat.password != nil {
+		sessionKey = formSessionKey(remoteKey, privateKey, nat.password)
+	}
+	sendControlMsg := func(tag byte, msg []byte) error {
+		return nat.send(path.via, path.peer, tag, msg)
+	}
+	fwd, err := nat.newForwarder(path.peer, path.via, path.connUID, sessionKey, outbound, sendControlMsg)
+	if err != nil {
+		nat.failed(path, time.Now(), err)
+		return
+	}
+
+	nat.lock.Lock()
+	if nat.paths[path.peer.Name] != path || path.state != natPunching {
+		// superseded while we weren't holding the lock
+		nat.lock.Unlock()
+		fwd.Stop()
+		return
+	}
+	stopChan := make(chan struct{})
+	path.fwd, path.stopChan = fwd, stopChan
+	nat.lock.Unlock()
+
+	go nat.monitor(path, fwd, stopChan)
+	fwd.Confirm()
+}
+
+func (nat *natTraversal) monitor(path *natPath, fwd OverlayForwarder, stopChan <-chan struct{}) {
+	select {
+	case <-fwd.EstablishedChannel():
+		nat.established(path)
+	case err := <-fwd.ErrorChannel():
+		nat.failed(path, time.Now(), err)
+		return
+	case <-stopChan:
+		return
+	}
+	select {
+	case err := <-fwd.ErrorChannel():
+		nat.failed(path, time.Now(), err)
+	case <-stopChan:
+	}
+}
+
+func (nat *natTraversal) established(path *natPath) {
+	nat.lock.Lock()
+	if nat.paths[path.peer.Name] != path || path.state != natPunching {
+		nat.lock.Unlock()
+		return
+	}
+	path.state = natDirect
+	nat.lock.Unlock()
+	log.Print("NAT path to ", path.peer, " established")
+	nat.changed()
+}
+
+func (nat *natTraversal) failed(path *natPath, now time.Time, err error) {
+	nat.lock.Lock()
+	if nat.paths[path.peer.Name] != path || path.state == natRelayed {
+		nat.lock.Unlock()
+		return
+	}
+	nat.giveUp(path, now, err)
+	nat.lock.Unlock()
+	nat.changed()
+}
+
+// Must be called with the lock held
+func (nat *natTraversal) giveUp(path *natPath, now time.Time, reason interface{}) {
+	log.Print("NAT path to ", path.peer, " failed (", reason, "); relaying via ", path.via)
+	nat.stopForwarder(path)
+	path.state = natRelayed
+	path.since = now
+	path.privateKey = nil
+}
+
+// Must be called with the lock held
+func (nat *natTraversal) stopForwarder(path *natPath) {
+	if path.fwd != nil {
+		close(path.stopChan)
+		path.fwd.Stop()
+		path.fwd = nil
+	}
+}
+
+// Where traffic to a peer we have a NAT path to goes: to its
+// forwarder once established, otherwise through the rendezvous
+func (nat *natTraversal) route(name mesh.PeerName) (fwd OverlayForwarder, via mesh.PeerName, found bool) {
+	nat.lock.Lock()
+	defer nat.lock.Unlock()
+	path, found := nat.paths[name]
+	if !found {
+		return nil, 0, false
+	}
+	if path.state == natDirect {
+		return path.fwd, 0, true
+	}
+	return nil, path.via, true
+}
+
+type natPathStatus struct {
+	peer  *mesh.Peer
+	via   mesh.PeerName
+	state natState
+}
+
+func (nat *natTraversal) status() []natPathStatus {
+	nat.lock.Lock()
+	defer nat.lock.Unlock()
+	var slice []natPathStatus
+	for _, path := range nat.paths {
+		slice = append(slice, natPathStatus{path.peer, path.via, path.state})
+	}
+	return slice
+}
+
+// Choose, for each peer we have no connection to, a neighbour that is
+// connected to it to act as rendezvous, taking the lowest name so
+// that we stick to the same one while we can
+func chooseRendezvous(ourName mesh.PeerName, graph map[mesh.PeerName][]mesh.PeerName, connected map[mesh.PeerName]bool) map[mesh.PeerName]mesh.PeerName {
+	neighbours := make(map[mesh.PeerName]bool)
+	for _, name := range graph[ourName] {
+		neighbours[name] = true
+	}
+	rendezvous := make(map[mesh.PeerName]mesh.PeerName)
+	for name, conns := range graph {
+		if name == ourName || connected[name] {
+			continue
+		}
+		for _, via := range conns {
+			if current, found := rendezvous[name]; neighbours[via] && (!found || via < current) {
+				rendezvous[name] = via
+			}
+		}
+	}
+	return rendezvous
+}
+
+// Overlays that can make NAT paths
+type natTraverser interface {
+	natTraversal() *natTraversal
+}
+
+func (router *NetworkRouter) runNATTraversal() {
+	for now := range time.Tick(natCheckInterval) {
+		router.nat.update(now, router.natRendezvous())
+	}
+}
+
+func (router *NetworkRouter) natRendezvous() map[mesh.PeerName]mesh.PeerName {
+	status := mesh.NewStatus(router.Router)
+	connected := make(map[mesh.PeerName]bool)
+	for _, peer := range status.Peers {
+		if peer.Name != status.Name {
+			continue
+		}
+		// including connections that aren't established, which
+		// mesh is still trying
+		for _, conn := range peer.Connections {
+			if name, err := mesh.PeerNameFromString(conn.Name); err == nil {
+				connected[name] = true
+			}
+		}
+	}
+	return chooseRendezvous(router.Ourself.Name, establishedGraph(status), connected)
+}
+
+type RelayStatus struct {
+	Name        string
+	NickName    string
+	State       string
+	Via         string // unless direct
+	ViaNickName string
+}
+
+// The peers we have NAT paths to, and the rendezvous their traffic
+// goes through when the path isn't established
+func NewRelayStatusSlice(router *NetworkRouter) []RelayStatus {
+	if router.nat == nil {
+		return nil
+	}
+	paths := router.nat.status()
+	sort.Sort(natPathsByName(paths))
+	var slice []RelayStatus
+	for _, path := range paths {
+		status := RelayStatus{Name: path.peer.Name.String(), NickName: path.peer.NickName, State: path.state.String()}
+		if path.state != natDirect {
+			status.Via = path.via.String()
+			if viaPeer := router.Peers.Fetch(path.via); viaPeer != nil {
+				status.ViaNickName = viaPeer.NickName
+			}
+		}
+		slice = append(slice, status)
+	}
+	return slice
+}
+
+type natPathsByName []natPathStatus
+
+func (s natPathsByName) Len() int           { return len(s) }
+func (s natPathsByName) Less(i, j int) bool { return s[i].peer.Name < s[j].peer.Name }
+func (s natPathsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,303 @@
+package router
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+type fakeForwarder struct {
+	lock            sync.Mutex
+	outbound        bool
+	sessionKey      *[32]byte
+	confirmed       bool
+	stopped         bool
+	controlMsgs     []byte
+	establishedChan chan struct{}
+	errorChan       chan error
+}
+
+func (fwd *fakeForwarder) Confirm()                            { fwd.confirmed = true }
+func (fwd *fakeForwarder) EstablishedChannel() <-chan struct{} { return fwd.establishedChan }
+func (fwd *fakeForwarder) ErrorChannel() <-chan error          { return fwd.errorChan }
+func (fwd *fakeForwarder) Stop() {
+	fwd.lock.Lock()
+	fwd.stopped = true
+	fwd.lock.Unlock()
+}
+
+func (fwd *fakeForwarder) isStopped() bool {
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	return fwd.stopped
+}
+func (fwd *fakeForwarder) ControlMessage(tag byte, msg []byte) {
+	fwd.controlMsgs = append(fwd.controlMsgs, tag)
+}
+func (fwd *fakeForwarder) DisplayName() string             { return "fake" }
+func (fwd *fakeForwarder) Forward(ForwardPacketKey) FlowOp { return nil }
+
+// A peer's NAT traversal, whose control messages go to the other
+// peers in the same natTestMesh
+type natTestPeer struct {
+	*natTraversal
+	forwarders []*fakeForwarder
+	sent       map[byte]int
+}
+
+type natTestMesh struct {
+	peers map[mesh.PeerName]*natTestPeer
+	// the rendezvous that pass on control messages
+	relays map[mesh.PeerName]bool
+}
+
+func newNATTestMesh(relays ...mesh.PeerName) *natTestMesh {
+	m := &natTestMesh{peers: make(map[mesh.PeerName]*natTestPeer), relays: make(map[mesh.PeerName]bool)}
+	for _, relay := range relays {
+		m.relays[relay] = true
+	}
+	return m
+}
+
+func (m *natTestMesh) addPeer(name mesh.PeerName) *natTestPeer {
+	peer := &natTestPeer{natTraversal: newNATTraversal(), sent: make(map[byte]int)}
+	peer.ourName = name
+	peer.password = []byte("secret")
+	peer.lookupPeer = func(name mesh.PeerName) *mesh.Peer { return &mesh.Peer{Name: name} }
+	peer.send = func(via mesh.PeerName, dst *mesh.Peer, tag byte, msg []byte) error {
+		peer.sent[tag]++
+		if !m.relays[via] {
+			return fmt.Errorf("no connection to %s", via)
+		}
+		if remote := m.peers[dst.Name]; remote != nil {
+			remote.handleControlMsg(time.Now(), name, via, tag, msg)
+		}
+		return nil
+	}
+	peer.newForwarder = func(remote *mesh.Peer, via mesh.PeerName, connUID uint64, sessionKey *[32]byte, outbound bool, sendControlMsg func(byte, []byte) error) (OverlayForwarder, error) {
+		fwd := &fakeForwarder{
+			outbound:        outbound,
+			sessionKey:      sessionKey,
+			establishedChan: make(chan struct{}),
+			errorChan:       make(chan error, 1),
+		}
+		peer.forwarders = append(peer.forwarders, fwd)
+		return fwd, nil
+	}
+	m.peers[name] = peer
+	return peer
+}
+
+func (peer *natTestPeer) state(name mesh.PeerName) (natState, bool) {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	path, found := peer.paths[name]
+	if !found {
+		return 0, false
+	}
+	return path.state, true
+}
+
+func (peer *natTestPeer) requireState(t *testing.T, name mesh.PeerName, expected natState) {
+	state, found := peer.state(name)
+	require.True(t, found, "path to %s", name)
+	require.Equal(t, expected, state, "path to %s", name)
+}
+
+// The forwarder's monitor runs in a goroutine of its own
+func (peer *natTestPeer) awaitState(t *testing.T, name mesh.PeerName, expected natState) {
+	for i := 0; i < 100; i++ {
+		if state, found := peer.state(name); found && state == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	peer.requireState(t, name, expected)
+}
+
+func TestChooseRendezvous(t *testing.T) {
+	graph := map[mesh.PeerName][]mesh.PeerName{
+		1: {2, 3},
+		2: {1, 4},
+		3: {1, 4, 5},
+		4: {2, 3},
+		5: {3},
+		6: {7},
+		7: {6},
+	}
+	require.Equal(t, map[mesh.PeerName]mesh.PeerName{4: 2, 5: 3},
+		chooseRendezvous(1, graph, map[mesh.PeerName]bool{2: true, 3: true}))
+	// a connection that isn't established still counts
+	require.Equal(t, map[mesh.PeerName]mesh.PeerName{5: 3},
+		chooseRendezvous(1, graph, map[mesh.PeerName]bool{2: true, 3: true, 4: true}))
+}
+
+func TestRelayedControlMsgCodec(t *testing.T) {
+	src, dst := &mesh.Peer{Name: 1}, &mesh.Peer{Name: 2}
+	src.NameByte, dst.NameByte = make([]byte, NameSize), make([]byte, NameSize)
+	src.NameByte[NameSize-1], dst.NameByte[NameSize-1] = 1, 2
+
+	dstName, srcName, tag, body, err := decodeRelayedControlMsg(encodeRelayedControlMsg(dst, src, ProtocolPunch, []byte("addrs")))
+	require.NoError(t, err)
+	require.Equal(t, mesh.PeerNameFromBin(dst.NameByte), dstName)
+	require.Equal(t, mesh.PeerNameFromBin(src.NameByte), srcName)
+	require.Equal(t, byte(ProtocolPunch), tag)
+	require.Equal(t, []byte("addrs"), body)
+
+	_, _, _, _, err = decodeRelayedControlMsg(make([]byte, 2*NameSize))
+	require.Error(t, err)
+}
+
+func TestNATHandshakeCodec(t *testing.T) {
+	key := [32]byte{1, 2, 3}
+	connUID, decodedKey, err := decodeNATHandshake(encodeNATHandshake(0x123456789, &key))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0x123456789), connUID)
+	require.Equal(t, key, *decodedKey)
+
+	_, _, err = decodeNATHandshake([]byte{1, 2, 3})
+	require.Error(t, err)
+}
+
+func TestNATPathEstablished(t *testing.T) {
+	m := newNATTestMesh(3)
+	a, b := m.addPeer(1), m.addPeer(2)
+	now := time.Now()
+
+	// only the peer with the lower name asks
+	b.update(now, map[mesh.PeerName]mesh.PeerName{1: 3})
+	_, found := b.state(1)
+	require.False(t, found)
+
+	a.update(now, map[mesh.PeerName]mesh.PeerName{2: 3})
+	a.requireState(t, 2, natPunching)
+	b.requireState(t, 1, natPunching)
+	require.Len(t, a.forwarders, 1)
+	require.Len(t, b.forwarders, 1)
+	fwdA, fwdB := a.forwarders[0], b.forwarders[0]
+	require.True(t, fwdA.outbound)
+	require.False(t, fwdB.outbound)
+	require.True(t, fwdA.confirmed && fwdB.confirmed)
+	require.NotNil(t, fwdA.sessionKey)
+	require.Equal(t, *fwdA.sessionKey, *fwdB.sessionKey)
+
+	// traffic goes through the rendezvous until the path works
+	fwd, via, found := a.route(2)
+	require.True(t, found)
+	require.Nil(t, fwd)
+	require.Equal(t, mesh.PeerName(3), via)
+	_, _, found = a.route(4)
+	require.False(t, found)
+
+	close(fwdA.establishedChan)
+	a.awaitState(t, 2, natDirect)
+	fwd, _, found = a.route(2)
+	require.True(t, found)
+	require.Equal(t, fwdA, fwd)
+
+	// control messages from b's forwarder reach a's
+	b.send(3, &mesh.Peer{Name: 1}, ProtocolPunch, nil)
+	require.Equal(t, []byte{ProtocolPunch}, fwdA.controlMsgs)
+
+	// once connected, the path goes
+	a.update(now, map[mesh.PeerName]mesh.PeerName{})
+	_, found = a.state(2)
+	require.False(t, found)
+	require.True(t, fwdA.isStopped())
+}
+
+func TestNATPathNoPassword(t *testing.T) {
+	m := newNATTestMesh(3)
+	a, b := m.addPeer(1), m.addPeer(2)
+	a.password, b.password = nil, nil
+	a.update(time.Now(), map[mesh.PeerName]mesh.PeerName{2: 3})
+	require.Nil(t, a.forwarders[0].sessionKey)
+	require.Nil(t, b.forwarders[0].sessionKey)
+}
+
+func TestNATPathTimeout(t *testing.T) {
+	// the rendezvous doesn't pass anything on
+	m := newNATTestMesh()
+	a := m.addPeer(1)
+	now := time.Now()
+	rendezvous := map[mesh.PeerName]mesh.PeerName{2: 3}
+
+	a.update(now, rendezvous)
+	a.requireState(t, 2, natRequested)
+	require.Equal(t, 1, a.sent[ProtocolNATRequest])
+
+	a.update(now.Add(natPunchTimeout-time.Second), rendezvous)
+	a.requireState(t, 2, natRequested)
+	now = now.Add(natPunchTimeout)
+	a.update(now, rendezvous)
+	a.requireState(t, 2, natRelayed)
+	fwd, via, found := a.route(2)
+	require.True(t, found)
+	require.Nil(t, fwd)
+	require.Equal(t, mesh.PeerName(3), via)
+
+	// a direct path is tried again later
+	a.update(now.Add(relayRetryInterval-time.Second), rendezvous)
+	a.requireState(t, 2, natRelayed)
+	a.update(now.Add(relayRetryInterval), rendezvous)
+	a.requireState(t, 2, natRequested)
+	require.Equal(t, 2, a.sent[ProtocolNATRequest])
+}
+
+func TestNATPathFailed(t *testing.T) {
+	m := newNATTestMesh(3)
+	a, b := m.addPeer(1), m.addPeer(2)
+	a.update(time.Now(), map[mesh.PeerName]mesh.PeerName{2: 3})
+	fwdA, fwdB := a.forwarders[0], b.forwarders[0]
+
+	fwdB.errorChan <- fmt.Errorf("timed out waiting for UDP heartbeat")
+	b.awaitState(t, 1, natRelayed)
+	require.True(t, fwdB.isStopped())
+	fwd, via, _ := b.route(1)
+	require.Nil(t, fwd)
+	require.Equal(t, mesh.PeerName(3), via)
+
+	// and once established
+	close(fwdA.establishedChan)
+	a.awaitState(t, 2, natDirect)
+	fwdA.errorChan <- fmt.Errorf("timed out waiting for UDP heartbeat")
+	a.awaitState(t, 2, natRelayed)
+	require.True(t, fwdA.isStopped())
+}
+
+func TestNATPathRendezvousChanged(t *testing.T) {
+	m := newNATTestMesh(3, 4)
+	a, b := m.addPeer(1), m.addPeer(2)
+	now := time.Now()
+	a.update(now, map[mesh.PeerName]mesh.PeerName{2: 3})
+
+	// the peer that accepted keeps the path, whatever it thinks
+	// the rendezvous should be
+	b.update(now, map[mesh.PeerName]mesh.PeerName{1: 4})
+	b.requireState(t, 1, natPunching)
+
+	// the one that asked starts again
+	a.update(now, map[mesh.PeerName]mesh.PeerName{2: 4})
+	require.True(t, a.forwarders[0].isStopped())
+	require.True(t, b.forwarders[0].isStopped())
+	require.Len(t, a.forwarders, 2)
+	_, via, _ := a.route(2)
+	require.Equal(t, mesh.PeerName(4), via)
+	_, via, _ = b.route(1)
+	require.Equal(t, mesh.PeerName(4), via)
+}
+
+func TestNATPathStaleAccept(t *testing.T) {
+	m := newNATTestMesh()
+	a := m.addPeer(1)
+	a.update(time.Now(), map[mesh.PeerName]mesh.PeerName{2: 3})
+
+	key := [32]byte{}
+	a.handleControlMsg(time.Now(), 2, 3, ProtocolNATAccept, encodeNATHandshake(0, &key))
+	a.requireState(t, 2, natRequested)
+	require.Len(t, a.forwarders, 0)
+}
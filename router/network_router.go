@@ -9,6 +9,7 @@ import (
 
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/db"
+	"github.com/weaveworks/weave/net/address"
 )
 
 const (
@@ -32,9 +33,11 @@ var (
 )
 
 type NetworkConfig struct {
-	BufSz         int
-	PacketLogging PacketLogging
-	Bridge        Bridge
+	BufSz          int
+	PacketLogging  PacketLogging
+	Bridge         Bridge
+	MTU            int // of the overlay network; zero if not configured
+	TrafficClasses *TrafficClasses
 }
 
 type PacketLogging interface {
@@ -45,8 +48,13 @@ type PacketLogging interface {
 type NetworkRouter struct {
 	*mesh.Router
 	NetworkConfig
-	Macs *MacCache
-	db   db.DB
+	Macs      *MacCache
+	db        db.DB
+	distances *peerDistances
+	arp       *arpSuppressor
+	multicast *multicastSnooper
+	costs     *costRouter
+	nat       *natTraversal // nil if the overlay can't make NAT paths
 }
 
 func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh.PeerName, nickName string, overlay NetworkOverlay, db db.DB) *NetworkRouter {
@@ -60,20 +68,65 @@ func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh
 	router := &NetworkRouter{Router: mesh.NewRouter(config, name, nickName, overlay, common.LogLogger()), NetworkConfig: networkConfig, db: db}
 	router.Peers.OnInvalidateShortIDs(overlay.InvalidateShortIDs)
 	router.Routes.OnChange(overlay.InvalidateRoutes)
+	router.distances = newPeerDistances(router.Router)
+	router.Routes.OnChange(router.distances.invalidate)
+	router.costs = newCostRouter(router, name)
+	router.costs.gossip = router.NewGossip("linkcosts", router.costs)
+	router.Routes.OnChange(router.costs.invalidate)
+	router.arp = newARPSuppressor(router, name)
+	router.arp.gossip = router.NewGossip("ARP", router.arp)
+	router.multicast = newMulticastSnooper(router, name)
+	router.multicast.gossip = router.NewGossip("multicast", router.multicast)
+	if traverser, ok := overlay.(natTraverser); ok {
+		if router.nat = traverser.natTraversal(); router.nat != nil {
+			router.nat.password = config.Password
+			router.nat.onChange = overlay.InvalidateRoutes
+		}
+	}
 	router.Macs = NewMacCache(macMaxAge,
 		func(mac net.HardwareAddr, peer *mesh.Peer) {
 			log.Println("Expired MAC", mac, "at", peer)
+			if peer == router.Ourself.Peer {
+				var key MAC
+				copy(key[:], mac)
+				router.arp.forget(key)
+			}
 		})
-	router.Peers.OnGC(func(peer *mesh.Peer) { router.Macs.Delete(peer) })
+	router.Peers.OnGC(func(peer *mesh.Peer) {
+		router.Macs.Delete(peer)
+		router.arp.peerGone(peer.Name)
+		router.multicast.peerGone(peer.Name)
+		router.costs.peerGone(peer.Name)
+	})
 	return router
 }
 
+// Encrypted says whether all traffic between peers is encrypted,
+// which it is when we have a password and trust no subnets: fast
+// datapath refuses encrypted connections, leaving them to sleeve.
+func (router *NetworkRouter) Encrypted() bool {
+	return len(router.Password) > 0 && len(router.TrustedSubnets) == 0
+}
+
+// SetLocalAddresses replaces the addresses that source, e.g. IPAM,
+// has given to local containers.  ARP suppression only learns the MACs
+// of these addresses.
+func (router *NetworkRouter) SetLocalAddresses(source string, addrs []address.Address) {
+	router.arp.setLocalAddresses(source, addrs)
+}
+
 // Start listening for TCP connections, locally captured packets, and
 // forwarded packets.
 func (router *NetworkRouter) Start() {
 	log.Println("Sniffing traffic on", router.Bridge)
 	checkFatal(router.Bridge.StartConsumingPackets(router.handleCapturedPacket))
 	checkFatal(router.Overlay.(NetworkOverlay).StartConsumingPackets(router.Ourself.Peer, router.Peers, router.handleForwardedPacket))
+	go router.multicast.run()
+	go router.costs.run()
+	go router.distances.run()
+	if router.nat != nil {
+		go router.runNATTraversal()
+	}
 	router.Router.Start()
 }
 
@@ -112,6 +165,17 @@ func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
 		// If we don't know which peer corresponds to the dest
 		// MAC, broadcast it.
 		router.PacketLogging.LogPacket("Broadcasting", key)
+		switch {
+		case key.DstMAC == broadcastMAC:
+			// might be an ARP request we can answer; other
+			// broadcasts are flooded as usual
+			return arpFlowOp{arp: router.arp, flood: router.relayBroadcast(router.Ourself.Peer, key)}
+		case ipv4Multicast(key.DstMAC):
+			// might be an IGMP membership report, which goes
+			// to 224.0.0.22 for IGMPv3 but to the group's own
+			// address for v1 and v2
+			return igmpFlowOp{snooper: router.multicast, flood: router.relayBroadcast(router.Ourself.Peer, key)}
+		}
 		return router.relayBroadcast(router.Ourself.Peer, key)
 	default:
 		router.PacketLogging.LogPacket("Forwarding", key)
@@ -171,7 +235,17 @@ func (router *NetworkRouter) handleForwardedPacket(key ForwardPacketKey) FlowOp
 // Routing
 
 func (router *NetworkRouter) relay(key ForwardPacketKey) FlowOp {
-	relayPeerName, found := router.Routes.Unicast(key.DstPeer.Name)
+	var relayPeerName mesh.PeerName
+	var found bool
+	if router.nat != nil {
+		var fwd OverlayForwarder
+		if fwd, relayPeerName, found = router.nat.route(key.DstPeer.Name); fwd != nil {
+			return fwd.Forward(key)
+		}
+	}
+	if !found {
+		relayPeerName, found = router.unicastNextHop(key.DstPeer.Name)
+	}
 	if !found {
 		// Not necessarily an error as there could be a race with the
 		// dst disappearing whilst the frame is in flight
@@ -190,7 +264,7 @@ func (router *NetworkRouter) relay(key ForwardPacketKey) FlowOp {
 }
 
 func (router *NetworkRouter) relayBroadcast(srcPeer *mesh.Peer, key PacketKey) FlowOp {
-	nextHops := router.Routes.Broadcast(srcPeer.Name)
+	nextHops := router.broadcastNextHops(srcPeer.Name)
 	if len(nextHops) == 0 {
 		return DiscardingFlowOp{}
 	}
@@ -198,6 +272,10 @@ func (router *NetworkRouter) relayBroadcast(srcPeer *mesh.Peer, key PacketKey) F
 	op := NewMultiFlowOp(true)
 
 	for _, conn := range router.Ourself.ConnectionsTo(nextHops) {
+		// Only relay multicast towards peers with listeners
+		if !router.multicast.wanted(srcPeer.Name, conn.Remote().Name, key.DstMAC) {
+			continue
+		}
 		op.Add(conn.(*mesh.LocalConnection).OverlayConn.(OverlayForwarder).Forward(ForwardPacketKey{
 			PacketKey: key,
 			SrcPeer:   srcPeer,
@@ -207,6 +285,36 @@ func (router *NetworkRouter) relayBroadcast(srcPeer *mesh.Peer, key PacketKey) F
 	return op
 }
 
+// Least-cost routes if we have them, otherwise mesh's
+func (router *NetworkRouter) unicastNextHop(to mesh.PeerName) (mesh.PeerName, bool) {
+	if next, found, active := router.costs.unicast(to); active {
+		return next, found
+	}
+	return router.Routes.Unicast(to)
+}
+
+func (router *NetworkRouter) broadcastNextHops(from mesh.PeerName) []mesh.PeerName {
+	if hops, active := router.costs.broadcast(from); active {
+		return hops
+	}
+	return router.Routes.Broadcast(from)
+}
+
+// Does a broadcast from src, relayed to hop, reach peer?  Without
+// least-cost trees we don't know mesh's broadcast tree exactly, but
+// it is made of shortest paths, so peer is only reached through hop
+// if hop is on a shortest path to it.
+func (router *NetworkRouter) leadsTo(src, hop, peer mesh.PeerName) bool {
+	if reached, active := router.costs.leadsTo(src, hop, peer); active {
+		return reached
+	}
+	d := router.distances
+	d.Lock()
+	defer d.Unlock()
+	hopDistance, found := d.from(hop)[peer]
+	return found && d.from(src)[hop]+hopDistance == d.from(src)[peer]
+}
+
 // Persisting the set of peers we are supposed to connect to
 const peersIdent = "directPeers"
 
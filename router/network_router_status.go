@@ -8,9 +8,16 @@ import (
 
 type NetworkRouterStatus struct {
 	*mesh.Status
-	Interface    string
-	CaptureStats map[string]int
-	MACs         []MACStatus
+	Interface      string
+	CaptureStats   map[string]int
+	MTU            int
+	MACs           []MACStatus
+	ARP            ARPStatus
+	Multicast      []MulticastGroupStatus
+	Links          []LinkStatus
+	Relays         []RelayStatus
+	MTUMismatches  []MTUMismatch
+	TrafficClasses []TrafficClassStatus
 }
 
 type MACStatus struct {
@@ -25,7 +32,14 @@ func NewNetworkRouterStatus(router *NetworkRouter) *NetworkRouterStatus {
 		mesh.NewStatus(router.Router),
 		router.Bridge.String(),
 		router.Bridge.Stats(),
-		NewMACStatusSlice(router.Macs)}
+		router.MTU,
+		NewMACStatusSlice(router.Macs),
+		NewARPStatus(router.arp),
+		NewMulticastStatusSlice(router.multicast),
+		NewLinkStatusSlice(router),
+		NewRelayStatusSlice(router),
+		NewMTUMismatchSlice(router),
+		NewTrafficClassStatusSlice(router.TrafficClasses)}
 }
 
 func NewMACStatusSlice(cache *MacCache) []MACStatus {
@@ -40,6 +40,11 @@ func (osw *OverlaySwitch) SetCompatOverlay(overlay NetworkOverlay) {
 
 func (osw *OverlaySwitch) AddFeaturesTo(features map[string]string) {
 	features["Overlays"] = strings.Join(osw.overlayNames, " ")
+	features[heartbeatEchoFeature] = "1"
+	features[natTraversalFeature] = "1"
+	for _, overlay := range osw.overlays {
+		overlay.AddFeaturesTo(features)
+	}
 }
 
 func (osw *OverlaySwitch) Diagnostics() interface{} {
@@ -71,6 +76,16 @@ func (osw *OverlaySwitch) StartConsumingPackets(localPeer *mesh.Peer, peers *mes
 	return nil
 }
 
+// The NAT traversal of the first overlay that does it
+func (osw *OverlaySwitch) natTraversal() *natTraversal {
+	for _, name := range osw.overlayNames {
+		if traverser, ok := osw.overlays[name].(natTraverser); ok {
+			return traverser.natTraversal()
+		}
+	}
+	return nil
+}
+
 type namedOverlay struct {
 	NetworkOverlay
 	name string
@@ -150,6 +165,12 @@ type subForwarder struct {
 	stopChan chan<- struct{}
 }
 
+// A forwarder which is only to be used once all the others have
+// failed, however early it becomes established
+type lastResortForwarder interface {
+	lastResort()
+}
+
 // An event from a subsidiary forwarder
 type subForwarderEvent struct {
 	// the index of the forwarder
@@ -290,12 +311,6 @@ func (fwd *overlaySwitchForwarder) established(index int) {
 	defer fwd.lock.Unlock()
 
 	fwd.forwarders[index].established = true
-
-	if !fwd.alreadyEstablished {
-		fwd.alreadyEstablished = true
-		close(fwd.establishedChan)
-	}
-
 	fwd.chooseBest()
 }
 
@@ -326,8 +341,10 @@ func (fwd *overlaySwitchForwarder) stopFrom(index int) {
 func (fwd *overlaySwitchForwarder) chooseBest() {
 	// the most preferred established forwarder is the best
 	// otherwise, the most preferred working forwarder is the best
+	// and only if there are none of those, a last resort
 	bestEstablished := -1
 	bestWorking := -1
+	lastResort := -1
 
 	for i := range fwd.forwarders {
 		subFwd := &fwd.forwarders[i]
@@ -335,6 +352,13 @@ func (fwd *overlaySwitchForwarder) chooseBest() {
 			continue
 		}
 
+		if _, ok := subFwd.fwd.(lastResortForwarder); ok {
+			if lastResort < 0 {
+				lastResort = i
+			}
+			continue
+		}
+
 		if bestWorking < 0 {
 			bestWorking = i
 		}
@@ -346,7 +370,10 @@ func (fwd *overlaySwitchForwarder) chooseBest() {
 
 	best := bestEstablished
 	if best < 0 {
-		if bestWorking < 0 {
+		best = bestWorking
+	}
+	if best < 0 {
+		if lastResort < 0 {
 			select {
 			case fwd.errorChan <- fmt.Errorf("no working forwarders to %s", fwd.remotePeer):
 			default:
@@ -355,13 +382,18 @@ func (fwd *overlaySwitchForwarder) chooseBest() {
 			return
 		}
 
-		best = bestWorking
+		best = lastResort
 	}
 
 	if fwd.best != best {
 		fwd.best = best
 		log.Info(fwd.logPrefix(), "using ", fwd.forwarders[best].overlayName)
 	}
+
+	if fwd.forwarders[best].established && !fwd.alreadyEstablished {
+		fwd.alreadyEstablished = true
+		close(fwd.establishedChan)
+	}
 }
 
 func (fwd *overlaySwitchForwarder) Confirm() {
@@ -424,6 +456,38 @@ func (fwd *overlaySwitchForwarder) ControlMessage(tag byte, msg []byte) {
 	}
 }
 
+// The quality of the link through the forwarder in use
+func (fwd *overlaySwitchForwarder) LinkQuality() (LinkQuality, bool) {
+	var best OverlayForwarder
+
+	fwd.lock.Lock()
+	if fwd.best >= 0 {
+		best = fwd.forwarders[fwd.best].fwd
+	}
+	fwd.lock.Unlock()
+
+	if reporter, ok := best.(linkQualityReporter); ok {
+		return reporter.LinkQuality()
+	}
+	return LinkQuality{}, false
+}
+
+// The path MTU of the link through the forwarder in use
+func (fwd *overlaySwitchForwarder) PMTU() (int, bool) {
+	var best OverlayForwarder
+
+	fwd.lock.Lock()
+	if fwd.best >= 0 {
+		best = fwd.forwarders[fwd.best].fwd
+	}
+	fwd.lock.Unlock()
+
+	if reporter, ok := best.(pmtuReporter); ok {
+		return reporter.PMTU()
+	}
+	return 0, false
+}
+
 func (fwd *overlaySwitchForwarder) DisplayName() string {
 	var best OverlayForwarder
 
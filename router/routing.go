@@ -0,0 +1,507 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Cost-based routing
+//
+// Every peer turns the measured quality of its connections into link
+// costs and gossips them, alongside the topology.  Unicast and
+// broadcast routes then follow least-cost paths rather than fewest
+// hops.  Every peer must compute the same broadcast trees, so the
+// calculation is deterministic.  Mixing cost and hop-count routes
+// could send frames round in circles, so all peers must agree on
+// which are in force.  Each peer says in its gossip whether it has the
+// costs of every peer in the topology, and cost routes only take over
+// from mesh's hop-count routes once every peer in the topology says
+// so.  Peers that don't advertise costs at all, such as those running
+// older versions, keep everyone on hop-count routes.
+//
+// Costs are damped in three ways: the measurements are smoothed, a
+// cost is only re-advertised when it has changed by more than
+// linkCostThreshold, and advertisements are made at most every
+// linkCostInterval.
+
+const (
+	linkCostInterval = 30 * time.Second
+	// relative change needed before we advertise a new cost
+	linkCostThreshold = 0.2
+	// the cost of a hop regardless of its latency, so that among
+	// equally fast paths the shortest wins
+	linkHopCost = 1
+	// for links nobody has measured
+	linkDefaultCost = 10
+	// don't let lossy links look infinitely expensive
+	linkMaxLoss = 0.9
+)
+
+// linkCost is in milliseconds of round trip time, inflated by the
+// expected number of transmissions
+func linkCost(quality LinkQuality) uint32 {
+	loss := math.Min(quality.Loss, linkMaxLoss)
+	ms := float64(quality.RTT) / float64(time.Millisecond)
+	return linkHopCost + uint32(ms/(1-loss))
+}
+
+// The costs of one peer's links, which are only ever changed by that
+// peer and are replaced wholesale when they change
+type peerLinkCosts struct {
+	Version int64 // from the owner's clock; only compared with itself
+	Costs   map[mesh.PeerName]uint32
+	Ready   bool // the owner has the costs of every peer in the topology
+}
+
+type linkCostsGossipData map[mesh.PeerName]*peerLinkCosts
+
+func (g linkCostsGossipData) Merge(other mesh.GossipData) mesh.GossipData {
+	result := linkCostsGossipData{}
+	for name, costs := range g {
+		result[name] = costs
+	}
+	result.merge(other.(linkCostsGossipData), mesh.UnknownPeerName)
+	return result
+}
+
+// merge in newer costs, except those of ourName, returning what was
+// new
+func (g linkCostsGossipData) merge(other linkCostsGossipData, ourName mesh.PeerName) linkCostsGossipData {
+	updated := linkCostsGossipData{}
+	for name, costs := range other {
+		if name == ourName {
+			continue
+		}
+		if existing, found := g[name]; !found || existing.Version < costs.Version {
+			g[name] = costs
+			updated[name] = costs
+		}
+	}
+	return updated
+}
+
+func (g linkCostsGossipData) Encode() [][]byte {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(g); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+// A least-cost tree rooted at some peer
+type costTree struct {
+	costs   map[mesh.PeerName]uint64
+	parents map[mesh.PeerName]mesh.PeerName
+}
+
+// Is peer in the subtree below (or at) hop?
+func (tree *costTree) leadsTo(hop, peer mesh.PeerName) bool {
+	for {
+		if peer == hop {
+			return true
+		}
+		parent, found := tree.parents[peer]
+		if !found {
+			return false
+		}
+		peer = parent
+	}
+}
+
+// Fetching the topology from mesh means waiting on its actors, which
+// the forwarding path mustn't do, so the run goroutine fetches it
+// whenever the routes change, and the forwarding path only reads the
+// copy.  Trees are worked out from that copy as they are needed.
+type costRouter struct {
+	sync.Mutex
+	router   *NetworkRouter
+	ourName  mesh.PeerName
+	gossip   mesh.Gossip
+	topology func() map[mesh.PeerName][]mesh.PeerName
+	costs    linkCostsGossipData
+	graph    map[mesh.PeerName][]mesh.PeerName // as last fetched by run
+	active   bool
+	trees    map[mesh.PeerName]*costTree // by root
+	changed  chan struct{}               // tells run to fetch the topology and check whether we are ready
+}
+
+func newCostRouter(router *NetworkRouter, ourName mesh.PeerName) *costRouter {
+	return &costRouter{
+		router:  router,
+		ourName: ourName,
+		topology: func() map[mesh.PeerName][]mesh.PeerName {
+			return establishedGraph(mesh.NewStatus(router.Router))
+		},
+		costs:   linkCostsGossipData{ourName: &peerLinkCosts{Version: time.Now().UnixNano()}},
+		trees:   make(map[mesh.PeerName]*costTree),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// The routes have changed, so the topology needs fetching again
+func (cr *costRouter) invalidate() {
+	cr.poke()
+}
+
+func (cr *costRouter) poke() {
+	select {
+	case cr.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Every peer in the topology, connected or not
+func topologyPeers(graph map[mesh.PeerName][]mesh.PeerName) map[mesh.PeerName]bool {
+	peers := make(map[mesh.PeerName]bool)
+	for peer, neighbours := range graph {
+		peers[peer] = true
+		for _, neighbour := range neighbours {
+			peers[neighbour] = true
+		}
+	}
+	return peers
+}
+
+// Do we have the costs of every peer in the topology?  Called with
+// the lock held
+func (cr *costRouter) ready(graph map[mesh.PeerName][]mesh.PeerName) bool {
+	for peer := range topologyPeers(graph) {
+		if _, found := cr.costs[peer]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Does every peer in the topology, ourselves included, say it has the
+// costs of every other?  Called with the lock held
+func (cr *costRouter) allReady(graph map[mesh.PeerName][]mesh.PeerName) bool {
+	peers := topologyPeers(graph)
+	peers[cr.ourName] = true
+	for peer := range peers {
+		if costs, found := cr.costs[peer]; !found || !costs.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// Throw away the trees, after a change to the topology or costs.
+// Called with the lock held
+func (cr *costRouter) resetTrees() {
+	cr.trees = make(map[mesh.PeerName]*costTree)
+	cr.active = cr.allReady(cr.graph)
+}
+
+// refresh fetches the topology and puts the routes on it in force
+func (cr *costRouter) refresh() {
+	graph := cr.topology()
+	cr.Lock()
+	wasActive := cr.active
+	cr.graph = graph
+	cr.resetTrees()
+	active := cr.active
+	cr.Unlock()
+	if wasActive || active {
+		cr.routesChanged()
+	}
+}
+
+// Called with the lock held
+func (cr *costRouter) tree(root mesh.PeerName) *costTree {
+	if !cr.active {
+		return nil
+	}
+	tree, found := cr.trees[root]
+	if !found {
+		tree = cr.computeTree(root)
+		cr.trees[root] = tree
+	}
+	return tree
+}
+
+// The cost of the link between two peers is the higher of what each
+// end has measured, so that all peers agree on it
+func (cr *costRouter) cost(a, b mesh.PeerName) uint64 {
+	var cost uint32
+	measured := false
+	if costs, found := cr.costs[a]; found {
+		cost, measured = costs.Costs[b]
+	}
+	if costs, found := cr.costs[b]; found {
+		if other, ok := costs.Costs[a]; ok {
+			if !measured || other > cost {
+				cost = other
+			}
+			measured = true
+		}
+	}
+	if !measured {
+		return linkDefaultCost
+	}
+	return uint64(cost)
+}
+
+// Dijkstra's algorithm, breaking ties in favour of the lower peer
+// name, so that all peers come up with the same tree
+func (cr *costRouter) computeTree(root mesh.PeerName) *costTree {
+	tree := &costTree{
+		costs:   map[mesh.PeerName]uint64{root: 0},
+		parents: make(map[mesh.PeerName]mesh.PeerName),
+	}
+	done := make(map[mesh.PeerName]bool)
+	for {
+		var (
+			current mesh.PeerName
+			best    uint64 = math.MaxUint64
+		)
+		for peer, cost := range tree.costs {
+			if !done[peer] && (cost < best || (cost == best && peer < current)) {
+				current, best = peer, cost
+			}
+		}
+		if best == math.MaxUint64 {
+			return tree
+		}
+		done[current] = true
+		for _, next := range cr.graph[current] {
+			if done[next] {
+				continue
+			}
+			cost := best + cr.cost(current, next)
+			existing, found := tree.costs[next]
+			if !found || cost < existing || (cost == existing && current < tree.parents[next]) {
+				tree.costs[next] = cost
+				tree.parents[next] = current
+			}
+		}
+	}
+}
+
+// The next hop towards a peer, and whether there is one.  The last
+// result is false if cost-based routing is not in force.
+func (cr *costRouter) unicast(to mesh.PeerName) (mesh.PeerName, bool, bool) {
+	cr.Lock()
+	defer cr.Unlock()
+	tree := cr.tree(cr.ourName)
+	if tree == nil {
+		return mesh.UnknownPeerName, false, false
+	}
+	for {
+		parent, found := tree.parents[to]
+		switch {
+		case !found:
+			return mesh.UnknownPeerName, false, true
+		case parent == cr.ourName:
+			return to, true, true
+		}
+		to = parent
+	}
+}
+
+// Our children in the broadcast tree rooted at a peer, if cost-based
+// routing is in force
+func (cr *costRouter) broadcast(from mesh.PeerName) ([]mesh.PeerName, bool) {
+	cr.Lock()
+	defer cr.Unlock()
+	tree := cr.tree(from)
+	if tree == nil {
+		return nil, false
+	}
+	var hops []mesh.PeerName
+	for _, next := range cr.graph[cr.ourName] {
+		if parent, found := tree.parents[next]; found && parent == cr.ourName {
+			hops = append(hops, next)
+		}
+	}
+	return hops, true
+}
+
+// Does a broadcast from src, relayed to hop, reach peer? The second
+// result is false if cost-based routing is not in force.
+func (cr *costRouter) leadsTo(src, hop, peer mesh.PeerName) (bool, bool) {
+	cr.Lock()
+	defer cr.Unlock()
+	tree := cr.tree(src)
+	if tree == nil {
+		return false, false
+	}
+	return tree.leadsTo(hop, peer), true
+}
+
+// The measured quality of our links to our neighbours
+func (cr *costRouter) linkQualities() map[*mesh.Peer]LinkQuality {
+	cr.Lock()
+	neighbours := cr.graph[cr.ourName]
+	cr.Unlock()
+	qualities := make(map[*mesh.Peer]LinkQuality)
+	for _, conn := range cr.router.Ourself.ConnectionsTo(neighbours) {
+		reporter, ok := conn.(*mesh.LocalConnection).OverlayConn.(linkQualityReporter)
+		if !ok {
+			continue
+		}
+		if quality, ok := reporter.LinkQuality(); ok {
+			qualities[conn.Remote()] = quality
+		}
+	}
+	return qualities
+}
+
+// The costs to advertise, given those we advertised before and those
+// just measured, and whether they differ enough to be worth it
+func dampCosts(advertised, measured map[mesh.PeerName]uint32) (map[mesh.PeerName]uint32, bool) {
+	changed := len(measured) != len(advertised)
+	costs := make(map[mesh.PeerName]uint32, len(measured))
+	for peer, cost := range measured {
+		previous, found := advertised[peer]
+		if found && math.Abs(float64(cost)-float64(previous)) <= linkCostThreshold*float64(previous) {
+			cost = previous
+		} else {
+			changed = true
+		}
+		costs[peer] = cost
+	}
+	return costs, changed
+}
+
+// Advertise the costs of our links, if they have changed enough
+func (cr *costRouter) update() {
+	measured := make(map[mesh.PeerName]uint32)
+	for peer, quality := range cr.linkQualities() {
+		measured[peer.Name] = linkCost(quality)
+	}
+
+	cr.Lock()
+	costs, changed := dampCosts(cr.costs[cr.ourName].Costs, measured)
+	cr.advertise(costs, changed)
+}
+
+// Advertise whether we have the costs of every peer, if that has
+// changed
+func (cr *costRouter) updateReady() {
+	cr.Lock()
+	cr.advertise(cr.costs[cr.ourName].Costs, false)
+}
+
+// Called with the lock held, which it releases
+func (cr *costRouter) advertise(costs map[mesh.PeerName]uint32, changed bool) {
+	ours := cr.costs[cr.ourName]
+	ready := cr.ready(cr.graph)
+	if !changed && ready == ours.Ready {
+		cr.Unlock()
+		return
+	}
+	version := time.Now().UnixNano()
+	if version <= ours.Version {
+		version = ours.Version + 1
+	}
+	ours = &peerLinkCosts{Version: version, Costs: costs, Ready: ready}
+	cr.costs[cr.ourName] = ours
+	cr.resetTrees()
+	cr.Unlock()
+
+	cr.routesChanged()
+	if cr.gossip != nil {
+		cr.gossip.GossipBroadcast(linkCostsGossipData{cr.ourName: ours})
+	}
+}
+
+func (cr *costRouter) run() {
+	cr.refresh()
+	tick := time.Tick(linkCostInterval)
+	for {
+		select {
+		case <-tick:
+			cr.update()
+		case <-cr.changed:
+			cr.refresh()
+			cr.updateReady()
+		}
+	}
+}
+
+func (cr *costRouter) peerGone(name mesh.PeerName) {
+	cr.Lock()
+	delete(cr.costs, name)
+	cr.resetTrees()
+	cr.Unlock()
+	cr.poke()
+}
+
+// Flows and caches built on the old routes are now wrong
+func (cr *costRouter) routesChanged() {
+	cr.router.Overlay.(NetworkOverlay).InvalidateRoutes()
+}
+
+// mesh.Gossiper implementation
+
+func (cr *costRouter) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+func (cr *costRouter) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	return cr.receive(msg)
+}
+
+func (cr *costRouter) Gossip() mesh.GossipData {
+	cr.Lock()
+	defer cr.Unlock()
+	result := linkCostsGossipData{}
+	for name, costs := range cr.costs {
+		result[name] = costs
+	}
+	return result
+}
+
+func (cr *costRouter) OnGossip(msg []byte) (mesh.GossipData, error) {
+	return cr.receive(msg)
+}
+
+func (cr *costRouter) receive(msg []byte) (mesh.GossipData, error) {
+	var gossip linkCostsGossipData
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&gossip); err != nil {
+		return nil, err
+	}
+	cr.Lock()
+	updated := cr.costs.merge(gossip, cr.ourName)
+	if len(updated) > 0 {
+		cr.resetTrees()
+	}
+	cr.Unlock()
+	if len(updated) == 0 {
+		return nil, nil
+	}
+	cr.routesChanged()
+	cr.poke()
+	return updated, nil
+}
+
+type LinkStatus struct {
+	Name     string
+	NickName string
+	RTT      time.Duration
+	Loss     float64
+	Cost     uint32
+}
+
+func NewLinkStatusSlice(router *NetworkRouter) []LinkStatus {
+	cr := router.costs
+	qualities := cr.linkQualities()
+	cr.Lock()
+	defer cr.Unlock()
+	var slice []LinkStatus
+	for peer, quality := range qualities {
+		slice = append(slice, LinkStatus{
+			peer.Name.String(),
+			peer.NickName,
+			quality.RTT,
+			quality.Loss,
+			cr.costs[cr.ourName].Costs[peer.Name]})
+	}
+	return slice
+}
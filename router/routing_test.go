@@ -0,0 +1,156 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+// A cost router for peer 1 in a fixed topology, with nothing gossiped
+func newTestCostRouter(graph map[mesh.PeerName][]mesh.PeerName) *costRouter {
+	router := &NetworkRouter{Router: &mesh.Router{Overlay: NullNetworkOverlay{}}}
+	cr := newCostRouter(router, 1)
+	cr.topology = func() map[mesh.PeerName][]mesh.PeerName { return graph }
+	cr.refresh()
+	return cr
+}
+
+func (cr *costRouter) heardFrom(name mesh.PeerName, ready bool, costs map[mesh.PeerName]uint32) {
+	cr.Lock()
+	defer cr.Unlock()
+	version := int64(1)
+	if existing, found := cr.costs[name]; found {
+		version = existing.Version + 1
+	}
+	cr.costs.merge(linkCostsGossipData{name: &peerLinkCosts{Version: version, Costs: costs, Ready: ready}}, cr.ourName)
+	cr.resetTrees()
+}
+
+func TestLinkCost(t *testing.T) {
+	require.Equal(t, uint32(linkHopCost), linkCost(LinkQuality{}))
+	require.Equal(t, uint32(linkHopCost+20), linkCost(LinkQuality{RTT: 20 * time.Millisecond}))
+	// each packet takes two tries on average
+	require.Equal(t, uint32(linkHopCost+40), linkCost(LinkQuality{RTT: 20 * time.Millisecond, Loss: 0.5}))
+	// however lossy the link, it has a cost
+	require.Equal(t, uint32(linkHopCost+200), linkCost(LinkQuality{RTT: 20 * time.Millisecond, Loss: 1}))
+}
+
+func TestDampCosts(t *testing.T) {
+	advertised := map[mesh.PeerName]uint32{2: 100, 3: 100}
+
+	costs, changed := dampCosts(advertised, map[mesh.PeerName]uint32{2: 115, 3: 81})
+	require.False(t, changed, "small changes aren't advertised")
+	require.Equal(t, advertised, costs)
+
+	costs, changed = dampCosts(advertised, map[mesh.PeerName]uint32{2: 130, 3: 100})
+	require.True(t, changed)
+	require.Equal(t, map[mesh.PeerName]uint32{2: 130, 3: 100}, costs)
+
+	// a new or lost link is always a change
+	costs, changed = dampCosts(advertised, map[mesh.PeerName]uint32{2: 100, 3: 100, 4: 5})
+	require.True(t, changed)
+	require.Equal(t, uint32(5), costs[4])
+	_, changed = dampCosts(advertised, map[mesh.PeerName]uint32{2: 100})
+	require.True(t, changed)
+}
+
+// 1 - 2 - 4, and 1 - 3 - 4 with 2 - 3 between them
+var costTestGraph = map[mesh.PeerName][]mesh.PeerName{
+	1: {2, 3},
+	2: {1, 3, 4},
+	3: {1, 2, 4},
+	4: {2, 3},
+}
+
+func TestComputeTree(t *testing.T) {
+	cr := newTestCostRouter(costTestGraph)
+	cr.graph = costTestGraph
+
+	// with no costs, all links cost the same, and ties go to the
+	// lower peer name
+	tree := cr.computeTree(1)
+	require.Equal(t, map[mesh.PeerName]mesh.PeerName{2: 1, 3: 1, 4: 2}, tree.parents)
+	require.Equal(t, uint64(2*linkDefaultCost), tree.costs[4])
+
+	// the link cost is the higher of what each end says
+	cr.costs[1] = &peerLinkCosts{Costs: map[mesh.PeerName]uint32{2: 5, 3: 5}}
+	cr.costs[2] = &peerLinkCosts{Costs: map[mesh.PeerName]uint32{1: 50, 3: 5, 4: 5}}
+	cr.costs[3] = &peerLinkCosts{Costs: map[mesh.PeerName]uint32{1: 5, 2: 5, 4: 5}}
+	cr.costs[4] = &peerLinkCosts{Costs: map[mesh.PeerName]uint32{2: 5, 3: 5}}
+	tree = cr.computeTree(1)
+	require.Equal(t, map[mesh.PeerName]mesh.PeerName{2: 3, 3: 1, 4: 3}, tree.parents)
+	require.Equal(t, uint64(10), tree.costs[2])
+	require.True(t, tree.leadsTo(3, 2))
+	require.False(t, tree.leadsTo(2, 4))
+
+	// every peer computes the same tree for a root
+	other := newTestCostRouter(costTestGraph)
+	other.graph, other.costs = costTestGraph, cr.costs
+	require.Equal(t, tree, other.computeTree(1))
+}
+
+func TestCostRoutingNeedsEveryPeerReady(t *testing.T) {
+	cr := newTestCostRouter(costTestGraph)
+	_, _, active := cr.unicast(4)
+	require.False(t, active)
+
+	// everyone has advertised costs, but not that they have
+	// everyone else's
+	for _, peer := range []mesh.PeerName{2, 3, 4} {
+		cr.heardFrom(peer, false, nil)
+	}
+	_, _, active = cr.unicast(4)
+	require.False(t, active)
+
+	// we have, so we say so, but still wait for the others
+	cr.updateReady()
+	require.True(t, cr.costs[1].Ready)
+	cr.heardFrom(2, true, nil)
+	cr.heardFrom(3, true, nil)
+	_, _, active = cr.unicast(4)
+	require.False(t, active)
+
+	cr.heardFrom(4, true, nil)
+	next, found, active := cr.unicast(4)
+	require.True(t, active)
+	require.True(t, found)
+	require.Equal(t, mesh.PeerName(2), next)
+
+	// a peer that joins without costs puts everyone back on
+	// hop-count routes
+	graph := map[mesh.PeerName][]mesh.PeerName{5: {4}}
+	for peer, neighbours := range costTestGraph {
+		graph[peer] = neighbours
+	}
+	graph[4] = append(graph[4], 5)
+	cr.topology = func() map[mesh.PeerName][]mesh.PeerName { return graph }
+	cr.refresh()
+	_, _, active = cr.unicast(4)
+	require.False(t, active)
+	cr.updateReady()
+	require.False(t, cr.costs[1].Ready)
+}
+
+func TestCostRoutingForwardsWithoutFetchingTopology(t *testing.T) {
+	cr := newTestCostRouter(costTestGraph)
+	for _, peer := range []mesh.PeerName{2, 3, 4} {
+		cr.heardFrom(peer, true, nil)
+	}
+	cr.updateReady()
+
+	// the run goroutine fetches the topology when the routes change;
+	// forwarding only reads what it fetched last
+	cr.topology = func() map[mesh.PeerName][]mesh.PeerName {
+		require.FailNow(t, "fetched the topology while forwarding")
+		return nil
+	}
+	cr.invalidate()
+	next, found, active := cr.unicast(4)
+	require.True(t, active)
+	require.True(t, found)
+	require.Equal(t, mesh.PeerName(2), next)
+	_, active = cr.broadcast(1)
+	require.True(t, active)
+}
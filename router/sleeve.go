@@ -9,7 +9,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"sync"
@@ -59,11 +58,22 @@ const (
 	ProtocolConnectionEstablished = mesh.ProtocolReserved1
 	ProtocolFragmentationReceived = mesh.ProtocolReserved2
 	ProtocolPMTUVerified          = mesh.ProtocolReserved3
+	// Only sent to peers with heartbeatEchoFeature or
+	// natTraversalFeature, which reach us through the OverlaySwitch,
+	// so these never reach mesh itself
+	ProtocolHeartbeatEcho = 0x80
+	ProtocolObservedAddr  = 0x81
+	ProtocolPunch         = 0x82
+	// Passed on by a rendezvous, and carried in those
+	ProtocolRelayedControl = 0x83
+	ProtocolNATRequest     = 0x84
+	ProtocolNATAccept      = 0x85
 )
 
 type SleeveOverlay struct {
 	host      string
 	localPort int
+	classes   *TrafficClasses // nil if traffic classes are not in use
 
 	// These fields are set in StartConsumingPackets, and not
 	// subsequently modified
@@ -72,13 +82,20 @@ type SleeveOverlay struct {
 	consumer     OverlayConsumer
 	peers        *mesh.Peers
 	conn         *net.UDPConn
+	// A blocking duplicate of conn, for batched I/O
+	connFile *os.File
+	connFd   int
 
-	lock       sync.Mutex
-	forwarders map[mesh.PeerName]*sleeveForwarder
+	lock          sync.Mutex
+	forwarders    map[mesh.PeerName]*sleeveForwarder
+	observedAddrs []*net.UDPAddr
+	gso           bool
+
+	nat *natTraversal
 }
 
-func NewSleeveOverlay(host string, localPort int) NetworkOverlay {
-	return &SleeveOverlay{host: host, localPort: localPort}
+func NewSleeveOverlay(host string, localPort int, classes *TrafficClasses) NetworkOverlay {
+	return &SleeveOverlay{host: host, localPort: localPort, classes: classes, nat: newNATTraversal()}
 }
 
 func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
@@ -97,20 +114,35 @@ func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *
 		return err
 	}
 
-	defer f.Close()
 	fd := int(f.Fd())
 
 	// This makes sure all packets we send out do not have DF set
 	// on them.
 	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
 	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// readUDP waits in recvmmsg
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		f.Close()
 		return err
 	}
 
+	// Segmentation offload needs kernel support, and so is
+	// optional
+	_, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_UDP, udpSegment)
+	gso := err == nil
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_UDP, udpGRO, 1); err != nil {
+		log.Debug("UDP GRO not available: ", err)
+	}
+
 	sleeve.lock.Lock()
 	defer sleeve.lock.Unlock()
 
 	if sleeve.localPeer != nil {
+		f.Close()
 		conn.Close()
 		return fmt.Errorf("StartConsumingPackets already called")
 	}
@@ -120,7 +152,14 @@ func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *
 	sleeve.consumer = consumer
 	sleeve.peers = peers
 	sleeve.conn = conn
+	sleeve.connFile = f
+	sleeve.connFd = fd
+	sleeve.gso = gso
 	sleeve.forwarders = make(map[mesh.PeerName]*sleeveForwarder)
+	sleeve.nat.ourName = localPeer.Name
+	sleeve.nat.send = sleeve.sendRelayedControlMsg
+	sleeve.nat.newForwarder = sleeve.newNATForwarder
+	sleeve.nat.lookupPeer = peers.Fetch
 	go sleeve.readUDP()
 	return nil
 }
@@ -163,51 +202,63 @@ func (sleeve *SleeveOverlay) removeForwarder(peer mesh.PeerName, fwd *sleeveForw
 
 func (sleeve *SleeveOverlay) readUDP() {
 	defer sleeve.conn.Close()
+	defer sleeve.connFile.Close()
 	dec := NewEthernetDecoder()
-	buf := make([]byte, MaxUDPPacketSize)
+	reader := newMMsgReader(sleeve.connFd, MaxUDPPacketSize)
 
 	for {
-		n, sender, err := sleeve.conn.ReadFromUDP(buf)
-		if err == io.EOF {
+		n, err := reader.read()
+		if err == syscall.EBADF {
 			return
 		} else if err != nil {
 			log.Print("ignoring UDP read error ", err)
 			continue
-		} else if n < NameSize {
-			log.Print("ignoring too short UDP packet from ", sender)
-			continue
 		}
 
-		fwdName := mesh.PeerNameFromBin(buf[:NameSize])
-		fwd := sleeve.lookupForwarder(fwdName)
-		if fwd == nil {
-			continue
+		for i := 0; i < n; i++ {
+			buf, sender, segSize := reader.datagram(i)
+			splitGRO(buf, segSize, func(datagram []byte) {
+				sleeve.handleDatagram(datagram, sender, dec)
+			})
 		}
+	}
+}
 
-		packet := make([]byte, n-NameSize)
-		copy(packet, buf[NameSize:n])
+func (sleeve *SleeveOverlay) handleDatagram(buf []byte, sender *net.UDPAddr, dec *EthernetDecoder) {
+	if len(buf) < NameSize {
+		log.Print("ignoring too short UDP packet from ", sender)
+		return
+	}
 
-		err = fwd.crypto.Dec.IterateFrames(packet,
-			func(src []byte, dst []byte, frame []byte) {
-				sleeve.handleFrame(sender, fwd, src, dst, frame, dec)
-			})
-		if err != nil {
-			// Errors during UDP packet decoding /
-			// processing are non-fatal. One common cause
-			// is that we receive and attempt to decrypt a
-			// "stray" packet. This can actually happen
-			// quite easily if there is some connection
-			// churn between two peers. After all, UDP
-			// isn't a connection-oriented protocol, yet
-			// we pretend it is.
-			//
-			// If anything really is seriously,
-			// unrecoverably amiss with a connection, that
-			// will typically result in missed heartbeats
-			// and the connection getting shut down
-			// because of that.
-			log.Print(fwd.logPrefixFor(sender), err)
-		}
+	fwdName := mesh.PeerNameFromBin(buf[:NameSize])
+	fwd := sleeve.lookupForwarder(fwdName)
+	if fwd == nil {
+		return
+	}
+
+	packet := make([]byte, len(buf)-NameSize)
+	copy(packet, buf[NameSize:])
+
+	err := fwd.crypto.Dec.IterateFrames(packet,
+		func(src []byte, dst []byte, frame []byte) {
+			sleeve.handleFrame(sender, fwd, src, dst, frame, dec)
+		})
+	if err != nil {
+		// Errors during UDP packet decoding /
+		// processing are non-fatal. One common cause
+		// is that we receive and attempt to decrypt a
+		// "stray" packet. This can actually happen
+		// quite easily if there is some connection
+		// churn between two peers. After all, UDP
+		// isn't a connection-oriented protocol, yet
+		// we pretend it is.
+		//
+		// If anything really is seriously,
+		// unrecoverably amiss with a connection, that
+		// will typically result in missed heartbeats
+		// and the connection getting shut down
+		// because of that.
+		log.Print(fwd.logPrefixFor(sender), err)
 	}
 }
 
@@ -263,6 +314,7 @@ func (sleeve *SleeveOverlay) sendToConsumer(srcPeer, dstPeer *mesh.Peer, frame [
 
 type udpSender interface {
 	send([]byte, *net.UDPAddr) error
+	sendBatch(*udpBatch, *net.UDPAddr) error
 }
 
 func (sleeve *SleeveOverlay) send(msg []byte, raddr *net.UDPAddr) error {
@@ -279,6 +331,51 @@ func (sleeve *SleeveOverlay) send(msg []byte, raddr *net.UDPAddr) error {
 	return err
 }
 
+// GSO segments have to fit the route's MTU, which we don't know, so
+// we only use it for messages that fit the usual one.  If even those
+// don't fit, we get EINVAL, and send them without.
+const gsoMaxSegmentSize = 1500 - UDPOverhead
+
+func (sleeve *SleeveOverlay) sendBatch(batch *udpBatch, raddr *net.UDPAddr) error {
+	sleeve.lock.Lock()
+	conn, fd, gso := sleeve.conn, sleeve.connFd, sleeve.gso
+	sleeve.lock.Unlock()
+
+	if conn == nil {
+		// Consume wasn't called yet
+		return nil
+	}
+	if raddr == nil {
+		return fmt.Errorf("no address to send to")
+	}
+
+	addr := rawSockaddrInet4(raddr)
+	msgs := batch.msgs
+	if gso {
+		runs, segSizes, counts := batch.gsoRuns(gsoMaxSegmentSize)
+		sent, err := sendmmsg(fd, runs, segSizes, addr)
+		switch err {
+		case nil:
+			return nil
+		case syscall.EIO:
+			// The device can't do the checksums for GSO
+			log.Print("disabling UDP GSO: ", err)
+			sleeve.lock.Lock()
+			sleeve.gso = false
+			sleeve.lock.Unlock()
+		case syscall.EINVAL:
+		default:
+			return err
+		}
+		for _, count := range counts[:sent] {
+			msgs = msgs[count:]
+		}
+	}
+
+	_, err := sendmmsg(fd, msgs, nil, addr)
+	return err
+}
+
 type sleeveCrypto struct {
 	Dec   Decryptor
 	Enc   Encryptor
@@ -311,6 +408,7 @@ type sleeveForwarder struct {
 	remotePeerBin  []byte
 	sendControlMsg func(byte, []byte) error
 	connUID        uint64
+	natPath        bool // not part of a mesh connection
 
 	// Channels to communicate with the aggregator goroutine
 	aggregatorChan   chan<- aggregatorFrame
@@ -320,13 +418,20 @@ type sleeveForwarder struct {
 	confirmedChan    chan<- struct{}
 	finishedChan     <-chan struct{}
 
+	// When traffic classes are in use, frames go in the queue of
+	// their class instead of to the aggregator channels, and
+	// classWake tells the forwarder goroutine about them
+	classQueues []*classQueue
+	classWake   chan struct{}
+
 	// listener channels
 	establishedChan chan struct{}
 	errorChan       chan error
 
 	// Explicitly locked state
-	lock       sync.RWMutex
-	remoteAddr *net.UDPAddr
+	lock        sync.RWMutex
+	remoteAddr  *net.UDPAddr
+	verifiedMTU int // zero until PMTU verification completes
 
 	// These fields are accessed and updated independently, so no
 	// locking needed.
@@ -337,6 +442,7 @@ type sleeveForwarder struct {
 	crypto     sleeveCrypto
 	senderDF   *udpSenderDF
 	maxPayload int
+	batch      udpBatch
 
 	// How many bytes of overhead it takes to turn an IP packet on
 	// the overlay network into an encapsulated packet on the underlay
@@ -348,12 +454,22 @@ type sleeveForwarder struct {
 	heartbeatTimeout  *time.Timer
 	fragTestTicker    *time.Ticker
 	ackedHeartbeat    bool
+	echoHeartbeats    bool
+	monitor           linkMonitor
+
+	natTraversal bool
+	reportedAddr *net.UDPAddr // what we last told the remote peer
+	punchAddrs   []*net.UDPAddr
+	punchTimer   *time.Timer
+	punchSent    bool
 
 	mtuTestTimeout *time.Timer
 	mtuTestsSent   uint
 	mtuHighestGood int
 	mtuLowestBad   int
 	mtuCandidate   int
+
+	classTimer *time.Timer // for when a rate limit allows sending
 }
 
 type aggregatorFrame struct {
@@ -362,6 +478,19 @@ type aggregatorFrame struct {
 	frame []byte
 }
 
+// A frame in a traffic class queue
+type queuedFrame struct {
+	aggregatorFrame
+	df bool
+}
+
+type classQueue struct {
+	frames chan queuedFrame
+	// Only used by the forwarder goroutine
+	pending    queuedFrame
+	hasPending bool
+}
+
 // A "special" frame over UDP
 type specialFrame struct {
 	sender *net.UDPAddr
@@ -375,6 +504,10 @@ type controlMessage struct {
 }
 
 func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	return sleeve.newForwarder(params, false), nil
+}
+
+func (sleeve *SleeveOverlay) newForwarder(params mesh.OverlayConnectionParams, natPath bool) *sleeveForwarder {
 	aggChan := make(chan aggregatorFrame, ChannelSize)
 	aggDFChan := make(chan aggregatorFrame, ChannelSize)
 	specialChan := make(chan specialFrame, 1)
@@ -383,7 +516,7 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 	finishedChan := make(chan struct{})
 
 	var remoteAddr *net.UDPAddr
-	if params.Outbound {
+	if params.Outbound && !natPath {
 		remoteAddr = makeUDPAddr(params.RemoteAddr)
 	}
 
@@ -395,6 +528,7 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		remotePeerBin:    params.RemotePeer.NameByte,
 		sendControlMsg:   params.SendControlMessage,
 		connUID:          params.ConnUID,
+		natPath:          natPath,
 		aggregatorChan:   aggChan,
 		aggregatorDFChan: aggDFChan,
 		specialChan:      specialChan,
@@ -410,9 +544,20 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		overheadDF:       crypto.Overhead(),
 		senderDF:         newUDPSenderDF(params.LocalAddr.IP, sleeve.localPort),
 	}
+	_, fwd.echoHeartbeats = params.Features[heartbeatEchoFeature]
+	_, fwd.natTraversal = params.Features[natTraversalFeature]
+
+	if classes := sleeve.classes; classes != nil {
+		fwd.classWake = make(chan struct{}, 1)
+		for range classes.classes {
+			fwd.classQueues = append(fwd.classQueues, &classQueue{
+				frames: make(chan queuedFrame, ChannelSize),
+			})
+		}
+	}
 
 	go fwd.run(aggChan, aggDFChan, specialChan, controlMsgChan, confirmedChan, finishedChan)
-	return fwd, nil
+	return fwd
 }
 
 func (fwd *sleeveForwarder) logPrefixFor(sender *net.UDPAddr) string {
@@ -467,6 +612,10 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 
 	srcName := f.key.SrcPeer.NameByte
 	dstName := f.key.DstPeer.NameByte
+	class := -1
+	if classes := fwd.sleeve.classes; classes != nil {
+		class = classes.classify(dec)
+	}
 
 	// We could use non-blocking channel sends here, i.e. drop frames
 	// on the floor when the forwarder is busy. This would allow our
@@ -480,7 +629,7 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	// of our pipeline.
 	if dec.DF() {
 		if !frameTooBig(frame, mtu) {
-			fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, frame)
+			fwd.enqueue(class, true, srcName, dstName, frame)
 			return
 		}
 
@@ -510,14 +659,14 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	}
 
 	if stackFrag || len(dec.decoded) < 2 {
-		fwd.aggregate(fwd.aggregatorChan, srcName, dstName, frame)
+		fwd.enqueue(class, false, srcName, dstName, frame)
 		return
 	}
 
 	// Don't have trustworthy stack, so we're going to have to
 	// send it DF in any case.
 	if !frameTooBig(frame, mtu) {
-		fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, frame)
+		fwd.enqueue(class, true, srcName, dstName, frame)
 		return
 	}
 
@@ -526,10 +675,47 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	// fragment it ourself.
 	checkWarn(fragment(dec.Eth, dec.IP, mtu,
 		func(segFrame []byte) {
-			fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, segFrame)
+			fwd.enqueue(class, true, srcName, dstName, segFrame)
 		}))
 }
 
+// Hand a frame to the forwarder goroutine, in the queue of its
+// traffic class if it has one
+func (fwd *sleeveForwarder) enqueue(class int, df bool, src []byte, dst []byte, frame []byte) {
+	if class < 0 {
+		if df {
+			fwd.aggregate(fwd.aggregatorDFChan, src, dst, frame)
+		} else {
+			fwd.aggregate(fwd.aggregatorChan, src, dst, frame)
+		}
+		return
+	}
+
+	qf := queuedFrame{aggregatorFrame{src, dst, frame}, df}
+	if fwd.sleeve.classes.classes[class].Rate != 0 {
+		// A rate-limited class that has filled its queue has
+		// its frames dropped, rather than holding up those of
+		// other classes as we would by blocking
+		select {
+		case fwd.classQueues[class].frames <- qf:
+		default:
+			fwd.sleeve.classes.dropped(class)
+			return
+		}
+	} else {
+		select {
+		case fwd.classQueues[class].frames <- qf:
+		case <-fwd.finishedChan:
+			return
+		}
+	}
+
+	select {
+	case fwd.classWake <- struct{}{}:
+	default:
+	}
+}
+
 func (fwd *sleeveForwarder) aggregate(ch chan<- aggregatorFrame, src []byte, dst []byte, frame []byte) {
 	select {
 	case ch <- aggregatorFrame{src, dst, frame}:
@@ -610,6 +796,16 @@ func (fwd *sleeveForwarder) DisplayName() string {
 	return "sleeve"
 }
 
+func (fwd *sleeveForwarder) LinkQuality() (LinkQuality, bool) {
+	return fwd.monitor.LinkQuality()
+}
+
+func (fwd *sleeveForwarder) PMTU() (int, bool) {
+	fwd.lock.RLock()
+	defer fwd.lock.RUnlock()
+	return fwd.verifiedMTU, fwd.verifiedMTU != 0
+}
+
 func (fwd *sleeveForwarder) Stop() {
 	fwd.sleeve.removeForwarder(fwd.remotePeer.Name, fwd)
 
@@ -631,10 +827,16 @@ loop:
 	for err == nil {
 		select {
 		case frame := <-aggChan:
-			err = fwd.aggregateAndSend(frame, aggChan, fwd.crypto.Enc, fwd.sleeve, MaxUDPPacketSize-UDPOverhead)
+			err = fwd.aggregateAndSend(frame, pollAggregator(aggChan), fwd.crypto.Enc, fwd.sleeve, MaxUDPPacketSize-UDPOverhead)
 
 		case frame := <-aggDFChan:
-			err = fwd.aggregateAndSend(frame, aggDFChan, fwd.crypto.EncDF, fwd.senderDF, fwd.maxPayload)
+			err = fwd.aggregateAndSend(frame, pollAggregator(aggDFChan), fwd.crypto.EncDF, fwd.senderDF, fwd.maxPayload)
+
+		case <-fwd.classWake:
+			err = fwd.sendQueued()
+
+		case <-timerChan(fwd.classTimer):
+			err = fwd.sendQueued()
 
 		case sf := <-specialChan:
 			err = fwd.handleSpecialFrame(sf)
@@ -662,6 +864,9 @@ loop:
 
 		case <-timerChan(fwd.mtuTestTimeout):
 			err = fwd.handleMTUTestFailure()
+
+		case <-timerChan(fwd.punchTimer):
+			err = fwd.punch()
 		}
 	}
 
@@ -677,6 +882,12 @@ loop:
 	if fwd.mtuTestTimeout != nil {
 		fwd.mtuTestTimeout.Stop()
 	}
+	if fwd.punchTimer != nil {
+		fwd.punchTimer.Stop()
+	}
+	if fwd.classTimer != nil {
+		fwd.classTimer.Stop()
+	}
 
 	checkWarn(fwd.senderDF.close())
 
@@ -687,16 +898,20 @@ loop:
 	fwd.errorChan <- err
 }
 
-func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-chan aggregatorFrame, enc Encryptor, sender udpSender, limit int) error {
+// Send frame, along with as many more frames as next gives without
+// waiting
+func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, next func() (aggregatorFrame, bool), enc Encryptor, sender udpSender, limit int) error {
 	// Give up after processing N frames, to avoid starving the
 	// other activities of the forwarder goroutine.
 	i := 0
 
+	// The messages are sent in a batch at the end, saving system
+	// calls
 	for {
 		// Adding the first frame to an empty buffer
 		if !fits(frame, enc, limit) {
 			log.Print(fwd.logPrefix(), "Dropping too big frame during forwarding: frame len ", len(frame.frame), ", limit ", limit)
-			return nil
+			return fwd.flushBatch(sender)
 		}
 
 		for {
@@ -705,15 +920,14 @@ func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-ch
 
 			gotOne := false
 			if i < 100 {
-				select {
-				case frame = <-aggChan:
-					gotOne = true
-				default:
-				}
+				frame, gotOne = next()
 			}
 
 			if !gotOne {
-				return fwd.flushEncryptor(enc, sender)
+				if err := fwd.batchEncryptor(enc, sender); err != nil {
+					return err
+				}
+				return fwd.flushBatch(sender)
 			}
 
 			// Accumulate frames until doing so would
@@ -727,12 +941,102 @@ func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-ch
 			}
 		}
 
-		if err := fwd.flushEncryptor(enc, sender); err != nil {
+		if err := fwd.batchEncryptor(enc, sender); err != nil {
 			return err
 		}
 	}
 }
 
+func pollAggregator(aggChan <-chan aggregatorFrame) func() (aggregatorFrame, bool) {
+	return func() (aggregatorFrame, bool) {
+		select {
+		case frame := <-aggChan:
+			return frame, true
+		default:
+			return aggregatorFrame{}, false
+		}
+	}
+}
+
+// Send the frames in the traffic class queues, from the queue of
+// highest priority that its rate limit allows to send, until they
+// are empty or held back by their rate limits.  The rate limits are
+// shared with the other connections, so a frame is charged to its
+// class as soon as it is chosen to be sent.
+func (fwd *sleeveForwarder) sendQueued() error {
+	classes := fwd.sleeve.classes
+	// Give up after a while, to avoid starving the other
+	// activities of the forwarder goroutine, and come back later
+	for batches := 0; batches < 100; batches++ {
+		now := time.Now()
+		var next *classQueue
+		var nextClass int
+		var wait time.Duration
+		for i, queue := range fwd.classQueues {
+			if !queue.peek() {
+				continue
+			}
+			if d := classes.admit(i, len(queue.pending.frame), now); d > 0 {
+				if wait == 0 || d < wait {
+					wait = d
+				}
+				continue
+			}
+			next, nextClass = queue, i
+			break
+		}
+		if next == nil {
+			if wait > 0 {
+				fwd.classTimer = setTimer(fwd.classTimer, wait)
+			}
+			return nil
+		}
+
+		df := next.pending.df
+		frame := next.take(classes, nextClass)
+		more := func() (aggregatorFrame, bool) {
+			if !next.peek() || next.pending.df != df || classes.admit(nextClass, len(next.pending.frame), now) > 0 {
+				return aggregatorFrame{}, false
+			}
+			return next.take(classes, nextClass), true
+		}
+		var err error
+		if df {
+			err = fwd.aggregateAndSend(frame, more, fwd.crypto.EncDF, fwd.senderDF, fwd.maxPayload)
+		} else {
+			err = fwd.aggregateAndSend(frame, more, fwd.crypto.Enc, fwd.sleeve, MaxUDPPacketSize-UDPOverhead)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case fwd.classWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Is there a frame in the queue?  If so, it is in pending.
+func (queue *classQueue) peek() bool {
+	if !queue.hasPending {
+		select {
+		case queue.pending = <-queue.frames:
+			queue.hasPending = true
+		default:
+		}
+	}
+	return queue.hasPending
+}
+
+func (queue *classQueue) take(classes *TrafficClasses, class int) aggregatorFrame {
+	frame := queue.pending.aggregatorFrame
+	queue.pending, queue.hasPending = queuedFrame{}, false
+	classes.sent(class, len(frame.frame))
+	return frame
+}
+
 func fits(frame aggregatorFrame, enc Encryptor, limit int) bool {
 	return enc.TotalLen()+enc.FrameOverhead()+len(frame.frame) <= limit
 }
@@ -746,6 +1050,31 @@ func (fwd *sleeveForwarder) flushEncryptor(enc Encryptor, sender udpSender) erro
 	return fwd.processSendError(sender.send(msg, fwd.remoteAddr))
 }
 
+func (fwd *sleeveForwarder) batchEncryptor(enc Encryptor, sender udpSender) error {
+	msg, err := enc.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if !fwd.batch.add(msg) {
+		if err := fwd.flushBatch(sender); err != nil {
+			return err
+		}
+		fwd.batch.add(msg)
+	}
+	return nil
+}
+
+func (fwd *sleeveForwarder) flushBatch(sender udpSender) error {
+	if len(fwd.batch.msgs) == 0 {
+		return nil
+	}
+
+	err := sender.sendBatch(&fwd.batch, fwd.remoteAddr)
+	fwd.batch.reset()
+	return fwd.processSendError(err)
+}
+
 func (fwd *sleeveForwarder) sendSpecial(enc Encryptor, sender udpSender, data []byte) error {
 	enc.AppendFrame(fwd.sleeve.localPeerBin, fwd.remotePeerBin, data)
 	return fwd.flushEncryptor(enc, sender)
@@ -776,6 +1105,23 @@ func (fwd *sleeveForwarder) handleControlMessage(cm controlMessage) error {
 	case ProtocolPMTUVerified:
 		return fwd.handleMTUTestAck(cm.msg)
 
+	case ProtocolHeartbeatEcho:
+		fwd.monitor.heartbeatEchoed()
+		return nil
+
+	case ProtocolObservedAddr:
+		for _, addr := range decodeUDPAddrs(cm.msg) {
+			fwd.sleeve.addObservedAddr(addr)
+		}
+		return nil
+
+	case ProtocolPunch:
+		return fwd.handlePunch(cm.msg)
+
+	case ProtocolRelayedControl:
+		fwd.sleeve.handleRelayedControlMsg(fwd, cm.msg)
+		return nil
+
 	default:
 		log.Print(fwd.logPrefix(), "Ignoring unknown control message tag: ", cm.tag)
 		return nil
@@ -798,13 +1144,16 @@ func (fwd *sleeveForwarder) confirmed() error {
 	// even if we don't do sendHeartbeat() yet due to lacking the
 	// remote address.
 	fwd.heartbeatInterval = FastHeartbeat
-	if fwd.remoteAddr != nil {
+	if fwd.remoteAddr != nil || len(fwd.punchAddrs) > 0 {
 		if err := fwd.sendHeartbeat(); err != nil {
 			return err
 		}
 	}
 
 	fwd.heartbeatTimeout = time.NewTimer(HeartbeatTimeout)
+	if fwd.natTraversal {
+		fwd.punchTimer = time.NewTimer(punchDelay)
+	}
 	return nil
 }
 
@@ -817,7 +1166,77 @@ func (fwd *sleeveForwarder) sendHeartbeat() error {
 
 	buf := make([]byte, EthernetOverhead+8)
 	binary.BigEndian.PutUint64(buf[EthernetOverhead:], fwd.connUID)
-	return fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, buf)
+	if fwd.echoHeartbeats {
+		fwd.monitor.heartbeatSent()
+	}
+	if fwd.remoteAddr != nil {
+		if err := fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, buf); err != nil {
+			return err
+		}
+	}
+	return fwd.punchHoles(buf)
+}
+
+// Until we hear from the remote peer, send heartbeats to all the
+// addresses it might be at too
+func (fwd *sleeveForwarder) punchHoles(heartbeat []byte) error {
+	if fwd.ackedHeartbeat {
+		return nil
+	}
+	for _, addr := range fwd.punchAddrs {
+		if fwd.remoteAddr != nil && udpAddrsEqual(addr, fwd.remoteAddr) {
+			continue
+		}
+		fwd.crypto.EncDF.AppendFrame(fwd.sleeve.localPeerBin, fwd.remotePeerBin, heartbeat)
+		msg, err := fwd.crypto.EncDF.Bytes()
+		if err != nil {
+			return err
+		}
+		// the address may well be bogus, so don't give up on
+		// the connection because of it
+		if err := fwd.senderDF.send(msg, addr); err != nil {
+			log.Debug(fwd.logPrefix(), "punching hole to ", addr, ": ", err)
+		}
+	}
+	return nil
+}
+
+// Tell the remote peer where it might reach us, if it hasn't been
+// able to yet
+func (fwd *sleeveForwarder) punch() error {
+	if fwd.ackedHeartbeat {
+		return nil
+	}
+	fwd.punchTimer = setTimer(fwd.punchTimer, SlowHeartbeat)
+	fwd.punchSent = true
+	log.Debug(fwd.logPrefix(), "punch")
+	return fwd.sendControlMsg(ProtocolPunch, encodeUDPAddrs(fwd.sleeve.candidateAddrs(fwd.senderDF.localIP)))
+}
+
+func (fwd *sleeveForwarder) handlePunch(msg []byte) error {
+	fwd.punchAddrs = decodeUDPAddrs(msg)
+	log.Print(fwd.logPrefix(), "Punching holes to ", fwd.punchAddrs)
+
+	if fwd.heartbeatInterval != 0 {
+		if fwd.heartbeatTimer == nil {
+			// we haven't been sending heartbeats, for want
+			// of an address
+			if err := fwd.sendHeartbeat(); err != nil {
+				return err
+			}
+		} else {
+			buf := make([]byte, EthernetOverhead+8)
+			binary.BigEndian.PutUint64(buf[EthernetOverhead:], fwd.connUID)
+			if err := fwd.punchHoles(buf); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !fwd.punchSent {
+		return fwd.punch()
+	}
+	return nil
 }
 
 func (fwd *sleeveForwarder) handleHeartbeat(special specialFrame) error {
@@ -840,6 +1259,13 @@ func (fwd *sleeveForwarder) handleHeartbeat(special specialFrame) error {
 		fwd.setRemoteAddr(special.sender)
 	}
 
+	if fwd.natTraversal && (fwd.reportedAddr == nil || !udpAddrsEqual(fwd.reportedAddr, special.sender)) {
+		fwd.reportedAddr = special.sender
+		if err := fwd.sendControlMsg(ProtocolObservedAddr, encodeUDPAddrs([]*net.UDPAddr{special.sender})); err != nil {
+			return err
+		}
+	}
+
 	if !fwd.ackedHeartbeat {
 		fwd.ackedHeartbeat = true
 		if err := fwd.sendControlMsg(ProtocolConnectionEstablished, nil); err != nil {
@@ -847,6 +1273,12 @@ func (fwd *sleeveForwarder) handleHeartbeat(special specialFrame) error {
 		}
 	}
 
+	if fwd.echoHeartbeats {
+		if err := fwd.sendControlMsg(ProtocolHeartbeatEcho, nil); err != nil {
+			return err
+		}
+	}
+
 	// we can receive a heartbeat before confirmed() has set up
 	// heartbeatTimeout
 	if fwd.heartbeatTimeout != nil {
@@ -989,6 +1421,9 @@ func (fwd *sleeveForwarder) searchMTU() error {
 		fwd.mtuCandidate = 0
 		fwd.maxPayload = mtu + fwd.overheadDF - UDPOverhead
 		fwd.mtu = mtu
+		fwd.lock.Lock()
+		fwd.verifiedMTU = mtu
+		fwd.lock.Unlock()
 		return nil
 	}
 
@@ -1004,6 +1439,10 @@ type udpSenderDF struct {
 	localIP   net.IP
 	remoteIP  net.IP
 	socket    *net.IPConn
+	// A duplicate of socket, for batched I/O
+	socketFile *os.File
+	// Reused from one batch to the next
+	packets [][]byte
 }
 
 func newUDPSenderDF(localIP net.IP, localPort int) *udpSenderDF {
@@ -1025,7 +1464,7 @@ func newUDPSenderDF(localIP net.IP, localPort int) *udpSenderDF {
 
 func (sender *udpSenderDF) dial() error {
 	if sender.socket != nil {
-		if err := sender.socket.Close(); err != nil {
+		if err := sender.close(); err != nil {
 			return err
 		}
 
@@ -1041,24 +1480,55 @@ func (sender *udpSenderDF) dial() error {
 		return err
 	}
 
-	defer f.Close()
-
 	// This makes sure all packets we send out have DF set on them.
 	err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
 	if err != nil {
+		f.Close()
 		return err
 	}
 
 	sender.socket = s
+	sender.socketFile = f
 	return nil
 }
 
 func (sender *udpSenderDF) send(msg []byte, raddr *net.UDPAddr) error {
+	packet, err := sender.serialize(msg, raddr)
+	if err != nil {
+		return err
+	}
+
+	_, err = sender.socket.Write(packet)
+	return sender.checkMsgSize(err, packet, msg)
+}
+
+func (sender *udpSenderDF) sendBatch(batch *udpBatch, raddr *net.UDPAddr) error {
+	for len(sender.packets) < len(batch.msgs) {
+		sender.packets = append(sender.packets, nil)
+	}
+	packets := sender.packets[:len(batch.msgs)]
+	for i, msg := range batch.msgs {
+		packet, err := sender.serialize(msg, raddr)
+		if err != nil {
+			return err
+		}
+		packets[i] = append(packets[i][:0], packet...)
+	}
+
+	sent, err := sendmmsg(int(sender.socketFile.Fd()), packets, nil, nil)
+	if err != nil {
+		return sender.checkMsgSize(err, packets[sent], batch.msgs[sent])
+	}
+	return nil
+}
+
+// Prepend the UDP header to msg, returning the packet to send
+func (sender *udpSenderDF) serialize(msg []byte, raddr *net.UDPAddr) ([]byte, error) {
 	// Ensure we have a socket sending to the right IP address
 	if sender.socket == nil || !bytes.Equal(sender.remoteIP, raddr.IP) {
 		sender.remoteIP = raddr.IP
 		if err := sender.dial(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -1066,23 +1536,19 @@ func (sender *udpSenderDF) send(msg []byte, raddr *net.UDPAddr) error {
 	payload := gopacket.Payload(msg)
 	err := gopacket.SerializeLayers(sender.ipBuf, sender.opts, sender.udpHeader, &payload)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	packet := sender.ipBuf.Bytes()
-	_, err = sender.socket.Write(packet)
-	if err == nil || PosixError(err) != syscall.EMSGSIZE {
-		return err
-	}
+	return sender.ipBuf.Bytes(), nil
+}
 
-	f, err := sender.socket.File()
-	if err != nil {
+func (sender *udpSenderDF) checkMsgSize(err error, packet []byte, msg []byte) error {
+	if err == nil || PosixError(err) != syscall.EMSGSIZE {
 		return err
 	}
-	defer f.Close()
 
 	log.Print("EMSGSIZE on send, expecting PMTU update (IP packet was ", len(packet), " bytes, payload was ", len(msg), " bytes)")
-	pmtu, err := syscall.GetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU)
+	pmtu, err := syscall.GetsockoptInt(int(sender.socketFile.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU)
 	if err != nil {
 		return err
 	}
@@ -1103,6 +1569,9 @@ func (sender *udpSenderDF) close() error {
 		return nil
 	}
 
+	if err := sender.socketFile.Close(); err != nil {
+		return err
+	}
 	return sender.socket.Close()
 }
 
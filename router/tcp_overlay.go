@@ -0,0 +1,217 @@
+package router
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+// TCPOverlay carries frames over the mesh connection itself, as
+// overlay control messages, for networks where UDP is blocked.  It
+// is slow - every frame is sent on its own, and shares the stream
+// with gossip - so its forwarders are last resorts, which the
+// OverlaySwitch only uses once the UDP-based overlays have failed.
+// Frames are dropped when the queues either way are full, rather
+// than holding up the capture loop or mesh's receiving of gossip and
+// heartbeats.  Since the mesh connection is encrypted when a
+// password is set, so are the frames.
+
+const (
+	tcpOverlayHello = iota
+	tcpOverlayFrame
+)
+
+type TCPOverlay struct {
+	// These fields are set in StartConsumingPackets, and not
+	// subsequently modified
+	localPeer *mesh.Peer
+	peers     *mesh.Peers
+	consumer  OverlayConsumer
+}
+
+func NewTCPOverlay() *TCPOverlay {
+	return &TCPOverlay{}
+}
+
+func (*TCPOverlay) AddFeaturesTo(map[string]string) {
+	// Nothing needed.  Support is indicated through OverlaySwitch.
+}
+
+func (*TCPOverlay) Diagnostics() interface{} {
+	return nil
+}
+
+func (*TCPOverlay) InvalidateRoutes() {
+}
+
+func (*TCPOverlay) InvalidateShortIDs() {
+}
+
+func (tcp *TCPOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
+	if tcp.localPeer != nil {
+		return fmt.Errorf("StartConsumingPackets already called")
+	}
+	tcp.localPeer = localPeer
+	tcp.peers = peers
+	tcp.consumer = consumer
+	return nil
+}
+
+func (tcp *TCPOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	framesChan := make(chan []byte, ChannelSize)
+	receivedChan := make(chan []byte, ChannelSize)
+	stopChan := make(chan struct{})
+	fwd := &tcpForwarder{
+		tcp:             tcp,
+		remotePeer:      params.RemotePeer,
+		sendControlMsg:  params.SendControlMessage,
+		framesChan:      framesChan,
+		receivedChan:    receivedChan,
+		stopChan:        stopChan,
+		establishedChan: make(chan struct{}),
+		errorChan:       make(chan error, 1),
+	}
+	go fwd.run(framesChan, stopChan)
+	go fwd.receive(receivedChan, stopChan)
+	return fwd, nil
+}
+
+type tcpForwarder struct {
+	tcp            *TCPOverlay
+	remotePeer     *mesh.Peer
+	sendControlMsg func(byte, []byte) error
+	framesChan     chan<- []byte
+	receivedChan   chan<- []byte
+	stopChan       chan struct{}
+	stopOnce       sync.Once
+
+	establishOnce   sync.Once
+	establishedChan chan struct{}
+	errorChan       chan error
+}
+
+func (fwd *tcpForwarder) logPrefix() string {
+	return fmt.Sprintf("tcp ->[%s] ", fwd.remotePeer)
+}
+
+func (fwd *tcpForwarder) run(framesChan <-chan []byte, stopChan <-chan struct{}) {
+	for {
+		select {
+		case msg := <-framesChan:
+			if err := fwd.sendControlMsg(tcpOverlayFrame, msg); err != nil {
+				fwd.error(err)
+				return
+			}
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+func (fwd *tcpForwarder) receive(receivedChan <-chan []byte, stopChan <-chan struct{}) {
+	dec := NewEthernetDecoder()
+	for {
+		select {
+		case msg := <-receivedChan:
+			fwd.handleFrame(msg, dec)
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+func (fwd *tcpForwarder) error(err error) {
+	select {
+	case fwd.errorChan <- err:
+	default:
+	}
+}
+
+func (fwd *tcpForwarder) Confirm() {
+	if err := fwd.sendControlMsg(tcpOverlayHello, nil); err != nil {
+		fwd.error(err)
+	}
+}
+
+func (fwd *tcpForwarder) Forward(key ForwardPacketKey) FlowOp {
+	return tcpFlowOp{fwd: fwd, key: key}
+}
+
+type tcpFlowOp struct {
+	NonDiscardingFlowOp
+	fwd *tcpForwarder
+	key ForwardPacketKey
+}
+
+func (op tcpFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	msg := make([]byte, 2*NameSize+len(frame))
+	copy(msg, op.key.SrcPeer.NameByte)
+	copy(msg[NameSize:], op.key.DstPeer.NameByte)
+	copy(msg[2*NameSize:], frame)
+	select {
+	case op.fwd.framesChan <- msg:
+	default:
+	}
+}
+
+func (fwd *tcpForwarder) EstablishedChannel() <-chan struct{} {
+	return fwd.establishedChan
+}
+
+func (fwd *tcpForwarder) ErrorChannel() <-chan error {
+	return fwd.errorChan
+}
+
+func (fwd *tcpForwarder) Stop() {
+	fwd.stopOnce.Do(func() { close(fwd.stopChan) })
+}
+
+func (fwd *tcpForwarder) ControlMessage(tag byte, msg []byte) {
+	switch tag {
+	case tcpOverlayHello:
+		// The other end is ready to receive frames
+		fwd.establishOnce.Do(func() { close(fwd.establishedChan) })
+
+	case tcpOverlayFrame:
+		select {
+		case fwd.receivedChan <- msg:
+		default:
+		}
+
+	default:
+		log.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
+	}
+}
+
+func (fwd *tcpForwarder) handleFrame(msg []byte, dec *EthernetDecoder) {
+	tcp := fwd.tcp
+	if len(msg) < 2*NameSize || tcp.consumer == nil {
+		return
+	}
+	srcPeer := tcp.peers.Fetch(mesh.PeerNameFromBin(msg[:NameSize]))
+	dstPeer := tcp.peers.Fetch(mesh.PeerNameFromBin(msg[NameSize : 2*NameSize]))
+	if srcPeer == nil || dstPeer == nil {
+		return
+	}
+
+	frame := msg[2*NameSize:]
+	dec.DecodeLayers(frame)
+	if len(dec.decoded) == 0 {
+		return
+	}
+	fop := tcp.consumer(ForwardPacketKey{
+		SrcPeer:   srcPeer,
+		DstPeer:   dstPeer,
+		PacketKey: dec.PacketKey(),
+	})
+	if fop != nil {
+		fop.Process(frame, dec, false)
+	}
+}
+
+func (fwd *tcpForwarder) lastResort() {}
+
+func (fwd *tcpForwarder) DisplayName() string {
+	return "tcp"
+}
@@ -0,0 +1,119 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+type fakeOverlay struct {
+	NullNetworkOverlay
+	fwd OverlayForwarder
+}
+
+func (overlay fakeOverlay) PrepareConnection(mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	return overlay.fwd, nil
+}
+
+func newTCPTestSwitch(t *testing.T, udpFwd OverlayForwarder) *overlaySwitchForwarder {
+	osw := NewOverlaySwitch()
+	osw.Add("sleeve", fakeOverlay{fwd: udpFwd})
+	osw.Add("tcp", NewTCPOverlay())
+	conn, err := osw.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer:         &mesh.Peer{Name: 2},
+		Features:           map[string]string{"Overlays": "sleeve tcp"},
+		SendControlMessage: func(byte, []byte) error { return nil },
+	})
+	require.NoError(t, err)
+	fwd := conn.(*overlaySwitchForwarder)
+	fwd.Confirm()
+	return fwd
+}
+
+// The subsidiary forwarders' events reach the switch asynchronously
+func awaitSwitch(t *testing.T, fwd *overlaySwitchForwarder, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		fwd.lock.Lock()
+		done := cond()
+		fwd.lock.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "timed out waiting for the overlay switch")
+}
+
+func switchEstablished(fwd *overlaySwitchForwarder) bool {
+	select {
+	case <-fwd.EstablishedChannel():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestTCPOverlayLastResort(t *testing.T) {
+	udpFwd := &fakeForwarder{establishedChan: make(chan struct{}), errorChan: make(chan error, 1)}
+	fwd := newTCPTestSwitch(t, udpFwd)
+	defer fwd.Stop()
+
+	// the other end's tcp forwarder says hello, but the UDP
+	// forwarder is still trying
+	fwd.ControlMessage(mesh.ProtocolOverlayControlMsg, []byte{1, tcpOverlayHello})
+	awaitSwitch(t, fwd, func() bool { return fwd.forwarders[1].established })
+	require.Equal(t, 0, fwd.best)
+	require.False(t, switchEstablished(fwd))
+	require.Equal(t, "fake", fwd.DisplayName())
+
+	udpFwd.errorChan <- fmt.Errorf("timed out waiting for UDP heartbeat")
+	awaitSwitch(t, fwd, func() bool { return fwd.best == 1 })
+	require.True(t, switchEstablished(fwd))
+	require.Equal(t, "tcp", fwd.DisplayName())
+}
+
+func TestTCPOverlayNotUsedWhenUDPWorks(t *testing.T) {
+	udpFwd := &fakeForwarder{establishedChan: make(chan struct{}), errorChan: make(chan error, 1)}
+	fwd := newTCPTestSwitch(t, udpFwd)
+	defer fwd.Stop()
+
+	close(udpFwd.establishedChan)
+	awaitSwitch(t, fwd, func() bool { return fwd.forwarders[0].established })
+	require.True(t, switchEstablished(fwd))
+
+	fwd.ControlMessage(mesh.ProtocolOverlayControlMsg, []byte{1, tcpOverlayHello})
+	awaitSwitch(t, fwd, func() bool { return fwd.forwarders[1].established })
+	require.Equal(t, 0, fwd.best)
+}
+
+func TestTCPFlowOpDropsWhenFull(t *testing.T) {
+	unblock := make(chan struct{})
+	conn, err := NewTCPOverlay().PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer: &mesh.Peer{Name: 2},
+		SendControlMessage: func(byte, []byte) error {
+			<-unblock
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	fwd := conn.(*tcpForwarder)
+	defer fwd.Stop()
+	defer close(unblock)
+
+	op := fwd.Forward(ForwardPacketKey{SrcPeer: &mesh.Peer{Name: 1}, DstPeer: &mesh.Peer{Name: 2}})
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 4*ChannelSize; i++ {
+			op.Process(make([]byte, 64), nil, false)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "sending blocked")
+	}
+}
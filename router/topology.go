@@ -0,0 +1,134 @@
+package router
+
+import (
+	"math"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Unreachable is the distance to peers we have no route to
+const Unreachable = math.MaxInt32
+
+// peerDistances caches the number of hops between peers, since
+// working it out means walking the whole topology. Fetching the
+// topology means waiting on mesh's actors, so run fetches it whenever
+// the routes change and lookups only read the last copy.
+type peerDistances struct {
+	sync.Mutex
+	router    *mesh.Router
+	graph     map[mesh.PeerName][]mesh.PeerName
+	distances map[mesh.PeerName]map[mesh.PeerName]int // by starting peer
+	changed   chan struct{}
+}
+
+func newPeerDistances(router *mesh.Router) *peerDistances {
+	return &peerDistances{
+		router:    router,
+		distances: make(map[mesh.PeerName]map[mesh.PeerName]int),
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+func (d *peerDistances) invalidate() {
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (d *peerDistances) run() {
+	for {
+		d.refresh()
+		<-d.changed
+	}
+}
+
+func (d *peerDistances) refresh() {
+	graph := establishedGraph(mesh.NewStatus(d.router))
+	d.Lock()
+	d.graph = graph
+	d.distances = make(map[mesh.PeerName]map[mesh.PeerName]int)
+	d.Unlock()
+}
+
+func (d *peerDistances) lookup(name mesh.PeerName) int {
+	return d.between(d.router.Ourself.Peer.Name, name)
+}
+
+func (d *peerDistances) between(from, to mesh.PeerName) int {
+	d.Lock()
+	defer d.Unlock()
+	if distance, found := d.from(from)[to]; found {
+		return distance
+	}
+	return Unreachable
+}
+
+// The distances from a peer to all those reachable from it. The
+// result must not be modified.
+func (d *peerDistances) from(name mesh.PeerName) map[mesh.PeerName]int {
+	distances, found := d.distances[name]
+	if !found {
+		distances = computeDistances(d.graph, name)
+		d.distances[name] = distances
+	}
+	return distances
+}
+
+// The connections that both ends consider established, which are the
+// only ones mesh follows for routing.
+func establishedGraph(status *mesh.Status) map[mesh.PeerName][]mesh.PeerName {
+	established := make(map[string]map[string]bool)
+	for _, peer := range status.Peers {
+		conns := make(map[string]bool)
+		for _, conn := range peer.Connections {
+			if conn.Established {
+				conns[conn.Name] = true
+			}
+		}
+		established[peer.Name] = conns
+	}
+
+	graph := make(map[mesh.PeerName][]mesh.PeerName)
+	for nameStr, conns := range established {
+		name, err := mesh.PeerNameFromString(nameStr)
+		if err != nil {
+			continue
+		}
+		for remoteStr := range conns {
+			if !established[remoteStr][nameStr] {
+				continue
+			}
+			if remote, err := mesh.PeerNameFromString(remoteStr); err == nil {
+				graph[name] = append(graph[name], remote)
+			}
+		}
+	}
+	return graph
+}
+
+// Breadth-first search from a peer
+func computeDistances(graph map[mesh.PeerName][]mesh.PeerName, from mesh.PeerName) map[mesh.PeerName]int {
+	distances := map[mesh.PeerName]int{from: 0}
+	queue := []mesh.PeerName{from}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, next := range graph[current] {
+			if _, seen := distances[next]; seen {
+				continue
+			}
+			distances[next] = distances[current] + 1
+			queue = append(queue, next)
+		}
+	}
+	return distances
+}
+
+// PeerDistance returns how many hops away a peer is over established
+// connections: zero for ourself, one for peers we are directly
+// connected to, and Unreachable if there is no route.
+func (router *NetworkRouter) PeerDistance(name mesh.PeerName) int {
+	return router.distances.lookup(name)
+}
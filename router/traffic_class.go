@@ -0,0 +1,367 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic classes
+//
+// Frames can be put into traffic classes, by the DSCP of the IP
+// packets they carry, or by the container they come from, so that
+// one busy container cannot starve the others sharing a link.  Each
+// class has a priority, and optionally a rate limit on all the
+// traffic of the class leaving this host.  The sleeve overlay queues
+// the frames of each class separately, always sending from the
+// highest priority queue that is within its rate limit, with all its
+// connections drawing on the same token bucket per class.  Fast
+// datapath gets the same from the kernel, with an HTB qdisc on its
+// vxlan device.
+
+const (
+	// Frames not put in any other class go in this one
+	DefaultTrafficClass = "default"
+	// Priorities go from 0, the highest, to MaxTrafficPriority
+	DefaultTrafficPriority = 4
+	MaxTrafficPriority     = 7
+
+	// How long a rate-limited class may send at full speed after
+	// being idle
+	trafficBurstTime = 100 * time.Millisecond
+	// The least burst, in bytes, so that any frame can be sent
+	minTrafficBurst = MaxUDPPacketSize
+)
+
+type TrafficClass struct {
+	Name     string
+	Priority int
+	Rate     uint64 // bits per second; zero for no limit
+	DSCP     []uint8
+}
+
+var rateUnits = map[string]uint64{
+	"bit":  1,
+	"kbit": 1000,
+	"mbit": 1000 * 1000,
+	"gbit": 1000 * 1000 * 1000,
+}
+
+// ParseTrafficClass parses a traffic class given as
+// <name>[,priority=<n>][,rate=<rate>][,dscp=<n>[:<n>...]], where the
+// rate is in bits per second, with an optional kbit, mbit or gbit
+// unit as for tc(8).
+func ParseTrafficClass(s string) (*TrafficClass, error) {
+	fields := strings.Split(s, ",")
+	class := &TrafficClass{Name: fields[0], Priority: DefaultTrafficPriority}
+	if class.Name == "" {
+		return nil, fmt.Errorf("traffic class %q has no name", s)
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("traffic class %q: expected key=value, got %q", s, field)
+		}
+		var err error
+		switch key, value := kv[0], kv[1]; key {
+		case "priority":
+			class.Priority, err = strconv.Atoi(value)
+			if err == nil && (class.Priority < 0 || class.Priority > MaxTrafficPriority) {
+				err = fmt.Errorf("must be between 0 and %d", MaxTrafficPriority)
+			}
+		case "rate":
+			class.Rate, err = parseRate(value)
+		case "dscp":
+			for _, v := range strings.Split(value, ":") {
+				var dscp uint64
+				if dscp, err = strconv.ParseUint(v, 0, 6); err != nil {
+					break
+				}
+				class.DSCP = append(class.DSCP, uint8(dscp))
+			}
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("traffic class %q: invalid %s: %s", s, kv[0], err)
+		}
+	}
+	return class, nil
+}
+
+func parseRate(s string) (uint64, error) {
+	digits := strings.TrimRightFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	multiplier := uint64(1)
+	if unit := strings.ToLower(s[len(digits):]); unit != "" {
+		var found bool
+		if multiplier, found = rateUnits[unit]; !found {
+			return 0, fmt.Errorf("unknown unit %q", unit)
+		}
+	}
+	rate, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate == 0 {
+		return 0, fmt.Errorf("must be more than zero")
+	}
+	return rate * multiplier, nil
+}
+
+// Where a rate is given as bits per second
+func formatRate(rate uint64) string {
+	for _, unit := range []string{"gbit", "mbit", "kbit"} {
+		if rate%rateUnits[unit] == 0 {
+			return fmt.Sprint(rate/rateUnits[unit], unit)
+		}
+	}
+	return fmt.Sprint(rate, "bit")
+}
+
+type byPriority []*TrafficClass
+
+func (c byPriority) Len() int           { return len(c) }
+func (c byPriority) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byPriority) Less(i, j int) bool { return c[i].Priority < c[j].Priority }
+
+// TrafficClasses says which traffic class each frame belongs in.
+// Classes are referred to by their index in classes, which are in
+// order of priority.
+type TrafficClasses struct {
+	classes      []*TrafficClass
+	defaultClass int
+	byDSCP       [64]int // index plus one; zero for no class
+	stats        []trafficClassStats
+
+	// The rate limits, shared by all connections
+	bucketLock sync.Mutex
+	buckets    []tokenBucket
+
+	sync.RWMutex
+	bySource map[[4]byte]int
+	onChange []func()
+}
+
+type trafficClassStats struct {
+	frames  uint64
+	bytes   uint64
+	dropped uint64
+}
+
+func NewTrafficClasses(classes []*TrafficClass) (*TrafficClasses, error) {
+	tc := &TrafficClasses{bySource: make(map[[4]byte]int)}
+	names := make(map[string]bool)
+	for _, class := range classes {
+		if names[class.Name] {
+			return nil, fmt.Errorf("traffic class %q given more than once", class.Name)
+		}
+		names[class.Name] = true
+		tc.classes = append(tc.classes, class)
+	}
+	if !names[DefaultTrafficClass] {
+		tc.classes = append(tc.classes, &TrafficClass{Name: DefaultTrafficClass, Priority: DefaultTrafficPriority})
+	}
+	sort.Stable(byPriority(tc.classes))
+	tc.stats = make([]trafficClassStats, len(tc.classes))
+
+	for i, class := range tc.classes {
+		tc.buckets = append(tc.buckets, newTokenBucket(class.Rate))
+		if class.Name == DefaultTrafficClass {
+			tc.defaultClass = i
+		}
+		for _, dscp := range class.DSCP {
+			if other := tc.byDSCP[dscp]; other != 0 {
+				return nil, fmt.Errorf("DSCP %d is in both traffic classes %q and %q", dscp, tc.classes[other-1].Name, class.Name)
+			}
+			tc.byDSCP[dscp] = i + 1
+		}
+	}
+	return tc, nil
+}
+
+func (tc *TrafficClasses) lookup(name string) (int, bool) {
+	for i, class := range tc.classes {
+		if class.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// The class of a frame: that of the container it comes from, if it
+// is in one, otherwise by DSCP
+func (tc *TrafficClasses) classify(dec *EthernetDecoder) int {
+	if len(dec.decoded) < 2 {
+		return tc.defaultClass
+	}
+	var src [4]byte
+	copy(src[:], dec.IP.SrcIP.To4())
+	tc.RLock()
+	class, found := tc.bySource[src]
+	tc.RUnlock()
+	if found {
+		return class
+	}
+	if class := tc.byDSCP[dec.IP.TOS>>2]; class != 0 {
+		return class - 1
+	}
+	return tc.defaultClass
+}
+
+// SetSource puts the frames with source address ip into the named
+// class
+func (tc *TrafficClasses) SetSource(ip net.IP, name string) error {
+	class, found := tc.lookup(name)
+	if !found {
+		return fmt.Errorf("unknown traffic class %q", name)
+	}
+	var src [4]byte
+	copy(src[:], ip.To4())
+	tc.Lock()
+	tc.bySource[src] = class
+	onChange := tc.onChange
+	tc.Unlock()
+	for _, f := range onChange {
+		f()
+	}
+	return nil
+}
+
+func (tc *TrafficClasses) ForgetSource(ip net.IP) {
+	var src [4]byte
+	copy(src[:], ip.To4())
+	tc.Lock()
+	_, found := tc.bySource[src]
+	delete(tc.bySource, src)
+	onChange := tc.onChange
+	tc.Unlock()
+	if found {
+		for _, f := range onChange {
+			f()
+		}
+	}
+}
+
+// OnChange registers a function to call when the class of a source
+// address changes
+func (tc *TrafficClasses) OnChange(f func()) {
+	tc.Lock()
+	defer tc.Unlock()
+	tc.onChange = append(tc.onChange, f)
+}
+
+// The source addresses put into classes
+func (tc *TrafficClasses) sources() map[[4]byte]int {
+	tc.RLock()
+	defer tc.RUnlock()
+	sources := make(map[[4]byte]int, len(tc.bySource))
+	for src, class := range tc.bySource {
+		sources[src] = class
+	}
+	return sources
+}
+
+func (tc *TrafficClasses) sent(class int, bytes int) {
+	atomic.AddUint64(&tc.stats[class].frames, 1)
+	atomic.AddUint64(&tc.stats[class].bytes, uint64(bytes))
+}
+
+func (tc *TrafficClasses) dropped(class int) {
+	atomic.AddUint64(&tc.stats[class].dropped, 1)
+}
+
+// admit takes n bytes from the rate limit of the class if it allows
+// sending them now, otherwise says how long until it would
+func (tc *TrafficClasses) admit(class int, n int, now time.Time) time.Duration {
+	tc.bucketLock.Lock()
+	defer tc.bucketLock.Unlock()
+	bucket := &tc.buckets[class]
+	if wait := bucket.wait(n, now); wait > 0 {
+		return wait
+	}
+	bucket.take(n)
+	return 0
+}
+
+// tokenBucket enforces the rate limit of a traffic class
+type tokenBucket struct {
+	rate   float64 // bytes per second; zero for no limit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bitRate uint64) tokenBucket {
+	rate := float64(bitRate) / 8
+	burst := math.Max(rate*trafficBurstTime.Seconds(), minTrafficBurst)
+	return tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// How long until n bytes may be sent
+func (b *tokenBucket) wait(n int, now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= float64(n) {
+		return 0
+	}
+	wait := time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+func (b *tokenBucket) take(n int) {
+	b.tokens -= float64(n)
+}
+
+type TrafficClassStatus struct {
+	Name     string
+	Priority int
+	Rate     string
+	DSCP     []uint8
+	Sources  int
+	Frames   uint64
+	Bytes    uint64
+	Dropped  uint64
+}
+
+// The traffic classes, with how many frames the sleeve overlay has
+// sent and dropped in each.  Fast datapath traffic is not counted.
+func NewTrafficClassStatusSlice(tc *TrafficClasses) []TrafficClassStatus {
+	if tc == nil {
+		return nil
+	}
+	sources := make([]int, len(tc.classes))
+	for _, class := range tc.sources() {
+		sources[class]++
+	}
+	var slice []TrafficClassStatus
+	for i, class := range tc.classes {
+		status := TrafficClassStatus{
+			Name:     class.Name,
+			Priority: class.Priority,
+			DSCP:     class.DSCP,
+			Sources:  sources[i],
+			Frames:   atomic.LoadUint64(&tc.stats[i].frames),
+			Bytes:    atomic.LoadUint64(&tc.stats[i].bytes),
+			Dropped:  atomic.LoadUint64(&tc.stats[i].dropped),
+		}
+		if class.Rate != 0 {
+			status.Rate = formatRate(class.Rate)
+		}
+		slice = append(slice, status)
+	}
+	return slice
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// How long to wait for a container to be given addresses once it has
+// started, since 'weave run' only attaches it then
+const trafficClassAttachTimeout = 10 * time.Second
+
+// TrafficClassObserver puts the addresses of containers with a
+// traffic class label into that class
+type TrafficClassObserver struct {
+	sync.Mutex
+	docker    *docker.Client
+	allocator *ipam.Allocator // nil if IPAM is disabled
+	ipRange   address.CIDR
+	classes   *TrafficClasses
+	label     string
+	addrs     map[string][]net.IP // by container ID
+}
+
+func NewTrafficClassObserver(dockerCli *docker.Client, allocator *ipam.Allocator, ipRange address.CIDR, classes *TrafficClasses, label string) *TrafficClassObserver {
+	return &TrafficClassObserver{
+		docker:    dockerCli,
+		allocator: allocator,
+		ipRange:   ipRange,
+		classes:   classes,
+		label:     label,
+		addrs:     make(map[string][]net.IP),
+	}
+}
+
+func (o *TrafficClassObserver) ContainerStarted(ident string) {
+	container, err := o.docker.InspectContainer(ident)
+	if err != nil || !container.State.Running {
+		return
+	}
+	class, found := container.Config.Labels[o.label]
+	if !found {
+		return
+	}
+	// Addresses in networks other than Docker's own, as given by
+	// the Docker plugin
+	var networkAddrs []string
+	for name, network := range container.NetworkSettings.Networks {
+		if name != "bridge" && name != "host" && name != "none" {
+			networkAddrs = append(networkAddrs, network.IPAddress)
+		}
+	}
+	go func() {
+		for deadline := time.Now().Add(trafficClassAttachTimeout); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+			if addrs := o.lookup(ident, networkAddrs); len(addrs) > 0 {
+				o.set(ident, addrs, class)
+				return
+			}
+		}
+		log.Warningf("[traffic-class] No address found for container %s to put in traffic class %q", ident, class)
+	}()
+}
+
+// The addresses IPAM gave the container, and those of networkAddrs in
+// the IPAM range
+func (o *TrafficClassObserver) lookup(ident string, networkAddrs []string) []net.IP {
+	var addrs []net.IP
+	if o.allocator != nil {
+		cidrs, _ := o.allocator.Lookup(ident, o.ipRange.Range())
+		for _, cidr := range cidrs {
+			addrs = append(addrs, cidr.Addr.IP4())
+		}
+	}
+	for _, s := range networkAddrs {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			if o.allocator == nil || o.ipRange.Range().Contains(address.FromIP4(ip)) {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	return addrs
+}
+
+func (o *TrafficClassObserver) set(ident string, addrs []net.IP, class string) {
+	o.Lock()
+	defer o.Unlock()
+	for _, addr := range addrs {
+		if err := o.classes.SetSource(addr, class); err != nil {
+			log.Warningf("[traffic-class] Container %s: %s", ident, err)
+			return
+		}
+	}
+	log.Infof("[traffic-class] Container %s with %v in traffic class %q", ident, addrs, class)
+	o.addrs[ident] = addrs
+}
+
+func (o *TrafficClassObserver) ContainerDied(ident string) {
+	o.Lock()
+	defer o.Unlock()
+	for _, addr := range o.addrs[ident] {
+		o.classes.ForgetSource(addr)
+	}
+	delete(o.addrs, ident)
+}
+
+func (o *TrafficClassObserver) ContainerDestroyed(ident string) {
+	o.ContainerDied(ident)
+}
+
+func (o *TrafficClassObserver) ContainerHealthChanged(ident string, healthy bool) {}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrafficClass(t *testing.T) {
+	class, err := ParseTrafficClass("voice")
+	require.NoError(t, err)
+	require.Equal(t, &TrafficClass{Name: "voice", Priority: DefaultTrafficPriority}, class)
+
+	class, err = ParseTrafficClass("bulk,priority=6,rate=50mbit,dscp=8:0x0a")
+	require.NoError(t, err)
+	require.Equal(t, &TrafficClass{Name: "bulk", Priority: 6, Rate: 50 * 1000 * 1000, DSCP: []uint8{8, 10}}, class)
+
+	for _, s := range []string{
+		"",
+		",priority=1",
+		"bulk,priority",
+		"bulk,priority=8",
+		"bulk,priority=-1",
+		"bulk,rate=0",
+		"bulk,dscp=64",
+		"bulk,colour=red",
+	} {
+		_, err := ParseTrafficClass(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"1200":    1200,
+		"64bit":   64,
+		"100kbit": 100 * 1000,
+		"10Mbit":  10 * 1000 * 1000,
+		"2gbit":   2 * 1000 * 1000 * 1000,
+	} {
+		rate, err := parseRate(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, rate, s)
+	}
+	for _, s := range []string{"", "mbit", "0", "10mbps", "1.5mbit"} {
+		_, err := parseRate(s)
+		require.Error(t, err, s)
+	}
+	require.Equal(t, "50mbit", formatRate(50*1000*1000))
+	require.Equal(t, "1500bit", formatRate(1500))
+}
+
+func TestTokenBucket(t *testing.T) {
+	unlimited := newTokenBucket(0)
+	require.Equal(t, time.Duration(0), unlimited.wait(1<<30, time.Now()))
+
+	// 8mbit is a byte per microsecond, with a 100ms burst
+	b := newTokenBucket(8 * 1000 * 1000)
+	now := time.Now()
+	require.Equal(t, time.Duration(0), b.wait(100*1000, now))
+	b.take(100 * 1000)
+	require.Equal(t, time.Millisecond, b.wait(1000, now))
+	require.Equal(t, time.Duration(0), b.wait(1000, now.Add(time.Millisecond)))
+
+	// tokens don't build up beyond the burst
+	now = now.Add(time.Hour)
+	require.Equal(t, time.Duration(0), b.wait(100*1000, now))
+	b.take(100 * 1000)
+	require.Equal(t, 10*time.Millisecond, b.wait(10*1000, now))
+
+	// any frame can be sent, however low the rate
+	slow := newTokenBucket(8)
+	require.Equal(t, time.Duration(0), slow.wait(MaxUDPPacketSize, time.Now()))
+}
+
+func TestTrafficClassRateIsShared(t *testing.T) {
+	tc, err := NewTrafficClasses([]*TrafficClass{{Name: "bulk", Priority: 6, Rate: 8 * 1000 * 1000}})
+	require.NoError(t, err)
+	bulk, _ := tc.lookup("bulk")
+	now := time.Now()
+
+	// what one connection sends comes out of what another may
+	require.Equal(t, time.Duration(0), tc.admit(bulk, 60*1000, now))
+	require.Equal(t, time.Duration(0), tc.admit(bulk, 40*1000, now))
+	require.Equal(t, 10*time.Millisecond, tc.admit(bulk, 10*1000, now))
+	require.Equal(t, time.Duration(0), tc.admit(tc.defaultClass, 1<<30, now))
+}